@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// batchOp is a single operation recorded in a WriteBatch
+type batchOp struct {
+	op    byte
+	key   []byte
+	value []byte
+}
+
+// WriteBatch collects puts, deletes and range deletes to be applied together by DB.Write.
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	ops []batchOp
+	//range deletes, keyed by start key, see DeleteRange
+	rangeDeletes []batchOp
+}
+
+// NewWriteBatch returns an empty batch
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put records a put of key with value
+func (b *WriteBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{op: OpPut, key: bytes.Clone(key), value: bytes.Clone(value)})
+}
+
+// Delete records a delete of key
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{op: OpDelete, key: bytes.Clone(key)})
+}
+
+// DeleteRange records a delete of every key in [start, end). Range deletes are
+// applied after the point operations of the batch and are newer than them, so
+// a key put by the same batch is deleted by a range delete covering it.
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	for i, rd := range b.rangeDeletes {
+		if bytes.Equal(rd.key, start) {
+			//ranges sharing a start key are merged into the widest one
+			if bytes.Compare(end, rd.value) > 0 {
+				b.rangeDeletes[i].value = bytes.Clone(end)
+			}
+			return
+		}
+	}
+	b.rangeDeletes = append(b.rangeDeletes, batchOp{op: OpRangeDelete, key: bytes.Clone(start), value: bytes.Clone(end)})
+}
+
+// Len returns the number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops) + len(b.rangeDeletes)
+}
+
+// Reset empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+	b.rangeDeletes = b.rangeDeletes[:0]
+}
+
+// Write applies the batch. Its entries are written to the WAL as one record with
+// a single sync, so after a crash either all of them are recovered or none.
+// The batch reserves a contiguous range of sequence numbers: point operations
+// get one each, in the order they were added, and range deletes share the last one.
+func (db *DB) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	for _, rd := range b.rangeDeletes {
+		if bytes.Compare(rd.key, rd.value) >= 0 {
+			return fmt.Errorf("invalid range delete: start %q is not before end %q", rd.key, rd.value)
+		}
+	}
+	db.writeMu.RLock()
+	defer db.writeMu.RUnlock()
+	if err := db.backgroundError(); err != nil {
+		return err
+	}
+	if err := db.maybeStallWrite(); err != nil {
+		return err
+	}
+	n := uint64(len(b.ops))
+	if len(b.rangeDeletes) > 0 {
+		n++
+	}
+	db.commitMu.Lock()
+	seqNum := db.sequenceNum.Add(n) - n + 1
+	entries := make([]*LogEntry, 0, b.Len())
+	for _, op := range b.ops {
+		entries = append(entries, &LogEntry{Op: op.op, Key: op.key, Value: op.value, SeqNum: seqNum})
+		seqNum++
+	}
+	for _, rd := range b.rangeDeletes {
+		entries = append(entries, &LogEntry{Op: OpRangeDelete, Key: rd.key, Value: rd.value, SeqNum: seqNum})
+	}
+	db.mu.RLock()
+	wal := db.wal
+	memTable := db.mem
+	db.mu.RUnlock()
+	if !db.opts.InMemory {
+		if err := wal.WriteEntries(entries); err != nil {
+			db.commitMu.Unlock()
+			return fmt.Errorf("failed to write WAL: %w", err)
+		}
+	}
+	putMemTableEntries(memTable, entries)
+	db.publish(entries...)
+	db.commitMu.Unlock()
+	if !db.opts.InMemory && memTable.ApproximateSize() > MemTableSizeThreshold {
+		db.flushMemtable()
+	}
+	return nil
+}
+
+// DeleteMany deletes every key in keys as a single WriteBatch: the tombstones get
+// consecutive sequence numbers, are written to the WAL with one sync and added
+// to the memtable under one lock acquisition.
+func (db *DB) DeleteMany(keys [][]byte) error {
+	b := NewWriteBatch()
+	for _, key := range keys {
+		b.Delete(key)
+	}
+	return db.Write(b)
+}
+
+// KVPair is a key and its value to write with PutMany
+type KVPair = KeyValue
+
+// PutMany writes every pair as a single WriteBatch, in order, so a later pair
+// overwrites an earlier one with the same key. When the keys are sorted and
+// distinct and the memtable's OrderedMap can take a sorted run, they are added
+// to the memtable as one run instead of one insertion at a time.
+func (db *DB) PutMany(pairs []KVPair) error {
+	b := NewWriteBatch()
+	for _, pair := range pairs {
+		b.Put(pair.Key, pair.Value)
+	}
+	return db.Write(b)
+}
+
+// GetMany returns the newest value of every key, in the order of keys, with nil
+// for keys that are absent or deleted. All keys are read at one sequence number.
+// They are looked up in sorted order, SSTable by SSTable, so keys stored in the
+// same data block share a single read of it.
+func (db *DB) GetMany(keys [][]byte) ([][]byte, error) {
+	db.mu.RLock()
+	seqNum := db.sequenceNum.Load()
+	mem := db.mem
+	imm := db.immutableMem
+	activeTables := make([]int, len(db.activeSSTables))
+	copy(activeTables, db.activeSSTables)
+	db.mu.RUnlock()
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return bytes.Compare(keys[order[a]], keys[order[b]]) < 0 })
+	values := make([][]byte, len(keys))
+	sources := make([]string, len(keys))
+	//indexes into keys of the keys not found yet, in key order
+	var pending []int
+	for _, i := range order {
+		val, _, found := mem.Get(keys[i])
+		source := GetSourceMemtable
+		if !found && imm != nil {
+			val, _, found = imm.Get(keys[i])
+			source = GetSourceImmutable
+		}
+		if found {
+			values[i], sources[i] = val, source
+			continue
+		}
+		pending = append(pending, i)
+	}
+	for t := len(activeTables) - 1; t >= 0 && len(pending) > 0 && !db.opts.InMemory; t-- {
+		sstNum := activeTables[t]
+		if db.tableNewerThan(sstNum, seqNum) {
+			continue
+		}
+		reader, err := db.openSSTable(sstNum)
+		if err != nil {
+			if os.IsNotExist(err) && !db.isActiveSSTable(sstNum) {
+				//a compaction replaced the table, search the current set
+				db.mu.RLock()
+				activeTables = make([]int, len(db.activeSSTables))
+				copy(activeTables, db.activeSSTables)
+				db.mu.RUnlock()
+				t = len(activeTables)
+				continue
+			}
+			return nil, fmt.Errorf("failed to open SSTable %d: %w", sstNum, err)
+		}
+		pendingKeys := make([][]byte, len(pending))
+		for j, i := range pending {
+			pendingKeys[j] = keys[i]
+		}
+		resolved := make([]bool, len(pending))
+		err = reader.getManyAt(pendingKeys, seqNum, func(j int, value []byte, _ uint64) {
+			values[pending[j]], sources[pending[j]] = value, GetSourceSSTable
+			resolved[j] = true
+		})
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSTable %d: %w", sstNum, err)
+		}
+		remaining := pending[:0]
+		for j, i := range pending {
+			if !resolved[j] {
+				remaining = append(remaining, i)
+			}
+		}
+		pending = remaining
+	}
+	if m := db.opts.Metrics; m != nil {
+		for i, value := range values {
+			if sources[i] == "" {
+				sources[i] = GetSourceNone
+			}
+			m.OnGet(value != nil, sources[i])
+		}
+	}
+	return values, nil
+}
+
+// rangeDeletePoints returns a point tombstone for every user key the range
+// deletes of imm cover in imm or in the SSTables, at the sequence number of the
+// range delete, in InternalKey order. The flush writes them in place of the
+// range deletes, which SSTables cannot hold. Every SSTable is older than imm, so
+// the keys are listed whatever their sequence numbers.
+func (db *DB) rangeDeletePoints(imm MemTable) ([]InternalKey, error) {
+	tombstones := imm.RangeTombstones(math.MaxUint64)
+	if len(tombstones) == 0 {
+		return nil, nil
+	}
+	db.mu.RLock()
+	activeTables := make([]int, len(db.activeSSTables))
+	copy(activeTables, db.activeSSTables)
+	db.mu.RUnlock()
+	var deletes []InternalKey
+	for _, t := range tombstones {
+		covered := make(map[string]bool)
+		memIt := imm.Iterator()
+		memIt.Seek(InternalKey{UserKey: t.Start, SeqNum: math.MaxUint64})
+		for memIt.Next() && memIt.Key().UserKey < t.End {
+			covered[memIt.Key().UserKey] = true
+		}
+		memIt.Close()
+		for i := 0; i < len(activeTables); i++ {
+			reader, err := db.openSSTable(activeTables[i])
+			if err != nil {
+				if os.IsNotExist(err) && !db.isActiveSSTable(activeTables[i]) {
+					//a compaction replaced the table, its output is in the current set
+					db.mu.RLock()
+					activeTables = make([]int, len(db.activeSSTables))
+					copy(activeTables, db.activeSSTables)
+					db.mu.RUnlock()
+					i = -1
+					continue
+				}
+				return nil, fmt.Errorf("failed to open SSTable %d: %w", activeTables[i], err)
+			}
+			it := reader.NewIterator(math.MaxUint64)
+			it.seek([]byte(t.Start))
+			for it.Next() && it.Key().UserKey < t.End {
+				if it.Key().UserKey >= t.Start {
+					covered[it.Key().UserKey] = true
+				}
+			}
+			err = it.Error()
+			it.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SSTable %d: %w", activeTables[i], err)
+			}
+		}
+		for key := range covered {
+			deletes = append(deletes, InternalKey{UserKey: key, SeqNum: t.SeqNum, Type: OpTypeDelete})
+		}
+	}
+	sort.Slice(deletes, func(i, j int) bool { return internalKeyComparable{}.Compare(deletes[i], deletes[j]) < 0 })
+	return deletes, nil
+}
+
+// AtomicBatch builds a batch with fn and applies it with Write if fn returns nil.
+// If fn returns an error the batch is discarded and nothing is written. fn must
+// only write through the batch: a DB.Put or DB.Delete from inside fn is applied
+// immediately, outside the batch, and is not rolled back.
+func (db *DB) AtomicBatch(fn func(b *WriteBatch) error) error {
+	b := NewWriteBatch()
+	if err := fn(b); err != nil {
+		return err
+	}
+	return db.Write(b)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteManySyncsOnce(t *testing.T) {
+	recorder := &metricsRecorder{}
+	opts := DefaultOptions()
+	opts.Metrics = recorder
+	db, _ := openTestDB(t, opts)
+	putKeys(t, db, 0, 600)
+	keys := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%05d", i))
+	}
+	recorder.mu.Lock()
+	syncs := recorder.walSyncs
+	recorder.mu.Unlock()
+	if err := db.DeleteMany(keys); err != nil {
+		t.Fatal(err)
+	}
+	recorder.mu.Lock()
+	syncs = recorder.walSyncs - syncs
+	recorder.mu.Unlock()
+	if syncs != 1 {
+		t.Fatalf("DeleteMany of %d keys synced the WAL %d times, want 1", len(keys), syncs)
+	}
+	for _, key := range keys {
+		if _, found, err := db.Get(key); err != nil || found {
+			t.Fatalf("%s was not deleted, err %v", key, err)
+		}
+	}
+	checkKeys(t, db, 500, 600)
+	//consecutive sequence numbers
+	first, err := db.History(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := db.History(keys[len(keys)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first[0].Type != OpTypeDelete || last[0].SeqNum-first[0].SeqNum != uint64(len(keys)-1) {
+		t.Fatalf("tombstones from seqnum %d to %d for %d keys", first[0].SeqNum, last[0].SeqNum, len(keys))
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	var pairs []KVPair
+	for i := 0; i < 300; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key%05d", i)), Value: []byte(fmt.Sprintf("value%05d", i))})
+	}
+	if err := db.PutMany(pairs[:200]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutMany(pairs[200:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("key00100")); err != nil {
+		t.Fatal(err)
+	}
+	//unsorted, with a repeated, a deleted and an absent key
+	keys := [][]byte{[]byte("key00250"), []byte("key00003"), []byte("missing"), []byte("key00100"), []byte("key00003")}
+	values, err := db.GetMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"value00250", "value00003", "", "", "value00003"}
+	if len(values) != len(want) {
+		t.Fatalf("GetMany returned %d values for %d keys", len(values), len(keys))
+	}
+	for i, value := range values {
+		if string(value) != want[i] || (want[i] == "") != (value == nil) {
+			t.Fatalf("GetMany(%s) = %q, want %q", keys[i], value, want[i])
+		}
+	}
+}
+
+// BenchmarkGetMany reads 1000 random keys spread over 10 SSTables with one
+// GetMany, and with one Get per key
+func BenchmarkGetMany(b *testing.B) {
+	db, err := NewDB(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.DisableAutoCompaction()
+	const tables, perTable = 10, 1000
+	for n := 0; n < tables; n++ {
+		var pairs []KVPair
+		for i := 0; i < perTable; i++ {
+			//interleaved, so every table spans the whole key range
+			key := fmt.Sprintf("key%06d", i*tables+n)
+			pairs = append(pairs, KVPair{Key: []byte(key), Value: []byte("value-" + key)})
+		}
+		if err := db.PutMany(pairs); err != nil {
+			b.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%06d", rng.Intn(tables*perTable)))
+	}
+	b.Run("GetMany", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetMany(keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				if _, found, err := db.Get(key); err != nil || !found {
+					b.Fatalf("%s not found, err %v", key, err)
+				}
+			}
+		}
+	})
+}
+
+func TestReopenDropsTruncatedBatch(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 10)
+	path := filepath.Join(dir, activeWalFileName)
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := stat.Size()
+	//small enough to stay in the memtable and the WAL until the crash
+	b := NewWriteBatch()
+	b.Delete([]byte("key00000"))
+	for i := 10; i < 30; i++ {
+		b.Put([]byte(fmt.Sprintf("key%05d", i)), bytes.Repeat([]byte{'v'}, 100))
+	}
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.SSTables()) != 0 {
+		t.Fatal("the batch was flushed")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a crash in the header, the middle and the end of the batch record
+	for _, size := range []int64{before + 5, (before + int64(len(data))) / 2, int64(len(data)) - 1} {
+		if err := os.WriteFile(path, data[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDB(dir)
+		if err != nil {
+			t.Fatalf("WAL cut to %d bytes: %v", size, err)
+		}
+		//none of the batch, all of what came before
+		checkKeys(t, db, 0, 10)
+		for i := 10; i < 30; i++ {
+			if _, found, err := db.Get([]byte(fmt.Sprintf("key%05d", i))); err != nil || found {
+				t.Fatalf("WAL cut to %d bytes: key%05d of the batch was recovered, err %v", size, i, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriteBatchDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DisableAutoCompaction()
+	putKeys(t, db, 0, 10)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 10, 20)
+	//the range delete is newer than the puts of its batch, but older than later writes
+	b := NewWriteBatch()
+	b.Put([]byte("key00005"), []byte("batch"))
+	b.Put([]byte("key00020"), []byte("batch"))
+	b.DeleteRange([]byte("key00003"), []byte("key00015"))
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("key00004"), []byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	check := func(where string) {
+		t.Helper()
+		var want [][]byte
+		for i := 0; i <= 20; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			value := fmt.Sprintf("value%05d", i)
+			switch {
+			case i == 4:
+				value = "later"
+			case i == 20:
+				value = "batch"
+			case i >= 3 && i < 15:
+				value = ""
+			}
+			got, found, err := db.Get([]byte(key))
+			if err != nil || found != (value != "") || string(got) != value {
+				t.Fatalf("%s: Get(%s) = %q, %v, %v, want %q", where, key, got, found, err, value)
+			}
+			if value != "" {
+				want = append(want, []byte(key))
+			}
+		}
+		keys, err := db.Keys(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bytes.Join(keys, []byte(",")), bytes.Join(want, []byte(","))) {
+			t.Fatalf("%s: Keys = %s, want %s", where, bytes.Join(keys, []byte(",")), bytes.Join(want, []byte(",")))
+		}
+	}
+	check("memtable")
+	reopen := func() {
+		t.Helper()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = NewDB(dir); err != nil {
+			t.Fatal(err)
+		}
+		db.DisableAutoCompaction()
+	}
+	reopen()
+	check("WAL replay")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("flush")
+	reopen()
+	check("SSTables")
+	db.compact()
+	check("compaction")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkBulkLoad loads 10 000 keys with Put and with PutNoWAL, then flushes
+func BenchmarkBulkLoad(b *testing.B) {
+	const n = 10000
+	value := bytes.Repeat([]byte{'v'}, 100)
+	loads := map[string]func(db *DB, key []byte) error{
+		"Put":      func(db *DB, key []byte) error { return db.Put(key, value) },
+		"PutNoWAL": func(db *DB, key []byte) error { return db.PutNoWAL(key, value) },
+	}
+	for _, name := range []string{"Put", "PutNoWAL"} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db, err := NewDB(b.TempDir())
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				for k := 0; k < n; k++ {
+					if err := loads[name](db, []byte(fmt.Sprintf("key%08d", k))); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := db.Flush(); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// OpTypeBlobIndex marks an SSTable entry whose value was moved to a blob file
+// at flush time. The stored value is a blob reference:
+// [File Number (varint)][Offset (varint)][Length (varint)]
+// It is never found in a memtable, compactions copy it without reading the value.
+const OpTypeBlobIndex OpType = 3
+
+const (
+	// DefaultMinBlobSize is the value size from which values go to blob files
+	DefaultMinBlobSize = 4 * 1024
+	// DefaultBlobGCRatio is the fraction of dead data in a blob file above which
+	// its live values are rewritten
+	DefaultBlobGCRatio = 0.5
+	//every value in a blob file is followed by its CRC-32
+	blobChecksumSize = 4
+)
+
+// blobPath returns the path of blob file num in dir
+func blobPath(dir string, num int) string {
+	return fmt.Sprintf("%s/%05d.blob", dir, num)
+}
+
+// blobRef locates a value in a blob file
+type blobRef struct {
+	fileNum int
+	offset  uint64
+	length  uint64
+}
+
+func (ref blobRef) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(ref.fileNum))
+	buf = binary.AppendUvarint(buf, ref.offset)
+	return binary.AppendUvarint(buf, ref.length)
+}
+
+func decodeBlobRef(data []byte) (blobRef, error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return blobRef{}, fmt.Errorf("%w: malformed blob reference", ErrCorruption)
+		}
+		fields[i] = v
+		data = data[n:]
+	}
+	return blobRef{fileNum: int(fields[0]), offset: fields[1], length: fields[2]}, nil
+}
+
+// blobStore reads values out of the blob files of a DB
+type blobStore struct {
+	fs  FS
+	dir string
+}
+
+// read returns the value ref points at, checking its CRC-32
+func (s *blobStore) read(ref []byte) ([]byte, error) {
+	r, err := decodeBlobRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.fs.Open(blobPath(s.dir, r.fileNum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob file %d: %w", r.fileNum, err)
+	}
+	defer file.Close()
+	buf := make([]byte, r.length+blobChecksumSize)
+	if _, err := file.ReadAt(buf, int64(r.offset)); err != nil {
+		return nil, fmt.Errorf("failed to read blob file %d at offset %d: %w", r.fileNum, r.offset, err)
+	}
+	value := buf[:r.length]
+	if crc32.ChecksumIEEE(value) != binary.LittleEndian.Uint32(buf[r.length:]) {
+		return nil, fmt.Errorf("%w: value at offset %d of blob file %d", ErrCorruption, r.offset, r.fileNum)
+	}
+	return value, nil
+}
+
+// blobWriter appends values to a new blob file: [Value][CRC-32] for every value
+type blobWriter struct {
+	fileNum int
+	path    string
+	fs      FS
+	file    File
+	w       *bufio.Writer
+	offset  uint64
+}
+
+func createBlobWriter(fs FS, dir string, num int) (*blobWriter, error) {
+	path := blobPath(dir, num)
+	file, err := fs.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{fileNum: num, path: path, fs: fs, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// add appends value and returns its encoded reference
+func (bw *blobWriter) add(value []byte) ([]byte, error) {
+	var checksum [blobChecksumSize]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(value))
+	if _, err := bw.w.Write(value); err != nil {
+		return nil, err
+	}
+	if _, err := bw.w.Write(checksum[:]); err != nil {
+		return nil, err
+	}
+	ref := blobRef{fileNum: bw.fileNum, offset: bw.offset, length: uint64(len(value))}
+	bw.offset += uint64(len(value)) + blobChecksumSize
+	return ref.encode(), nil
+}
+
+// finish flushes, syncs and closes the file. A file that received no value is
+// removed, finish then reports false.
+func (bw *blobWriter) finish() (bool, error) {
+	if bw.offset == 0 {
+		bw.abort()
+		return false, nil
+	}
+	err := bw.w.Flush()
+	if err == nil {
+		err = bw.file.Sync()
+	}
+	if cerr := bw.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		bw.fs.Remove(bw.path)
+		return false, err
+	}
+	return true, nil
+}
+
+// abort closes and removes the file
+func (bw *blobWriter) abort() {
+	bw.file.Close()
+	bw.fs.Remove(bw.path)
+}
+
+// blobSeparator feeds src to WriteSSTable, moving values of at least minSize
+// bytes to a blob file and passing their reference instead
+type blobSeparator struct {
+	src     TableSource
+	blobs   *blobWriter
+	minSize int
+	key     InternalKey
+	value   []byte
+	err     error
+}
+
+func (s *blobSeparator) Next() bool {
+	if s.err != nil || !s.src.Next() {
+		return false
+	}
+	s.key, s.value = s.src.Key(), s.src.Value()
+	if s.key.Type == OpTypePut && len(s.value) >= s.minSize {
+		ref, err := s.blobs.add(s.value)
+		if err != nil {
+			s.err = fmt.Errorf("failed to write blob file %d: %w", s.blobs.fileNum, err)
+			return false
+		}
+		s.key.Type = OpTypeBlobIndex
+		s.value = ref
+	}
+	return true
+}
+
+func (s *blobSeparator) Key() InternalKey { return s.key }
+func (s *blobSeparator) Value() []byte    { return s.value }
+func (s *blobSeparator) Error() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.src.Error()
+}
+
+// liveBlobBytes sums, for every blob file, the bytes of the records the active
+// SSTables reference. It reports false if an active table has no properties, in
+// which case its references are unknown. Caller must hold db.mu.
+func (db *DB) liveBlobBytes() (map[int]uint64, bool) {
+	live := make(map[int]uint64)
+	for _, sstNum := range db.activeSSTables {
+		props, ok := db.tableProps[sstNum]
+		if !ok {
+			return nil, false
+		}
+		for num, n := range props.BlobBytes {
+			live[num] += n
+		}
+	}
+	return live, true
+}
+
+// collectBlobGarbage removes the blob files no active SSTable references, and
+// rewrites the live values of blob files whose fraction of dead data exceeds
+// Options.BlobGCRatio. Values are rewritten with CompareAndSwap, so a write
+// racing with the rewrite wins; once the next compaction drops the old
+// references, the file is removed. Runs are serialized, one started while
+// another is running waits for it.
+func (db *DB) collectBlobGarbage() {
+	db.blobGCMu.Lock()
+	defer db.blobGCMu.Unlock()
+	if _, _, err := db.collectBlobGarbageLocked(db.opts.BlobGCRatio); err != nil {
+		db.opts.logger().Errorf("Blob file garbage collection failed: %v", err)
+	}
+}
+
+// RunValueLogGC reclaims the space of the blob files whose fraction of dead
+// data exceeds discardRatio, in (0, 1). It flushes the memtable and compacts
+// the SSTables, so deleted and overwritten values are no longer referenced,
+// rewrites the live values of those files, then flushes and compacts again so
+// no table references them, and removes them. It returns the bytes of the blob
+// files it removed, which DBStats.BlobBytesReclaimed also adds up.
+func (db *DB) RunValueLogGC(discardRatio float64) (int64, error) {
+	if discardRatio <= 0 || discardRatio >= 1 {
+		return 0, fmt.Errorf("invalid discard ratio %v, want a value in (0, 1)", discardRatio)
+	}
+	if db.opts.InMemory {
+		return 0, nil
+	}
+	db.blobGCMu.Lock()
+	defer db.blobGCMu.Unlock()
+	if err := db.Flush(); err != nil {
+		return 0, err
+	}
+	db.compact()
+	reclaimed, rewritten, err := db.collectBlobGarbageLocked(discardRatio)
+	if err != nil || rewritten == 0 {
+		return reclaimed, err
+	}
+	if err := db.Flush(); err != nil {
+		return reclaimed, err
+	}
+	db.compact()
+	//no file is more than entirely dead, this only removes the unreferenced ones
+	removed, _, err := db.collectBlobGarbageLocked(1)
+	return reclaimed + removed, err
+}
+
+// collectBlobGarbageLocked is collectBlobGarbage with discardRatio in place of
+// Options.BlobGCRatio. It returns the bytes of the blob files it removed and
+// the number of values it rewrote. Caller must hold blobGCMu.
+func (db *DB) collectBlobGarbageLocked(discardRatio float64) (int64, int, error) {
+	fs := db.opts.fileSystem()
+	db.mu.Lock()
+	live, ok := db.liveBlobBytes()
+	if !ok {
+		db.mu.Unlock()
+		return 0, 0, nil
+	}
+	var obsolete []int
+	rewrite := make(map[int]bool)
+	kept := make([]int, 0, len(db.blobFiles))
+	for _, num := range db.blobFiles {
+		liveBytes, referenced := live[num]
+		if !referenced {
+			obsolete = append(obsolete, num)
+			continue
+		}
+		kept = append(kept, num)
+		if size := fileSize(fs, blobPath(db.dataDir, num)); size > 0 {
+			if 1-float64(liveBytes)/float64(size) > discardRatio {
+				rewrite[num] = true
+			}
+		}
+	}
+	db.blobFiles = kept
+	var err error
+	if len(obsolete) > 0 {
+		err = db.saveState()
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to save state after dropping blob files: %w", err)
+	}
+	var reclaimed int64
+	for _, num := range obsolete {
+		path := blobPath(db.dataDir, num)
+		size := fileSize(fs, path)
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			db.opts.logger().Errorf("Failed to remove blob file %d: %v", num, err)
+			continue
+		}
+		reclaimed += size
+	}
+	if len(obsolete) > 0 {
+		db.opts.logger().Infof("Removed %d unreferenced blob files, %d bytes", len(obsolete), reclaimed)
+		db.mu.Lock()
+		db.stats.BlobBytesReclaimed += reclaimed
+		db.mu.Unlock()
+	}
+	if len(rewrite) == 0 {
+		return reclaimed, 0, nil
+	}
+	rewritten, err := db.rewriteBlobFiles(rewrite)
+	if err != nil {
+		return reclaimed, rewritten, fmt.Errorf("failed to rewrite blob files: %w", err)
+	}
+	return reclaimed, rewritten, nil
+}
+
+// rewriteBlobFiles writes every live value held by the blob files in nums
+// again, in a single scan of the DB, so the next flush moves them to a new
+// blob file. It returns the number of values it rewrote.
+func (db *DB) rewriteBlobFiles(nums map[int]bool) (int, error) {
+	it, err := db.NewIterator(IteratorOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	rewritten := 0
+	for it.Next() {
+		if it.blobRef == nil {
+			continue
+		}
+		ref, err := decodeBlobRef(it.blobRef)
+		if err != nil {
+			return rewritten, err
+		}
+		if !nums[ref.fileNum] {
+			continue
+		}
+		value := it.Value()
+		if err := it.Error(); err != nil {
+			return rewritten, err
+		}
+		if _, err := db.CompareAndSwap(it.Key(), value, value); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	if err := it.Error(); err != nil {
+		return rewritten, err
+	}
+	db.opts.logger().Infof("Rewrote %d live values of %d blob files", rewritten, len(nums))
+	return rewritten, nil
+}
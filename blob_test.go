@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// blobBytes returns the total size of the blob files in dir
+func blobBytes(t *testing.T, dir string) int64 {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += stat.Size()
+	}
+	return total
+}
+
+func TestBlobGCReclaimsDeletedValues(t *testing.T) {
+	opts := DefaultOptions()
+	opts.EnableBlobFiles = true
+	opts.MinBlobSize = 100
+	opts.BlobGCRatio = 0.4
+	db, dir := openTestDB(t, opts)
+	db.DisableAutoCompaction()
+	value := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i%26)}, 1000) }
+	const n = 40
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before := blobBytes(t, dir)
+	if before < n*1000 {
+		t.Fatalf("%d bytes of blob files for %d values of 1000 bytes", before, n)
+	}
+	for i := 0; i < n; i += 2 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the compaction drops the deleted values, the collection rewrites the live
+	//ones, which the next flush and compaction move out of the old blob files.
+	//Compactions also start a collection in the background, which may rewrite
+	//the values after the flush of a round, so take a few rounds.
+	for round := 0; blobBytes(t, dir) > before*3/4; round++ {
+		if round == 10 {
+			t.Fatalf("%d bytes of blob files after deleting half the keys, %d before", blobBytes(t, dir), before)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		db.compact()
+		db.collectBlobGarbage()
+	}
+	for i := 0; i < n; i++ {
+		got, found, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if deleted := i%2 == 0; err != nil || found == deleted || !deleted && !bytes.Equal(got, value(i)) {
+			t.Fatalf("Get(key%05d) = %d bytes, found %v, err %v", i, len(got), found, err)
+		}
+	}
+}
+
+func TestRunValueLogGC(t *testing.T) {
+	opts := DefaultOptions()
+	opts.EnableBlobFiles = true
+	opts.MinBlobSize = 100
+	db, dir := openTestDB(t, opts)
+	db.DisableAutoCompaction()
+	value := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i%26)}, 1000) }
+	const n = 40
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before := blobBytes(t, dir)
+	if before != n*(1000+blobChecksumSize) {
+		t.Fatalf("%d bytes of blob files for %d records of 1000 bytes", before, n)
+	}
+	for i := 0; i < n; i += 2 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the flushes wrote a blob file every few values, each holds deleted ones and
+	//is replaced by files of the live half
+	reclaimed, err := db.RunValueLogGC(0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != before {
+		t.Fatalf("RunValueLogGC reclaimed %d bytes, want the %d of the old blob files", reclaimed, before)
+	}
+	if after := blobBytes(t, dir); after != before/2 {
+		t.Fatalf("%d bytes of blob files after the GC, want %d", after, before/2)
+	}
+	if stats := db.Stats(); stats.BlobBytesReclaimed != reclaimed {
+		t.Fatalf("DBStats.BlobBytesReclaimed = %d, want %d", stats.BlobBytesReclaimed, reclaimed)
+	}
+	for i := 0; i < n; i++ {
+		got, found, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if deleted := i%2 == 0; err != nil || found == deleted || !deleted && !bytes.Equal(got, value(i)) {
+			t.Fatalf("Get(key%05d) = %d bytes, found %v, err %v", i, len(got), found, err)
+		}
+	}
+	//nothing is dead any more
+	if reclaimed, err := db.RunValueLogGC(0.1); err != nil || reclaimed != 0 {
+		t.Fatalf("second RunValueLogGC = %d bytes, %v", reclaimed, err)
+	}
+}
+
+func TestBlobGCKeepsLiveFilesOfSmallValues(t *testing.T) {
+	opts := DefaultOptions()
+	opts.EnableBlobFiles = true
+	opts.MinBlobSize = 1
+	//the checksum of a record of 10 bytes is more than a fifth of it
+	opts.BlobGCRatio = 0.2
+	db, _ := openTestDB(t, opts)
+	db.DisableAutoCompaction()
+	for i := 0; i < 50; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	seqNum := db.sequenceNum.Load()
+	db.collectBlobGarbage()
+	if rewritten := db.sequenceNum.Load() - seqNum; rewritten != 0 {
+		t.Fatalf("%d values of a blob file without dead data were rewritten", rewritten)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// blockFormatGob is the original entry layout:
+	// [Key Size (4 bytes)][Value Size (4 bytes)][gob encoded InternalKey][Value]
+	blockFormatGob = 0
+	// blockFormatCompact is a hand-rolled entry layout:
+	// [User Key Size (varint)][Value Size (varint)][User Key][Seq (8 bytes)][Type (1 byte)][Value]
+	blockFormatCompact = 1
+	// blockFormatCompressed uses the compact entry layout, and every block is
+	// followed by a 1-byte CompressionType trailer
+	blockFormatCompressed = 2
+	// blockFormatPrefix shares key prefixes between consecutive entries and
+	// ends every block with restart points, see blockBuilder
+	blockFormatPrefix = 3
+	// blockFormatPrefixChecksum is blockFormatPrefix with a 4-byte CRC-32 of the
+	// value after every value, written with Options.ValueChecksums
+	blockFormatPrefixChecksum = 4
+
+	DefaultBlockRestartInterval = 16
+)
+
+// blockBuilder accumulates sorted entries into a data block in blockFormatPrefix:
+// [Entry 0]...[Entry n-1][Restart 0 (4 bytes)]...[Restart m-1 (4 bytes)][Restart Count (4 bytes)]
+// Entry = [Shared (varint)][Unshared (varint)][Value Size (varint)][Unshared User Key][Seq (8 bytes)][Type (1 byte)][Value]
+// Every restartInterval-th entry is a restart point: it stores its full user key
+// (Shared = 0) and its offset is listed in the trailer, so a reader can start
+// decoding, or binary search, from there.
+// With value checksums every value is followed by [Value CRC-32 (4 bytes)].
+type blockBuilder struct {
+	buf             bytes.Buffer
+	restarts        []uint32
+	restartInterval int
+	counter         int
+	lastKey         string
+	valueChecksums  bool
+}
+
+func newBlockBuilder(restartInterval int, valueChecksums bool) *blockBuilder {
+	if restartInterval < 1 {
+		restartInterval = DefaultBlockRestartInterval
+	}
+	return &blockBuilder{restartInterval: restartInterval, valueChecksums: valueChecksums}
+}
+
+// Format returns the block format the builder writes, to be recorded in the footer
+func (b *blockBuilder) Format() int {
+	if b.valueChecksums {
+		return blockFormatPrefixChecksum
+	}
+	return blockFormatPrefix
+}
+
+// Add appends an entry. Keys must be added in InternalKey order.
+func (b *blockBuilder) Add(key InternalKey, value []byte) {
+	shared := 0
+	if b.counter%b.restartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(b.buf.Len()))
+	} else {
+		limit := min(len(b.lastKey), len(key.UserKey))
+		for shared < limit && b.lastKey[shared] == key.UserKey[shared] {
+			shared++
+		}
+	}
+	var scratch [3*binary.MaxVarintLen64 + 9]byte
+	n := binary.PutUvarint(scratch[:], uint64(shared))
+	n += binary.PutUvarint(scratch[n:], uint64(len(key.UserKey)-shared))
+	n += binary.PutUvarint(scratch[n:], uint64(len(value)))
+	b.buf.Write(scratch[:n])
+	b.buf.WriteString(key.UserKey[shared:])
+	binary.LittleEndian.PutUint64(scratch[0:8], key.SeqNum)
+	scratch[8] = key.Type
+	b.buf.Write(scratch[:9])
+	b.buf.Write(value)
+	if b.valueChecksums {
+		binary.LittleEndian.PutUint32(scratch[:4], crc32.ChecksumIEEE(value))
+		b.buf.Write(scratch[:4])
+	}
+	b.lastKey = key.UserKey
+	b.counter++
+}
+
+// entrySize returns an upper bound of the bytes Add would use for the entry,
+// restart point included
+func (b *blockBuilder) entrySize(key InternalKey, value []byte) int {
+	size := 3*binary.MaxVarintLen64 + len(key.UserKey) + 9 + len(value) + 4
+	if b.valueChecksums {
+		size += 4
+	}
+	return size
+}
+
+// EstimatedSize returns the size of the block if it were finished now
+func (b *blockBuilder) EstimatedSize() int {
+	return b.buf.Len() + 4*len(b.restarts) + 4
+}
+
+// Empty reports whether no entry has been added since the last Reset
+func (b *blockBuilder) Empty() bool {
+	return b.counter == 0
+}
+
+// Finish appends the restart trailer and returns the block. The result is only
+// valid until the next call to Reset.
+func (b *blockBuilder) Finish() []byte {
+	var scratch [4]byte
+	for _, off := range b.restarts {
+		binary.LittleEndian.PutUint32(scratch[:], off)
+		b.buf.Write(scratch[:])
+	}
+	binary.LittleEndian.PutUint32(scratch[:], uint32(len(b.restarts)))
+	b.buf.Write(scratch[:])
+	return b.buf.Bytes()
+}
+
+// Reset clears the builder so it can be used for the next block
+func (b *blockBuilder) Reset() {
+	b.buf.Reset()
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = ""
+}
+
+// blockReader decodes the entries of a single data block in order.
+// Returned values are subslices of the block data.
+type blockReader struct {
+	data   []byte
+	pos    int
+	format int
+	//blockFormatPrefix only: end of the entries, restart offsets and the previous user key
+	end      int
+	restarts []uint32
+	prevKey  []byte
+}
+
+// blockEntry is an entry decoded by nextEntry. userKey and value alias the block
+// or the reader's key scratch space, so they are only valid until the next call.
+type blockEntry struct {
+	userKey []byte
+	seqNum  uint64
+	typ     byte
+	value   []byte
+}
+
+func newBlockReader(data []byte, format int) (*blockReader, error) {
+	b := &blockReader{}
+	if err := b.reset(data, format); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// reset points the reader at the start of a new block, reusing its restart and
+// key scratch space
+func (b *blockReader) reset(data []byte, format int) error {
+	b.data, b.pos, b.format, b.end = data, 0, format, len(data)
+	b.restarts, b.prevKey = b.restarts[:0], b.prevKey[:0]
+	if format < blockFormatPrefix {
+		return nil
+	}
+	if len(data) < 4 {
+		return fmt.Errorf("block too short: %d bytes", len(data))
+	}
+	count := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	b.end = len(data) - 4 - 4*count
+	if count < 0 || b.end < 0 {
+		return fmt.Errorf("block corrupted: %d restart points do not fit in %d bytes", count, len(data))
+	}
+	for i := 0; i < count; i++ {
+		off := binary.LittleEndian.Uint32(data[b.end+4*i:])
+		if int(off) > b.end {
+			return fmt.Errorf("block corrupted: restart point %d out of bounds", i)
+		}
+		b.restarts = append(b.restarts, off)
+	}
+	return nil
+}
+
+// next decodes the next entry, returning io.EOF once the block is exhausted
+func (b *blockReader) next() (InternalKey, []byte, error) {
+	if b.pos >= b.end {
+		return InternalKey{}, nil, io.EOF
+	}
+	if b.format == blockFormatGob {
+		return b.nextGob()
+	}
+	e, err := b.nextEntry()
+	if err != nil {
+		return InternalKey{}, nil, err
+	}
+	return InternalKey{UserKey: string(e.userKey), SeqNum: e.seqNum, Type: e.typ}, e.value, nil
+}
+
+// nextEntry is next without copying the user key, for callers that only compare it
+func (b *blockReader) nextEntry() (blockEntry, error) {
+	if b.pos >= b.end {
+		return blockEntry{}, io.EOF
+	}
+	var e blockEntry
+	var err error
+	switch b.format {
+	case blockFormatGob:
+		key, value, err := b.nextGob()
+		return blockEntry{userKey: []byte(key.UserKey), seqNum: key.SeqNum, typ: key.Type, value: value}, err
+	case blockFormatCompact, blockFormatCompressed:
+		e, err = b.nextCompact()
+	default:
+		e, err = b.nextPrefix()
+	}
+	if err == nil && !validOpType(e.typ) {
+		return blockEntry{}, fmt.Errorf("%w: block entry of key %q has unknown type %d", ErrCorruption, e.userKey, e.typ)
+	}
+	return e, err
+}
+
+// seek positions the reader so the next call to next returns the last restart
+// point entry below target, or the first entry of the block. Only O(log n)
+// restart keys are decoded. Blocks without restart points are left at the start.
+func (b *blockReader) seek(target InternalKey, cmp internalKeyComparable) error {
+	if len(b.restarts) == 0 {
+		return nil
+	}
+	//find the last restart point whose key is < target
+	lo, hi := 0, len(b.restarts)-1
+	for lo < hi {
+		mid := int(uint(lo+hi+1) >> 1)
+		key, err := b.restartKey(mid)
+		if err != nil {
+			return err
+		}
+		if cmp.Compare(key, target) < 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	b.pos = int(b.restarts[lo])
+	b.prevKey = b.prevKey[:0]
+	return nil
+}
+
+// restartKey decodes the key of the entry at restart point i
+func (b *blockReader) restartKey(i int) (InternalKey, error) {
+	b.pos = int(b.restarts[i])
+	b.prevKey = b.prevKey[:0]
+	e, err := b.nextPrefix()
+	if err == nil && b.data[b.restarts[i]] != 0 {
+		//restart points always store the full key
+		err = fmt.Errorf("block corrupted: restart point %d shares its key", i)
+	}
+	return InternalKey{UserKey: string(e.userKey), SeqNum: e.seqNum, Type: e.typ}, err
+}
+
+// uvarint decodes a varint at the current position
+func (b *blockReader) uvarint(field string) (uint64, error) {
+	v, n := binary.Uvarint(b.data[b.pos:b.end])
+	if n <= 0 {
+		return 0, fmt.Errorf("block entry at %d: bad %s", b.pos, field)
+	}
+	b.pos += n
+	return v, nil
+}
+
+// nextPrefix decodes an entry written in blockFormatPrefix or blockFormatPrefixChecksum
+func (b *blockReader) nextPrefix() (blockEntry, error) {
+	shared, err := b.uvarint("shared key size")
+	if err != nil {
+		return blockEntry{}, err
+	}
+	unshared, err := b.uvarint("unshared key size")
+	if err != nil {
+		return blockEntry{}, err
+	}
+	valueSize, err := b.uvarint("value size")
+	if err != nil {
+		return blockEntry{}, err
+	}
+	trailer := uint64(9)
+	if b.format == blockFormatPrefixChecksum {
+		trailer += 4
+	}
+	remaining := uint64(b.end - b.pos)
+	if shared > uint64(len(b.prevKey)) || unshared > remaining || valueSize > remaining || unshared+trailer+valueSize > remaining {
+		return blockEntry{}, fmt.Errorf("block entry at %d: sizes exceed block", b.pos)
+	}
+	keyEnd := b.pos + int(unshared)
+	b.prevKey = append(b.prevKey[:shared], b.data[b.pos:keyEnd]...)
+	entry := blockEntry{
+		userKey: b.prevKey,
+		seqNum:  binary.LittleEndian.Uint64(b.data[keyEnd : keyEnd+8]),
+		typ:     b.data[keyEnd+8],
+	}
+	b.pos = keyEnd + 9
+	entry.value = b.data[b.pos : b.pos+int(valueSize)]
+	b.pos += int(valueSize)
+	if b.format == blockFormatPrefixChecksum {
+		if crc32.ChecksumIEEE(entry.value) != binary.LittleEndian.Uint32(b.data[b.pos:]) {
+			return blockEntry{}, ErrValueCorrupted(entry.userKey)
+		}
+		b.pos += 4
+	}
+	return entry, nil
+}
+
+// nextCompact decodes an entry written in blockFormatCompact
+func (b *blockReader) nextCompact() (blockEntry, error) {
+	keySize, err := b.uvarint("key size")
+	if err != nil {
+		return blockEntry{}, err
+	}
+	valueSize, err := b.uvarint("value size")
+	if err != nil {
+		return blockEntry{}, err
+	}
+	remaining := uint64(b.end - b.pos)
+	if keySize > remaining || valueSize > remaining || keySize+9+valueSize > remaining {
+		return blockEntry{}, fmt.Errorf("block entry at %d: sizes exceed block", b.pos)
+	}
+	end := b.pos + int(keySize)
+	entry := blockEntry{
+		userKey: b.data[b.pos:end],
+		seqNum:  binary.LittleEndian.Uint64(b.data[end : end+8]),
+		typ:     b.data[end+8],
+	}
+	b.pos = end + 9
+	entry.value = b.data[b.pos : b.pos+int(valueSize)]
+	b.pos += int(valueSize)
+	return entry, nil
+}
+
+// nextGob decodes an entry written in blockFormatGob
+func (b *blockReader) nextGob() (InternalKey, []byte, error) {
+	if len(b.data)-b.pos < 8 {
+		return InternalKey{}, nil, fmt.Errorf("block entry at %d: truncated header", b.pos)
+	}
+	keySize := uint64(binary.LittleEndian.Uint32(b.data[b.pos:]))
+	valueSize := uint64(binary.LittleEndian.Uint32(b.data[b.pos+4:]))
+	b.pos += 8
+	if keySize+valueSize > uint64(len(b.data)-b.pos) {
+		return InternalKey{}, nil, fmt.Errorf("block entry at %d: sizes exceed block", b.pos)
+	}
+	var key InternalKey
+	keyBytes := b.data[b.pos : b.pos+int(keySize)]
+	if err := gob.NewDecoder(bytes.NewReader(keyBytes)).Decode(&key); err != nil {
+		return InternalKey{}, nil, err
+	}
+	if !validOpType(key.Type) {
+		return InternalKey{}, nil, fmt.Errorf("%w: block entry of key %q has unknown type %d", ErrCorruption, key.UserKey, key.Type)
+	}
+	b.pos += int(keySize)
+	value := b.data[b.pos : b.pos+int(valueSize)]
+	b.pos += int(valueSize)
+	return key, value, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestBlockEntryVarintSizes(t *testing.T) {
+	const n = 1000
+	//entries in blockFormatCompact, which stores every key in full, against the
+	//same entries with the key and value sizes in 4 bytes each
+	var compact []byte
+	fixedWidth := 0
+	for i := 0; i < n; i++ {
+		key := InternalKey{UserKey: fmt.Sprintf("key-%03d", i), SeqNum: uint64(i + 1), Type: OpTypePut}
+		value := []byte(fmt.Sprintf("value-%03d", i))
+		compact = binary.AppendUvarint(compact, uint64(len(key.UserKey)))
+		compact = binary.AppendUvarint(compact, uint64(len(value)))
+		compact = append(compact, key.UserKey...)
+		compact = binary.LittleEndian.AppendUint64(compact, key.SeqNum)
+		compact = append(compact, key.Type)
+		compact = append(compact, value...)
+		fixedWidth += 8 + len(key.UserKey) + 9 + len(value)
+	}
+	r, err := newBlockReader(compact, blockFormatCompact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		key, value, err := r.next()
+		if err != nil || key.UserKey != fmt.Sprintf("key-%03d", i) || string(value) != fmt.Sprintf("value-%03d", i) {
+			t.Fatalf("entry %d decoded as %q = %q, %v", i, key.UserKey, value, err)
+		}
+	}
+	saved := fixedWidth - len(compact)
+	t.Logf("%d bytes with varint sizes, %d with fixed-width ones: %.0f%% smaller", len(compact), fixedWidth, 100*float64(saved)/float64(fixedWidth))
+	//both sizes of every entry fit in a byte instead of 4
+	if saved != 6*n {
+		t.Fatalf("varint sizes save %d bytes on %d entries, want %d", saved, n, 6*n)
+	}
+}
+
+// blockEntries are the entries of a test block, in InternalKey order
+type blockEntries struct {
+	keys   []InternalKey
+	values [][]byte
+}
+
+// readBlock decodes every entry of a block
+func readBlock(t *testing.T, data []byte, format int) blockEntries {
+	t.Helper()
+	r, err := newBlockReader(data, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got blockEntries
+	for {
+		key, value, err := r.next()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("entry %d: %v", len(got.keys), err)
+		}
+		got.keys = append(got.keys, key)
+		got.values = append(got.values, bytes.Clone(value))
+	}
+}
+
+// checkBlockEntries fails unless got and want hold the same entries
+func checkBlockEntries(t *testing.T, got, want blockEntries) {
+	t.Helper()
+	if len(got.keys) != len(want.keys) {
+		t.Fatalf("decoded %d entries, want %d", len(got.keys), len(want.keys))
+	}
+	for i := range want.keys {
+		if got.keys[i] != want.keys[i] || !bytes.Equal(got.values[i], want.values[i]) {
+			t.Fatalf("entry %d is %+v = %q, want %+v = %q", i, got.keys[i], got.values[i], want.keys[i], want.values[i])
+		}
+	}
+}
+
+// FuzzBlockReader decodes arbitrary bytes as a data block of every format. It
+// must fail cleanly, never panic, and never return more key and value bytes
+// than the block holds.
+func FuzzBlockReader(f *testing.F) {
+	for _, checksums := range []bool{false, true} {
+		b := newBlockBuilder(2, checksums)
+		b.Add(InternalKey{UserKey: "apple", SeqNum: 3, Type: OpTypePut}, []byte("red"))
+		b.Add(InternalKey{UserKey: "apple", SeqNum: 2, Type: OpTypeDelete}, nil)
+		b.Add(InternalKey{UserKey: "banana", SeqNum: 1, Type: OpTypePut}, []byte("yellow"))
+		f.Add(b.Finish(), uint8(b.Format()))
+	}
+	//one entry in blockFormatCompact
+	compact := binary.AppendUvarint(nil, 3)
+	compact = binary.AppendUvarint(compact, 1)
+	compact = append(compact, "key"...)
+	compact = binary.LittleEndian.AppendUint64(compact, 7)
+	compact = append(compact, OpTypePut, 'v')
+	f.Add(compact, uint8(blockFormatCompact))
+	//sizes far beyond the block
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0xff, 0xff, 0xff, 0xff, 0x0f}, uint8(blockFormatCompact))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint8(blockFormatGob))
+	f.Add([]byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, uint8(blockFormatPrefix))
+
+	f.Fuzz(func(t *testing.T, data []byte, format uint8) {
+		r, err := newBlockReader(data, int(format%(blockFormatPrefixChecksum+1)))
+		if err != nil {
+			return
+		}
+		if len(r.restarts) > 0 {
+			if err := r.seek(InternalKey{UserKey: "b", SeqNum: 1}, internalKeyComparable{}); err != nil {
+				return
+			}
+		}
+		for {
+			key, value, err := r.next()
+			if err != nil {
+				return
+			}
+			if len(key.UserKey)+len(value) > len(data) {
+				t.Fatalf("decoded a %d byte key and a %d byte value from a %d byte block", len(key.UserKey), len(value), len(data))
+			}
+		}
+	})
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	var want blockEntries
+	for i := 0; i < 1000; i++ {
+		want.keys = append(want.keys, InternalKey{UserKey: fmt.Sprintf("key-%03d", i), SeqNum: uint64(i + 1), Type: OpTypePut})
+		want.values = append(want.values, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	for _, checksums := range []bool{false, true} {
+		b := newBlockBuilder(DefaultBlockRestartInterval, checksums)
+		for i, key := range want.keys {
+			b.Add(key, want.values[i])
+		}
+		checkBlockEntries(t, readBlock(t, b.Finish(), b.Format()), want)
+	}
+}
+
+func TestBlockReaderDecodesOlderFormats(t *testing.T) {
+	want := blockEntries{
+		keys: []InternalKey{
+			{UserKey: "apple", SeqNum: 2, Type: OpTypePut},
+			{UserKey: "apple", SeqNum: 1, Type: OpTypeDelete},
+			{UserKey: "banana", SeqNum: 3, Type: OpTypePut},
+		},
+		values: [][]byte{[]byte("red"), {}, []byte("yellow")},
+	}
+	//[Key Size (4 bytes)][Value Size (4 bytes)][gob encoded InternalKey][Value]
+	var gobBlock []byte
+	for i, key := range want.keys {
+		var encoded bytes.Buffer
+		if err := gob.NewEncoder(&encoded).Encode(key); err != nil {
+			t.Fatal(err)
+		}
+		gobBlock = binary.LittleEndian.AppendUint32(gobBlock, uint32(encoded.Len()))
+		gobBlock = binary.LittleEndian.AppendUint32(gobBlock, uint32(len(want.values[i])))
+		gobBlock = append(gobBlock, encoded.Bytes()...)
+		gobBlock = append(gobBlock, want.values[i]...)
+	}
+	checkBlockEntries(t, readBlock(t, gobBlock, blockFormatGob), want)
+	//[User Key Size (varint)][Value Size (varint)][User Key][Seq (8 bytes)][Type (1 byte)][Value]
+	var compactBlock []byte
+	for i, key := range want.keys {
+		compactBlock = binary.AppendUvarint(compactBlock, uint64(len(key.UserKey)))
+		compactBlock = binary.AppendUvarint(compactBlock, uint64(len(want.values[i])))
+		compactBlock = append(compactBlock, key.UserKey...)
+		compactBlock = binary.LittleEndian.AppendUint64(compactBlock, key.SeqNum)
+		compactBlock = append(compactBlock, key.Type)
+		compactBlock = append(compactBlock, want.values[i]...)
+	}
+	checkBlockEntries(t, readBlock(t, compactBlock, blockFormatCompact), want)
+}
+
+func TestBlockAdversarialKeys(t *testing.T) {
+	long := string(bytes.Repeat([]byte{'k'}, 300))
+	sets := map[string][]InternalKey{
+		"empty keys": {
+			{UserKey: "", SeqNum: 3, Type: OpTypePut},
+			{UserKey: "", SeqNum: 2, Type: OpTypeDelete},
+			{UserKey: "", SeqNum: 1, Type: OpTypePut},
+			{UserKey: "a", SeqNum: 4, Type: OpTypePut},
+		},
+		"one user key": {
+			{UserKey: "same", SeqNum: 9, Type: OpTypePut},
+			{UserKey: "same", SeqNum: 8, Type: OpTypeDelete},
+			{UserKey: "same", SeqNum: 7, Type: OpTypePut},
+			{UserKey: "same", SeqNum: 6, Type: OpTypePut},
+			{UserKey: "same", SeqNum: 5, Type: OpTypeDelete},
+		},
+		"long shared prefix": {
+			{UserKey: long, SeqNum: 1, Type: OpTypePut},
+			{UserKey: long + "a", SeqNum: 2, Type: OpTypePut},
+			{UserKey: long + "ab", SeqNum: 3, Type: OpTypePut},
+			{UserKey: long + "b", SeqNum: 4, Type: OpTypePut},
+		},
+		"prefix of the next key": {
+			{UserKey: "a", SeqNum: 1, Type: OpTypePut},
+			{UserKey: "aa", SeqNum: 2, Type: OpTypePut},
+			{UserKey: "aaa", SeqNum: 3, Type: OpTypePut},
+			{UserKey: "ab", SeqNum: 4, Type: OpTypePut},
+			{UserKey: "b", SeqNum: 5, Type: OpTypePut},
+		},
+		"binary keys": {
+			{UserKey: "\x00", SeqNum: 1, Type: OpTypePut},
+			{UserKey: "\x00\x00", SeqNum: 2, Type: OpTypePut},
+			{UserKey: "\x00\xff", SeqNum: 3, Type: OpTypePut},
+			{UserKey: "\xff", SeqNum: 4, Type: OpTypePut},
+		},
+	}
+	for name, keys := range sets {
+		var want blockEntries
+		for i, key := range keys {
+			want.keys = append(want.keys, key)
+			//empty values in between, and one larger than a varint byte
+			want.values = append(want.values, bytes.Repeat([]byte{'v'}, i*100))
+		}
+		for _, restartInterval := range []int{1, 2, DefaultBlockRestartInterval} {
+			for _, checksums := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/restart %d/checksums %v", name, restartInterval, checksums), func(t *testing.T) {
+					b := newBlockBuilder(restartInterval, checksums)
+					for i, key := range want.keys {
+						b.Add(key, want.values[i])
+					}
+					data := b.Finish()
+					checkBlockEntries(t, readBlock(t, data, b.Format()), want)
+					checkBlockSeek(t, data, b.Format(), want)
+				})
+			}
+		}
+	}
+}
+
+// checkBlockSeek seeks to every key of want and checks that reading on from
+// there reaches it
+func checkBlockSeek(t *testing.T, data []byte, format int, want blockEntries) {
+	t.Helper()
+	cmp := internalKeyComparable{}
+	for _, target := range want.keys {
+		r, err := newBlockReader(data, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.seek(target, cmp); err != nil {
+			t.Fatalf("seek(%+v): %v", target, err)
+		}
+		for {
+			key, _, err := r.next()
+			if err != nil {
+				t.Fatalf("%+v not found after seeking to it: %v", target, err)
+			}
+			if c := cmp.Compare(key, target); c == 0 {
+				break
+			} else if c > 0 {
+				t.Fatalf("seek(%+v) positioned past it, at %+v", target, key)
+			}
+		}
+	}
+}
+
+func TestBlockValueChecksums(t *testing.T) {
+	b := newBlockBuilder(DefaultBlockRestartInterval, true)
+	b.Add(InternalKey{UserKey: "apple", SeqNum: 1, Type: OpTypePut}, []byte("red"))
+	b.Add(InternalKey{UserKey: "banana", SeqNum: 2, Type: OpTypePut}, []byte("yellow"))
+	data := bytes.Clone(b.Finish())
+	//a bit flipped in memory, before any block checksum covers it
+	data[bytes.Index(data, []byte("yellow"))] ^= 1
+	r, err := newBlockReader(data, b.Format())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _, err := r.next(); err != nil || key.UserKey != "apple" {
+		t.Fatalf("first entry = %+v, %v", key, err)
+	}
+	_, _, err = r.next()
+	var corrupted *ValueCorruptedError
+	if !errors.As(err, &corrupted) || string(corrupted.Key) != "banana" || !errors.Is(err, ErrCorruption) {
+		t.Fatalf("reading the corrupted value = %v, want a ValueCorruptedError for banana", err)
+	}
+}
+
+func TestBlockRejectsUnknownType(t *testing.T) {
+	for _, checksums := range []bool{false, true} {
+		b := newBlockBuilder(DefaultBlockRestartInterval, checksums)
+		b.Add(InternalKey{UserKey: "apple", SeqNum: 2, Type: OpTypePut}, []byte("red"))
+		b.Add(InternalKey{UserKey: "banana", SeqNum: 1, Type: 42}, []byte("yellow"))
+		r, err := newBlockReader(b.Finish(), b.Format())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, _, err := r.next(); err != nil || key.UserKey != "apple" {
+			t.Fatalf("first entry = %+v, %v", key, err)
+		}
+		if key, _, err := r.next(); !errors.Is(err, ErrCorruption) {
+			t.Fatalf("entry of type 42 = %+v, %v, want ErrCorruption", key, err)
+		}
+	}
+}
+
+func TestBlockPrefixCompression(t *testing.T) {
+	b := newBlockBuilder(DefaultBlockRestartInterval, false)
+	//the same entries in blockFormatCompact, which stores every key in full
+	var compact []byte
+	for i := 0; i < 1000; i++ {
+		key := InternalKey{UserKey: fmt.Sprintf("key-%03d", i), SeqNum: uint64(i + 1), Type: OpTypePut}
+		b.Add(key, nil)
+		compact = binary.AppendUvarint(compact, uint64(len(key.UserKey)))
+		compact = binary.AppendUvarint(compact, 0)
+		compact = append(compact, key.UserKey...)
+		compact = binary.LittleEndian.AppendUint64(compact, key.SeqNum)
+		compact = append(compact, key.Type)
+	}
+	prefix := b.Finish()
+	saved := 1 - float64(len(prefix))/float64(len(compact))
+	t.Logf("%d bytes with shared prefixes, %d without: %.0f%% smaller", len(prefix), len(compact), 100*saved)
+	//"key-" and most of the number are shared, restart points cost a little
+	if saved < 0.15 {
+		t.Fatalf("shared prefixes save %.0f%% of %d bytes, want at least 15%%", 100*saved, len(compact))
+	}
+}
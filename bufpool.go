@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Pooled block buffers come in power of two size classes from 4KiB to 1MiB.
+// Larger blocks are allocated and dropped as before.
+const (
+	minBlockBufferShift = 12
+	maxBlockBufferShift = 20
+)
+
+// blockBufferPools holds *[]byte with a capacity of exactly 1<<(minBlockBufferShift+i).
+//
+// Ownership: a buffer taken with getBlockBuffer belongs to the caller until it is
+// handed back with putBlockBuffer. Nothing that outlives the call which took it may
+// point into it, values must be copied out before the buffer goes back, and it is
+// never returned to users of the DB or put into the block cache.
+var blockBufferPools [maxBlockBufferShift - minBlockBufferShift + 1]sync.Pool
+
+// blockBufferClass returns the index of the smallest pool whose buffers hold size
+// bytes, or -1 if size is larger than every class
+func blockBufferClass(size int) int {
+	if size <= 1<<minBlockBufferShift {
+		return 0
+	}
+	shift := bits.Len(uint(size - 1))
+	if shift > maxBlockBufferShift {
+		return -1
+	}
+	return shift - minBlockBufferShift
+}
+
+// getBlockBuffer returns a buffer of length size, from a pool when size fits a class
+func getBlockBuffer(size int) *[]byte {
+	class := blockBufferClass(size)
+	if class < 0 {
+		buf := make([]byte, size)
+		return &buf
+	}
+	if buf, ok := blockBufferPools[class].Get().(*[]byte); ok {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	buf := make([]byte, size, 1<<(minBlockBufferShift+class))
+	return &buf
+}
+
+// putBlockBuffer hands a buffer from getBlockBuffer back to its pool. A nil buffer
+// is ignored so callers can defer it unconditionally.
+func putBlockBuffer(buf *[]byte) {
+	if buf == nil {
+		return
+	}
+	class := blockBufferClass(cap(*buf))
+	if class < 0 || cap(*buf) != 1<<(minBlockBufferShift+class) {
+		return
+	}
+	*buf = (*buf)[:0]
+	blockBufferPools[class].Put(buf)
+}
+
+// blockReaderPool recycles blockReaders along with their restart and key scratch space
+var blockReaderPool = sync.Pool{
+	New: func() any { return new(blockReader) },
+}
+
+// getBlockReader is newBlockReader backed by blockReaderPool. The reader must be
+// handed back with release once the caller is done with it and every key it
+// returned through nextEntry.
+func getBlockReader(data []byte, format int) (*blockReader, error) {
+	b := blockReaderPool.Get().(*blockReader)
+	if err := b.reset(data, format); err != nil {
+		b.release()
+		return nil, err
+	}
+	return b, nil
+}
+
+// release drops the reader's reference to its block and puts it back in blockReaderPool
+func (b *blockReader) release() {
+	b.data = nil
+	blockReaderPool.Put(b)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// nextDBID hands out the identifiers that keep cache entries of different DBs apart
+var nextDBID atomic.Uint64
+
+// blockCacheKey identifies a data block: the DB, the SSTable file number and the block offset
+type blockCacheKey struct {
+	dbID    uint64
+	fileNum int
+	offset  int64
+}
+
+type cacheEntry struct {
+	key   blockCacheKey
+	value []byte
+}
+
+// Cache is an LRU cache of decompressed data blocks with a budget in bytes.
+// It is safe for concurrent use, and one Cache can be shared by several DBs
+// through Options.BlockCache so they stay within a single memory budget.
+type Cache struct {
+	mu       sync.Mutex
+	capacity int64
+	usage    int64
+	lru      *list.List //front is most recently used
+	entries  map[blockCacheKey]*list.Element
+}
+
+// NewCache returns a cache holding at most capacity bytes of blocks
+func NewCache(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[blockCacheKey]*list.Element),
+	}
+}
+
+// get returns the cached block for key. The block must not be modified.
+func (c *Cache) get(key blockCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+// add inserts block, evicting least recently used blocks to stay within the capacity.
+// Blocks larger than the whole capacity are not cached.
+func (c *Cache) add(key blockCacheKey, block []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(len(block)) > c.capacity {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: block})
+	c.usage += int64(len(block))
+	for c.usage > c.capacity {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.usage -= int64(len(entry.value))
+	}
+}
+
+// Usage returns the number of bytes currently held by the cache
+func (c *Cache) Usage() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.usage
+}
+
+// Capacity returns the budget of the cache in bytes
+func (c *Cache) Capacity() int64 {
+	return c.capacity
+}
+
+// FileLimiter bounds the number of SSTable files open at once. Share one through
+// Options.FileLimiter to give several DBs a global file descriptor budget.
+// Opening a reader blocks while the limit is reached, so the limit must be larger
+// than the number of tables a single iterator keeps open.
+type FileLimiter struct {
+	slots chan struct{}
+}
+
+// NewFileLimiter returns a limiter allowing n open files
+func NewFileLimiter(n int) *FileLimiter {
+	return &FileLimiter{slots: make(chan struct{}, n)}
+}
+
+func (l *FileLimiter) acquire() {
+	l.slots <- struct{}{}
+}
+
+func (l *FileLimiter) release() {
+	<-l.slots
+}
+
+// InUse returns the number of files currently open through the limiter
+func (l *FileLimiter) InUse() int {
+	return len(l.slots)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSharedCache(t *testing.T) {
+	const budget = 16 << 20
+	cache := NewCache(budget)
+	limiter := NewFileLimiter(16)
+	var dbs []*DB
+	for _, name := range []string{"a", "b"} {
+		opts := DefaultOptions()
+		opts.BlockCache = cache
+		opts.FileLimiter = limiter
+		db, _ := openTestDB(t, opts)
+		//the same file numbers and keys in both DBs, only the values differ
+		for i := 0; i < 2000; i++ {
+			value := append([]byte(name), bytes.Repeat([]byte{'v'}, 1000)...)
+			if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+	for round := 0; round < 2; round++ {
+		for d, db := range dbs {
+			for i := 0; i < 2000; i++ {
+				value, found, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !found || value[0] != "ab"[d] {
+					t.Fatalf("DB %d read key%05d from the other DB's blocks", d, i)
+				}
+			}
+		}
+	}
+	if usage := cache.Usage(); usage == 0 || usage > budget {
+		t.Fatalf("shared cache holds %d bytes, budget %d", usage, budget)
+	}
+	if inUse := limiter.InUse(); inUse != 0 {
+		t.Fatalf("%d files still open through the limiter", inUse)
+	}
+}
+
+func TestCacheEvictsToCapacity(t *testing.T) {
+	cache := NewCache(100)
+	block := bytes.Repeat([]byte{'b'}, 30)
+	for i := 0; i < 10; i++ {
+		cache.add(blockCacheKey{dbID: uint64(i % 2), fileNum: 1, offset: int64(i)}, block)
+		if usage := cache.Usage(); usage > cache.Capacity() {
+			t.Fatalf("usage %d over capacity %d", usage, cache.Capacity())
+		}
+	}
+	//the least recently used blocks went first
+	if _, ok := cache.get(blockCacheKey{dbID: 0, fileNum: 1, offset: 0}); ok {
+		t.Fatal("the oldest block was not evicted")
+	}
+	if _, ok := cache.get(blockCacheKey{dbID: 1, fileNum: 1, offset: 9}); !ok {
+		t.Fatal("the newest block was evicted")
+	}
+	cache.add(blockCacheKey{offset: 100}, bytes.Repeat([]byte{'b'}, 101))
+	if _, ok := cache.get(blockCacheKey{offset: 100}); ok {
+		t.Fatal("a block larger than the capacity was cached")
+	}
+}
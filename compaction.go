@@ -1,18 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"container/heap"
-	"encoding/binary"
-	"encoding/gob"
 	"fmt"
-	"io"
-	"log"
+	"math"
 	"os"
 	"sort"
-
-	"github.com/huandu/skiplist"
+	"sync"
+	"time"
 )
 
 type minHeap []*heapItem
@@ -35,173 +30,650 @@ func (h minHeap) Less(i, j int) bool {
 type heapItem struct {
 	key      InternalKey
 	value    []byte
-	iterator *sstableIterator
-}
-
-type sstableIterator struct {
-	file   *os.File
-	reader *bufio.Reader
-	key    InternalKey
-	value  []byte
-	err    error
+	iterator internalIterator
 }
 
-// newSSTableFileIterator creates an iterator that streams from a file path.
-func newSSTableFileIterator(path string) (*sstableIterator, error) {
-	file, err := os.Open(path)
+// newSSTableFileIterator opens the SSTable at path and iterates all of its entries.
+func newSSTableFileIterator(path string, opts *Options) (*tableIterator, error) {
+	reader, err := NewSSTableReaderWithOptions(path, opts)
 	if err != nil {
 		return nil, err
 	}
-	return &sstableIterator{
-		file:   file,
-		reader: bufio.NewReader(file),
-	}, nil
+	return reader.NewIterator(math.MaxUint64), nil
+}
+
+// MergeSSTables compacts multiple SSTables into a single new one. Only the newest
+// version of every key is kept and deleted keys are dropped. When nothing is left
+// no file is created and the returned metadata has no entries.
+func MergeSSTables(paths []string, outputPath string, opts *Options) (TableMeta, error) {
+	return mergeSSTables(paths, outputPath, opts, true, nil)
 }
 
-func (it *sstableIterator) Next() bool {
-	var keySize, valueSize uint32
-	if err := binary.Read(it.reader, binary.LittleEndian, &keySize); err != nil {
-		if err != io.EOF {
-			it.err = err
+// mergeSSTables is MergeSSTables, keeping the newest version of deleted keys as
+// tombstones unless dropDeletes is set. Deletes can only be dropped when no
+// older table can hold a version of the key they would uncover. The newest
+// version visible at each sequence number of snapshots, in ascending order, is
+// kept as well.
+func mergeSSTables(paths []string, outputPath string, opts *Options, dropDeletes bool, snapshots []uint64) (TableMeta, error) {
+	merge := &compactionIterator{h: &minHeap{}, keepDeletes: !dropDeletes, snapshots: snapshots}
+	defer merge.Close()
+	//inputs are read sequentially once, without the block cache or file limiter
+	readOpts := DefaultOptions()
+	readOpts.FS = opts.FS
+	var itemCount uint
+	for _, path := range paths {
+		it, err := newSSTableFileIterator(path, readOpts)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return TableMeta{}, err
 		}
-		return false
+		merge.sources = append(merge.sources, it)
+		itemCount += uint(it.r.properties.NumEntries)
 	}
-	if err := binary.Read(it.reader, binary.LittleEndian, &valueSize); err != nil {
-		it.err = err
-		return false
+	heap.Init(merge.h)
+	for _, it := range merge.sources {
+		merge.push(it)
 	}
-	keyBytes := make([]byte, keySize)
-	if _, err := io.ReadFull(it.reader, keyBytes); err != nil {
-		it.err = err
-		return false
+	meta, err := WriteSSTable(outputPath, itemCount, merge, opts)
+	if err != nil {
+		return TableMeta{}, err
 	}
-	if err := gob.NewDecoder(bytes.NewReader(keyBytes)).Decode(&it.key); err != nil {
-		it.err = err
-		return false
+	if meta.NumEntries == 0 {
+		// It's possible for a compaction to result in no keys if all keys
+		// were deleted. In this case, we don't keep an empty SSTable.
+		opts.fileSystem().Remove(outputPath)
 	}
-	valueBytes := make([]byte, valueSize)
-	if _, err := io.ReadFull(it.reader, valueBytes); err != nil {
-		it.err = err
-		return false
+	return meta, nil
+}
+
+// compactionIterator merges SSTables for MergeSSTables, returning the newest
+// version of every user key and skipping keys whose newest version is a delete,
+// unless keepDeletes is set. Older versions are returned while a snapshot sees them.
+type compactionIterator struct {
+	sources     []internalIterator
+	h           *minHeap
+	keepDeletes bool
+	//sequence numbers of the live snapshots, ascending
+	snapshots []uint64
+
+	key         InternalKey
+	value       []byte
+	lastUserKey string
+	hasLast     bool
+	//sequence number of the previous version of lastUserKey
+	lastSeq uint64
+}
+
+// push advances src and, if it has an entry, adds it to the merge heap
+func (it *compactionIterator) push(src internalIterator) {
+	if src.Next() {
+		heap.Push(it.h, &heapItem{
+			key:      src.Key(),
+			value:    src.Value(),
+			iterator: src,
+		})
 	}
-	it.value = valueBytes
-	return true
 }
 
-// MergeSSTables compacts multiple SSTables into a single new one.
-func MergeSSTables(paths []string, outputPath string) error {
-	var iterators []*sstableIterator
-	for _, path := range paths {
-		it, err := newSSTableFileIterator(path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
+func (it *compactionIterator) Next() bool {
+	for it.h.Len() > 0 {
+		item := heap.Pop(it.h).(*heapItem)
+		it.push(item.iterator)
+		if !it.hasLast || item.key.UserKey != it.lastUserKey {
+			it.lastUserKey = item.key.UserKey
+			it.hasLast = true
+			it.lastSeq = math.MaxUint64
+		}
+		//the newest version seen by the snapshots in [seq, lastSeq), skip it if there are none
+		newest := it.lastSeq == math.MaxUint64
+		seen := newest || it.snapshotIn(item.key.SeqNum, it.lastSeq)
+		it.lastSeq = item.key.SeqNum
+		if !seen {
+			continue
+		}
+		//no older version is kept for a snapshot, nothing for the delete to hide
+		if item.key.Type == OpTypeDelete && !it.keepDeletes && !it.snapshotIn(0, item.key.SeqNum) {
+			continue
+		}
+		it.key = item.key
+		it.value = item.value
+		return true
+	}
+	return false
+}
+
+// snapshotIn reports whether a snapshot has a sequence number in [lo, hi)
+func (it *compactionIterator) snapshotIn(lo, hi uint64) bool {
+	i := sort.Search(len(it.snapshots), func(i int) bool { return it.snapshots[i] >= lo })
+	return i < len(it.snapshots) && it.snapshots[i] < hi
+}
+
+func (it *compactionIterator) Key() InternalKey { return it.key }
+func (it *compactionIterator) Value() []byte    { return it.value }
+
+// Error returns the first error of the merged SSTables
+func (it *compactionIterator) Error() error {
+	for _, src := range it.sources {
+		if err := src.Error(); err != nil {
 			return err
 		}
-		iterators = append(iterators, it)
 	}
+	return nil
+}
 
-	h := &minHeap{}
-	heap.Init(h)
+// Close closes every merged SSTable
+func (it *compactionIterator) Close() error {
+	var firstErr error
+	for _, src := range it.sources {
+		if err := src.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.sources = nil
+	return firstErr
+}
 
-	for _, it := range iterators {
-		if it.Next() {
-			heap.Push(h, &heapItem{
-				key:      it.key,
-				value:    it.value,
-				iterator: it,
-			})
+// compactionScore reports how urgently tables need compacting, a score >= 1
+// means a compaction should be scheduled. Tables whose tombstone ratio exceeds
+// Options.TombstoneCompactionRatio boost the score so deleted data is reclaimed
+// without waiting for the table count threshold.
+// Caller must hold db.mu.
+func (db *DB) compactionScore(tables []int) float64 {
+	score := float64(len(tables)) / float64(SSTableCountThreshold)
+	for _, num := range tables {
+		props, ok := db.tableProps[num]
+		if ok && props.TombstoneRatio() > db.opts.TombstoneCompactionRatio {
+			db.opts.logger().Debugf("SSTable %d has tombstone ratio %.2f, boosting compaction score", num, props.TombstoneRatio())
+			score += 1
+			break
 		}
 	}
+	return score
+}
 
-	list := skiplist.New(NewInternalKeyComparator())
-	var lastUserKey string
-	var itemCount uint
+// maxCompactionHistory caps how many CompactionStats the DB keeps
+const maxCompactionHistory = 100
+
+// CompactionStats describes the cost and result of a single compaction
+type CompactionStats struct {
+	//all SSTables live in a single level for now, so this is always 0
+	Level        int
+	FilesIn      int
+	FilesOut     int
+	BytesRead    int64
+	BytesWritten int64
+	Duration     time.Duration
+}
+
+// DBStats holds running totals over the lifetime of the DB, and totals of the
+// properties of the active SSTables
+type DBStats struct {
+	TotalCompactionBytesRead    int64
+	TotalCompactionBytesWritten int64
+	TotalCompactionDuration     time.Duration
+	//bytes of SSTables written by memtable flushes, the data originally written to storage
+	TotalFlushBytesWritten int64
+
+	//WAL entries replayed by NewDB, and bytes of corrupted or partially written
+	//WAL tails it truncated
+	RecoveredWALEntries uint64
+	DiscardedWALBytes   int64
+
+	//bytes of blob files removed once no SSTable referenced them, see RunValueLogGC
+	BlobBytesReclaimed int64
+
+	//compaction jobs queued on the worker pool that no worker has picked up yet
+	PendingCompactionJobs int
 
-	for h.Len() > 0 {
-		item := heap.Pop(h).(*heapItem)
-		// Skip all older events
-		if item.key.UserKey != lastUserKey {
-			if item.key.Type == OpTypePut {
-				list.Set(item.key, item.value)
-				itemCount++
+	NumTables          int
+	TotalEntries       uint64
+	TotalDeletions     uint64
+	TotalRawKeyBytes   uint64
+	TotalRawValueBytes uint64
+}
+
+// GetCompactionHistory returns the stats of the most recent compactions, oldest first
+func (db *DB) GetCompactionHistory() []CompactionStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	history := make([]CompactionStats, len(db.compactionHistory))
+	copy(history, db.compactionHistory)
+	return history
+}
+
+// Stats returns the running totals of the DB and the aggregated properties of its SSTables
+func (db *DB) Stats() DBStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stats := db.stats
+	stats.PendingCompactionJobs = db.compactionPool.pending()
+	for _, num := range db.activeSSTables {
+		props := db.tableProps[num]
+		stats.NumTables++
+		stats.TotalEntries += props.NumEntries
+		stats.TotalDeletions += props.NumDeletions
+		stats.TotalRawKeyBytes += props.RawKeyBytes
+		stats.TotalRawValueBytes += props.RawValueBytes
+	}
+	return stats
+}
+
+// recordCompaction appends stats to the history and updates the running totals.
+// Caller must hold db.mu.
+func (db *DB) recordCompaction(stats CompactionStats) {
+	db.compactionHistory = append(db.compactionHistory, stats)
+	if len(db.compactionHistory) > maxCompactionHistory {
+		db.compactionHistory = db.compactionHistory[len(db.compactionHistory)-maxCompactionHistory:]
+	}
+	db.stats.TotalCompactionBytesRead += stats.BytesRead
+	db.stats.TotalCompactionBytesWritten += stats.BytesWritten
+	db.stats.TotalCompactionDuration += stats.Duration
+	db.opts.logger().Infof("Compaction stats: level %d, %d files in (%d bytes), %d files out (%d bytes), took %v",
+		stats.Level, stats.FilesIn, stats.BytesRead, stats.FilesOut, stats.BytesWritten, stats.Duration)
+}
+
+// fileSize returns the size of the file at path, or 0 if it cannot be stat'ed
+func fileSize(fs FS, path string) int64 {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// maybeScheduleCompaction queues a compaction of SSTables no other job is
+// compacting if auto compaction is enabled and the compaction score of some of
+// them calls for one, see compactionInputs. Caller must hold db.mu.
+func (db *DB) maybeScheduleCompaction() {
+	if db.compactionPool == nil || !db.autoCompactionEnabled.Load() {
+		return
+	}
+	tables := db.compactionInputs()
+	if tables == nil {
+		return
+	}
+	job := db.newCompactionJob(tables)
+	if !db.compactionPool.enqueue(job) {
+		db.opts.logger().Warnf("Compaction queue is full, dropping a compaction of %d tables", len(tables))
+		db.releaseCompactionJob(job)
+		return
+	}
+	db.scheduledCompactions++
+}
+
+// idleRuns returns the runs of consecutive active SSTables that are not the
+// input of a queued or running compaction, oldest first. A compaction takes a
+// single run: its output replaces its oldest input, so merging tables on both
+// sides of a busy one would move data of the newer side behind it.
+// Caller must hold db.mu.
+func (db *DB) idleRuns() [][]int {
+	var runs [][]int
+	var run []int
+	for _, num := range db.activeSSTables {
+		if db.compactingTables[num] {
+			if len(run) > 0 {
+				runs = append(runs, run)
 			}
-			lastUserKey = item.key.UserKey
+			run = nil
+			continue
+		}
+		run = append(run, num)
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// compactionInputs returns the tables of the next compaction, or nil if no run
+// of idle tables has a compaction score of 1 or more. Within a run the newest
+// tables of generation 0 are taken alone when their score calls for it, so the
+// larger output of earlier compactions is not rewritten on every flush. Between
+// runs the highest score wins, then the one of lower generations.
+// Caller must hold db.mu.
+func (db *DB) compactionInputs() []int {
+	var best []int
+	bestScore, bestGeneration := 0.0, 0
+	for _, run := range db.idleRuns() {
+		tables := run
+		fresh := len(run)
+		for fresh > 0 && db.generations[run[fresh-1]] == 0 {
+			fresh--
 		}
-		if item.iterator.Next() {
-			heap.Push(h, &heapItem{
-				key:      item.iterator.key,
-				value:    item.iterator.value,
-				iterator: item.iterator,
-			})
+		if fresh > 0 && db.compactionScore(run[fresh:]) >= 1 {
+			tables = run[fresh:]
 		}
+		score := db.compactionScore(tables)
+		generation := 0
+		for _, num := range tables {
+			generation = max(generation, db.generations[num])
+		}
+		if score < 1 || score < bestScore || (score == bestScore && generation >= bestGeneration) {
+			continue
+		}
+		best, bestScore, bestGeneration = tables, score, generation
 	}
-	if list.Len() == 0 {
-		// It's possible for a compaction to result in no keys if all keys
-		// were deleted. In this case, we don't create an empty SSTable.
+	return best
+}
+
+// newCompactionJob reserves tables and an output file number for a compaction.
+// The job must be run or released. Caller must hold db.mu.
+func (db *DB) newCompactionJob(tables []int) CompactionJob {
+	job := CompactionJob{
+		OutputPrefix: fmt.Sprintf("%s/%05d", db.dataDir, db.nextFileNumber),
+		inputs:       tables,
+		outputNum:    db.nextFileNumber,
+		//the inputs of earlier jobs are older and may hold keys deleted in tables
+		dropDeletes: len(tables) > 0 && tables[0] == db.activeSSTables[0],
+	}
+	db.nextFileNumber++
+	for _, num := range tables {
+		job.InputPaths = append(job.InputPaths, fmt.Sprintf("%s/%05d.sst", db.dataDir, num))
+		db.compactingTables[num] = true
+	}
+	return job
+}
+
+// releaseCompactionJob returns the tables of job to the ones later jobs may
+// compact. Caller must hold db.mu.
+func (db *DB) releaseCompactionJob(job CompactionJob) {
+	for _, num := range job.inputs {
+		delete(db.compactingTables, num)
+	}
+	db.compactDone.Broadcast()
+}
+
+// runQueuedCompaction runs a job taken off the worker pool
+func (db *DB) runQueuedCompaction(job CompactionJob) {
+	db.runCompaction(job)
+	db.mu.Lock()
+	db.scheduledCompactions--
+	db.compactDone.Broadcast()
+	db.mu.Unlock()
+}
+
+// dropQueuedCompaction releases a job the worker pool did not run because the DB
+// was closed
+func (db *DB) dropQueuedCompaction(job CompactionJob) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.releaseCompactionJob(job)
+	db.scheduledCompactions--
+}
+
+// compactionQueueSize is the number of jobs the worker pool queues before
+// maybeScheduleCompaction drops new ones
+const compactionQueueSize = 64
+
+// CompactionJob is a compaction queued on the CompactionWorkerPool: it merges
+// the input SSTables into a single table written at OutputPrefix + ".sst".
+type CompactionJob struct {
+	InputPaths []string
+	//all SSTables live in a single level for now, so this is always 0
+	OutputLevel  int
+	OutputPrefix string
+
+	//file numbers of InputPaths and of the output
+	inputs    []int
+	outputNum int
+	//set when the inputs include the oldest active table, so tombstones can go
+	dropDeletes bool
+}
+
+// CompactionWorkerPool runs the compactions of a DB on Options.CompactionConcurrency
+// goroutines. Jobs never share an input table, so they can run in parallel.
+type CompactionWorkerPool struct {
+	jobs   chan CompactionJob
+	closed <-chan struct{}
+	drop   func(CompactionJob)
+	wg     sync.WaitGroup
+}
+
+// newCompactionWorkerPool starts workers goroutines calling run for every queued
+// job until closed is closed
+func newCompactionWorkerPool(workers int, run, drop func(CompactionJob), closed <-chan struct{}) *CompactionWorkerPool {
+	p := &CompactionWorkerPool{
+		jobs:   make(chan CompactionJob, compactionQueueSize),
+		closed: closed,
+		drop:   drop,
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case <-closed:
+					return
+				case job := <-p.jobs:
+					run(job)
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// enqueue queues job, it reports false if the queue is full or the pool is shut down
+func (p *CompactionWorkerPool) enqueue(job CompactionJob) bool {
+	select {
+	case <-p.closed:
+		return false
+	default:
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// pending returns the number of queued jobs no worker has picked up yet
+func (p *CompactionWorkerPool) pending() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.jobs)
+}
+
+// shutdown waits for the running jobs once closed is closed, and drops the
+// queued ones
+func (p *CompactionWorkerPool) shutdown() {
+	p.wg.Wait()
+	for {
+		select {
+		case job := <-p.jobs:
+			p.drop(job)
+		default:
+			return
+		}
+	}
+}
+
+// WaitForCompaction blocks until no compaction is running or scheduled, e.g.
+// before a backup or a benchmark measurement. It returns ErrTimeout if that
+// takes longer than timeout. It returns immediately when no compaction is
+// running, even if L0SlowdownWritesTrigger or more SSTables are active, as they
+// are with auto compaction disabled.
+func (db *DB) WaitForCompaction(timeout time.Duration) error {
+	if db.opts.InMemory {
 		return nil
 	}
+	deadline := time.Now().Add(timeout)
+	//wake the loop below at the deadline
+	timer := time.AfterFunc(timeout, func() {
+		db.mu.Lock()
+		db.compactDone.Broadcast()
+		db.mu.Unlock()
+	})
+	defer timer.Stop()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.compacting > 0 || db.scheduledCompactions > 0 {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: compaction still running after %v", ErrTimeout, timeout)
+		}
+		db.compactDone.Wait()
+	}
+	return nil
+}
+
+// DisableAutoCompaction stops scheduling compactions after flushes, e.g. during
+// a bulk ingestion. A compaction that is already running completes. Writes are
+// still slowed down once L0SlowdownWritesTrigger SSTables pile up.
+func (db *DB) DisableAutoCompaction() {
+	db.autoCompactionEnabled.Store(false)
+}
 
-	return WriteSSTable(outputPath, itemCount, list.Front())
+// EnableAutoCompaction resumes scheduling compactions and immediately starts
+// one if the SSTables need it.
+func (db *DB) EnableAutoCompaction() {
+	db.autoCompactionEnabled.Store(true)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.maybeScheduleCompaction()
 }
 
+// maybeStallWrite delays a write by writeSlowdownDelay while too many SSTables are
+// active, and blocks it while a flush is running and the memtable has already
+// grown to Options.MemTableStallSize, so writes cannot outpace flushes and grow
+// the memtable without bound. It returns the error of a flush that failed.
+func (db *DB) maybeStallWrite() error {
+	limit := db.opts.MemTableStallSize
+	db.mu.RLock()
+	tables := len(db.activeSSTables)
+	stall := limit > 0 && db.flushing && db.mem.ApproximateSize() >= limit
+	db.mu.RUnlock()
+	if stall {
+		db.mu.Lock()
+		for db.flushing && db.mem.ApproximateSize() >= limit {
+			db.flushDone.Wait()
+		}
+		err := db.bgErr
+		db.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if tables >= L0SlowdownWritesTrigger {
+		time.Sleep(writeSlowdownDelay)
+	}
+	return nil
+}
+
+// compact synchronously compacts the SSTables no queued or running job holds,
+// the longest run of them if a job holds tables in between
 func (db *DB) compact() {
 	db.mu.Lock()
-	log.Println("Starting compaction ...")
-	tablesToCompact := make([]int, len(db.activeSSTables))
-	copy(tablesToCompact, db.activeSSTables)
-	outputNum := db.nextFileNumber
-	db.nextFileNumber++
+	var tables []int
+	for _, run := range db.idleRuns() {
+		if len(run) > len(tables) {
+			tables = run
+		}
+	}
+	if len(tables) == 0 {
+		db.mu.Unlock()
+		return
+	}
+	job := db.newCompactionJob(tables)
+	db.mu.Unlock()
+	db.runCompaction(job)
+}
 
+// runCompaction merges the inputs of job into one table that takes their place
+// among the active SSTables, then releases the job
+func (db *DB) runCompaction(job CompactionJob) {
+	db.mu.Lock()
+	for db.verifying {
+		db.compactDone.Wait()
+	}
+	db.compacting++
+	//snapshots taken later see the newest versions, which are always kept
+	snapshots := db.snapshotSeqs()
+	db.opts.logger().Infof("Starting compaction of %d tables ...", len(job.inputs))
 	db.mu.Unlock()
-	var pathsToCompact []string
-	for _, num := range tablesToCompact {
-		pathsToCompact = append(pathsToCompact, fmt.Sprintf("%s/%05d.sst", db.dataDir, num))
+	defer func() {
+		db.mu.Lock()
+		db.compacting--
+		db.releaseCompactionJob(job)
+		db.mu.Unlock()
+	}()
+	start := time.Now()
+	stats := CompactionStats{Level: job.OutputLevel, FilesIn: len(job.inputs)}
+	for _, path := range job.InputPaths {
+		stats.BytesRead += fileSize(db.opts.fileSystem(), path)
 	}
-	newSSTablePath := fmt.Sprintf("%s/%05d.sst", db.dataDir, outputNum)
-	tmpPath := newSSTablePath + ".tmp"
+	outputNum := job.outputNum
+	newSSTablePath := job.OutputPrefix + ".sst"
 
-	if err := MergeSSTables(pathsToCompact, tmpPath); err != nil {
-		log.Printf("ERROR: Compaction failed: %v", err)
+	meta, err := mergeSSTables(job.InputPaths, newSSTablePath, db.opts, job.dropDeletes, snapshots)
+	if err != nil {
+		db.opts.logger().Errorf("Compaction failed: %v", err)
 		return
 	}
+	meta.FileNum = outputNum
 
-	if err := os.Rename(tmpPath, newSSTablePath); err != nil {
-		log.Printf("ERROR: Compaction failed during file rename: %v", err)
-		return
+	if meta.NumEntries > 0 {
+		db.opts.logger().Infof("Compaction wrote table %d: %d entries, %d bytes", meta.FileNum, meta.NumEntries, meta.Size)
+		stats.FilesOut = 1
+		stats.BytesWritten = meta.Size
 	}
+	stats.Duration = time.Since(start)
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	newActiveTables := []int{outputNum}
 	isCompacted := make(map[int]bool)
-	for _, num := range tablesToCompact {
+	generation := 0
+	for _, num := range job.inputs {
 		isCompacted[num] = true
+		generation = max(generation, db.generations[num]+1)
+		delete(db.tableProps, num)
+		delete(db.generations, num)
+	}
+	if meta.NumEntries > 0 {
+		db.tableProps[outputNum] = meta.Properties
+		db.generations[outputNum] = generation
 	}
 
-	// Check the *current* activeSSTables list for any new files.
+	//the output holds older data than the tables flushed during the compaction,
+	//and newer data than the inputs of an earlier job, so it takes the place of
+	//its oldest input
+	newActiveTables := []int{}
+	placed := false
 	for _, num := range db.activeSSTables {
 		if !isCompacted[num] {
 			newActiveTables = append(newActiveTables, num)
+			continue
 		}
+		if !placed && meta.NumEntries > 0 {
+			newActiveTables = append(newActiveTables, outputNum)
+		}
+		placed = true
 	}
 
 	db.activeSSTables = newActiveTables
-	sort.Ints(db.activeSSTables)
-
 	if err := db.saveState(); err != nil {
-		log.Printf("CRITICAL ERROR: Failed to save state after compaction: %v", err)
+		db.opts.logger().Errorf("Failed to save state after compaction: %v", err)
 		return
 	}
-	log.Println("Compaction completed successfully.")
+	db.opts.logger().Infof("Compaction completed successfully.")
+	db.recordCompaction(stats)
+	if m := db.opts.Metrics; m != nil {
+		m.OnCompaction(stats.FilesIn, stats.FilesOut, stats.BytesWritten)
+	}
+	if db.opts.EnableBlobFiles || len(db.blobFiles) > 0 {
+		go db.collectBlobGarbage()
+	}
 	//delete old sstable files asynchronously
 	go func(pathsToDelete []string) {
 		for _, path := range pathsToDelete {
-			if err := os.Remove(path); err != nil {
-				log.Printf("ERROR: Failed to remove old SSTable %s after compaction: %v", path, err)
+			if err := db.opts.fileSystem().Remove(path); err != nil {
+				db.opts.logger().Errorf("Failed to remove old SSTable %s after compaction: %v", path, err)
 			}
 		}
-		log.Printf("Successfully garbage collected %d old SSTables.", len(pathsToDelete))
-	}(pathsToCompact)
+		db.opts.logger().Infof("Successfully garbage collected %d old SSTables.", len(pathsToDelete))
+	}(job.InputPaths)
 }
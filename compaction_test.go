@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flushTables writes n SSTables of one key each to db
+func flushTables(t *testing.T, db *DB, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWaitForCompaction(t *testing.T) {
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	//enough tables for several compactions, how many depends on how the
+	//flushes and compactions interleave
+	flushTables(t, db, 3*SSTableCountThreshold)
+	start := time.Now()
+	if err := db.WaitForCompaction(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Fatalf("WaitForCompaction returned after %v", elapsed)
+	}
+	db.mu.Lock()
+	compacting, scheduled := db.compacting, db.scheduledCompactions
+	db.mu.Unlock()
+	if compacting != 0 || scheduled != 0 {
+		t.Fatalf("WaitForCompaction returned with %d compactions running and %d scheduled", compacting, scheduled)
+	}
+	if history := db.GetCompactionHistory(); len(history) == 0 {
+		t.Fatal("no compaction ran")
+	}
+}
+
+func TestWaitForCompactionReturnsWhenNoneIsRunning(t *testing.T) {
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.DisableAutoCompaction()
+	flushTables(t, db, L0SlowdownWritesTrigger)
+	if err := db.WaitForCompaction(5 * time.Second); err != nil {
+		t.Fatalf("WaitForCompaction with auto compaction disabled: %v", err)
+	}
+}
+
+func TestCompactionHistory(t *testing.T) {
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	//compactions are scheduled when a flush starts, so flush one table at a
+	//time until three of them ran
+	for flushes := 0; len(db.GetCompactionHistory()) < 3; flushes++ {
+		if flushes == 10*SSTableCountThreshold {
+			t.Fatalf("%d compactions after %d flushes", len(db.GetCompactionHistory()), flushes)
+		}
+		flushTables(t, db, 1)
+		if err := db.WaitForCompaction(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var read, written int64
+	for i, stats := range db.GetCompactionHistory() {
+		if stats.FilesIn == 0 || stats.FilesOut == 0 || stats.BytesRead == 0 || stats.BytesWritten == 0 || stats.Duration == 0 {
+			t.Fatalf("compaction %d has zero stats: %+v", i, stats)
+		}
+		read += stats.BytesRead
+		written += stats.BytesWritten
+	}
+	if stats := db.Stats(); stats.TotalCompactionBytesRead != read || stats.TotalCompactionBytesWritten != written {
+		t.Fatalf("totals %d read, %d written, want the %d and %d of the history",
+			stats.TotalCompactionBytesRead, stats.TotalCompactionBytesWritten, read, written)
+	}
+}
+
+func TestDisableAutoCompaction(t *testing.T) {
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.DisableAutoCompaction()
+	//past L0SlowdownWritesTrigger, so the writes are slowed down but go through
+	flushTables(t, db, 50)
+	if err := db.WaitForCompaction(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if history := db.GetCompactionHistory(); len(history) != 0 {
+		t.Fatalf("%d compactions ran with auto compaction disabled", len(history))
+	}
+	if tables := len(db.SSTables()); tables != 50 {
+		t.Fatalf("%d SSTables after 50 flushes", tables)
+	}
+	db.EnableAutoCompaction()
+	if err := db.WaitForCompaction(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if history := db.GetCompactionHistory(); len(history) == 0 {
+		t.Fatal("no compaction ran after enabling auto compaction")
+	}
+	if tables := len(db.SSTables()); tables >= 50 {
+		t.Fatalf("%d SSTables after compacting", tables)
+	}
+	//flushTables wrote key00000..key00049
+	for i := 0; i < 50; i++ {
+		if _, found, err := db.Get([]byte(fmt.Sprintf("key%05d", i))); err != nil || !found {
+			t.Fatalf("key%05d lost by compaction, err %v", i, err)
+		}
+	}
+}
+
+// generations returns the generation of every live SSTable, oldest first
+func generations(db *DB) []int {
+	var gens []int
+	for _, info := range db.SSTables() {
+		gens = append(gens, info.Generation)
+	}
+	return gens
+}
+
+func TestCompactionGenerations(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DisableAutoCompaction()
+	flushTables(t, db, SSTableCountThreshold)
+	if gens := fmt.Sprint(generations(db)); gens != "[0 0 0]" {
+		t.Fatalf("flushed tables have generations %s, want 0", gens)
+	}
+	db.compact()
+	if gens := fmt.Sprint(generations(db)); gens != "[1]" {
+		t.Fatalf("generations %s after the first compaction, want [1]", gens)
+	}
+	//one more than the newest input, whatever the generations of the others
+	flushTables(t, db, 2)
+	if gens := fmt.Sprint(generations(db)); gens != "[1 0 0]" {
+		t.Fatalf("generations %s after two more flushes, want [1 0 0]", gens)
+	}
+	db.compact()
+	if gens := fmt.Sprint(generations(db)); gens != "[2]" {
+		t.Fatalf("generations %s after the second compaction, want [2]", gens)
+	}
+	if out, _ := db.GetProperty("leveldb.sstables"); !strings.Contains(out, "generation 2") {
+		t.Fatalf("leveldb.sstables does not show generation 2:\n%s", out)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if gens := fmt.Sprint(generations(db)); gens != "[2]" {
+		t.Fatalf("generations %s after reopening, want [2]", gens)
+	}
+}
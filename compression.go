@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CompressionType selects how data blocks are compressed. It is stored as a
+// 1-byte trailer after every block, so tables written with different settings
+// (or blocks that did not compress well) can be mixed freely.
+type CompressionType = byte
+
+const (
+	NoCompression CompressionType = 0
+	// SnappyCompression uses the Snappy block format: fast, moderate ratio
+	SnappyCompression CompressionType = 1
+	// DeflateCompression uses compress/flate: slower, better ratio
+	DeflateCompression CompressionType = 2
+)
+
+var errCorruptSnappy = errors.New("snappy: corrupt input")
+
+// maxDeflateRatio bounds how much a deflate block may expand when decompressed
+const maxDeflateRatio = 1032
+
+// compressBlock compresses raw with the requested algorithm and appends the
+// compression type byte. Blocks that do not shrink are stored uncompressed.
+func compressBlock(raw []byte, ct CompressionType) ([]byte, error) {
+	var compressed []byte
+	switch ct {
+	case NoCompression:
+	case SnappyCompression:
+		compressed = snappyEncode(raw)
+	case DeflateCompression:
+		buf := new(bytes.Buffer)
+		w, err := flate.NewWriter(buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		compressed = buf.Bytes()
+	default:
+		return nil, fmt.Errorf("unknown compression type %d", ct)
+	}
+	if compressed == nil || len(compressed) >= len(raw) {
+		out := make([]byte, len(raw)+1)
+		copy(out, raw)
+		out[len(raw)] = NoCompression
+		return out, nil
+	}
+	return append(compressed, ct), nil
+}
+
+// decompressBlock strips the compression type trailer and decompresses the block
+func decompressBlock(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("block is missing its compression type")
+	}
+	ct := stored[len(stored)-1]
+	payload := stored[:len(stored)-1]
+	switch ct {
+	case NoCompression:
+		return payload, nil
+	case SnappyCompression:
+		return snappyDecode(payload)
+	case DeflateCompression:
+		r := flate.NewReader(bytes.NewReader(payload))
+		defer r.Close()
+		//deflate cannot expand more than this, more output means a corrupt block
+		limit := int64(len(payload))*maxDeflateRatio + 1
+		raw, err := io.ReadAll(io.LimitReader(r, limit))
+		if err == nil && int64(len(raw)) == limit {
+			err = fmt.Errorf("%w: deflate block expands beyond %d times its size", ErrCorruption, maxDeflateRatio)
+		}
+		return raw, err
+	default:
+		return nil, fmt.Errorf("unknown compression type %d", ct)
+	}
+}
+
+// snappyEncode compresses src in the Snappy block format:
+// [Decompressed Length (varint)][Elements], where each element is a literal run
+// or a copy of earlier output. Only 2-byte offset copies are emitted.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	const (
+		minMatch  = 4
+		maxOffset = 1<<16 - 1
+		tableBits = 12
+	)
+	var table [1 << tableBits]int32
+	hash := func(u uint32) uint32 { return (u * 0x1e35a7bd) >> (32 - tableBits) }
+	load := func(i int) uint32 { return binary.LittleEndian.Uint32(src[i:]) }
+
+	litStart := 0
+	i := 0
+	for i+minMatch <= len(src) {
+		h := hash(load(i))
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > maxOffset || load(candidate) != load(i) {
+			i++
+			continue
+		}
+		//extend the match as far as it goes
+		length := minMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyEmitLiteral(dst, src[litStart:i])
+		dst = snappyEmitCopy(dst, i-candidate, length)
+		i += length
+		litStart = i
+	}
+	return snappyEmitLiteral(dst, src[litStart:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	//a 2-byte offset copy holds at most 64 bytes
+	for length > 0 {
+		n := min(length, 64)
+		dst = append(dst, byte(n-1)<<2|0x02, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// snappyDecode decompresses a Snappy block format buffer
+func snappyDecode(src []byte) ([]byte, error) {
+	dLen, n := binary.Uvarint(src)
+	//a 3-byte copy expands to at most 64 bytes, anything larger is corrupt
+	if n <= 0 || dLen > uint64(len(src))*32 {
+		return nil, errCorruptSnappy
+	}
+	src = src[n:]
+	dst := make([]byte, 0, dLen)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case 0x00:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errCorruptSnappy
+				}
+				length = 0
+				for j := extra - 1; j >= 0; j-- {
+					length = length<<8 | int(src[j])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || uint64(len(dst)+length) > dLen {
+				return nil, errCorruptSnappy
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 0x01:
+			if len(src) < 2 {
+				return nil, errCorruptSnappy
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 0x02:
+			if len(src) < 3 {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 0x03:
+			if len(src) < 5 {
+				return nil, errCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > dLen {
+			return nil, errCorruptSnappy
+		}
+		//copies may overlap their own output, so go byte by byte
+		start := len(dst) - offset
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	if uint64(len(dst)) != dLen {
+		return nil, errCorruptSnappy
+	}
+	return dst, nil
+}
@@ -1,83 +1,275 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	MemTableSizeThreshold = 1 * 1024 * 4 //4KB
 	stateFileName         = "state.json"
 	activeWalFileName     = "db.wal"
+	// legacyWalFileName is where NewDB moves an active WAL in an older format
+	// until it is flushed. It sorts before the rotated WALs, like its entries.
+	legacyWalFileName     = "wal-00000-legacy.log"
 	SSTableCountThreshold = 3
+	// L0SlowdownWritesTrigger is the SSTable count at which every write is
+	// delayed by writeSlowdownDelay, so compaction (or an operator who disabled
+	// it) can catch up before reads degrade further
+	L0SlowdownWritesTrigger = 8
+	writeSlowdownDelay      = time.Millisecond
+
+	// DefaultMemTableStallSize is the Options.MemTableStallSize set by DefaultOptions
+	DefaultMemTableStallSize = 4 * MemTableSizeThreshold
 )
 
+// ErrNotWritable is returned by NewDB when the data directory cannot be written to,
+// e.g. because the filesystem is read-only or full
+var ErrNotWritable = errors.New("data directory is not writable")
+
+// ErrUnsupportedVersion is returned when a WAL, an SSTable or the state file was
+// written in a newer format than this code can read
+var ErrUnsupportedVersion = errors.New("unsupported format version")
+
+// DBFormatVersion is the format version recorded in the state file. It is raised
+// when the layout of the data directory changes incompatibly.
+const DBFormatVersion = 1
+
+// ErrTimeout is returned by WaitForCompaction when the compactions do not finish in time
+var ErrTimeout = errors.New("timed out")
+
+// ErrStaleSequenceNumber is returned by ApplyEntry for an entry that is not newer than the DB
+var ErrStaleSequenceNumber = errors.New("sequence number is not newer than the last applied one")
+
+// ErrInUse is returned by DropAll while snapshots or Subscribe subscriptions are
+// open, since the sequence numbers they hold would refer to the dropped history
+var ErrInUse = errors.New("snapshots or subscriptions are open")
+
 type DBState struct {
-	NextFileNumber int   `json:"next_file_number"`
+	//0 for state files written before the version was recorded
+	FormatVersion  int `json:"format_version"`
+	NextFileNumber int `json:"next_file_number"`
+	//oldest first: a compaction output replaces the oldest tables, flushes append.
+	//File numbers are not in this order, a flush can finish after a compaction
+	//that started later and took a higher file number.
 	ActiveSSTables []int `json:"active_sstables"`
+	//highest sequence number handed out when the state was saved, so it never
+	//goes backwards even if every table and WAL holding it is gone
+	LastSequence uint64 `json:"last_sequence"`
+	//blob files holding values of the active SSTables, see Options.EnableBlobFiles
+	BlobFiles []int `json:"blob_files,omitempty"`
+	//generation of the active SSTables written by compactions, see DB.generations.
+	//Flushed tables are generation 0 and not listed.
+	Generations map[int]int `json:"generations,omitempty"`
 }
 
 // saveState serializes the current DB state to a json file
 func (db *DB) saveState() error {
-	state := DBState{
+	return writeState(db.opts.fileSystem(), db.dataDir, DBState{
+		FormatVersion:  DBFormatVersion,
 		NextFileNumber: db.nextFileNumber,
 		ActiveSSTables: db.activeSSTables,
-	}
+		LastSequence:   db.sequenceNum.Load(),
+		BlobFiles:      db.blobFiles,
+		Generations:    db.generations,
+	})
+}
+
+// writeState writes state to the state file in dir
+func writeState(fs FS, dir string, state DBState) error {
 	data, err := json.MarshalIndent(state, "", "\t")
 	if err != nil {
 		return err
 	}
-	statePath := filepath.Join(db.dataDir, stateFileName)
-	return os.WriteFile(statePath, data, 0644)
+	statePath := filepath.Join(dir, stateFileName)
+	return fs.WriteFile(statePath, data, 0644)
+}
+
+// loadState reads the state file in dir, returning the state of an empty DB
+// when there is none
+func loadState(fs FS, dir string, logger Logger) (DBState, error) {
+	statePath := filepath.Join(dir, stateFileName)
+	var state DBState
+	data, err := fs.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Infof("State file not found, initializing with default state...")
+			return DBState{
+				NextFileNumber: 1,
+				ActiveSSTables: []int{},
+			}, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	if state.FormatVersion > DBFormatVersion {
+		return state, fmt.Errorf("%w: %s has version %d, supported up to %d", ErrUnsupportedVersion, statePath, state.FormatVersion, DBFormatVersion)
+	}
+	logger.Infof("Loaded state: NextFileNumber is %d, ActiveSSTables: %v", state.NextFileNumber, state.ActiveSSTables)
+	return state, nil
 }
 
 type DB struct {
 	mu           sync.RWMutex
 	wal          *WAL
-	mem          *MemTable
-	immutableMem *MemTable //hold the memtable data being flushed
+	mem          MemTable
+	immutableMem MemTable //hold the memtable data being flushed
 
 	dataDir        string
+	opts           *Options
 	nextFileNumber int
 	activeSSTables []int
+	//properties of every active SSTable, keyed by file number
+	tableProps map[int]TableProperties
+	//blob files written by flushes, removed once no active SSTable references them
+	blobFiles []int
+	blobs     *blobStore
+	//serializes collectBlobGarbage runs
+	blobGCMu sync.Mutex
+	//number of running compactions, Verify waits until there are none
+	compacting int
+	//set while Verify is running, compactions wait until it is cleared
+	verifying bool
+	//inputs of the queued and running compactions, no two jobs share a table
+	compactingTables map[int]bool
+	//number of compactions the data of an active SSTable went through: a
+	//compaction output is one more than its newest input generation, flushed
+	//tables are generation 0 and not listed
+	generations map[int]int
+	//compactions queued by maybeScheduleCompaction that have not returned yet
+	scheduledCompactions int
+	//broadcast when a compaction or Verify finishes
+	compactDone *sync.Cond
+	//runs the compactions queued by maybeScheduleCompaction, nil when in memory
+	compactionPool *CompactionWorkerPool
+	//first error of a background flush, writes fail with it until the DB is
+	//reopened or, for a failed SSTable write, Flush retries it successfully
+	bgErr error
+	//the flush that set bgErr, kept with immutableMem and its WAL for Flush to retry
+	failedFlush *failedFlush
+	//cleared by DisableAutoCompaction to stop scheduling compactions after flushes
+	autoCompactionEnabled atomic.Bool
+	//set while immutableMem is being written, flushDone is signaled when it clears
+	flushing  bool
+	flushDone *sync.Cond
+	//stats of the most recent compactions, capped at maxCompactionHistory
+	compactionHistory []CompactionStats
+	stats             DBStats
 	//global sequence number for all operations
 	sequenceNum atomic.Uint64
+	//held shared by every write and exclusively by CompareAndSwap, so no write
+	//can land between its read and its write, and by DropAll
+	writeMu sync.RWMutex
+	//held by every write from the allocation of its sequence numbers until it
+	//is published, so the WAL and subscribers see writes in sequence order, and
+	//by memtable rotations, so no write lands in a memtable being flushed
+	commitMu sync.Mutex
+	//distinguishes this DB's blocks in a shared Options.BlockCache, replaced by
+	//DropAll since file numbers are reused afterwards
+	id atomic.Uint64
+	//Subscribe registrations, see subscribe.go
+	subMu       sync.Mutex
+	subscribers map[*subscriber]struct{}
+	//SubscribeFunc registrations, callbacks run under notifyMu only
+	notifyMu        sync.Mutex
+	funcSubscribers map[*funcSubscriber]struct{}
+	//live snapshots, see GetSnapshot
+	snapshots map[*Snapshot]struct{}
+	//signalled by the WAL once Options.WALSyncBytes are unsynced, see walSyncLoop
+	walSyncDue chan struct{}
+	//when the memtable was last rotated for a flush, see flushIntervalLoop
+	lastFlush time.Time
+	//closed by Close to stop background goroutines
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-// NewDB creates or opens a database at the specified path.
-// It first replays all WALs to recover the state
+// NewDB creates or opens a database at the specified path with the default options.
 func NewDB(dir string) (*DB, error) {
+	return NewDBWithOptions(dir, DefaultOptions())
+}
+
+// NewDBWithOptions creates or opens a database at the specified path.
+// It first replays all WALs to recover the state
+func NewDBWithOptions(dir string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if opts.InMemory {
+		opts.logger().Infof("Opening in-memory database, data will be lost when the process exits")
+		db := &DB{
+			mem:        opts.newMemTable(),
+			dataDir:    dir,
+			opts:       opts,
+			tableProps: make(map[int]TableProperties),
+			closed:     make(chan struct{}),
+		}
+		db.id.Store(nextDBID.Add(1))
+		db.autoCompactionEnabled.Store(true)
+		db.startBackgroundTasks()
+		return db, nil
+	}
+	fs := opts.fileSystem()
 	//first, replay the WAL to recover the state
 	//file mode 0755: https://www.warp.dev/terminus/chmod-755
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotWritable, err)
+	}
+	walDir := opts.walDir(dir)
+	if err := fs.MkdirAll(walDir, 0755); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotWritable, err)
+	}
+	//fail here with a clear error rather than half way through recovery
+	if err := checkWritable(fs, dir); err != nil {
 		return nil, err
 	}
-	statePath := filepath.Join(dir, stateFileName)
-	var state DBState
-	data, err := os.ReadFile(statePath)
+	if walDir != dir {
+		if err := checkWritable(fs, walDir); err != nil {
+			return nil, err
+		}
+	}
+	state, err := loadState(fs, dir, opts.logger())
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("State file not found, initializing with default state...")
-			state = DBState{
-				NextFileNumber: 1,
-				ActiveSSTables: []int{},
-			}
+		return nil, err
+	}
+	//tables a crash left half written, their data is still in the WALs or inputs
+	tmpFiles, _ := fs.Glob(filepath.Join(dir, "*"+tmpFileSuffix))
+	for _, path := range tmpFiles {
+		if err := fs.Remove(path); err != nil {
+			opts.logger().Warnf("Failed to remove leftover temporary file %s: %v", path, err)
 		} else {
-			return nil, err
+			opts.logger().Infof("Removed leftover temporary file %s", path)
 		}
-	} else {
-		if err := json.Unmarshal(data, &state); err != nil {
-			return nil, err
+	}
+	//tables a crash left between writing them and saving the state, or that an
+	//uncommitted compaction wrote, their data is still in the WALs or inputs, and
+	//their numbers are handed out again
+	sstFiles, _ := fs.Glob(filepath.Join(dir, "*.sst"))
+	for _, path := range sstFiles {
+		num, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".sst"))
+		if err != nil || num < state.NextFileNumber || slices.Contains(state.ActiveSSTables, num) {
+			continue
+		}
+		if err := fs.Remove(path); err != nil {
+			opts.logger().Warnf("Failed to remove leftover SSTable %s: %v", path, err)
+		} else {
+			opts.logger().Infof("Removed leftover SSTable %s", path)
 		}
-		log.Printf("Loaded state: NextFileNumber is %d, ActiveSSTables: %v", state.NextFileNumber, state.ActiveSSTables)
 	}
-	mem := NewMemTable()
+	mem := opts.newMemTable()
 	var maxSeqNum uint64 = 0
 	// List all WAL files and sort them in order so that we replay in the order they were created.
 	// Imagine this situation:
@@ -87,116 +279,687 @@ func NewDB(dir string) (*DB, error) {
 	//   - a new db.wal is created
 	//   - the full memtable is moved to immutableMem
 	//   - lock is released
-	walFiles, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
-	sort.Strings(walFiles)
-	activeWal := filepath.Join(dir, activeWalFileName)
-	walFiles = append(walFiles, activeWal)
+	//WALs left in the data directory by opening the DB before WALDir was set
+	//predate the ones in WALDir. They are flushed and removed once the DB is open.
+	var strayWals []string
+	if walDir != dir {
+		for _, walPath := range listWALs(fs, dir) {
+			if _, err := fs.Stat(walPath); err == nil {
+				strayWals = append(strayWals, walPath)
+			}
+		}
+	}
+	activeWal := filepath.Join(walDir, activeWalFileName)
+	var walRecords uint64
+	var walDiscarded int64
+	//WALs written before WALFormatVersion are replayed once, then flushed and removed
+	var legacyWals []string
+	walFiles := append(strayWals, listWALs(fs, walDir)...)
 	for _, walPath := range walFiles {
-		if _, err := os.Stat(walPath); os.IsNotExist(err) {
+		if _, err := fs.Stat(walPath); os.IsNotExist(err) {
 			continue
 		}
-		recoveredData, lastSeq, err := Replay(walPath)
+		recoveredData, lastSeq, report, err := replayWAL(fs, walPath, opts.WALRecoveryMode, opts.logger())
 		if err != nil {
 			return nil, err
 		}
+		walRecords += uint64(report.Records)
+		walDiscarded += report.DiscardedBytes
+		if report.FormatVersion < WALFormatVersion && walPath != activeWal && !slices.Contains(strayWals, walPath) {
+			legacyWals = append(legacyWals, walPath)
+		}
 		if lastSeq > maxSeqNum {
 			maxSeqNum = lastSeq
 		}
 		for key, value := range recoveredData {
+			if value.Type == OpRangeDelete {
+				mem.DeleteRange([]byte(key.UserKey), value.Value, key.SeqNum)
+				continue
+			}
 			mem.Put(key, value.Value)
 		}
 	}
-	log.Printf("Recovery complete. Highest sequence number is %d", maxSeqNum)
-	wal, err := NewWal(activeWal)
+	opts.logger().Infof("Recovery complete. Highest sequence number is %d, %d WAL entries replayed, %d bytes of corrupted WALs discarded",
+		maxSeqNum, walRecords, walDiscarded)
+	//new entries cannot be appended to an active WAL in an older format, it is
+	//moved aside so a new one is started
+	if version, err := readWALVersion(fs, activeWal); err == nil && version < WALFormatVersion {
+		if stat, err := fs.Stat(activeWal); err == nil && stat.Size() > 0 {
+			legacyWal := filepath.Join(walDir, legacyWalFileName)
+			if err := fs.Rename(activeWal, legacyWal); err != nil {
+				return nil, fmt.Errorf("failed to move aside WAL of version %d: %w", version, err)
+			}
+			legacyWals = append(legacyWals, legacyWal)
+		}
+	}
+	wal, err := openWAL(fs, activeWal)
 	if err != nil {
 		return nil, err
 	}
 	db := &DB{
-		wal:            wal,
-		mem:            mem,
-		dataDir:        dir,
-		nextFileNumber: state.NextFileNumber,
-		activeSSTables: state.ActiveSSTables,
+		wal:              wal,
+		mem:              mem,
+		dataDir:          dir,
+		opts:             opts,
+		nextFileNumber:   state.NextFileNumber,
+		activeSSTables:   state.ActiveSSTables,
+		tableProps:       make(map[int]TableProperties),
+		compactingTables: make(map[int]bool),
+		generations:      make(map[int]int),
+		blobFiles:        state.BlobFiles,
+		blobs:            &blobStore{fs: fs, dir: dir},
+		closed:           make(chan struct{}),
+		walSyncDue:       make(chan struct{}, 1),
+		lastFlush:        time.Now(),
 	}
-	db.sequenceNum.Store(maxSeqNum)
+	db.configureWAL(wal)
+	db.id.Store(nextDBID.Add(1))
+	db.stats.RecoveredWALEntries = walRecords
+	db.stats.DiscardedWALBytes = walDiscarded
+	db.flushDone = sync.NewCond(&db.mu)
+	db.compactDone = sync.NewCond(&db.mu)
+	db.autoCompactionEnabled.Store(true)
+	for _, sstNum := range db.activeSSTables {
+		if gen := state.Generations[sstNum]; gen > 0 {
+			db.generations[sstNum] = gen
+		}
+		path := fmt.Sprintf("%s/%05d.sst", dir, sstNum)
+		if opts.ParanoidChecks {
+			if err := checkFileChecksum(path, opts); err != nil {
+				db.wal.Close()
+				return nil, fmt.Errorf("SSTable %d: %w", sstNum, err)
+			}
+		}
+		props, err := readTableProperties(path, opts)
+		if err != nil {
+			opts.logger().Errorf("Failed to read properties of SSTable %d: %v", sstNum, err)
+			continue
+		}
+		db.tableProps[sstNum] = props
+		largestSeq := props.LargestSeq
+		if largestSeq == 0 {
+			//tables written before the properties block do not record their sequence numbers
+			if largestSeq, err = scanLargestSeq(path, opts); err != nil {
+				db.wal.Close()
+				return nil, fmt.Errorf("failed to scan SSTable %d for its sequence numbers: %w", sstNum, err)
+			}
+		}
+		//the WALs of flushed tables are gone, never hand out a sequence number again
+		maxSeqNum = max(maxSeqNum, largestSeq)
+	}
+	db.sequenceNum.Store(max(maxSeqNum, state.LastSequence))
 	err = db.saveState()
 	if err != nil {
 		return nil, err
 	}
+	if len(strayWals) > 0 || len(legacyWals) > 0 {
+		if err := db.Flush(); err != nil {
+			db.wal.Close()
+			return nil, fmt.Errorf("failed to flush the WALs of %s: %w", dir, err)
+		}
+		for _, walPath := range append(strayWals, legacyWals...) {
+			if err := fs.Remove(walPath); err != nil && !os.IsNotExist(err) {
+				opts.logger().Errorf("Failed to remove WAL %s after moving its data: %v", walPath, err)
+			}
+		}
+		if len(strayWals) > 0 {
+			opts.logger().Infof("Flushed %d WALs of %s, new WALs go to %s", len(strayWals), dir, walDir)
+		}
+		if len(legacyWals) > 0 {
+			opts.logger().Infof("Flushed %d WALs written before WAL format version %d", len(legacyWals), WALFormatVersion)
+		}
+	}
+	if opts.CompactOnOpen {
+		if err := db.compactOnOpen(); err != nil {
+			db.wal.Close()
+			return nil, err
+		}
+	}
+	report := db.HealthCheck()
+	for _, issue := range report.Issues {
+		if issue.Severity == IssueWarning {
+			opts.logger().Warnf("Health check of %s: %s", dir, issue.Description)
+		}
+	}
+	if err := report.Err(); err != nil {
+		db.wal.Close()
+		return nil, fmt.Errorf("health check of %s failed: %w", dir, err)
+	}
+	db.startBackgroundTasks()
 	return db, nil
 }
+
+// compactOnOpen flushes the recovered memtable, removes the rotated WALs left by
+// a crash and compacts the SSTables, see Options.CompactOnOpen
+func (db *DB) compactOnOpen() error {
+	//listed before the flush, which rotates and deletes a WAL of its own
+	fs := db.opts.fileSystem()
+	orphanedWals, _ := fs.Glob(filepath.Join(db.walDir(), "wal-*.log"))
+	if err := db.Flush(); err != nil {
+		return fmt.Errorf("failed to flush recovered data: %w", err)
+	}
+	//their entries were replayed into the memtable that was just flushed
+	for _, walPath := range orphanedWals {
+		if err := fs.Remove(walPath); err != nil && !os.IsNotExist(err) {
+			db.opts.logger().Errorf("Failed to remove orphaned WAL %s: %v", walPath, err)
+		} else {
+			db.opts.logger().Infof("Removed orphaned WAL %s", walPath)
+		}
+	}
+	if stats := db.Stats(); stats.NumTables > 1 || stats.TotalDeletions > 0 {
+		db.compact()
+	}
+	return nil
+}
+
+// startBackgroundTasks starts the goroutines that run until Close
+func (db *DB) startBackgroundTasks() {
+	if db.opts.StatsLogInterval > 0 {
+		go db.logStatsLoop(db.opts.StatsLogInterval)
+	}
+	if !db.opts.InMemory && db.opts.WALSyncMode == WALSyncPeriodic {
+		interval := db.opts.WALSyncInterval
+		if interval <= 0 {
+			interval = DefaultWALSyncInterval
+		}
+		go db.walSyncLoop(interval)
+	}
+	if !db.opts.InMemory && db.opts.FlushInterval > 0 {
+		go db.flushIntervalLoop(db.opts.FlushInterval)
+	}
+	if !db.opts.InMemory {
+		db.compactionPool = newCompactionWorkerPool(db.opts.CompactionConcurrency, db.runQueuedCompaction, db.dropQueuedCompaction, db.closed)
+	}
+}
+
+// flushIntervalLoop starts a background flush of a non-empty memtable once
+// interval has passed since the last one, until Close
+func (db *DB) flushIntervalLoop(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-db.closed:
+			return
+		}
+		db.commitMu.Lock()
+		db.mu.Lock()
+		wait := interval - time.Since(db.lastFlush)
+		if wait > 0 || db.mem.Len() == 0 || db.immutableMem != nil {
+			db.mu.Unlock()
+			db.commitMu.Unlock()
+			//a flush is due later, running, or there is nothing to flush
+			if wait <= 0 {
+				wait = interval
+			}
+			timer.Reset(wait)
+			continue
+		}
+		select {
+		case <-db.closed:
+			db.mu.Unlock()
+			db.commitMu.Unlock()
+			return
+		default:
+		}
+		db.opts.logger().Infof("Memtable was not flushed for %v, starting flush...", interval)
+		imm, rotatedWalPath, sstNum, ok := db.rotateMemtable()
+		db.mu.Unlock()
+		db.commitMu.Unlock()
+		if ok {
+			go db.writeImmutableMemtable(imm, rotatedWalPath, sstNum)
+		}
+		timer.Reset(interval)
+	}
+}
+
 func (db *DB) flushMemtable() {
 	//prevent other operations while flushing
 
-	log.Println("Memtable is full, starting flush...")
+	db.opts.logger().Infof("Memtable is full, starting flush...")
+	db.commitMu.Lock()
 	db.mu.Lock()
-	if db.immutableMem != nil {
-		db.mu.Unlock()
+	imm, rotatedWalPath, sstNum, ok := db.rotateMemtable()
+	db.mu.Unlock()
+	db.commitMu.Unlock()
+	if !ok {
 		return
 	}
+	go db.writeImmutableMemtable(imm, rotatedWalPath, sstNum)
+}
+
+// rotateMemtable moves the active memtable to immutableMem and rotates the WAL.
+// It reports false if a flush is already in progress or the rotation failed.
+// Callers must hold commitMu and db.mu and, on success, call writeImmutableMemtable.
+func (db *DB) rotateMemtable() (MemTable, string, int, bool) {
+	if db.immutableMem != nil || db.bgErr != nil {
+		return nil, "", 0, false
+	}
 	//WAL rotation
 	sstNum := db.nextFileNumber
 	db.nextFileNumber++
 	walPath := db.wal.file.Name()
-	rotatedWalPath := fmt.Sprintf("%s/wal-%05d.log", db.dataDir, sstNum)
-	db.wal.Close()
-	if err := os.Rename(walPath, rotatedWalPath); err != nil {
-		log.Printf("CRITICAL: Failed to rename WAL: %v", err)
-		db.mu.Unlock()
-		return
+	rotatedWalPath := filepath.Join(db.walDir(), fmt.Sprintf("wal-%05d.log", sstNum))
+	if err := db.wal.Close(); err != nil {
+		db.opts.logger().Errorf("Failed to close WAL before rotation: %v", err)
+	}
+	fs := db.opts.fileSystem()
+	if err := fs.Rename(walPath, rotatedWalPath); err != nil {
+		db.opts.logger().Errorf("Failed to rename WAL: %v", err)
+		db.reopenWAL(walPath)
+		return nil, "", 0, false
 	}
-	newWal, err := NewWal(walPath)
+	newWal, err := openWAL(fs, walPath)
 	if err != nil {
-		log.Printf("CRITICAL ERROR: Failed to open new WAL: %v", err)
-		db.mu.Unlock()
-		return
+		db.opts.logger().Errorf("Failed to open new WAL: %v", err)
+		//keep appending to the old WAL
+		if err := fs.Rename(rotatedWalPath, walPath); err != nil {
+			db.bgErr = fmt.Errorf("failed to restore WAL after a failed rotation: %w", err)
+			return nil, "", 0, false
+		}
+		db.reopenWAL(walPath)
+		return nil, "", 0, false
 	}
+	db.configureWAL(newWal)
 	db.wal = newWal
 	db.immutableMem = db.mem
-	db.mem = NewMemTable()
-	if len(db.activeSSTables) >= SSTableCountThreshold {
-		go db.compact()
+	db.mem = db.opts.newMemTable()
+	db.flushing = true
+	db.lastFlush = time.Now()
+	db.maybeScheduleCompaction()
+	return db.immutableMem, rotatedWalPath, sstNum, true
+}
+
+// reopenWAL reopens the WAL at path after a failed rotation closed it.
+// Caller must hold db.mu.
+func (db *DB) reopenWAL(path string) {
+	wal, err := openWAL(db.opts.fileSystem(), path)
+	if err != nil {
+		db.bgErr = fmt.Errorf("failed to reopen WAL: %w", err)
+		return
 	}
-	db.mu.Unlock()
+	db.configureWAL(wal)
+	db.wal = wal
+}
+
+// configureWAL applies the options of the DB to a WAL it opened
+func (db *DB) configureWAL(wal *WAL) {
+	wal.metrics = db.opts.Metrics
+	wal.syncMode = db.opts.WALSyncMode
+	wal.syncBytes = db.opts.WALSyncBytes
+	wal.syncDue = db.walSyncDue
+}
+
+// SyncWAL syncs the WAL to stable storage: once it returns nil, every write
+// that returned before it was called survives a machine crash, whatever
+// Options.WALSyncMode is. It does nothing for an InMemory DB.
+func (db *DB) SyncWAL() error {
+	if db.opts.InMemory {
+		return nil
+	}
+	db.mu.RLock()
+	wal := db.wal
+	db.mu.RUnlock()
+	//a WAL rotated away in the meantime was synced when it was closed
+	return wal.Sync()
+}
 
-	go func(imm *MemTable, walToDelete string, sstNum int) {
-		log.Printf("Background flush: Starting to write SSTable %s...", sstNum)
-		sstablePath := fmt.Sprintf("%s/%05d.sst", db.dataDir, sstNum)
-		itemCount := imm.data.Len()
-		if err := WriteSSTable(sstablePath, uint(itemCount), imm.data.Front()); err != nil {
-			log.Printf("ERROR: Failed to write SSTable: %v", err)
+// walSyncLoop syncs the WAL every interval, and whenever a write signals
+// walSyncDue, until Close. A failed sync stops writes like a failed flush does:
+// what the OS failed to write back cannot be told apart from what it wrote.
+func (db *DB) walSyncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.walSyncDue:
+		case <-db.closed:
 			return
 		}
-		log.Printf("Successfully flushed memtable to %s", sstablePath)
+		if err := db.SyncWAL(); err != nil {
+			db.opts.logger().Errorf("Background WAL sync failed: %v", err)
+			db.mu.Lock()
+			if db.bgErr == nil {
+				db.bgErr = fmt.Errorf("failed to sync WAL: %w", err)
+			}
+			db.mu.Unlock()
+		}
+	}
+}
+
+// failedFlush is a memtable flush whose SSTable could not be written
+type failedFlush struct {
+	walPath string
+	sstNum  int
+	err     error
+}
+
+// backgroundError returns the error that stopped background flushes, if any
+func (db *DB) backgroundError() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.bgErr != nil {
+		return fmt.Errorf("DB is read-only after a background error: %w", db.bgErr)
+	}
+	return nil
+}
+
+// walDir returns the directory holding the WALs, see Options.WALDir
+func (db *DB) walDir() string {
+	return db.opts.walDir(db.dataDir)
+}
+
+// listWALs returns the paths of the rotated WALs in dir in the order they were
+// rotated, followed by the active WAL, which may not exist
+func listWALs(fs FS, dir string) []string {
+	walFiles, _ := fs.Glob(filepath.Join(dir, "wal-*.log"))
+	sort.Strings(walFiles)
+	return append(walFiles, filepath.Join(dir, activeWalFileName))
+}
+
+// checkWritable creates, syncs and removes a probe file in dir
+func checkWritable(fs FS, dir string) error {
+	probe := filepath.Join(dir, ".write-probe")
+	file, err := fs.Create(probe)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotWritable, err)
+	}
+	_, err = file.Write([]byte{0})
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	fs.Remove(probe)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotWritable, err)
+	}
+	return nil
+}
+
+// writeImmutableMemtable writes imm to SSTable sstNum, installs it and deletes the rotated WAL
+func (db *DB) writeImmutableMemtable(imm MemTable, walToDelete string, sstNum int) error {
+	db.opts.logger().Infof("Background flush: Starting to write SSTable %d...", sstNum)
+	start := time.Now()
+	sstablePath := fmt.Sprintf("%s/%05d.sst", db.dataDir, sstNum)
+	deletes, err := db.rangeDeletePoints(imm)
+	var meta TableMeta
+	var blobNum int
+	if err == nil {
+		itemCount := imm.Len() + len(deletes)
+		src := newMemTableSource(imm, deletes)
+		meta, blobNum, err = db.writeFlushTable(sstablePath, uint(itemCount), src)
+		src.Close()
+	}
+	if err != nil {
+		// immutableMem stays installed so Get keeps serving its keys, and the
+		// rotated WAL is kept so they are replayed on the next open.
+		db.opts.logger().Errorf("Failed to write SSTable: %v", err)
 		db.mu.Lock()
-		defer db.mu.Unlock()
-		db.immutableMem = nil
-		db.activeSSTables = append(db.activeSSTables, sstNum)
-		sort.Ints(db.activeSSTables)
-		if err := db.saveState(); err != nil {
-			log.Printf("CRITICAL ERROR: Failed to save state file: %v", err)
-			return
+		db.bgErr = fmt.Errorf("failed to write SSTable %d: %w", sstNum, err)
+		db.failedFlush = &failedFlush{walPath: walToDelete, sstNum: sstNum, err: db.bgErr}
+		db.flushing = false
+		db.flushDone.Broadcast()
+		db.mu.Unlock()
+		return err
+	}
+	meta.FileNum = sstNum
+	db.opts.logger().Infof("Successfully flushed memtable to %s: table %d, %d entries, %d bytes", sstablePath, meta.FileNum, meta.NumEntries, meta.Size)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.flushing = false
+	db.flushDone.Broadcast()
+	db.immutableMem = nil
+	if db.failedFlush != nil {
+		//the retry succeeded, writes can resume unless something else failed since
+		if db.bgErr == db.failedFlush.err {
+			db.bgErr = nil
 		}
+		db.failedFlush = nil
+	}
+	db.activeSSTables = append(db.activeSSTables, sstNum)
+	db.tableProps[sstNum] = meta.Properties
+	if blobNum > 0 {
+		db.blobFiles = append(db.blobFiles, blobNum)
+	}
+	db.stats.TotalFlushBytesWritten += meta.Size
+	if err := db.saveState(); err != nil {
+		db.opts.logger().Errorf("Failed to save state file: %v", err)
+		db.bgErr = fmt.Errorf("failed to save state file: %w", err)
+		return err
+	}
+	if m := db.opts.Metrics; m != nil {
+		m.OnFlush(meta.Size, time.Since(start))
+	}
 
-		log.Println("Truncating WAL file...")
-		if err := os.Remove(walToDelete); err != nil {
-			log.Printf("ERROR: Failed to delete rotated WAL %s: %v", walToDelete, err)
-		} else {
-			log.Printf("Background flush: Deleted old WAL %s", walToDelete)
+	db.opts.logger().Infof("Truncating WAL file...")
+	if err := db.opts.fileSystem().Remove(walToDelete); err != nil {
+		db.opts.logger().Errorf("Failed to delete rotated WAL %s: %v", walToDelete, err)
+	} else {
+		db.opts.logger().Infof("Background flush: Deleted old WAL %s", walToDelete)
+	}
+	return nil
+}
+
+// writeFlushTable writes src to the SSTable at path. With Options.EnableBlobFiles
+// large values go to a new blob file, whose number it returns, or 0 when no value
+// was large enough. On error neither file is left behind.
+func (db *DB) writeFlushTable(path string, itemCount uint, src TableSource) (TableMeta, int, error) {
+	if !db.opts.EnableBlobFiles {
+		meta, err := WriteSSTable(path, itemCount, src, db.opts)
+		return meta, 0, err
+	}
+	db.mu.Lock()
+	blobNum := db.nextFileNumber
+	db.nextFileNumber++
+	db.mu.Unlock()
+	blobs, err := createBlobWriter(db.opts.fileSystem(), db.dataDir, blobNum)
+	if err != nil {
+		return TableMeta{}, 0, fmt.Errorf("failed to create blob file %d: %w", blobNum, err)
+	}
+	meta, err := WriteSSTable(path, itemCount, &blobSeparator{src: src, blobs: blobs, minSize: db.opts.MinBlobSize}, db.opts)
+	if err != nil {
+		blobs.abort()
+		return TableMeta{}, 0, err
+	}
+	hasBlobs, err := blobs.finish()
+	if err != nil {
+		db.opts.fileSystem().Remove(path)
+		return TableMeta{}, 0, fmt.Errorf("failed to write blob file %d: %w", blobNum, err)
+	}
+	if !hasBlobs {
+		blobNum = 0
+	}
+	return meta, blobNum, nil
+}
+
+// Flush writes the active memtable to an SSTable and waits for it, after waiting
+// for any background flush. Everything written before Flush, including writes
+// made with PutNoWAL, is durable once it returns nil. If a background flush
+// failed, Flush first retries it; once that succeeds writes are accepted again.
+func (db *DB) Flush() error {
+	if db.opts.InMemory {
+		return nil
+	}
+	db.mu.Lock()
+	for db.flushing {
+		db.flushDone.Wait()
+	}
+	retry, imm := db.failedFlush, db.immutableMem
+	if retry != nil {
+		db.flushing = true
+	}
+	db.mu.Unlock()
+	if retry != nil {
+		db.opts.logger().Infof("Retrying the failed flush of SSTable %d", retry.sstNum)
+		if err := db.writeImmutableMemtable(imm, retry.walPath, retry.sstNum); err != nil {
+			return fmt.Errorf("a previous memtable flush failed again, its data is only in the WAL: %w", err)
 		}
+	}
+	//rotate with writes held off, a write may have started a flush in between
+	db.commitMu.Lock()
+	db.mu.Lock()
+	for db.flushing {
+		db.flushDone.Wait()
+	}
+	if db.immutableMem != nil {
+		db.mu.Unlock()
+		db.commitMu.Unlock()
+		return fmt.Errorf("a previous memtable flush failed, its data is only in the WAL")
+	}
+	if db.mem.Len() == 0 {
+		db.mu.Unlock()
+		db.commitMu.Unlock()
+		return nil
+	}
+	imm, rotatedWalPath, sstNum, ok := db.rotateMemtable()
+	db.mu.Unlock()
+	db.commitMu.Unlock()
+	if !ok {
+		return fmt.Errorf("failed to rotate the memtable")
+	}
+	return db.writeImmutableMemtable(imm, rotatedWalPath, sstNum)
+}
 
-		return
-	}(db.immutableMem, rotatedWalPath, sstNum)
+// DropAll deletes every key: it waits for a running flush and compaction, then
+// clears the memtables, deletes every SSTable and WAL, and starts over with an
+// empty WAL, sequence number 0 and file number 1, all under the DB lock. Other
+// writes are held off for the whole reset, so each one lands either before it,
+// and is dropped, or after it.
+//
+// Sequence numbers start over, so DropAll fails with ErrInUse while a snapshot
+// or a Subscribe channel is open: release and unsubscribe them first. Iterators
+// are not affected, they keep reading the view they were created with.
+func (db *DB) DropAll() error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.subMu.Lock()
+	subscribers := len(db.subscribers)
+	db.subMu.Unlock()
+	if len(db.snapshots) > 0 || subscribers > 0 {
+		return fmt.Errorf("%w: %d snapshots, %d subscriptions", ErrInUse, len(db.snapshots), subscribers)
+	}
+	if db.opts.InMemory {
+		//nothing is flushed or compacted
+		db.mem = db.opts.newMemTable()
+		db.sequenceNum.Store(0)
+		return nil
+	}
+	//queued compactions hold tables and file numbers about to be dropped
+	for db.flushing || db.compacting > 0 || db.scheduledCompactions > 0 {
+		if db.flushing {
+			db.flushDone.Wait()
+		} else {
+			db.compactDone.Wait()
+		}
+	}
+	db.mem = db.opts.newMemTable()
+	db.immutableMem = nil
+	db.sequenceNum.Store(0)
+	fs := db.opts.fileSystem()
+	//the WALs go first, so a crash part way cannot replay dropped writes
+	walPath := db.wal.file.Name()
+	if err := db.wal.Close(); err != nil {
+		db.opts.logger().Errorf("Failed to close WAL before DropAll: %v", err)
+	}
+	walFiles, _ := fs.Glob(filepath.Join(db.walDir(), "wal-*.log"))
+	for _, path := range append(walFiles, walPath) {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			db.reopenWAL(walPath)
+			return fmt.Errorf("failed to remove WAL %s: %w", path, err)
+		}
+	}
+	db.activeSSTables = []int{}
+	db.tableProps = make(map[int]TableProperties)
+	db.generations = make(map[int]int)
+	db.blobFiles = nil
+	db.nextFileNumber = 1
+	db.bgErr = nil
+	db.failedFlush = nil
+	//tables written from now on reuse file numbers, keep their cached blocks apart
+	db.id.Store(nextDBID.Add(1))
+	if err := db.saveState(); err != nil {
+		db.bgErr = fmt.Errorf("failed to save state file: %w", err)
+		db.reopenWAL(walPath)
+		return db.bgErr
+	}
+	//every table and blob file, including ones orphaned by a crash
+	sstFiles, _ := fs.Glob(filepath.Join(db.dataDir, "*.sst"))
+	blobFiles, _ := fs.Glob(filepath.Join(db.dataDir, "*.blob"))
+	for _, path := range append(sstFiles, blobFiles...) {
+		if err := fs.Remove(path); err != nil {
+			db.opts.logger().Errorf("Failed to remove %s in DropAll: %v", path, err)
+		}
+	}
+	db.reopenWAL(walPath)
+	return db.bgErr
 }
+
 func (db *DB) Put(key, value []byte) error {
+	return db.put(key, value, true)
+}
+
+// PutNoWAL is Put without the WAL record, for bulk loads that can be re-run after
+// a crash. WARNING: the entry is not durable until the memtable holding it is
+// flushed, a crash before that loses it. Call Flush after the bulk load.
+func (db *DB) PutNoWAL(key, value []byte) error {
+	return db.put(key, value, false)
+}
+
+// CompareAndSwap writes newValue to key only if the current value of key equals
+// expected, or if key is absent when expected is nil, and reports whether it did.
+// Other writes are held off from the read to the write, so the check and the
+// put are atomic with respect to Put, Delete, Write and ApplyEntry.
+func (db *DB) CompareAndSwap(key, expected, newValue []byte) (bool, error) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	current, found, err := db.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if found != (expected != nil) || !bytes.Equal(current, expected) {
+		return false, nil
+	}
+	if err := db.putLocked(key, newValue, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *DB) put(key, value []byte, writeWAL bool) error {
+	db.writeMu.RLock()
+	defer db.writeMu.RUnlock()
+	return db.putLocked(key, value, writeWAL)
+}
+
+// putLocked is put for callers already holding writeMu
+func (db *DB) putLocked(key, value []byte, writeWAL bool) error {
+	return db.write(key, value, OpTypePut, writeWAL)
+}
+
+// write adds a put of type typ to the WAL and memtable, the WAL operation
+// being the same byte as the type. Caller must hold writeMu.
+func (db *DB) write(key, value []byte, typ OpType, writeWAL bool) error {
+	if err := db.backgroundError(); err != nil {
+		return err
+	}
+	if err := db.maybeStallWrite(); err != nil {
+		return err
+	}
+	db.commitMu.Lock()
 	seqNum := db.sequenceNum.Add(1)
 	internalKey := InternalKey{
 		UserKey: string(key),
 		SeqNum:  seqNum,
-		Type:    OpTypePut,
+		Type:    typ,
 	}
 	entry := LogEntry{
-		Op:     OpPut,
+		Op:     typ,
 		Key:    key,
 		Value:  value,
 		SeqNum: seqNum,
@@ -205,11 +968,22 @@ func (db *DB) Put(key, value []byte) error {
 	wal := db.wal
 	memTable := db.mem
 	db.mu.RUnlock()
-	if err := wal.Write(&entry); err != nil {
-		return err
+	if db.opts.InMemory {
+		memTable.Put(internalKey, value)
+		db.publish(&entry)
+		db.commitMu.Unlock()
+		return nil
+	}
+	if writeWAL {
+		if err := wal.Write(&entry); err != nil {
+			db.commitMu.Unlock()
+			return fmt.Errorf("failed to write WAL: %w", err)
+		}
 	}
 
 	memTable.Put(internalKey, value)
+	db.publish(&entry)
+	db.commitMu.Unlock()
 
 	if memTable.ApproximateSize() > MemTableSizeThreshold {
 		db.flushMemtable()
@@ -217,57 +991,269 @@ func (db *DB) Put(key, value []byte) error {
 	return nil
 
 }
-func (db *DB) Get(key []byte) ([]byte, bool) {
+
+// ApplyEntry writes entry to the WAL and memtable with the sequence number it
+// carries instead of a locally generated one, so a follower can apply a leader's
+// WAL. The DB's sequence number advances to entry.SeqNum; entries that are not
+// newer than it are rejected with ErrStaleSequenceNumber.
+func (db *DB) ApplyEntry(entry LogEntry) error {
+	if entry.Op > OpRangeDelete && entry.Op != OpPutVersioned {
+		return fmt.Errorf("unknown operation %d", entry.Op)
+	}
+	if entry.Op == OpPutVersioned {
+		if _, _, err := decodeVersionedValue(entry.Value); err != nil {
+			return err
+		}
+	}
+	db.writeMu.RLock()
+	defer db.writeMu.RUnlock()
+	if err := db.backgroundError(); err != nil {
+		return err
+	}
+	if err := db.maybeStallWrite(); err != nil {
+		return err
+	}
+	db.commitMu.Lock()
+	if current := db.sequenceNum.Load(); entry.SeqNum <= current {
+		db.commitMu.Unlock()
+		return fmt.Errorf("%w: entry %d, current %d", ErrStaleSequenceNumber, entry.SeqNum, current)
+	}
+	db.sequenceNum.Store(entry.SeqNum)
 	db.mu.RLock()
+	wal := db.wal
+	memTable := db.mem
+	db.mu.RUnlock()
+	if !db.opts.InMemory {
+		if err := wal.Write(&entry); err != nil {
+			db.commitMu.Unlock()
+			return fmt.Errorf("failed to write WAL: %w", err)
+		}
+	}
+	switch entry.Op {
+	case OpPut:
+		memTable.Put(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypePut}, entry.Value)
+	case OpDelete:
+		memTable.Put(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypeDelete}, nil)
+	case OpPutVersioned:
+		memTable.Put(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypeVersionedPut}, entry.Value)
+	case OpRangeDelete:
+		memTable.DeleteRange(entry.Key, entry.Value, entry.SeqNum)
+	}
+	db.publish(&entry)
+	db.commitMu.Unlock()
+	if !db.opts.InMemory && memTable.ApproximateSize() > MemTableSizeThreshold {
+		db.flushMemtable()
+	}
+	return nil
+}
+
+// Get returns the newest value of key. It is safe to call from many goroutines,
+// concurrently with writes, flushes and compactions. A key put with an empty or
+// nil value is found, with a non-nil empty value. A value that fails its
+// checksum is returned as an error wrapping ErrCorruption, rather than falling
+// back to an older version of the key.
+func (db *DB) Get(key []byte) ([]byte, bool, error) {
+	val, _, found, source, err := db.get(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if m := db.opts.Metrics; m != nil {
+		m.OnGet(found, source)
+	}
+	return val, found, nil
+}
+
+// get is GetWithVersion, also returning where the lookup ended as a GetSource
+// constant. Only corruption is returned as an error, a table that cannot be
+// read otherwise is logged and skipped.
+func (db *DB) get(key []byte) ([]byte, uint64, bool, string, error) {
+	db.mu.RLock()
+	seqNum := db.sequenceNum.Load()
 	mem := db.mem
 	imm := db.immutableMem
-	activeTables := db.activeSSTables
+	//copy, flushes append to db.activeSSTables in place
+	activeTables := make([]int, len(db.activeSSTables))
+	copy(activeTables, db.activeSSTables)
 	db.mu.RUnlock()
 	//1.check in active memtable
-	val, found := mem.Get(key)
+	val, userTs, found := mem.Get(key)
+	if db.opts.InMemory {
+		//the memtable holds everything, there are no SSTables to open
+		if !found {
+			return nil, 0, false, GetSourceNone, nil
+		}
+		return val, userTs, val != nil, GetSourceMemtable, nil
+	}
 	if found {
 		if val == nil {
 			//delete log, not have value
-			return nil, false
+			return nil, 0, false, GetSourceMemtable, nil
 		}
-		return val, true
+		return val, userTs, true, GetSourceMemtable, nil
 	}
 	//2.check in immutable memtable
 	if imm != nil {
-		val, found = imm.Get(key)
+		val, userTs, found = imm.Get(key)
 		if found {
 			if val == nil {
 				// Found a delete tombstone
-				return nil, false
+				return nil, 0, false, GetSourceImmutable, nil
 			}
-			return val, true
+			return val, userTs, true, GetSourceImmutable, nil
 		}
 	}
-	log.Printf("sstable count: %d", len(activeTables))
+	db.opts.logger().Debugf("sstable count: %d", len(activeTables))
 	//3.search key in newest to oldest SSTables
-	for i := len(activeTables) - 1; i > 0; i-- {
+	for i := len(activeTables) - 1; i >= 0; i-- {
 		sstNum := activeTables[i]
+		if db.tableNewerThan(sstNum, seqNum) {
+			//flushed after the lookup started, only reachable after a retry below
+			continue
+		}
 		ssTablePath := fmt.Sprintf("%s/%05d.sst", db.dataDir, sstNum)
-		reader, err := NewSSTableReader(ssTablePath)
+		reader, err := db.openSSTable(sstNum)
 		if err != nil {
-			log.Printf("Error opening SSTable reader for %s: %v", ssTablePath, err)
+			if os.IsNotExist(err) && !db.isActiveSSTable(sstNum) {
+				//a compaction replaced the table after the snapshot, search the current set
+				db.mu.RLock()
+				activeTables = make([]int, len(db.activeSSTables))
+				copy(activeTables, db.activeSSTables)
+				db.mu.RUnlock()
+				i = len(activeTables)
+				continue
+			}
+			db.opts.logger().Errorf("Error opening SSTable reader for %s: %v", ssTablePath, err)
 			continue
 		}
-		val, found, err := reader.Get(key)
+		val, userTs, found, err := reader.getAtVersion(key, seqNum)
+		if closeErr := reader.Close(); closeErr != nil {
+			db.opts.logger().Errorf("Error closing SSTable reader for %s: %v", ssTablePath, closeErr)
+		}
+		if errors.Is(err, ErrCorruption) {
+			//an older table would return a stale version of the key
+			return nil, 0, false, GetSourceSSTable, fmt.Errorf("failed to read SSTable %s: %w", ssTablePath, err)
+		}
 		if err != nil {
-			log.Printf("Error reading SSTable %s: %v", ssTablePath, err)
+			db.opts.logger().Errorf("Error reading SSTable %s: %v", ssTablePath, err)
 			continue
 		}
 		if found {
 			if val == nil {
-				return nil, false
+				return nil, 0, false, GetSourceSSTable, nil
 			}
-			return val, true
+			return val, userTs, true, GetSourceSSTable, nil
 		}
 	}
-	return nil, false
+	return nil, 0, false, GetSourceNone, nil
+}
+
+// VersionedValue is one retained version of a key, as returned by History.
+// Value is nil for delete tombstones.
+type VersionedValue struct {
+	SeqNum uint64
+	Type   OpType
+	Value  []byte
+	// UserTs is the timestamp given to PutWithVersion, 0 for other writes
+	UserTs uint64
+}
+
+// History returns every retained version of key across the memtables and
+// SSTables, newest first. Versions dropped by compaction are not returned.
+func (db *DB) History(key []byte) ([]VersionedValue, error) {
+	db.mu.RLock()
+	mem := db.mem
+	imm := db.immutableMem
+	activeTables := make([]int, len(db.activeSSTables))
+	copy(activeTables, db.activeSSTables)
+	db.mu.RUnlock()
+
+	versions := memTableHistory(mem, key)
+	if imm != nil {
+		versions = append(versions, memTableHistory(imm, key)...)
+	}
+	var tableVersions []VersionedValue
+	for i := len(activeTables) - 1; i >= 0; i-- {
+		sstNum := activeTables[i]
+		ssTablePath := fmt.Sprintf("%s/%05d.sst", db.dataDir, sstNum)
+		reader, err := db.openSSTable(sstNum)
+		if err != nil {
+			if os.IsNotExist(err) && !db.isActiveSSTable(sstNum) {
+				//a compaction replaced the table after the snapshot, search the current set
+				db.mu.RLock()
+				activeTables = make([]int, len(db.activeSSTables))
+				copy(activeTables, db.activeSSTables)
+				db.mu.RUnlock()
+				tableVersions = tableVersions[:0]
+				i = len(activeTables)
+				continue
+			}
+			return nil, err
+		}
+		found, err := reader.History(key)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history from %s: %w", ssTablePath, err)
+		}
+		tableVersions = append(tableVersions, found...)
+	}
+	versions = append(versions, tableVersions...)
+	//a version can briefly be in both a memtable and an SSTable, keep one copy
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].SeqNum > versions[j].SeqNum })
+	result := versions[:0]
+	for i, v := range versions {
+		if i > 0 && v.SeqNum == versions[i-1].SeqNum {
+			continue
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// openSSTable opens a reader for SSTable sstNum that uses the DB's block cache, if any
+func (db *DB) openSSTable(sstNum int) (*SSTableReader, error) {
+	reader, err := NewSSTableReaderWithOptions(fmt.Sprintf("%s/%05d.sst", db.dataDir, sstNum), db.opts)
+	if err != nil {
+		return nil, err
+	}
+	if db.opts.BlockCache != nil {
+		reader.cache = db.opts.BlockCache
+		reader.cacheKey = blockCacheKey{dbID: db.id.Load(), fileNum: sstNum}
+	}
+	reader.blobs = db.blobs
+	return reader, nil
+}
+
+// tableNewerThan reports whether every entry of SSTable sstNum has a sequence number
+// above seqNum, so the table holds nothing visible at seqNum. Tables written before
+// sequence ranges were recorded are never skipped.
+func (db *DB) tableNewerThan(sstNum int, seqNum uint64) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	props, ok := db.tableProps[sstNum]
+	return ok && props.NumEntries > 0 && props.SmallestSeq > seqNum
+}
+
+// isActiveSSTable reports whether sstNum is still one of the active SSTables
+func (db *DB) isActiveSSTable(sstNum int) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, num := range db.activeSSTables {
+		if num == sstNum {
+			return true
+		}
+	}
+	return false
 }
 func (db *DB) Delete(key []byte) error {
+	db.writeMu.RLock()
+	defer db.writeMu.RUnlock()
+	if err := db.backgroundError(); err != nil {
+		return err
+	}
+	if err := db.maybeStallWrite(); err != nil {
+		return err
+	}
+	db.commitMu.Lock()
 	seqNum := db.sequenceNum.Add(1)
 	internalKey := InternalKey{
 		UserKey: string(key),
@@ -283,15 +1269,44 @@ func (db *DB) Delete(key []byte) error {
 	wal := db.wal
 	memTable := db.mem
 	db.mu.RUnlock()
+	if db.opts.InMemory {
+		memTable.Put(internalKey, nil)
+		db.publish(entry)
+		db.commitMu.Unlock()
+		return nil
+	}
 	if err := wal.Write(entry); err != nil {
-		return err
+		db.commitMu.Unlock()
+		return fmt.Errorf("failed to write WAL: %w", err)
 	}
 	memTable.Put(internalKey, nil)
+	db.publish(entry)
+	db.commitMu.Unlock()
 	if memTable.ApproximateSize() > MemTableSizeThreshold {
 		db.flushMemtable()
 	}
 	return nil
 }
+
+// TableProperties returns the properties of every active SSTable keyed by file number,
+// including the tombstone ratio used to prioritize compaction.
+func (db *DB) TableProperties() map[int]TableProperties {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	props := make(map[int]TableProperties, len(db.tableProps))
+	for num, p := range db.tableProps {
+		props[num] = p
+	}
+	return props
+}
 func (db *DB) Close() error {
+	db.closeOnce.Do(func() { close(db.closed) })
+	if db.compactionPool != nil {
+		db.compactionPool.shutdown()
+	}
+	db.stopSubscribers()
+	if db.opts.InMemory {
+		return nil
+	}
 	return db.wal.Close()
 }
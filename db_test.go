@@ -0,0 +1,1122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultyFS is an FS failing the creation of files whose name ends in
+// failSuffix with err, or errInjected if err is nil, while failing is set
+type faultyFS struct {
+	FS
+	failSuffix string
+	err        error
+	failing    atomic.Bool
+}
+
+func (f *faultyFS) Create(name string) (File, error) {
+	if f.failing.Load() && strings.HasSuffix(name, f.failSuffix) {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return nil, errInjected
+	}
+	return f.FS.Create(name)
+}
+
+// slowFS is an FS sleeping for delay before creating a file whose name ends in
+// suffix
+type slowFS struct {
+	FS
+	suffix string
+	delay  time.Duration
+}
+
+func (f *slowFS) Create(name string) (File, error) {
+	if strings.HasSuffix(name, f.suffix) {
+		time.Sleep(f.delay)
+	}
+	return f.FS.Create(name)
+}
+
+// crashFS is an FS simulating a process killed while writing a file whose name
+// ends in suffix: once limit bytes of such a file are written, writes fail and
+// the file can no longer be removed, leaving the partial file behind
+type crashFS struct {
+	FS
+	suffix  string
+	limit   int
+	crashed atomic.Bool
+}
+
+func (f *crashFS) Create(name string) (File, error) {
+	file, err := f.FS.Create(name)
+	if err != nil || !strings.HasSuffix(name, f.suffix) {
+		return file, err
+	}
+	return &crashFile{File: file, fs: f}, nil
+}
+
+func (f *crashFS) Remove(name string) error {
+	if f.crashed.Load() && strings.HasSuffix(name, f.suffix) {
+		return errInjected
+	}
+	return f.FS.Remove(name)
+}
+
+// crashFile is a file of crashFS
+type crashFile struct {
+	File
+	fs      *crashFS
+	written int
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	if f.fs.crashed.Load() {
+		return 0, errInjected
+	}
+	if left := f.fs.limit - f.written; len(p) > left {
+		n, _ := f.File.Write(p[:left])
+		f.written += n
+		f.fs.crashed.Store(true)
+		return n, errInjected
+	}
+	n, err := f.File.Write(p)
+	f.written += n
+	return n, err
+}
+
+// openTestDB opens a DB in a new temporary directory with opts, or the default
+// options if opts is nil, and closes it when the test ends
+func openTestDB(t *testing.T, opts *Options) (*DB, string) {
+	t.Helper()
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	dir := t.TempDir()
+	db, err := NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		//Close does not wait for a background flush, which would otherwise
+		//write to the directory while it is removed
+		db.mu.Lock()
+		for db.flushing {
+			db.flushDone.Wait()
+		}
+		db.mu.Unlock()
+		db.Close()
+	})
+	return db, dir
+}
+
+// putKeys puts key%05d = value%05d for i in [from, to)
+func putKeys(t *testing.T, db *DB, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkKeys checks that putKeys(from, to) can be read back
+func checkKeys(t *testing.T, db *DB, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		value, found, err := db.Get([]byte(key))
+		if want := fmt.Sprintf("value%05d", i); err != nil || !found || string(value) != want {
+			t.Fatalf("Get(%s) = %q, %v, %v, want %q", key, value, found, err, want)
+		}
+	}
+}
+
+func TestReopenRemovesSSTablesWrittenAfterTheState(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	next := db.nextFileNumber
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//a crash after WriteSSTable renamed a table into place, before the state was saved
+	active := filepath.Join(dir, fmt.Sprintf("%05d.sst", db.activeSSTables[0]))
+	orphan := filepath.Join(dir, fmt.Sprintf("%05d.sst", next))
+	data, err := os.ReadFile(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(orphan, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(dir)
+	if err != nil {
+		t.Fatalf("reopening with a leftover SSTable: %v", err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("leftover SSTable %s was not removed: %v", orphan, err)
+	}
+	if value, found, err := db.Get([]byte("key")); err != nil || !found || string(value) != "value" {
+		t.Fatalf("Get(key) = %q, %v, %v", value, found, err)
+	}
+}
+
+func TestDropAllHoldsOffConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every round drops what the last one wrote, so no flush runs alongside
+	for round := 0; round < 30; round++ {
+		dropAllDuringWrites(t, db, 16, 12)
+	}
+	keys, err := db.Keys(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//every write that outlived the resets is in the WAL, none that were dropped came back
+	db, err = NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reopened, err := db.Keys(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened) != len(keys) {
+		t.Fatalf("%d keys after reopening, %d before", len(reopened), len(keys))
+	}
+}
+
+// dropAllDuringWrites calls DropAll until writers goroutines have each put n keys
+func dropAllDuringWrites(t *testing.T, db *DB, writers, n int) {
+	t.Helper()
+	if err := db.DropAll(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := db.Put([]byte(fmt.Sprintf("w%02d-%03d", w, i)), []byte("value")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			if err := db.DropAll(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Put during DropAll: %v", err)
+	}
+}
+
+func TestGetDuringFlushes(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 0, 100)
+	stop := make(chan struct{})
+	missing := make(chan string, 1)
+	go func() {
+		defer close(missing)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key%05d", i)
+				if _, found, err := db.Get([]byte(key)); err != nil || !found {
+					missing <- key
+					return
+				}
+			}
+		}
+	}()
+	//later keys fill the memtable again and again, every flush moves the first ones on
+	for round := 1; round <= 10; round++ {
+		putKeys(t, db, round*100, (round+1)*100)
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if key, ok := <-missing; ok {
+		t.Fatalf("%s was not found during a flush", key)
+	}
+}
+
+func TestFailedFlushKeepsKeysReadable(t *testing.T) {
+	fs := &faultyFS{FS: OSFS, failSuffix: ".sst" + tmpFileSuffix}
+	opts := DefaultOptions()
+	opts.FS = fs
+	db, dir := openTestDB(t, opts)
+	putKeys(t, db, 0, 50)
+	fs.failing.Store(true)
+	if err := db.Flush(); !errors.Is(err, errInjected) {
+		t.Fatalf("Flush with SSTable creation failing = %v, want the injected error", err)
+	}
+	//the keys are still served by the immutable memtable
+	checkKeys(t, db, 0, 50)
+	fs.failing.Store(false)
+	if err := db.Flush(); err != nil {
+		t.Fatalf("retrying the flush: %v", err)
+	}
+	checkKeys(t, db, 0, 50)
+	putKeys(t, db, 50, 60)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkKeys(t, db, 0, 60)
+}
+
+func TestInMemoryPutGetCycles(t *testing.T) {
+	cycles := 1_000_000
+	if testing.Short() {
+		cycles = 10_000
+	}
+	opts := DefaultOptions()
+	opts.InMemory = true
+	db, dir := openTestDB(t, opts)
+	for i := 0; i < cycles; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i%10000))
+		value := []byte(fmt.Sprintf("value%07d", i))
+		if err := db.Put(key, value); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+		if got, found, err := db.Get(key); err != nil || !found || string(got) != string(value) {
+			t.Fatalf("cycle %d: Get(%s) = %q, %v, %v, want %q", i, key, got, found, err, value)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("an in-memory DB wrote %d files to %s", len(entries), dir)
+	}
+}
+
+func TestReopenRecoversFromCorruptedWALTail(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 20)
+	if err := db.Put([]byte("last"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//a crash before the last write reached the disk in full
+	path := filepath.Join(dir, activeWalFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(data) - 10; i < len(data); i++ {
+		data[i] ^= 0xff
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(dir)
+	if err != nil {
+		t.Fatalf("reopening with a corrupted WAL tail: %v", err)
+	}
+	defer db.Close()
+	checkKeys(t, db, 0, 20)
+	if _, found, err := db.Get([]byte("last")); err != nil || found {
+		t.Fatalf("the corrupted last write was recovered, err %v", err)
+	}
+	//the WAL takes new writes after the truncated tail
+	putKeys(t, db, 20, 30)
+	checkKeys(t, db, 0, 30)
+}
+
+func TestConcurrentGets(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	//keys in several SSTables and the memtable
+	for round := 0; round < 3; round++ {
+		putKeys(t, db, round*100, (round+1)*100)
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putKeys(t, db, 300, 350)
+	var wg sync.WaitGroup
+	errs := make(chan string, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			//every goroutine reads the same keys, from a different start
+			for n := 0; n < 350; n++ {
+				i := (g*25 + n) % 350
+				key := fmt.Sprintf("key%05d", i)
+				value, found, err := db.Get([]byte(key))
+				if want := fmt.Sprintf("value%05d", i); err != nil || !found || string(value) != want {
+					errs <- fmt.Sprintf("Get(%s) = %q, %v, %v, want %q", key, value, found, err, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	key := []byte("key")
+	//one version in an SSTable, the later ones in the memtable
+	for i, write := range []func() error{
+		func() error { return db.Put(key, []byte("v1")) },
+		db.Flush,
+		func() error { return db.Put(key, []byte("v2")) },
+		func() error { return db.Delete(key) },
+		func() error { return db.Put(key, []byte("v3")) },
+	} {
+		if err := write(); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	history, err := db.History(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []VersionedValue{{Type: OpPut, Value: []byte("v3")}, {Type: OpDelete}, {Type: OpPut, Value: []byte("v2")}, {Type: OpPut, Value: []byte("v1")}}
+	if len(history) != len(want) {
+		t.Fatalf("History returned %d versions, want %d: %+v", len(history), len(want), history)
+	}
+	for i, version := range history {
+		if version.Type != want[i].Type || string(version.Value) != string(want[i].Value) {
+			t.Fatalf("version %d is %+v, want %+v", i, version, want[i])
+		}
+		if i > 0 && version.SeqNum >= history[i-1].SeqNum {
+			t.Fatalf("version %d has seqnum %d after %d, want newest first", i, version.SeqNum, history[i-1].SeqNum)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 0, 10000)
+	//every tenth key deleted, some after their table was flushed
+	for i := 0; i < 10000; i += 10 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want []string
+	for i := 0; i < 10000; i++ {
+		if i%10 != 0 {
+			want = append(want, fmt.Sprintf("key%05d", i))
+		}
+	}
+	keys, err := db.Keys(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("Keys returned %d keys, want %d", len(keys), len(want))
+	}
+	for i, key := range keys {
+		if string(key) != want[i] {
+			t.Fatalf("key %d is %s, want %s", i, key, want[i])
+		}
+	}
+	//[start, end) and the streaming variant
+	keys, err = db.Keys([]byte("key00100"), []byte("key00200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 90 || string(keys[0]) != "key00101" || string(keys[89]) != "key00199" {
+		t.Fatalf("Keys(key00100, key00200) returned %d keys, from %s to %s", len(keys), keys[0], keys[len(keys)-1])
+	}
+	ch, errc := db.KeysChan(nil, nil)
+	n := 0
+	for key := range ch {
+		if string(key) != want[n] {
+			t.Fatalf("KeysChan key %d is %s, want %s", n, key, want[n])
+		}
+		n++
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Fatalf("KeysChan sent %d keys, want %d", n, len(want))
+	}
+}
+
+func TestNewDBFailsOnReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	for _, path := range []string{dir, filepath.Join(dir, "db")} {
+		if db, err := NewDB(path); !errors.Is(err, ErrNotWritable) {
+			if err == nil {
+				db.Close()
+			}
+			t.Fatalf("NewDB(%s) in a read-only directory = %v, want ErrNotWritable", path, err)
+		}
+	}
+}
+
+func TestNewDBFailsOnUnwritableFS(t *testing.T) {
+	fs := &faultyFS{FS: OSFS, failSuffix: ".write-probe", err: syscall.EROFS}
+	fs.failing.Store(true)
+	opts := DefaultOptions()
+	opts.FS = fs
+	dir := t.TempDir()
+	db, err := NewDBWithOptions(dir, opts)
+	if !errors.Is(err, ErrNotWritable) || !errors.Is(err, syscall.EROFS) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("NewDB on a read-only filesystem = %v, want ErrNotWritable wrapping EROFS", err)
+	}
+	//nothing was left half initialized
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("NewDB left %d files behind", len(entries))
+	}
+}
+
+func TestPutSurfacesFullDisk(t *testing.T) {
+	fs := &faultyFS{FS: OSFS, failSuffix: ".sst" + tmpFileSuffix, err: syscall.ENOSPC}
+	opts := DefaultOptions()
+	opts.FS = fs
+	db, _ := openTestDB(t, opts)
+	fs.failing.Store(true)
+	//enough keys to fill the memtable, so a background flush runs out of space
+	var err error
+	for i := 0; i < 10000 && err == nil; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i)))
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Put with the disk full = %v, want ENOSPC", err)
+	}
+	//space was freed, retrying the flush makes the DB writable again
+	fs.failing.Store(false)
+	if err := db.Flush(); err != nil {
+		t.Fatalf("retrying the flush: %v", err)
+	}
+	if err := db.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatalf("Put after the flush succeeded: %v", err)
+	}
+}
+
+func TestCrashDuringFlushLeavesNoPartialSSTable(t *testing.T) {
+	fs := &crashFS{FS: OSFS, suffix: ".sst" + tmpFileSuffix, limit: 1000}
+	opts := DefaultOptions()
+	opts.FS = fs
+	dir := t.TempDir()
+	db, err := NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 200)
+	if err := db.Flush(); err == nil {
+		t.Fatal("Flush succeeded although the SSTable write was killed")
+	}
+	if !fs.crashed.Load() {
+		t.Fatal("the SSTable write stopped before the crash")
+	}
+	//the process is gone: nothing else runs before the next open
+	db.Close()
+	partial, _ := filepath.Glob(filepath.Join(dir, "*.sst"+tmpFileSuffix))
+	if len(partial) != 1 {
+		t.Fatalf("temporary SSTables after the crash: %v, want the partial one", partial)
+	}
+	if tables, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(tables) != 0 {
+		t.Fatalf("the crash left %v under a final name", tables)
+	}
+	db, err = NewDB(dir)
+	if err != nil {
+		t.Fatalf("opening after the crash: %v", err)
+	}
+	defer db.Close()
+	if left, _ := filepath.Glob(filepath.Join(dir, "*"+tmpFileSuffix)); len(left) != 0 {
+		t.Fatalf("temporary files left after opening: %v", left)
+	}
+	//recovered from the rotated WAL
+	checkKeys(t, db, 0, 200)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, db, 0, 200)
+}
+
+func TestCompactOnOpenFlushesOrphanedWALs(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 20)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 20, 40)
+	if err := db.Delete([]byte("key00005")); err != nil {
+		t.Fatal(err)
+	}
+	next := db.nextFileNumber
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//a crash after the WAL was rotated, before its memtable was flushed
+	orphan := filepath.Join(dir, fmt.Sprintf("wal-%05d.log", next))
+	if err := os.Rename(filepath.Join(dir, activeWalFileName), orphan); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.CompactOnOpen = true
+	db, err = NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if wals, _ := filepath.Glob(filepath.Join(dir, "wal-*.log")); len(wals) != 0 {
+		t.Fatalf("WALs left after opening with CompactOnOpen: %v", wals)
+	}
+	if tables := db.SSTables(); len(tables) != 1 {
+		t.Fatalf("%d SSTables after opening with CompactOnOpen, want the 1 compacted table", len(tables))
+	}
+	checkKeys(t, db, 0, 5)
+	checkKeys(t, db, 6, 40)
+	if _, found, err := db.Get([]byte("key00005")); err != nil || found {
+		t.Fatalf("a deleted key came back, err %v", err)
+	}
+	if stats := db.Stats(); stats.TotalDeletions != 0 {
+		t.Fatalf("%d tombstones left after the compaction on open", stats.TotalDeletions)
+	}
+}
+
+func TestWALDirRecoversAfterCrash(t *testing.T) {
+	dataDir := t.TempDir()
+	//the WALs on a tmpfs when there is one, like a faster device
+	walDir := t.TempDir()
+	if _, err := os.Stat("/dev/shm"); err == nil {
+		if shm, err := os.MkdirTemp("/dev/shm", "wal"); err == nil {
+			walDir = shm
+			t.Cleanup(func() { os.RemoveAll(shm) })
+		}
+	}
+	//WALs written before WALDir was set, still in the data directory
+	db, err := NewDB(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 20)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.WALDir = walDir
+	db, err = NewDBWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 20, 40)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 40, 60)
+	next := db.nextFileNumber
+	//a crash after the WAL was rotated, before its memtable was flushed
+	db.Close()
+	if err := os.Rename(filepath.Join(walDir, activeWalFileName), filepath.Join(walDir, fmt.Sprintf("wal-%05d.log", next))); err != nil {
+		t.Fatal(err)
+	}
+	if wals, _ := filepath.Glob(filepath.Join(dataDir, "*.log")); len(wals) != 0 {
+		t.Fatalf("WALs left in the data directory: %v", wals)
+	}
+	if wals, _ := filepath.Glob(filepath.Join(dataDir, activeWalFileName)); len(wals) != 0 {
+		t.Fatalf("WALs left in the data directory: %v", wals)
+	}
+	if tables, _ := filepath.Glob(filepath.Join(walDir, "*.sst")); len(tables) != 0 {
+		t.Fatalf("SSTables written to the WAL directory: %v", tables)
+	}
+	db, err = NewDBWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkKeys(t, db, 0, 60)
+}
+
+func TestEmptyValuesAreNotDeletes(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(where string) {
+		t.Helper()
+		for _, key := range []string{"nil", "empty"} {
+			value, found, err := db.Get([]byte(key))
+			if err != nil || !found || value == nil || len(value) != 0 {
+				t.Fatalf("%s: Get(%s) = %q, %v, %v, want an empty value", where, key, value, found, err)
+			}
+		}
+		if value, found, err := db.Get([]byte("deleted")); err != nil || found {
+			t.Fatalf("%s: Get(deleted) = %q, %v, %v", where, value, found, err)
+		}
+		values, err := db.GetMany([][]byte{[]byte("nil"), []byte("deleted"), []byte("empty")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values[0] == nil || values[1] != nil || values[2] == nil {
+			t.Fatalf("%s: GetMany = %q, want empty, absent, empty", where, values)
+		}
+		keys, err := db.Keys(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bytes.Join(keys, []byte(" "))) != "empty nil" {
+			t.Fatalf("%s: Keys = %v, want the keys with empty values", where, keys)
+		}
+	}
+	for _, key := range []string{"nil", "deleted"} {
+		if err := db.Put([]byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("empty"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	check("memtable")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("WAL replay")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("SSTable")
+}
+
+func TestFlushInterval(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FlushInterval = 50 * time.Millisecond
+	db, _ := openTestDB(t, opts)
+	//far below MemTableSizeThreshold
+	putKeys(t, db, 0, 10)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(db.SSTables()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the memtable was not flushed after 5s idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkKeys(t, db, 0, 10)
+	//an empty memtable is not flushed
+	time.Sleep(4 * opts.FlushInterval)
+	if tables := len(db.SSTables()); tables != 1 {
+		t.Fatalf("%d SSTables after idling with an empty memtable, want 1", tables)
+	}
+}
+
+func TestNewDBRejectsNewerStateVersion(t *testing.T) {
+	dir := t.TempDir()
+	state := fmt.Sprintf(`{"format_version": %d, "next_file_number": 1, "active_sstables": []}`, DBFormatVersion+1)
+	if err := os.WriteFile(filepath.Join(dir, stateFileName), []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := NewDB(dir); !errors.Is(err, ErrUnsupportedVersion) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("NewDB with a state file of version %d = %v, want ErrUnsupportedVersion", DBFormatVersion+1, err)
+	}
+}
+
+func TestDropAll(t *testing.T) {
+	db, dir := openTestDB(t, nil)
+	putKeys(t, db, 0, 200)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 200, 250)
+	if err := db.DropAll(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := db.Keys(nil, nil); err != nil || len(keys) != 0 {
+		t.Fatalf("Keys after DropAll = %d keys, %v", len(keys), err)
+	}
+	if _, found, err := db.Get([]byte("key00000")); err != nil || found {
+		t.Fatalf("a dropped key was found, err %v", err)
+	}
+	if tables, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(tables) != 0 {
+		t.Fatalf("SSTables left after DropAll: %v", tables)
+	}
+	//a snapshot or a subscription would see the new writes under old sequence numbers
+	snapshot := db.GetSnapshot()
+	if err := db.DropAll(); !errors.Is(err, ErrInUse) {
+		t.Fatalf("DropAll with an open snapshot = %v, want ErrInUse", err)
+	}
+	snapshot.Release()
+	_, unsubscribe := db.Subscribe(0)
+	if err := db.DropAll(); !errors.Is(err, ErrInUse) {
+		t.Fatalf("DropAll with an open subscription = %v, want ErrInUse", err)
+	}
+	unsubscribe()
+	if err := db.DropAll(); err != nil {
+		t.Fatal(err)
+	}
+	//still usable, and nothing dropped comes back on reopening
+	putKeys(t, db, 1000, 1010)
+	checkKeys(t, db, 1000, 1010)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	keys, err := db.Keys(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 || string(keys[0]) != "key01000" {
+		t.Fatalf("%d keys after reopening, want the 10 written after DropAll", len(keys))
+	}
+}
+
+func TestWritesStallWhileFlushIsSlow(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FS = &slowFS{FS: OSFS, suffix: ".sst" + tmpFileSuffix, delay: 20 * time.Millisecond}
+	opts.WALSyncMode = WALSyncNever
+	db, _ := openTestDB(t, opts)
+	const writers, perWriter = 16, 300
+	value := make([]byte, 100)
+	var largest atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := db.Put([]byte(fmt.Sprintf("w%02d-%05d", w, i)), value); err != nil {
+					errs <- err
+					return
+				}
+				db.mu.RLock()
+				size := int64(db.mem.ApproximateSize())
+				db.mu.RUnlock()
+				for {
+					old := largest.Load()
+					if size <= old || largest.CompareAndSwap(old, size) {
+						break
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	//every writer may have passed the stall check before the memtable reached the limit
+	entry := int64(len("w00-00000") + len(value) + 64)
+	if limit := int64(opts.MemTableStallSize) + writers*entry; largest.Load() > limit {
+		t.Fatalf("memtable grew to %d bytes while a flush was slow, bound %d", largest.Load(), limit)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i += 50 {
+			if _, found, err := db.Get([]byte(fmt.Sprintf("w%02d-%05d", w, i))); err != nil || !found {
+				t.Fatalf("w%02d-%05d is missing, err %v", w, i, err)
+			}
+		}
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	key := []byte("key")
+	//absent key
+	if swapped, err := db.CompareAndSwap(key, []byte("x"), []byte("v1")); err != nil || swapped {
+		t.Fatalf("CompareAndSwap of an absent key expecting a value = %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap(key, nil, []byte("v1")); err != nil || !swapped {
+		t.Fatalf("CompareAndSwap of an absent key expecting absence = %v, %v", swapped, err)
+	}
+	//match and mismatch
+	if swapped, err := db.CompareAndSwap(key, []byte("v1"), []byte("v2")); err != nil || !swapped {
+		t.Fatalf("CompareAndSwap with the current value = %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap(key, []byte("v1"), []byte("v3")); err != nil || swapped {
+		t.Fatalf("CompareAndSwap with a stale value = %v, %v", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap(key, nil, []byte("v3")); err != nil || swapped {
+		t.Fatalf("CompareAndSwap of a present key expecting absence = %v, %v", swapped, err)
+	}
+	if value, _, err := db.Get(key); err != nil || string(value) != "v2" {
+		t.Fatalf("value is %q, err %v, want v2", value, err)
+	}
+}
+
+func TestCompareAndSwapConcurrentIncrements(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	key := []byte("counter")
+	if err := db.Put(key, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	//each goroutine retries until its increment lands, so exactly one of
+	//several concurrent swaps from the same value may succeed
+	const goroutines, increments = 8, 50
+	var mismatches atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				current, _, err := db.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				n, _ := strconv.Atoi(string(current))
+				swapped, err := db.CompareAndSwap(key, current, []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if swapped {
+					i++
+				} else {
+					mismatches.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if value, _, err := db.Get(key); err != nil || string(value) != strconv.Itoa(goroutines*increments) {
+		t.Fatalf("counter is %s after %d increments (%d mismatches), err %v", value, goroutines*increments, mismatches.Load(), err)
+	}
+}
+
+func TestSequenceNumbersGrowAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("deleted"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	//the newest write is a tombstone, which a compaction of every table drops
+	//along with the value it deletes, and the flush deletes its WAL
+	if err := db.Delete([]byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.History([]byte("deleted"))
+	if err != nil || len(history) == 0 {
+		t.Fatalf("History(deleted) = %+v, %v", history, err)
+	}
+	before := history[0].SeqNum
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.compact()
+	if history, _ := db.History([]byte("deleted")); len(history) != 0 {
+		t.Fatalf("compaction kept %+v", history)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	history, err = db.History([]byte("after"))
+	if err != nil || len(history) != 1 {
+		t.Fatalf("History(after) = %+v, %v", history, err)
+	}
+	if history[0].SeqNum <= before {
+		t.Fatalf("write after reopening has seqnum %d, not above %d from before", history[0].SeqNum, before)
+	}
+}
+
+func TestGetReturnsCorruptionInsteadOfOlderVersion(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueChecksums = true
+	db, dir := openTestDB(t, opts)
+	db.DisableAutoCompaction()
+	for _, value := range []string{"old-value", "new-value"} {
+		if err := db.Put([]byte("key"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("%d SSTables after two flushes, err %v", len(paths), err)
+	}
+	//the names sort by table number, the newest table is last
+	data, err := os.ReadFile(paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[bytes.Index(data, []byte("new-value"))] ^= 1
+	if err := os.WriteFile(paths[1], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := db.Get([]byte("key")); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Get of a corrupted value = %q, found %v, err %v, want ErrCorruption", value, found, err)
+	}
+	if _, _, _, err := db.GetWithVersion([]byte("key")); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("GetWithVersion of a corrupted value: err %v, want ErrCorruption", err)
+	}
+}
+
+// openFileDescriptors returns the number of file descriptors the process has open
+func openFileDescriptors(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fds)
+}
+
+func TestGetDoesNotLeakFileDescriptors(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("needs /proc/self/fd")
+	}
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 0, 100)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before := openFileDescriptors(t)
+	for i := 0; i < 5000; i++ {
+		checkKeys(t, db, i%100, i%100+1)
+	}
+	if after := openFileDescriptors(t); after > before+5 {
+		t.Fatalf("%d file descriptors open after 5000 Gets, %d before", after, before)
+	}
+}
+
+func TestReadsDoNotLeakFileDescriptors(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("needs /proc/self/fd")
+	}
+	db, _ := openTestDB(t, nil)
+	db.DisableAutoCompaction()
+	//every lookup of the first keys opens the three SSTables
+	for i := 0; i < 3; i++ {
+		putKeys(t, db, i*100, (i+1)*100)
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := openFileDescriptors(t)
+	for i := 0; i < 3000; i++ {
+		checkKeys(t, db, i%100, i%100+1)
+		if _, err := db.History([]byte(fmt.Sprintf("key%05d", i%300))); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 0 {
+			if _, err := db.Keys(nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if after := openFileDescriptors(t); after > before+5 {
+		t.Fatalf("%d file descriptors open after 3000 Gets and Histories, %d before", after, before)
+	}
+}
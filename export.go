@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportFormat selects the encoding of ExportData and ImportData
+type ExportFormat int
+
+const (
+	// ExportJSON writes one {"key":"...","value":"..."} object per line
+	ExportJSON ExportFormat = iota
+	// ExportCSV writes one key,value row per entry, without a header row
+	ExportCSV
+)
+
+// importBatchSize is the number of entries ImportData applies per WriteBatch
+const importBatchSize = 1000
+
+// exportRecord is a line of the ExportJSON format, keys and values are base64 encoded
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ExportData writes every live key and its value to w in ascending key order,
+// from a snapshot taken when it is called. Keys and values are base64 encoded
+// with the standard encoding, so any bytes survive both formats.
+func (db *DB) ExportData(w io.Writer, format ExportFormat) error {
+	if format != ExportJSON && format != ExportCSV {
+		return fmt.Errorf("unknown export format %d", format)
+	}
+	it, err := db.NewIterator(IteratorOptions{})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	cw := csv.NewWriter(bw)
+	for it.Next() {
+		key := base64.StdEncoding.EncodeToString(it.Key())
+		value := base64.StdEncoding.EncodeToString(it.Value())
+		if format == ExportJSON {
+			err = enc.Encode(exportRecord{Key: key, Value: value})
+		} else {
+			err = cw.Write([]string{key, value})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to export key %q: %w", it.Key(), err)
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportData reads entries written by ExportData in format and puts them,
+// applying them with Write in batches of importBatchSize. Batches written before
+// a malformed entry stay in the DB.
+func (db *DB) ImportData(r io.Reader, format ExportFormat) error {
+	var next func() (exportRecord, error)
+	switch format {
+	case ExportJSON:
+		dec := json.NewDecoder(r)
+		next = func() (exportRecord, error) {
+			var rec exportRecord
+			err := dec.Decode(&rec)
+			return rec, err
+		}
+	case ExportCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		next = func() (exportRecord, error) {
+			row, err := cr.Read()
+			if err != nil {
+				return exportRecord{}, err
+			}
+			return exportRecord{Key: row[0], Value: row[1]}, nil
+		}
+	default:
+		return fmt.Errorf("unknown export format %d", format)
+	}
+	batch := NewWriteBatch()
+	for n := 1; ; n++ {
+		rec, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read entry %d: %w", n, err)
+		}
+		key, err := base64.StdEncoding.DecodeString(rec.Key)
+		if err != nil {
+			return fmt.Errorf("entry %d: bad key: %w", n, err)
+		}
+		value, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return fmt.Errorf("entry %d: bad value: %w", n, err)
+		}
+		batch.Put(key, value)
+		if batch.Len() >= importBatchSize {
+			if err := db.Write(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return db.Write(batch)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src, _ := openTestDB(t, nil)
+	putKeys(t, src, 0, 500)
+	if err := src.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, src, 500, 600)
+	if err := src.Delete([]byte("key00007")); err != nil {
+		t.Fatal(err)
+	}
+	//binary keys and values, and commas and quotes CSV would have to escape
+	awkward := map[string]string{"\x00\xff": "\n\r", "a,b": `"quoted"`}
+	for key, value := range awkward {
+		if err := src.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, format := range map[string]ExportFormat{"json": ExportJSON, "csv": ExportCSV} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := src.ExportData(&buf, format); err != nil {
+				t.Fatal(err)
+			}
+			dst, _ := openTestDB(t, nil)
+			if err := dst.ImportData(&buf, format); err != nil {
+				t.Fatal(err)
+			}
+			want, err := src.Range(nil, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := dst.Range(nil, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("imported %d keys, exported %d", len(got), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i].Key, want[i].Key) || !bytes.Equal(got[i].Value, want[i].Value) {
+					t.Fatalf("pair %d is %q = %q, want %q = %q", i, got[i].Key, got[i].Value, want[i].Key, want[i].Value)
+				}
+			}
+			if _, found, err := dst.Get([]byte("key00007")); err != nil || found {
+				t.Fatalf("a deleted key was exported, err %v", err)
+			}
+		})
+	}
+}
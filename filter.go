@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sync"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+// FilterPolicy builds the filter block of an SSTable and answers membership
+// queries against it. The policy name is stored in the table, so a reader only
+// uses filters built by the policy it was configured with.
+type FilterPolicy interface {
+	// Name identifies the filter format. Change it whenever the format changes.
+	Name() string
+	// CreateFilter builds a filter over the user keys of a table
+	CreateFilter(keys [][]byte) []byte
+	// MayContain reports whether key may have been passed to CreateFilter.
+	// It must return true for every such key, false positives are allowed.
+	// It is called concurrently on the same filter, which it must not modify.
+	MayContain(filter, key []byte) bool
+}
+
+// bloomFilterPolicyName is also assumed for tables written before the policy name was stored
+const bloomFilterPolicyName = "bits-and-blooms.BloomFilter"
+
+// bloomFilterPolicy is the default FilterPolicy, a github.com/bits-and-blooms/bloom filter
+type bloomFilterPolicy struct {
+	bitsPerKey int
+}
+
+// NewBloomFilterPolicy returns a bloom filter policy using bitsPerKey bits per
+// key. More bits lower the false positive rate, 10 gives about 1%.
+func NewBloomFilterPolicy(bitsPerKey int) FilterPolicy {
+	return bloomFilterPolicy{bitsPerKey: max(bitsPerKey, 1)}
+}
+
+func (p bloomFilterPolicy) Name() string {
+	return bloomFilterPolicyName
+}
+
+func (p bloomFilterPolicy) CreateFilter(keys [][]byte) []byte {
+	//k = bitsPerKey * ln(2) minimizes the false positive rate
+	k := uint(math.Round(float64(p.bitsPerKey) * math.Ln2))
+	k = max(1, min(k, 30))
+	filter := bloom.New(uint(max(len(keys), 1)*p.bitsPerKey), k)
+	for _, key := range keys {
+		filter.Add(key)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := filter.WriteTo(buf); err != nil {
+		//writing to a bytes.Buffer cannot fail
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func (p bloomFilterPolicy) MayContain(filterData, key []byte) bool {
+	return p.decodeFilter(filterData)(key)
+}
+
+func (p bloomFilterPolicy) decodeFilter(filterData []byte) filterMatcher {
+	filter := &bloom.BloomFilter{}
+	if _, err := filter.ReadFrom(bytes.NewReader(filterData)); err != nil {
+		//an undecodable filter rules nothing out
+		return matchAll
+	}
+	return filter.Test
+}
+
+// filterMatcher reports whether a key may have been added to one filter
+type filterMatcher func(key []byte) bool
+
+// matchAll is the matcher of a filter that rules nothing out
+func matchAll([]byte) bool {
+	return true
+}
+
+// filterDecoder is implemented by policies whose filters are costly to decode,
+// such as the bloom filter policy. Readers decode every filter once, when they
+// load it, instead of on every MayContain.
+type filterDecoder interface {
+	decodeFilter(filter []byte) filterMatcher
+}
+
+// newFilterMatcher returns the matcher of filter, built by policy
+func newFilterMatcher(policy FilterPolicy, filter []byte) filterMatcher {
+	if decoder, ok := policy.(filterDecoder); ok {
+		return decoder.decodeFilter(filter)
+	}
+	return func(key []byte) bool {
+		return policy.MayContain(filter, key)
+	}
+}
+
+// bloomFalsePositiveRate returns the false positive rate of a bloom filter with
+// bitsPerKey bits per key and the number of hash functions CreateFilter picks
+func bloomFalsePositiveRate(bitsPerKey float64) float64 {
+	if bitsPerKey <= 0 {
+		return 1
+	}
+	k := max(1, min(math.Round(bitsPerKey*math.Ln2), 30))
+	return math.Pow(1-math.Exp(-k/bitsPerKey), k)
+}
+
+// PrefixExtractor maps a user key to its prefix, such as "user:<uuid>:" for
+// "user:<uuid>:field". With Options.PrefixExtractor set every SSTable gets a
+// second filter over the prefixes of its keys, which lets Get and
+// NewPrefixIterator skip tables holding no key with the prefix.
+type PrefixExtractor interface {
+	// Name identifies the extractor. Tables whose prefix filter was built by an
+	// extractor with another name are read without it.
+	Name() string
+	// Transform returns the prefix of key, or nil if key has none. The result
+	// must be a prefix of key.
+	Transform(key []byte) []byte
+}
+
+// fixedPrefixExtractor uses the first n bytes of a key as its prefix
+type fixedPrefixExtractor struct {
+	n int
+}
+
+// NewFixedPrefixExtractor returns an extractor using the first n bytes of a key
+// as its prefix. Keys shorter than n bytes have no prefix.
+func NewFixedPrefixExtractor(n int) PrefixExtractor {
+	return fixedPrefixExtractor{n: n}
+}
+
+func (e fixedPrefixExtractor) Name() string {
+	return fmt.Sprintf("leveldb.FixedPrefix.%d", e.n)
+}
+
+func (e fixedPrefixExtractor) Transform(key []byte) []byte {
+	if len(key) < e.n {
+		return nil
+	}
+	return key[:e.n]
+}
+
+// DefaultFilterPartitionBlocks is the Options.FilterPartitionBlocks set by DefaultOptions
+const DefaultFilterPartitionBlocks = 64
+
+// filterPartitionEntrySize is the size of an entry of the top level of a
+// partitioned filter: [Offset (8)][Size (4)][CRC-32 (4)]
+const filterPartitionEntrySize = 16
+
+// filterPartition locates the filter over one group of data blocks
+type filterPartition struct {
+	offset   int64
+	size     int
+	checksum uint32
+}
+
+// encodeFilterPartitions serializes the top level of a partitioned filter, which
+// follows the partitions: [Entries][Blocks Per Partition (4)][Partition Count (4)].
+// Partition p filters the keys of data blocks [p*Blocks Per Partition, (p+1)*Blocks Per Partition).
+func encodeFilterPartitions(partitions []filterPartition, blocksPerPartition int) []byte {
+	buf := make([]byte, len(partitions)*filterPartitionEntrySize+8)
+	for i, p := range partitions {
+		entry := buf[i*filterPartitionEntrySize:]
+		binary.LittleEndian.PutUint64(entry[0:], uint64(p.offset))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(p.size))
+		binary.LittleEndian.PutUint32(entry[12:], p.checksum)
+	}
+	tail := buf[len(partitions)*filterPartitionEntrySize:]
+	binary.LittleEndian.PutUint32(tail[0:], uint32(blocksPerPartition))
+	binary.LittleEndian.PutUint32(tail[4:], uint32(len(partitions)))
+	return buf
+}
+
+// partitionedFilter keeps only the top level of a partitioned filter in memory
+// and reads partitions on demand. Like partitionedIndex it caches the last
+// partition read, decoded; read may serve partitions from the block cache as well.
+type partitionedFilter struct {
+	partitions         []filterPartition
+	blocksPerPartition int
+	read               func(offset int64, size int) ([]byte, error)
+	policy             FilterPolicy
+	mu                 sync.Mutex
+	cachedIdx          int
+	cached             filterMatcher
+}
+
+// newPartitionedFilter parses the top level of a partitioned filter, the last
+// bytes of the filter region, whose partitions were built by policy
+func newPartitionedFilter(region []byte, policy FilterPolicy, read func(offset int64, size int) ([]byte, error)) (*partitionedFilter, error) {
+	if len(region) < 8 {
+		return nil, fmt.Errorf("partitioned filter too short: %d bytes", len(region))
+	}
+	tail := region[len(region)-8:]
+	blocksPerPartition := int(binary.LittleEndian.Uint32(tail[0:]))
+	count := int(binary.LittleEndian.Uint32(tail[4:]))
+	if blocksPerPartition < 1 || count*filterPartitionEntrySize > len(region)-8 {
+		return nil, fmt.Errorf("partitioned filter corrupted: %d partitions of %d blocks", count, blocksPerPartition)
+	}
+	entries := region[len(region)-8-count*filterPartitionEntrySize:]
+	partitions := make([]filterPartition, count)
+	for i := range partitions {
+		entry := entries[i*filterPartitionEntrySize:]
+		partitions[i] = filterPartition{
+			offset:   int64(binary.LittleEndian.Uint64(entry[0:])),
+			size:     int(binary.LittleEndian.Uint32(entry[8:])),
+			checksum: binary.LittleEndian.Uint32(entry[12:]),
+		}
+	}
+	return &partitionedFilter{partitions: partitions, blocksPerPartition: blocksPerPartition, read: read, policy: policy, cachedIdx: -1}, nil
+}
+
+// partition returns the matcher of the filter of the data block blockIndex
+// belongs to, or an error if it cannot be read or fails its checksum
+func (f *partitionedFilter) partition(blockIndex int) (filterMatcher, error) {
+	p := blockIndex / f.blocksPerPartition
+	if p >= len(f.partitions) {
+		return nil, fmt.Errorf("no filter partition for data block %d", blockIndex)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cachedIdx == p {
+		return f.cached, nil
+	}
+	part := f.partitions[p]
+	data, err := f.read(part.offset, part.size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read filter partition %d: %w", p, err)
+	}
+	if crc32.ChecksumIEEE(data) != part.checksum {
+		return nil, fmt.Errorf("%w: filter partition %d", ErrCorruption, p)
+	}
+	f.cachedIdx, f.cached = p, newFilterMatcher(f.policy, data)
+	return f.cached, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// File is the part of *os.File the DB uses
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Name() string
+}
+
+// FS is the filesystem holding the WALs, SSTables and state file. OSFS is the
+// default, NewMemFS keeps everything in memory for fast and hermetic tests while
+// still exercising the WAL and SSTable encoding.
+type FS interface {
+	Create(name string) (File, error)
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	Truncate(name string, size int64) error
+	Glob(pattern string) ([]string, error)
+	// SyncDir makes the creations, renames and removals of files in dir durable
+	SyncDir(dir string) error
+}
+
+// tmpFileSuffix ends the name of a file that is renamed once it is complete.
+// NewDB removes the ones a crash left behind.
+const tmpFileSuffix = ".tmp"
+
+// OSFS is the FS backed by the operating system
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (File, error) { return os.Create(name) }
+func (osFS) Open(name string) (File, error)   { return os.Open(name) }
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) ReadFile(name string) ([]byte, error)         { return os.ReadFile(name) }
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (osFS) Stat(name string) (os.FileInfo, error)  { return os.Stat(name) }
+func (osFS) Truncate(name string, size int64) error { return os.Truncate(name, size) }
+func (osFS) Glob(pattern string) ([]string, error)  { return filepath.Glob(pattern) }
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// memFS is an FS kept entirely in memory. Directories are implicit: MkdirAll
+// always succeeds and a file can be created under any path.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFileData
+}
+
+// NewMemFS returns an empty in-memory FS. Pass it as Options.FS to several
+// NewDB calls to reopen a database within one process.
+func NewMemFS() FS {
+	return &memFS{files: make(map[string]*memFileData)}
+}
+
+// memFileData is the content of a file, shared by every handle opened on it
+type memFileData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (m *memFS) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		data = &memFileData{modTime: time.Now()}
+		m.files[name] = data
+	} else if flag&os.O_TRUNC != 0 {
+		data.mu.Lock()
+		data.data = nil
+		data.mu.Unlock()
+	}
+	return &memFile{name: name, file: data, flag: flag}, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = data
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (m *memFS) Truncate(name string, size int64) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	data, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrNotExist}
+	}
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	if size < int64(len(data.data)) {
+		data.data = data.data[:size]
+	} else {
+		data.data = append(data.data, make([]byte, size-int64(len(data.data)))...)
+	}
+	data.modTime = time.Now()
+	return nil
+}
+
+func (m *memFS) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matches []string
+	for name := range m.files {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// memFile is an open handle on a memFS file with its own read offset
+type memFile struct {
+	name   string
+	file   *memFileData
+	flag   int
+	offset int64
+	closed bool
+}
+
+var errMemFileClosed = errors.New("file already closed")
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errMemFileClosed
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, errMemFileClosed
+	}
+	f.file.mu.RLock()
+	defer f.file.mu.RUnlock()
+	if off >= int64(len(f.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.file.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, errMemFileClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	f.file.mu.Lock()
+	defer f.file.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.file.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.file.data)) {
+		f.file.data = append(f.file.data, make([]byte, end-int64(len(f.file.data)))...)
+	}
+	copy(f.file.data[f.offset:], p)
+	f.offset += int64(len(p))
+	f.file.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return errMemFileClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return errMemFileClosed
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.file.mu.RLock()
+	defer f.file.mu.RUnlock()
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.file.data)), modTime: f.file.modTime}, nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0644 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
+
+// SyncDir does nothing, memFS changes are never lost short of the process exiting
+func (m *memFS) SyncDir(dir string) error { return nil }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// IssueSeverity tells how serious a HealthReport Issue is
+type IssueSeverity int
+
+const (
+	// IssueWarning is an inconsistency the DB works around, such as a leftover
+	// file. NewDB logs it and opens the DB.
+	IssueWarning IssueSeverity = iota
+	// IssueError is an inconsistency that can lose data or serve wrong results,
+	// such as a missing SSTable. NewDB fails on it.
+	IssueError
+)
+
+func (s IssueSeverity) String() string {
+	if s == IssueError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Issue is one inconsistency found by DB.HealthCheck
+type Issue struct {
+	Severity    IssueSeverity
+	Description string
+}
+
+// HealthReport is the result of DB.HealthCheck
+type HealthReport struct {
+	Issues []Issue
+}
+
+// HasErrors reports whether any issue is an IssueError
+func (r HealthReport) HasErrors() bool {
+	for _, issue := range r.Issues {
+		if issue.Severity == IssueError {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns an error listing the IssueErrors of the report, or nil if it has none
+func (r HealthReport) Err() error {
+	var errs []string
+	for _, issue := range r.Issues {
+		if issue.Severity == IssueError {
+			errs = append(errs, issue.Description)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrCorruption, strings.Join(errs, "; "))
+}
+
+func (r *HealthReport) add(severity IssueSeverity, format string, args ...any) {
+	r.Issues = append(r.Issues, Issue{Severity: severity, Description: fmt.Sprintf(format, args...)})
+}
+
+// HealthCheck compares the in-memory state of the DB with the files on disk:
+// every active SSTable must exist, start and end with the SSTable magic and
+// have a file number below the next one to be handed out; no other SSTable may
+// be left in the data directory; the active WAL must read back cleanly; and the
+// state file must parse and list the same tables. It reads the headers and
+// footers of the SSTables and the whole active WAL, holding off flushes,
+// compactions and writes while it does. NewDB runs it before returning.
+func (db *DB) HealthCheck() HealthReport {
+	var report HealthReport
+	if db.opts.InMemory {
+		return report
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	fs := db.opts.fileSystem()
+
+	active := make(map[int]bool, len(db.activeSSTables))
+	for _, num := range db.activeSSTables {
+		if active[num] {
+			report.add(IssueError, "SSTable %d is listed twice among the active SSTables", num)
+		}
+		active[num] = true
+		if num >= db.nextFileNumber {
+			report.add(IssueError, "SSTable %d is active but the next file number is %d, it would be overwritten", num, db.nextFileNumber)
+		}
+		path := filepath.Join(db.dataDir, fmt.Sprintf("%05d.sst", num))
+		if err := checkSSTableMagic(fs, path); err != nil {
+			report.add(IssueError, "SSTable %d: %v", num, err)
+		}
+	}
+	sstFiles, err := fs.Glob(filepath.Join(db.dataDir, "*.sst"))
+	if err != nil {
+		report.add(IssueWarning, "failed to list the SSTables of %s: %v", db.dataDir, err)
+	}
+	for _, path := range sstFiles {
+		num, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".sst"))
+		if err != nil || active[num] {
+			continue
+		}
+		//left by a compaction that has not committed or removed its files yet, or by a crash
+		report.add(IssueWarning, "SSTable file %s is not an active SSTable", path)
+		if num >= db.nextFileNumber {
+			report.add(IssueWarning, "SSTable file %s has a file number the next table will reuse, the next file number is %d", path, db.nextFileNumber)
+		}
+	}
+
+	db.checkWALHealth(&report)
+
+	state, err := loadState(fs, db.dataDir, noopLogger{})
+	switch {
+	case err != nil:
+		report.add(IssueError, "state file: %v", err)
+	case !slices.Equal(state.ActiveSSTables, db.activeSSTables):
+		report.add(IssueError, "state file lists SSTables %v, the DB uses %v", state.ActiveSSTables, db.activeSSTables)
+	case state.NextFileNumber > db.nextFileNumber:
+		report.add(IssueError, "state file has next file number %d, ahead of the DB's %d", state.NextFileNumber, db.nextFileNumber)
+	}
+	return report
+}
+
+// checkWALHealth reads the active WAL through, holding off writes. Caller must
+// hold db.mu.
+func (db *DB) checkWALHealth(report *HealthReport) {
+	wal := db.wal
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	path := wal.file.Name()
+	if err := wal.bw.Flush(); err != nil {
+		report.add(IssueError, "WAL %s: %v", path, err)
+		return
+	}
+	file, err := db.opts.fileSystem().Open(path)
+	if err != nil {
+		report.add(IssueError, "WAL %s: %v", path, err)
+		return
+	}
+	defer file.Close()
+	reader, err := newWALReader(file)
+	if err != nil {
+		report.add(IssueError, "WAL %s: %v", path, err)
+		return
+	}
+	for {
+		_, err := reader.next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			//replay skips it rather than failing, see SkipAnyCorruptedRecords
+			severity := IssueError
+			if db.opts.WALRecoveryMode == SkipAnyCorruptedRecords {
+				severity = IssueWarning
+			}
+			report.add(severity, "WAL %s has a bad entry at offset %d: %v", path, reader.fragmentStart, err)
+			return
+		}
+	}
+}
+
+// checkSSTableMagic checks that an SSTable starting with the magic also ends
+// with it. Tables of the oldest formats have no magic and pass.
+func checkSSTableMagic(fs FS, path string) error {
+	file, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(sstableMagic))
+	if _, err := file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if string(header) != sstableMagic {
+		return nil
+	}
+	if stat.Size() < int64(sstableHeaderSize+fixedFooterSize) {
+		return fmt.Errorf("%w: %d bytes, too short for a header and footer", ErrInvalidSSTableFormat, stat.Size())
+	}
+	footer := make([]byte, len(sstableMagic))
+	if _, err := file.ReadAt(footer, stat.Size()-int64(len(sstableMagic))); err != nil {
+		return err
+	}
+	if string(footer) != sstableMagic {
+		return fmt.Errorf("%w: the header has the magic but the footer does not", ErrInvalidSSTableFormat)
+	}
+	return nil
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// indexFormatGob is the original index block: a gob encoded []IndexEntry
+	indexFormatGob = 0
+	// indexFormatBinary is a flat binary index block that can be searched without decoding it entirely
+	indexFormatBinary = 1
+	// indexFormatPartitioned splits the index into binary index partitions,
+	// located through a top-level index, see encodePartitionedIndex
+	indexFormatPartitioned = 2
+	// indexFormatPrefix shares key prefixes between consecutive entries and
+	// varint encodes block locations, see encodePrefixIndexBlock
+	indexFormatPrefix = 3
+	// indexFormatPartitionedPrefix is indexFormatPartitioned with the top-level
+	// index and the partitions in indexFormatPrefix
+	indexFormatPartitionedPrefix = 4
+
+	DefaultIndexPartitionEntries = 1024
+	// indexRestartInterval is the number of index entries between restart points,
+	// decoding any entry walks at most this many entries
+	indexRestartInterval = 16
+)
+
+// tableIndex maps data block numbers to their location, and keys to data blocks
+type tableIndex interface {
+	// Len returns the number of data blocks in the table
+	Len() int
+	// Entry decodes the index entry of the i-th data block
+	Entry(i int) (IndexEntry, error)
+	// Search returns the first data block whose last key is >= key, or Len() if there is none
+	Search(key InternalKey, cmp internalKeyComparable) (int, error)
+}
+
+// indexBlock gives random access to the entries of an SSTable index written in
+// indexFormatGob or indexFormatBinary, the layout of the latter being:
+// [Entry 0]...[Entry n-1][Entry Offsets (4 bytes each)][Entry Count (4 bytes)]
+// Entry = [Block Offset (8 bytes)][Block Size (4 bytes)][Seq (8 bytes)][Type (1 byte)][User Key Size (4 bytes)][User Key]
+// Binary index blocks are kept as raw bytes and entries are decoded on demand,
+// so opening a table does not pay for decoding the whole index.
+type indexBlock struct {
+	data      []byte
+	count     int
+	offsetsAt int
+	//set for tables written with the gob index format
+	legacy []IndexEntry
+}
+
+// newIndexBlock validates the raw index block and prepares it for lookups
+func newIndexBlock(data []byte, format int) (*indexBlock, error) {
+	if format == indexFormatGob {
+		var entries []IndexEntry
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("failed to decode index: %w", err)
+		}
+		return &indexBlock{legacy: entries, count: len(entries)}, nil
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("index block too short: %d bytes", len(data))
+	}
+	count := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	offsetsAt := len(data) - 4 - 4*count
+	if count < 0 || offsetsAt < 0 {
+		return nil, fmt.Errorf("index block corrupted: %d entries do not fit in %d bytes", count, len(data))
+	}
+	return &indexBlock{data: data, count: count, offsetsAt: offsetsAt}, nil
+}
+
+// Len returns the number of data blocks in the table
+func (b *indexBlock) Len() int {
+	return b.count
+}
+
+// Entry decodes the i-th index entry
+func (b *indexBlock) Entry(i int) (IndexEntry, error) {
+	if b.legacy != nil {
+		return b.legacy[i], nil
+	}
+	start := int(binary.LittleEndian.Uint32(b.data[b.offsetsAt+4*i:]))
+	if start+25 > b.offsetsAt {
+		return IndexEntry{}, fmt.Errorf("index entry %d out of bounds", i)
+	}
+	e := b.data[start:]
+	keySize := int(binary.LittleEndian.Uint32(e[21:25]))
+	if start+25+keySize > b.offsetsAt {
+		return IndexEntry{}, fmt.Errorf("index entry %d key out of bounds", i)
+	}
+	return IndexEntry{
+		LastKey: InternalKey{
+			UserKey: string(e[25 : 25+keySize]),
+			SeqNum:  binary.LittleEndian.Uint64(e[12:20]),
+			Type:    e[20],
+		},
+		Offset: int64(binary.LittleEndian.Uint64(e[0:8])),
+		Size:   int(binary.LittleEndian.Uint32(e[8:12])),
+	}, nil
+}
+
+// Search returns the index of the first block whose last key is >= key,
+// or Len() if there is none. Only O(log n) entries are decoded.
+func (b *indexBlock) Search(key InternalKey, cmp internalKeyComparable) (int, error) {
+	lo, hi := 0, b.count
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		entry, err := b.Entry(mid)
+		if err != nil {
+			return 0, err
+		}
+		if cmp.Compare(entry.LastKey, key) >= 0 {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+// encodePrefixIndexBlock serializes index entries in indexFormatPrefix, which
+// compresses keys the way blockBuilder does:
+// [Entry 0]...[Entry n-1][Restart 0 (4 bytes)]...[Restart m-1 (4 bytes)][Restart Count (4 bytes)][Entry Count (4 bytes)]
+// Entry = [Shared (varint)][Unshared (varint)][Offset Delta (varint)][Block Size (varint)][Unshared User Key][Seq (8 bytes)][Type (1 byte)]
+// Offset Delta is the gap between the end of the previous block and this one,
+// 0 for blocks written back to back. Every indexRestartInterval-th entry is a
+// restart point storing its full user key and its offset relative to 0.
+func encodePrefixIndexBlock(entries []IndexEntry) []byte {
+	buf := new(bytes.Buffer)
+	var restarts []uint32
+	var scratch [4*binary.MaxVarintLen64 + 9]byte
+	var prevKey string
+	var prevEnd int64
+	for i, e := range entries {
+		shared := 0
+		if i%indexRestartInterval == 0 {
+			restarts = append(restarts, uint32(buf.Len()))
+			prevEnd = 0
+		} else {
+			limit := min(len(prevKey), len(e.LastKey.UserKey))
+			for shared < limit && prevKey[shared] == e.LastKey.UserKey[shared] {
+				shared++
+			}
+		}
+		n := binary.PutUvarint(scratch[:], uint64(shared))
+		n += binary.PutUvarint(scratch[n:], uint64(len(e.LastKey.UserKey)-shared))
+		n += binary.PutUvarint(scratch[n:], uint64(e.Offset-prevEnd))
+		n += binary.PutUvarint(scratch[n:], uint64(e.Size))
+		buf.Write(scratch[:n])
+		buf.WriteString(e.LastKey.UserKey[shared:])
+		binary.LittleEndian.PutUint64(scratch[0:8], e.LastKey.SeqNum)
+		scratch[8] = e.LastKey.Type
+		buf.Write(scratch[:9])
+		prevKey, prevEnd = e.LastKey.UserKey, e.Offset+int64(e.Size)
+	}
+	for _, off := range restarts {
+		binary.LittleEndian.PutUint32(scratch[:], off)
+		buf.Write(scratch[:4])
+	}
+	binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(restarts)))
+	binary.LittleEndian.PutUint32(scratch[4:8], uint32(len(entries)))
+	buf.Write(scratch[:8])
+	return buf.Bytes()
+}
+
+// prefixIndexBlock gives random access to an index block in indexFormatPrefix.
+// An entry is decoded by walking from its restart point, so lookups decode
+// O(log n + indexRestartInterval) entries and opening a table decodes none.
+type prefixIndexBlock struct {
+	data       []byte
+	count      int
+	restartsAt int
+	restarts   int
+}
+
+// newPrefixIndexBlock validates the trailer of the raw index block
+func newPrefixIndexBlock(data []byte) (*prefixIndexBlock, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("index block too short: %d bytes", len(data))
+	}
+	restarts := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	count := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	restartsAt := len(data) - 8 - 4*restarts
+	if restartsAt < 0 || restarts != (count+indexRestartInterval-1)/indexRestartInterval {
+		return nil, fmt.Errorf("index block corrupted: %d entries and %d restart points do not fit in %d bytes", count, restarts, len(data))
+	}
+	return &prefixIndexBlock{data: data, count: count, restartsAt: restartsAt, restarts: restarts}, nil
+}
+
+func (b *prefixIndexBlock) Len() int {
+	return b.count
+}
+
+// scan decodes the entries of restart group r in order, passing each with its
+// position to fn until fn returns false or the group ends
+func (b *prefixIndexBlock) scan(r int, fn func(i int, e IndexEntry) bool) error {
+	pos := int(binary.LittleEndian.Uint32(b.data[b.restartsAt+4*r:]))
+	var key []byte
+	var prevEnd int64
+	for i := r * indexRestartInterval; i < min((r+1)*indexRestartInterval, b.count); i++ {
+		var fields [4]uint64
+		for f := range fields {
+			if pos >= b.restartsAt {
+				return fmt.Errorf("index entry %d out of bounds", i)
+			}
+			v, n := binary.Uvarint(b.data[pos:b.restartsAt])
+			if n <= 0 {
+				return fmt.Errorf("index entry %d: bad varint", i)
+			}
+			fields[f], pos = v, pos+n
+		}
+		shared, unshared := fields[0], fields[1]
+		if shared > uint64(len(key)) || unshared > uint64(b.restartsAt-pos) || unshared+9 > uint64(b.restartsAt-pos) {
+			return fmt.Errorf("index entry %d: sizes exceed block", i)
+		}
+		keyEnd := pos + int(unshared)
+		key = append(key[:shared], b.data[pos:keyEnd]...)
+		e := IndexEntry{
+			LastKey: InternalKey{
+				UserKey: string(key),
+				SeqNum:  binary.LittleEndian.Uint64(b.data[keyEnd : keyEnd+8]),
+				Type:    b.data[keyEnd+8],
+			},
+			Offset: prevEnd + int64(fields[2]),
+			Size:   int(fields[3]),
+		}
+		pos = keyEnd + 9
+		prevEnd = e.Offset + int64(e.Size)
+		if !fn(i, e) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Entry decodes the i-th index entry
+func (b *prefixIndexBlock) Entry(i int) (IndexEntry, error) {
+	if i < 0 || i >= b.count {
+		return IndexEntry{}, fmt.Errorf("index entry %d out of bounds", i)
+	}
+	var entry IndexEntry
+	err := b.scan(i/indexRestartInterval, func(j int, e IndexEntry) bool {
+		entry = e
+		return j < i
+	})
+	return entry, err
+}
+
+// Search binary searches the restart points, then walks a single restart group
+func (b *prefixIndexBlock) Search(key InternalKey, cmp internalKeyComparable) (int, error) {
+	//find the last restart point whose key is < key
+	lo, hi := 0, b.restarts-1
+	for lo < hi {
+		mid := int(uint(lo+hi+1) >> 1)
+		entry, err := b.Entry(mid * indexRestartInterval)
+		if err != nil {
+			return 0, err
+		}
+		if cmp.Compare(entry.LastKey, key) < 0 {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	//the next restart point, if any, is >= key
+	found := min((lo+1)*indexRestartInterval, b.count)
+	err := b.scan(lo, func(i int, e IndexEntry) bool {
+		if cmp.Compare(e.LastKey, key) >= 0 {
+			found = i
+			return false
+		}
+		return true
+	})
+	return found, err
+}
+
+// openIndexBlock parses a single-level index block written in format
+func openIndexBlock(data []byte, format int) (tableIndex, error) {
+	switch format {
+	case indexFormatGob, indexFormatBinary:
+		return newIndexBlock(data, format)
+	case indexFormatPrefix:
+		return newPrefixIndexBlock(data)
+	default:
+		return nil, fmt.Errorf("%w: unknown index format %d", ErrInvalidSSTableFormat, format)
+	}
+}
+
+const (
+	// hashIndexEmpty marks a bucket no key hashed to, the key is not in the table
+	hashIndexEmpty = math.MaxUint32
+	// hashIndexCollision marks a bucket shared by keys living in different blocks,
+	// lookups fall back to the binary search index
+	hashIndexCollision = math.MaxUint32 - 1
+)
+
+// writeIndex writes the index of the data blocks to w at offset and returns the
+// format, offset and size of the block the footer should point to. Indexes with
+// more than partitionEntries entries are partitioned.
+func writeIndex(w io.Writer, offset int64, entries []IndexEntry, partitionEntries int) (int, int64, int, error) {
+	if partitionEntries < 1 || len(entries) <= partitionEntries {
+		indexBytes := encodePrefixIndexBlock(entries)
+		if _, err := w.Write(indexBytes); err != nil {
+			return 0, 0, 0, err
+		}
+		return indexFormatPrefix, offset, len(indexBytes), nil
+	}
+	//write the partitions, then the top-level index pointing at them
+	var partitions []IndexEntry
+	for start := 0; start < len(entries); start += partitionEntries {
+		chunk := entries[start:min(start+partitionEntries, len(entries))]
+		partitionBytes := encodePrefixIndexBlock(chunk)
+		if _, err := w.Write(partitionBytes); err != nil {
+			return 0, 0, 0, err
+		}
+		partitions = append(partitions, IndexEntry{
+			LastKey: chunk[len(chunk)-1].LastKey,
+			Offset:  offset,
+			Size:    len(partitionBytes),
+		})
+		offset += int64(len(partitionBytes))
+	}
+	top := encodePartitionedIndex(partitions, partitionEntries, len(entries))
+	if _, err := w.Write(top); err != nil {
+		return 0, 0, 0, err
+	}
+	return indexFormatPartitionedPrefix, offset, len(top), nil
+}
+
+// encodePartitionedIndex serializes the top-level index of a partitioned index:
+// [Entries Per Partition (4 bytes)][Total Entries (4 bytes)][Index Block Of Partitions]
+// Every partition but the last holds exactly Entries Per Partition entries, so
+// block i lives in partition i / Entries Per Partition.
+func encodePartitionedIndex(partitions []IndexEntry, partitionEntries, total int) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(partitionEntries))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(total))
+	return append(buf, encodePrefixIndexBlock(partitions)...)
+}
+
+// partitionedIndex keeps only the top-level index in memory and reads index
+// partitions from the file on demand. The last partition read is cached, which
+// makes sequential scans read each partition once.
+type partitionedIndex struct {
+	top tableIndex
+	//format of the top-level index and of every partition
+	format           int
+	partitionEntries int
+	total            int
+	read             func(offset int64, size int) ([]byte, error)
+
+	mu        sync.Mutex
+	cachedIdx int
+	cached    tableIndex
+}
+
+// newPartitionedIndex parses the top-level index, read is used to load partitions.
+// format is the single-level format of the top-level index and the partitions.
+func newPartitionedIndex(data []byte, format int, read func(offset int64, size int) ([]byte, error)) (*partitionedIndex, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("partitioned index too short: %d bytes", len(data))
+	}
+	partitionEntries := int(binary.LittleEndian.Uint32(data[0:4]))
+	total := int(binary.LittleEndian.Uint32(data[4:8]))
+	top, err := openIndexBlock(data[8:], format)
+	if err != nil {
+		return nil, err
+	}
+	if partitionEntries < 1 || (total+partitionEntries-1)/partitionEntries != top.Len() {
+		return nil, fmt.Errorf("partitioned index corrupted: %d entries in %d partitions of %d", total, top.Len(), partitionEntries)
+	}
+	return &partitionedIndex{
+		top:              top,
+		format:           format,
+		partitionEntries: partitionEntries,
+		total:            total,
+		read:             read,
+		cachedIdx:        -1,
+	}, nil
+}
+
+// partition returns the p-th index partition, reading it if it is not cached
+func (x *partitionedIndex) partition(p int) (tableIndex, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.cachedIdx == p {
+		return x.cached, nil
+	}
+	entry, err := x.top.Entry(p)
+	if err != nil {
+		return nil, err
+	}
+	data, err := x.read(entry.Offset, entry.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index partition %d: %w", p, err)
+	}
+	block, err := openIndexBlock(data, x.format)
+	if err != nil {
+		return nil, err
+	}
+	x.cachedIdx, x.cached = p, block
+	return block, nil
+}
+
+func (x *partitionedIndex) Len() int {
+	return x.total
+}
+
+func (x *partitionedIndex) Entry(i int) (IndexEntry, error) {
+	block, err := x.partition(i / x.partitionEntries)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	local := i % x.partitionEntries
+	if local >= block.Len() {
+		return IndexEntry{}, fmt.Errorf("index entry %d out of bounds", i)
+	}
+	return block.Entry(local)
+}
+
+// Search finds the partition through the top-level index, then searches only that partition
+func (x *partitionedIndex) Search(key InternalKey, cmp internalKeyComparable) (int, error) {
+	p, err := x.top.Search(key, cmp)
+	if err != nil || p >= x.top.Len() {
+		return x.total, err
+	}
+	block, err := x.partition(p)
+	if err != nil {
+		return 0, err
+	}
+	local, err := block.Search(key, cmp)
+	if err != nil {
+		return 0, err
+	}
+	return p*x.partitionEntries + local, nil
+}
+
+// hashUserKey is the hash used to place user keys into hash index buckets
+func hashUserKey(userKey []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(userKey)
+	return h.Sum32()
+}
+
+// hashIndexBuilder maps user keys to the data block holding their newest version
+type hashIndexBuilder struct {
+	buckets []uint32
+}
+
+func newHashIndexBuilder(itemCount uint) *hashIndexBuilder {
+	//power of two bucket count, at least one bucket per item
+	n := 1
+	for uint(n) < itemCount {
+		n <<= 1
+	}
+	buckets := make([]uint32, n)
+	for i := range buckets {
+		buckets[i] = hashIndexEmpty
+	}
+	return &hashIndexBuilder{buckets: buckets}
+}
+
+// Add records that userKey can be found in block blockIdx
+func (b *hashIndexBuilder) Add(userKey []byte, blockIdx int) {
+	bucket := hashUserKey(userKey) & uint32(len(b.buckets)-1)
+	switch b.buckets[bucket] {
+	case hashIndexEmpty:
+		b.buckets[bucket] = uint32(blockIdx)
+	case uint32(blockIdx), hashIndexCollision:
+	default:
+		b.buckets[bucket] = hashIndexCollision
+	}
+}
+
+// Finish serializes the buckets: [Bucket 0 (4 bytes)]...[Bucket n-1 (4 bytes)]
+func (b *hashIndexBuilder) Finish() []byte {
+	buf := make([]byte, 4*len(b.buckets))
+	for i, v := range b.buckets {
+		binary.LittleEndian.PutUint32(buf[4*i:], v)
+	}
+	return buf
+}
+
+// hashIndex is the raw hash index block of an SSTable
+type hashIndex []byte
+
+func newHashIndex(data []byte) (hashIndex, error) {
+	n := len(data) / 4
+	if len(data)%4 != 0 || n == 0 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("hash index corrupted: invalid size %d", len(data))
+	}
+	return hashIndex(data), nil
+}
+
+// Lookup returns the block that may hold userKey, hashIndexEmpty if the key
+// is not in the table, or hashIndexCollision if the caller must binary search
+func (h hashIndex) Lookup(userKey []byte) uint32 {
+	n := uint32(len(h) / 4)
+	bucket := hashUserKey(userKey) & (n - 1)
+	return binary.LittleEndian.Uint32(h[4*bucket:])
+}
@@ -10,12 +10,26 @@ const (
 	OpTypeDelete OpType = 1
 )
 
+// validOpType reports whether typ is the type of an entry a memtable or an
+// SSTable can hold. Decoders reject other types with ErrCorruption.
+func validOpType(typ OpType) bool {
+	switch typ {
+	case OpTypePut, OpTypeDelete, OpTypeBlobIndex, OpTypeVersionedPut:
+		return true
+	}
+	return false
+}
+
 // InternalKey combines the user key with metadata for versioning
 type InternalKey struct {
 	UserKey string
 	SeqNum  uint64
 	Type    OpType
 }
+
+// internalKeyComparatorName is recorded in the properties of every SSTable
+const internalKeyComparatorName = "leveldb.InternalKeyComparator"
+
 type internalKeyComparable struct{}
 
 // implement to be an interface, not used
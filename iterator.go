@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"math"
+	"os"
+)
+
+// internalIterator is implemented by every source the merge iterator reads from
+// (memtables and SSTables). Entries come out in InternalKey order.
+type internalIterator interface {
+	Next() bool
+	Key() InternalKey
+	Value() []byte
+	Error() error
+	Close() error
+}
+
+// memTableIterator walks a copy of the memtable taken at construction time,
+// so writers are never blocked by a slow reader.
+type memTableIterator struct {
+	keys   []InternalKey
+	values [][]byte
+	pos    int
+}
+
+// newMemTableIterator copies every entry in [start, end) with a sequence number
+// <= maxSeq. A nil start or end leaves that side of the range unbounded.
+func newMemTableIterator(m MemTable, maxSeq uint64, start, end []byte) *memTableIterator {
+	it := &memTableIterator{pos: -1}
+	e := m.Iterator()
+	defer e.Close()
+	if start != nil {
+		e.Seek(InternalKey{UserKey: string(start), SeqNum: math.MaxUint64})
+	}
+	for e.Next() {
+		ik := e.Key()
+		if end != nil && ik.UserKey >= string(end) {
+			break
+		}
+		//written after the snapshot, invisible to this iterator
+		if ik.SeqNum > maxSeq {
+			continue
+		}
+		it.keys = append(it.keys, ik)
+		it.values = append(it.values, e.Value())
+	}
+	return it
+}
+
+func (it *memTableIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+func (it *memTableIterator) Key() InternalKey { return it.keys[it.pos] }
+func (it *memTableIterator) Value() []byte    { return it.values[it.pos] }
+func (it *memTableIterator) Error() error     { return nil }
+func (it *memTableIterator) Close() error     { return nil }
+
+// Iterator walks the database in ascending user key order. For each user key
+// only the newest version visible at the iterator's snapshot is returned, and
+// deleted keys are skipped.
+type Iterator struct {
+	//snapshot: writes with a higher sequence number are invisible
+	seqNum uint64
+	//bounds of the key range, nil when unbounded
+	start   []byte
+	end     []byte
+	sources []internalIterator
+	h       *minHeap
+	//range deletes of the memtables visible at seqNum
+	rangeDels []RangeTombstone
+
+	key   []byte
+	value []byte
+	//reference of the current value when it is in a blob file, read by Value
+	blobRef []byte
+	blobs   *blobStore
+	//user timestamp of the current entry, 0 unless written by PutWithVersion
+	userTs      uint64
+	lastUserKey string
+	hasLast     bool
+	err         error
+}
+
+// IteratorOptions configures NewIterator. The zero value iterates every key as
+// of the NewIterator call.
+type IteratorOptions struct {
+	// Snapshot makes the iterator read the DB as of a snapshot from GetSnapshot
+	// instead of as of the NewIterator call.
+	Snapshot *Snapshot
+	// LowerBound and UpperBound restrict the iterator to the user keys in
+	// [LowerBound, UpperBound). nil leaves that side unbounded.
+	LowerBound []byte
+	UpperBound []byte
+	// FillCache adds the data blocks the iterator reads to Options.BlockCache.
+	// Blocks already cached are used either way. Leave it unset for large scans
+	// so they do not evict the blocks of point lookups.
+	FillCache bool
+}
+
+// NewIterator returns an iterator over a consistent view of the database: the
+// memtables are copied and the SSTables opened when it is called, so later
+// writes, flushes and compactions are not seen. The caller must call Close when
+// done.
+func (db *DB) NewIterator(opts IteratorOptions) (*Iterator, error) {
+	return db.newIteratorWithOptions(opts, nil)
+}
+
+// NewPrefixIterator returns an iterator over the keys starting with prefix. When
+// prefix is a whole prefix of Options.PrefixExtractor, SSTables whose prefix
+// filter rules it out are skipped.
+func (db *DB) NewPrefixIterator(prefix []byte) (*Iterator, error) {
+	var filterPrefix []byte
+	if e := db.opts.PrefixExtractor; e != nil && bytes.Equal(e.Transform(prefix), prefix) {
+		filterPrefix = prefix
+	}
+	return db.newIterator(prefix, prefixEnd(prefix), filterPrefix)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// newIterator is NewIterator restricted to the user keys in [start, end),
+// filling the block cache. A nil start or end leaves that side unbounded.
+func (db *DB) newIterator(start, end, filterPrefix []byte) (*Iterator, error) {
+	return db.newIteratorWithOptions(IteratorOptions{LowerBound: start, UpperBound: end, FillCache: true}, filterPrefix)
+}
+
+// newIteratorWithOptions is NewIterator. SSTables whose key range does not
+// overlap the bounds are not opened, the others start at the block holding the
+// lower bound. With a filterPrefix, SSTables whose prefix filter rules it out
+// are closed again. A table removed by a compaction before it could be opened
+// makes it start over from the current tables.
+func (db *DB) newIteratorWithOptions(opts IteratorOptions, filterPrefix []byte) (*Iterator, error) {
+	start, end := opts.LowerBound, opts.UpperBound
+	db.mu.RLock()
+	seqNum := db.sequenceNum.Load()
+	if opts.Snapshot != nil {
+		seqNum = opts.Snapshot.seqNum
+	}
+	mem := db.mem
+	imm := db.immutableMem
+	var activeTables []int
+	for _, sstNum := range db.activeSSTables {
+		if props, ok := db.tableProps[sstNum]; ok && (!props.overlaps(start, end) || props.NumEntries > 0 && props.SmallestSeq > seqNum) {
+			continue
+		}
+		activeTables = append(activeTables, sstNum)
+	}
+	db.mu.RUnlock()
+
+	it := &Iterator{
+		seqNum: seqNum,
+		start:  start,
+		end:    end,
+		h:      &minHeap{},
+		blobs:  db.blobs,
+	}
+	it.sources = append(it.sources, newMemTableIterator(mem, seqNum, start, end))
+	it.rangeDels = mem.RangeTombstones(seqNum)
+	if imm != nil {
+		it.sources = append(it.sources, newMemTableIterator(imm, seqNum, start, end))
+		it.rangeDels = append(it.rangeDels, imm.RangeTombstones(seqNum)...)
+	}
+	for _, sstNum := range activeTables {
+		ssTablePath := fmt.Sprintf("%s/%05d.sst", db.dataDir, sstNum)
+		reader, err := db.openSSTable(sstNum)
+		if err != nil {
+			it.Close()
+			if os.IsNotExist(err) && !db.isActiveSSTable(sstNum) {
+				//a compaction replaced the table after the snapshot, start over
+				//from the current set, which holds the table's entries
+				return db.newIteratorWithOptions(opts, filterPrefix)
+			}
+			return nil, fmt.Errorf("failed to open SSTable %s: %w", ssTablePath, err)
+		}
+		if filterPrefix != nil && !reader.mayContainPrefix(filterPrefix) {
+			reader.Close()
+			continue
+		}
+		reader.skipCacheFill = !opts.FillCache
+		tableIt := reader.NewIterator(seqNum)
+		if start != nil {
+			tableIt.seek(start)
+		}
+		it.sources = append(it.sources, tableIt)
+	}
+	heap.Init(it.h)
+	for _, src := range it.sources {
+		it.push(src)
+	}
+	return it, nil
+}
+
+// rangeDeleted reports whether a range delete visible to the iterator covers
+// the version of a key at key.SeqNum
+func (it *Iterator) rangeDeleted(key InternalKey) bool {
+	for _, t := range it.rangeDels {
+		if t.covers(key.UserKey, key.SeqNum, it.seqNum) {
+			return true
+		}
+	}
+	return false
+}
+
+// push advances src and, if it has an entry, adds it to the merge heap.
+func (it *Iterator) push(src internalIterator) {
+	if src.Next() {
+		heap.Push(it.h, &heapItem{
+			key:      src.Key(),
+			value:    src.Value(),
+			iterator: src,
+		})
+	}
+}
+
+// Next moves to the next live key. It returns false when the iterator is
+// exhausted or an error occurred; check Error to tell them apart.
+func (it *Iterator) Next() bool {
+	for it.h.Len() > 0 {
+		item := heap.Pop(it.h).(*heapItem)
+		if it.end != nil && item.key.UserKey >= string(it.end) {
+			//every remaining entry is past the range
+			heap.Push(it.h, item)
+			break
+		}
+		it.push(item.iterator)
+		if it.start != nil && item.key.UserKey < string(it.start) {
+			continue
+		}
+		if it.hasLast && item.key.UserKey == it.lastUserKey {
+			//older version of a key we already handled
+			continue
+		}
+		it.lastUserKey = item.key.UserKey
+		it.hasLast = true
+		if item.key.Type == OpTypeDelete || it.rangeDeleted(item.key) {
+			continue
+		}
+		it.key = []byte(item.key.UserKey)
+		it.value = item.value
+		it.blobRef = nil
+		it.userTs = 0
+		switch item.key.Type {
+		case OpTypeBlobIndex:
+			it.value, it.blobRef = nil, item.value
+		case OpTypeVersionedPut:
+			userTs, value, err := decodeVersionedValue(item.value)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.userTs, it.value = userTs, value
+		}
+		return true
+	}
+	for _, src := range it.sources {
+		if err := src.Error(); err != nil {
+			it.err = err
+			break
+		}
+	}
+	return false
+}
+
+// Key returns the user key of the current entry.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current entry. A value in a blob file is read
+// on the first call; if that fails, Value returns nil and Error the failure.
+func (it *Iterator) Value() []byte {
+	if it.blobRef != nil && it.value == nil && it.err == nil {
+		value, err := it.blobs.read(it.blobRef)
+		if err != nil {
+			it.err = err
+			return nil
+		}
+		it.value = value
+	}
+	return it.value
+}
+
+// Version returns the user timestamp the current entry was written with by
+// PutWithVersion, or 0.
+func (it *Iterator) Version() uint64 {
+	return it.userTs
+}
+
+// Error returns the first error encountered while iterating, if any.
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Close releases the files held by the iterator.
+func (it *Iterator) Close() error {
+	var firstErr error
+	for _, src := range it.sources {
+		if err := src.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.sources = nil
+	return firstErr
+}
+
+// keysChanBuffer is the buffer size of the channel returned by KeysChan
+const keysChanBuffer = 128
+
+// Keys returns the live user keys in [start, end) in ascending order, without
+// their values. A nil start or end leaves that side of the range unbounded.
+func (db *DB) Keys(start, end []byte) ([][]byte, error) {
+	var keys [][]byte
+	keyCh, errCh := db.KeysChan(start, end)
+	for key := range keyCh {
+		keys = append(keys, key)
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeysChan is the streaming variant of Keys: keys are sent in ascending order
+// on the first channel, which is closed when the range is exhausted. The error
+// channel then receives the iteration error, if any, and is closed. The caller
+// must drain the key channel, otherwise the goroutine producing it never exits.
+func (db *DB) KeysChan(start, end []byte) (<-chan []byte, <-chan error) {
+	keyCh := make(chan []byte, keysChanBuffer)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		defer close(keyCh)
+		it, err := db.newIterator(start, end, nil)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer it.Close()
+		for it.Next() {
+			keyCh <- it.Key()
+		}
+		if err := it.Error(); err != nil {
+			errCh <- err
+		}
+	}()
+	return keyCh, errCh
+}
+
+// KeyValue is a key and its value, as returned by Range
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+// Range returns up to limit live key/value pairs in [start, end) in ascending
+// key order, from a consistent snapshot. A nil start or end leaves that side of
+// the range unbounded and limit <= 0 means no limit. To page through a range,
+// call Range again with start set to the last returned key plus a zero byte.
+func (db *DB) Range(start, end []byte, limit int) ([]KeyValue, error) {
+	it, err := db.newIterator(start, end, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var result []KeyValue
+	for (limit <= 0 || len(result) < limit) && it.Next() {
+		result = append(result, KeyValue{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RangeScan calls fn for every live key/value pair in [start, end) in ascending
+// key order, from a snapshot taken when it is called, until fn returns false. A
+// nil start or end leaves that side of the range unbounded. Unlike Range nothing
+// is buffered, and no DB lock is held while fn runs, so fn may write to the DB;
+// those writes are not seen by the scan. fn must not keep key or value after it
+// returns.
+func (db *DB) RangeScan(start, end []byte, fn func(key, value []byte) bool) error {
+	it, err := db.newIterator(start, end, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		value := it.Value()
+		if err := it.Error(); err != nil {
+			return err
+		}
+		if !fn(it.Key(), value) {
+			break
+		}
+	}
+	return it.Error()
+}
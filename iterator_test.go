@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIteratorSurvivesConcurrentCompactions(t *testing.T) {
+	db, err := NewDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := db.Keys(nil, nil); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	//every flush adds a table, enough of them start compactions removing their inputs
+	for i := 0; i < 40*SSTableCountThreshold; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if err := <-errs; err != nil {
+		t.Fatalf("Keys during compactions: %v", err)
+	}
+	keys, err := db.Keys(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 40*SSTableCountThreshold {
+		t.Fatalf("Keys returned %d keys, want %d", len(keys), 40*SSTableCountThreshold)
+	}
+}
+
+func TestRangePagination(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	//keys in SSTables and the memtable, some deleted or overwritten after a flush
+	putKeys(t, db, 0, 300)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 300, 500)
+	for i := 0; i < 500; i += 7 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("key00001"), []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 100; i < 400; i++ {
+		if i%7 != 0 {
+			want = append(want, fmt.Sprintf("key%05d", i))
+		}
+	}
+	//pages of [key00100, key00400), each resuming after the last key returned
+	var got []string
+	start := []byte("key00100")
+	for page := 0; ; page++ {
+		if page > len(want) {
+			t.Fatal("pagination does not end")
+		}
+		kvs, err := db.Range(start, []byte("key00400"), 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) > 32 {
+			t.Fatalf("page %d has %d pairs, over the limit", page, len(kvs))
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		for _, kv := range kvs {
+			if want := "value" + string(kv.Key[3:]); string(kv.Value) != want {
+				t.Fatalf("%s = %q, want %q", kv.Key, kv.Value, want)
+			}
+			got = append(got, string(kv.Key))
+		}
+		start = append(kvs[len(kvs)-1].Key, 0)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("pages returned %d keys, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("key %d is %s, want %s", i, got[i], want[i])
+		}
+	}
+	//no limit, and the end is exclusive
+	kvs, err := db.Range([]byte("key00001"), []byte("key00003"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || string(kvs[0].Value) != "updated" || string(kvs[1].Key) != "key00002" {
+		t.Fatalf("Range(key00001, key00003) = %q", kvs)
+	}
+}
+
+func TestRangeScanDuringPuts(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 0, 1000)
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for i := 1000; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			//new keys on both sides of the range and overwrites inside it
+			for _, key := range []string{fmt.Sprintf("a%05d", i), fmt.Sprintf("key%05d", i%1000), fmt.Sprintf("z%05d", i)} {
+				if err := db.Put([]byte(key), []byte("new")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+	start, end := []byte("key00200"), []byte("key00300")
+	for round := 0; round < 20; round++ {
+		n := 0
+		var last []byte
+		err := db.RangeScan(start, end, func(key, value []byte) bool {
+			if bytes.Compare(key, start) < 0 || bytes.Compare(key, end) >= 0 {
+				t.Errorf("RangeScan returned %s outside [%s, %s)", key, start, end)
+				return false
+			}
+			if last != nil && bytes.Compare(key, last) <= 0 {
+				t.Errorf("RangeScan returned %s after %s", key, last)
+				return false
+			}
+			last = bytes.Clone(key)
+			n++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 100 {
+			t.Fatalf("round %d: RangeScan returned %d keys, want 100", round, n)
+		}
+	}
+	close(stop)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	//no lock is held while fn runs, so it may write
+	err := db.RangeScan(start, end, func(key, value []byte) bool {
+		if err := db.Put(append([]byte("copy-"), key...), value); err != nil {
+			t.Errorf("Put from the callback: %v", err)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := db.Keys([]byte("copy-"), []byte("copy.")); err != nil || len(keys) != 100 {
+		t.Fatalf("callback wrote %d keys, %v", len(keys), err)
+	}
+}
+
+// iteratorKeys reads the rest of it as key=value strings
+func iteratorKeys(t *testing.T, it *Iterator) []string {
+	t.Helper()
+	var got []string
+	for it.Next() {
+		got = append(got, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestIteratorIgnoresLaterWritesAndFlushes(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 0, 20)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 20, 40)
+	snap := db.GetSnapshot()
+	defer snap.Release()
+	putKeys(t, db, 40, 50)
+	var want []string
+	for i := 0; i < 50; i++ {
+		want = append(want, fmt.Sprintf("key%05d=value%05d", i, i))
+	}
+
+	it, err := db.NewIterator(IteratorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	atSnapshot, err := db.NewIterator(IteratorOptions{Snapshot: snap, LowerBound: []byte("key00010"), UpperBound: []byte("key00045")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer atSnapshot.Close()
+	//overwrites, deletes and new keys, flushed so the memtables the iterators
+	//captured are gone from the DB
+	if err := db.Put([]byte("key00000"), []byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("key00025")); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 50, 100)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := iteratorKeys(t, it); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("iterator read %v, want %v", got, want)
+	}
+	if got := iteratorKeys(t, atSnapshot); strings.Join(got, " ") != strings.Join(want[10:40], " ") {
+		t.Fatalf("iterator at the snapshot read %v, want %v", got, want[10:40])
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "log"
+
+// Logger receives the log messages of a DB, set through Options.Logger. The
+// default discards everything; use NewStdLogger to log to a standard library
+// logger. Implementations must be safe for concurrent use.
+type Logger interface {
+	// Debugf is called for frequent, low level events, such as every Get
+	Debugf(format string, args ...any)
+	// Infof is called for flushes, compactions and recovery progress
+	Infof(format string, args ...any)
+	// Warnf is called for problems the DB worked around, such as a truncated WAL tail
+	Warnf(format string, args ...any)
+	// Errorf is called for failures, including background ones that also stop writes
+	Errorf(format string, args ...any)
+}
+
+// noopLogger is the Logger used when Options.Logger is nil
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...any) {}
+func (noopLogger) Infof(string, ...any)  {}
+func (noopLogger) Warnf(string, ...any)  {}
+func (noopLogger) Errorf(string, ...any) {}
+
+// stdLogger adapts a *log.Logger, prefixing every message with its level
+type stdLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+// NewStdLogger returns a Logger writing to l. Debug messages are dropped unless
+// debug is set.
+func NewStdLogger(l *log.Logger, debug bool) Logger {
+	return stdLogger{l: l, debug: debug}
+}
+
+func (s stdLogger) Debugf(format string, args ...any) {
+	if s.debug {
+		s.l.Printf("DEBUG: "+format, args...)
+	}
+}
+func (s stdLogger) Infof(format string, args ...any)  { s.l.Printf("INFO: "+format, args...) }
+func (s stdLogger) Warnf(format string, args ...any)  { s.l.Printf("WARNING: "+format, args...) }
+func (s stdLogger) Errorf(format string, args ...any) { s.l.Printf("ERROR: "+format, args...) }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger is a Logger keeping every message with its level
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) { l.record("DEBUG", format, args...) }
+func (l *recordingLogger) Infof(format string, args ...any)  { l.record("INFO", format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...any)  { l.record("WARNING", format, args...) }
+func (l *recordingLogger) Errorf(format string, args ...any) { l.record("ERROR", format, args...) }
+
+// has reports whether a message of level contains substr
+func (l *recordingLogger) has(level, substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, message := range l.messages {
+		if strings.HasPrefix(message, level+": ") && strings.Contains(message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoggerCapturesMessages(t *testing.T) {
+	//nothing may reach the standard logger
+	var std bytes.Buffer
+	log.SetOutput(&std)
+	defer log.SetOutput(os.Stderr)
+
+	logger := &recordingLogger{}
+	opts := DefaultOptions()
+	opts.Logger = logger
+	dir := t.TempDir()
+	db, err := NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 10)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 10, 20)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//a torn write at the end of the WAL is worked around with a warning
+	wal := filepath.Join(dir, activeWalFileName)
+	data, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wal, data[:len(data)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if !logger.has("INFO", "State file not found") {
+		t.Errorf("no info message about the new state file in %q", logger.messages)
+	}
+	if !logger.has("WARNING", "truncating it to the last valid entry") {
+		t.Errorf("no warning about the torn WAL tail in %q", logger.messages)
+	}
+	if std.Len() != 0 {
+		t.Errorf("the standard logger received %q", std.String())
+	}
+}
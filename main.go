@@ -2,17 +2,34 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
 
 func main() {
+	//go run . dump 00001.sst prints every entry stored in an SSTable
+	if len(os.Args) == 3 && os.Args[1] == "dump" {
+		if err := dumpSSTable(os.Stdout, os.Args[2]); err != nil {
+			log.Fatalf("Failed to dump %s: %v", os.Args[2], err)
+		}
+		return
+	}
+	//go run . ls mydb lists the live SSTables of the DB in mydb
+	if len(os.Args) == 3 && os.Args[1] == "ls" {
+		if err := listSSTables(os.Stdout, os.Args[2]); err != nil {
+			log.Fatalf("Failed to list %s: %v", os.Args[2], err)
+		}
+		return
+	}
 	dbDir := "mydb"
 	os.RemoveAll(dbDir)
 
-	db, err := NewDB(dbDir)
+	opts := DefaultOptions()
+	opts.Logger = NewStdLogger(log.Default(), false)
+	db, err := NewDBWithOptions(dbDir, opts)
 	if err != nil {
-		log.Fatal("Failed to create DB: %v", err)
+		log.Fatalf("Failed to create DB: %v", err)
 	}
 
 	log.Println("Writing data to trigger a flush...")
@@ -28,16 +45,60 @@ func main() {
 	log.Println("Finished writing data.")
 	db.Close()
 
-	db2, err := NewDB(dbDir)
+	db2, err := NewDBWithOptions(dbDir, opts)
 	if err != nil {
 		log.Fatalf("Failed to reopen DB: %v", err)
 	}
 	defer db2.Close()
 
 	keyToFind := []byte("key-010")
-	val, ok := db2.Get(keyToFind)
+	val, ok, err := db2.Get(keyToFind)
+	if err != nil {
+		log.Fatalf("Failed to get 'key-010': %v", err)
+	}
 	if !ok {
 		log.Fatalf("Key 'key-010' not found")
 	}
 	log.Println(string(val))
 }
+
+// dumpSSTable writes one line per entry of the SSTable at path: user key,
+// sequence number and type
+func dumpSSTable(w io.Writer, path string) error {
+	reader, err := NewSSTableReaderFromFile(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	keys, err := reader.DumpEntries()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		typ := "put"
+		switch key.Type {
+		case OpTypeDelete:
+			typ = "delete"
+		case OpTypeBlobIndex:
+			typ = "blob"
+		case OpTypeVersionedPut:
+			typ = "versioned"
+		}
+		fmt.Fprintf(w, "%q seq=%d %s\n", key.UserKey, key.SeqNum, typ)
+	}
+	return nil
+}
+
+// listSSTables writes one line per live SSTable of the DB in dir, oldest first
+func listSSTables(w io.Writer, dir string) error {
+	db, err := NewDB(dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, t := range db.SSTables() {
+		fmt.Fprintf(w, "%s level=%d generation=%d size=%d entries=%d keys=[%q, %q] filter-fp=%.4f\n",
+			t.Path, t.Level, t.Generation, t.Size, t.NumEntries, t.SmallestKey, t.LargestKey, t.FilterFalsePositiveRate)
+	}
+	return nil
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"math"
+	"sort"
 	"sync"
-
-	"github.com/huandu/skiplist"
 )
 
 //MemTable
@@ -16,25 +16,240 @@ The data is then stored in a MemTable. The primary role of the MemTable is to
 store recently written data
 	in an ordered fashion in memory.
 Once certain conditions are met, the data is flushed to disk in batches
+
+The DB only uses a memtable through this interface, Options.NewMemTable plugs
+in another implementation, such as an arena-allocated skip list. Writes are
+serialized by the DB, reads may run concurrently with each other and with a
+write.
 */
-type MemTable struct {
+type MemTable interface {
+	// Put adds the version of key.UserKey at key.SeqNum. value is nil for a
+	// delete and holds the encoded user timestamp for a versioned put.
+	Put(key InternalKey, value []byte)
+	// DeleteRange adds a tombstone deleting the versions of every user key in
+	// [start, end) older than seqNum
+	DeleteRange(start, end []byte, seqNum uint64)
+	// Get returns the newest version of key: its value, nil for a delete or a
+	// range delete, and its user timestamp. found is false if the memtable
+	// holds no version of key.
+	Get(key []byte) (value []byte, userTs uint64, found bool)
+	// Iterator returns an iterator over the entries in InternalKey order. It
+	// may block writers until it is closed, so the caller must not call other
+	// methods of the memtable before closing it.
+	Iterator() MemTableIterator
+	// RangeTombstones returns the range deletes with a sequence number <= maxSeq
+	RangeTombstones(maxSeq uint64) []RangeTombstone
+	// ApproximateSize returns the approximate size of the entries in bytes
+	ApproximateSize() int
+	// Len returns the number of entries, every version of a key and every range
+	// delete counting once
+	Len() int
+}
+
+// MemTableIterator walks the entries of a MemTable, see MemTable.Iterator
+type MemTableIterator interface {
+	// Seek positions the iterator so that Next moves to the first entry >= key
+	Seek(key InternalKey)
+	Next() bool
+	Key() InternalKey
+	Value() []byte
+	Close() error
+}
+
+// RangeTombstone deletes the versions of every user key in [Start, End) older
+// than SeqNum
+type RangeTombstone struct {
+	Start, End string
+	SeqNum     uint64
+}
+
+// covers reports whether t deletes the version of userKey at seqNum, as seen
+// by a read at maxSeq
+func (t RangeTombstone) covers(userKey string, seqNum, maxSeq uint64) bool {
+	return t.SeqNum > seqNum && t.SeqNum <= maxSeq && userKey >= t.Start && userKey < t.End
+}
+
+// entriesPutter is implemented by memtables that add the entries of a batch
+// faster than one Put at a time
+type entriesPutter interface {
+	putEntries(entries []*LogEntry)
+}
+
+// putMemTableEntries adds the puts, deletes and range deletes among entries to
+// m, other operations are skipped
+func putMemTableEntries(m MemTable, entries []*LogEntry) {
+	if putter, ok := m.(entriesPutter); ok {
+		putter.putEntries(entries)
+		return
+	}
+	for _, entry := range entries {
+		switch entry.Op {
+		case OpPut:
+			m.Put(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypePut}, entry.Value)
+		case OpDelete:
+			m.Put(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypeDelete}, nil)
+		case OpPutVersioned:
+			m.Put(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypeVersionedPut}, entry.Value)
+		case OpRangeDelete:
+			m.DeleteRange(entry.Key, entry.Value, entry.SeqNum)
+		}
+	}
+}
+
+// memTableHistory returns every version of key held in m, newest first
+func memTableHistory(m MemTable, key []byte) []VersionedValue {
+	var versions []VersionedValue
+	for _, t := range m.RangeTombstones(math.MaxUint64) {
+		if t.covers(string(key), 0, math.MaxUint64) {
+			versions = append(versions, VersionedValue{SeqNum: t.SeqNum, Type: OpTypeDelete})
+		}
+	}
+	it := m.Iterator()
+	it.Seek(InternalKey{UserKey: string(key), SeqNum: math.MaxUint64, Type: OpTypePut})
+	for it.Next() && it.Key().UserKey == string(key) {
+		version := VersionedValue{
+			SeqNum: it.Key().SeqNum,
+			Type:   it.Key().Type,
+			Value:  it.Value(),
+		}
+		if version.Type == OpTypeVersionedPut {
+			version.UserTs, version.Value, _ = decodeVersionedValue(version.Value)
+			version.Type = OpTypePut
+		}
+		versions = append(versions, version)
+	}
+	it.Close()
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].SeqNum > versions[j].SeqNum })
+	return versions
+}
+
+// mapMemTable is the MemTable backed by an OrderedMap
+type mapMemTable struct {
 	mu   sync.RWMutex
-	data *skiplist.SkipList
-	size int //approximate size in bytes
+	data OrderedMap
+	//range deletes, in the order they were added, see DeleteRange
+	rangeDels []RangeTombstone
+	size      int //approximate size in bytes
 }
 
-func NewMemTable() *MemTable {
-	return &MemTable{
-		data: skiplist.New(internalKeyComparable{}),
+// DeleteRange adds a tombstone deleting the versions of every key in
+// [start, end) older than seqNum, in this memtable and in the older memtable
+// and SSTables, until the flush writes a point tombstone for each of them.
+func (m *mapMemTable) DeleteRange(start, end []byte, seqNum uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addRangeDeleteLocked(start, end, seqNum)
+}
+
+func (m *mapMemTable) addRangeDeleteLocked(start, end []byte, seqNum uint64) {
+	m.rangeDels = append(m.rangeDels, RangeTombstone{Start: string(start), End: string(end), SeqNum: seqNum})
+	m.size += len(start) + len(end)
+}
+
+func (m *mapMemTable) RangeTombstones(maxSeq uint64) []RangeTombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var visible []RangeTombstone
+	for _, t := range m.rangeDels {
+		if t.SeqNum <= maxSeq {
+			visible = append(visible, t)
+		}
 	}
+	return visible
 }
-func (m *MemTable) Put(key InternalKey, value []byte) {
+
+// rangeDeletedLocked reports whether a range delete covers the version of
+// userKey at seqNum. Caller must hold m.mu.
+func (m *mapMemTable) rangeDeletedLocked(userKey string, seqNum uint64) bool {
+	for _, t := range m.rangeDels {
+		if t.covers(userKey, seqNum, math.MaxUint64) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewMemTable returns an empty memtable backed by a skip list
+func NewMemTable() MemTable {
+	return NewMemTableWithImpl(MemTableSkipList)
+}
+
+// NewMemTableWithImpl returns an empty memtable backed by the OrderedMap impl selects
+func NewMemTableWithImpl(impl MemTableImpl) MemTable {
+	return NewMemTableWithMap(newOrderedMap(impl))
+}
+
+// NewMemTableWithMap returns a memtable backed by m, which must be empty
+func NewMemTableWithMap(m OrderedMap) MemTable {
+	return &mapMemTable{
+		data: m,
+	}
+}
+func (m *mapMemTable) Put(key InternalKey, value []byte) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.data.Set(key, value)
+	m.data.Set(key, storedValue(key.Type, value))
 	m.size += len(key.UserKey) + len(value)
 }
-func (m *MemTable) Get(key []byte) ([]byte, bool) {
+
+// storedValue returns the value to keep for an entry of type typ: an empty put
+// is stored as a non-nil empty slice, since a nil value reads as a tombstone
+func storedValue(typ OpType, value []byte) []byte {
+	if value == nil && typ != OpTypeDelete {
+		return []byte{}
+	}
+	return value
+}
+
+// putEntries adds the puts, deletes and range deletes among entries under a
+// single lock acquisition, other operations are skipped
+func (m *mapMemTable) putEntries(entries []*LogEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if setter, ok := m.data.(sortedRunSetter); ok && isSortedPutRun(entries) {
+		keys := make([]InternalKey, len(entries))
+		values := make([][]byte, len(entries))
+		for i, entry := range entries {
+			keys[i] = InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypePut}
+			values[i] = storedValue(OpTypePut, entry.Value)
+			m.size += len(entry.Key) + len(entry.Value)
+		}
+		setter.setSortedRun(keys, values)
+		return
+	}
+	for _, entry := range entries {
+		switch entry.Op {
+		case OpPut:
+			m.data.Set(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypePut}, storedValue(OpTypePut, entry.Value))
+		case OpDelete:
+			m.data.Set(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypeDelete}, nil)
+		case OpPutVersioned:
+			m.data.Set(InternalKey{UserKey: string(entry.Key), SeqNum: entry.SeqNum, Type: OpTypeVersionedPut}, entry.Value)
+		case OpRangeDelete:
+			m.addRangeDeleteLocked(entry.Key, entry.Value, entry.SeqNum)
+			continue
+		default:
+			continue
+		}
+		m.size += len(entry.Key) + len(entry.Value)
+	}
+}
+
+// isSortedPutRun reports whether entries are puts of strictly ascending keys,
+// which are then in InternalKey order whatever their sequence numbers
+func isSortedPutRun(entries []*LogEntry) bool {
+	for i, entry := range entries {
+		if entry.Op != OpPut {
+			return false
+		}
+		if i > 0 && bytes.Compare(entries[i-1].Key, entry.Key) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *mapMemTable) Get(key []byte) ([]byte, uint64, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	searchKey := InternalKey{
@@ -43,28 +258,100 @@ func (m *MemTable) Get(key []byte) ([]byte, bool) {
 		Type:    OpTypePut,
 	}
 	element := m.data.Find(searchKey)
-	if element == nil {
-		return nil, false //not found
+	if element == nil || element.Key().UserKey != string(key) {
+		//not found, unless a range delete hides the older versions
+		return nil, 0, m.rangeDeletedLocked(string(key), 0)
 	}
-	foundKey := element.Key().(InternalKey)
-	if foundKey.UserKey != string(key) {
-		return nil, false //not a match
+	foundKey := element.Key()
+	if foundKey.Type == OpTypeDelete || m.rangeDeletedLocked(foundKey.UserKey, foundKey.SeqNum) {
+		return nil, 0, true //delete operation, so don't have value
 	}
-	if foundKey.Type == OpTypeDelete {
-		return nil, true //delete operation, so don't have value
+	if foundKey.Type == OpTypeVersionedPut {
+		//the timestamp was checked before the entry reached the memtable
+		userTs, val, _ := decodeVersionedValue(element.Value())
+		return val, userTs, true
 	}
-	return element.Value.([]byte), true
+	return element.Value(), 0, true
 }
 
-// remove a key
-func (m *MemTable) Delete(key []byte) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if oldElement := m.data.Remove(key); oldElement != nil {
-		oldValue := oldElement.Value.([]byte)
-		m.size -= len(key) + len(oldValue)
-	}
+func (m *mapMemTable) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.data.Len() + len(m.rangeDels)
 }
-func (m *MemTable) ApproximateSize() int {
+
+func (m *mapMemTable) ApproximateSize() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.size
 }
+
+// Iterator holds the read lock of m until the iterator is closed
+func (m *mapMemTable) Iterator() MemTableIterator {
+	m.mu.RLock()
+	return &mapMemTableIterator{m: m, next: m.data.Front()}
+}
+
+type mapMemTableIterator struct {
+	m      *mapMemTable
+	next   MapEntry
+	cur    MapEntry
+	closed bool
+}
+
+func (it *mapMemTableIterator) Seek(key InternalKey) { it.next = it.m.data.Find(key) }
+
+func (it *mapMemTableIterator) Next() bool {
+	it.cur = it.next
+	if it.cur == nil {
+		return false
+	}
+	it.next = it.cur.Next()
+	return true
+}
+func (it *mapMemTableIterator) Key() InternalKey { return it.cur.Key() }
+func (it *mapMemTableIterator) Value() []byte    { return it.cur.Value() }
+
+func (it *mapMemTableIterator) Close() error {
+	if !it.closed {
+		it.closed = true
+		it.m.mu.RUnlock()
+	}
+	return nil
+}
+
+// memTableSource feeds the entries of a memtable that is no longer written to,
+// such as an immutable memtable being flushed, to WriteSSTable, merged with the
+// point tombstones its range deletes turn into. Close releases the memtable.
+type memTableSource struct {
+	it      MemTableIterator
+	hasNext bool
+	//point tombstones in InternalKey order, see DB.rangeDeletePoints
+	deletes []InternalKey
+	key     InternalKey
+	value   []byte
+}
+
+func newMemTableSource(m MemTable, deletes []InternalKey) *memTableSource {
+	s := &memTableSource{it: m.Iterator(), deletes: deletes}
+	s.hasNext = s.it.Next()
+	return s
+}
+
+func (s *memTableSource) Next() bool {
+	switch {
+	case s.hasNext && (len(s.deletes) == 0 || internalKeyComparable{}.Compare(s.it.Key(), s.deletes[0]) < 0):
+		s.key, s.value = s.it.Key(), s.it.Value()
+		s.hasNext = s.it.Next()
+	case len(s.deletes) > 0:
+		s.key, s.value = s.deletes[0], nil
+		s.deletes = s.deletes[1:]
+	default:
+		return false
+	}
+	return true
+}
+func (s *memTableSource) Key() InternalKey { return s.key }
+func (s *memTableSource) Value() []byte    { return s.value }
+func (s *memTableSource) Error() error     { return nil }
+func (s *memTableSource) Close() error     { return s.it.Close() }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+var memTableImpls = map[string]MemTableImpl{
+	"skip list":    MemTableSkipList,
+	"sorted array": MemTableSortedArray,
+}
+
+func TestMemTableImpls(t *testing.T) {
+	for name, impl := range memTableImpls {
+		t.Run(name, func(t *testing.T) {
+			m := NewMemTableWithImpl(impl)
+			rng := rand.New(rand.NewSource(1))
+			latest := make(map[string]string)
+			//reads between writes, so the sorted array re-sorts
+			for seq := uint64(1); seq <= 2000; seq++ {
+				key := fmt.Sprintf("key%04d", rng.Intn(500))
+				if rng.Intn(5) == 0 {
+					m.Put(InternalKey{UserKey: key, SeqNum: seq, Type: OpTypeDelete}, nil)
+					delete(latest, key)
+				} else {
+					value := fmt.Sprintf("value%d", seq)
+					m.Put(InternalKey{UserKey: key, SeqNum: seq, Type: OpTypePut}, []byte(value))
+					latest[key] = value
+				}
+				if seq%100 == 0 {
+					checkMemTable(t, m, latest)
+				}
+			}
+			if m.Len() != 2000 {
+				t.Fatalf("Len() = %d, want every version of the 2000 writes", m.Len())
+			}
+		})
+	}
+}
+
+// checkMemTable checks that m returns the value in latest for every key it may hold
+func checkMemTable(t *testing.T, m MemTable, latest map[string]string) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		value, _, found := m.Get([]byte(key))
+		want, live := latest[key]
+		if live && (!found || string(value) != want) {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, value, found, want)
+		}
+		if !live && found && value != nil {
+			t.Fatalf("Get(%s) = %q for a deleted or absent key", key, value)
+		}
+	}
+}
+
+// countingMemTable is a MemTable of another implementation that counts its
+// writes. Embedding the interface hides the batch fast path of the default one.
+type countingMemTable struct {
+	MemTable
+	writes *atomic.Int64
+}
+
+func (m countingMemTable) Put(key InternalKey, value []byte) {
+	m.writes.Add(1)
+	m.MemTable.Put(key, value)
+}
+
+func (m countingMemTable) DeleteRange(start, end []byte, seqNum uint64) {
+	m.writes.Add(1)
+	m.MemTable.DeleteRange(start, end, seqNum)
+}
+
+func TestDBUsesPluggedMemTable(t *testing.T) {
+	var writes atomic.Int64
+	opts := DefaultOptions()
+	opts.NewMemTable = func() MemTable {
+		return countingMemTable{MemTable: NewMemTableWithImpl(MemTableSortedArray), writes: &writes}
+	}
+	db, dir := openTestDB(t, opts)
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+	b := NewWriteBatch()
+	b.Put([]byte("key9"), []byte("batch"))
+	b.DeleteRange([]byte("key1"), []byte("key3"))
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := writes.Load(); got != 13 {
+		t.Fatalf("%d writes reached the plugged memtable, want 13", got)
+	}
+	check := func() {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key%d", i)
+			want := "value"
+			switch {
+			case i < 3:
+				want = ""
+			case i == 9:
+				want = "batch"
+			}
+			got, found, err := db.Get([]byte(key))
+			if err != nil || found != (want != "") || string(got) != want {
+				t.Fatalf("Get(%s) = %q, found %v, err %v, want %q", key, got, found, err, want)
+			}
+		}
+		it, err := db.NewIterator(IteratorOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		n := 0
+		for it.Next() {
+			n++
+		}
+		if n != 7 {
+			t.Fatalf("the iterator returned %d keys, want 7", n)
+		}
+	}
+	check()
+	//the WAL is replayed into a plugged memtable
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writes.Store(0)
+	db, err := NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if writes.Load() == 0 {
+		t.Fatal("the WAL was not replayed into the plugged memtable")
+	}
+	check()
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// BenchmarkMemTable compares the memtable implementations for 1M random writes,
+// then 1M random reads of the written keys
+func BenchmarkMemTable(b *testing.B) {
+	const n = 1_000_000
+	keys := make([][]byte, n)
+	rng := rand.New(rand.NewSource(1))
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%010d", rng.Int63()))
+	}
+	value := []byte("value")
+	for name, impl := range memTableImpls {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m := NewMemTableWithImpl(impl)
+				for seq, key := range keys {
+					m.Put(InternalKey{UserKey: string(key), SeqNum: uint64(seq + 1), Type: OpTypePut}, value)
+				}
+				for j := 0; j < n; j++ {
+					if _, _, found := m.Get(keys[rng.Intn(n)]); !found {
+						b.Fatal("a written key was not found")
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemTableInsert inserts 1M keys into an empty memtable of every
+// implementation, reporting the allocations a cheaper one should cut
+func BenchmarkMemTableInsert(b *testing.B) {
+	const n = 1_000_000
+	keys := make([]string, n)
+	rng := rand.New(rand.NewSource(1))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%010d", rng.Int63())
+	}
+	value := []byte("value")
+	for name, impl := range memTableImpls {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m := NewMemTableWithImpl(impl)
+				for seq, key := range keys {
+					m.Put(InternalKey{UserKey: key, SeqNum: uint64(seq + 1), Type: OpTypePut}, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// Sources of a Get reported to Metrics.OnGet
+const (
+	GetSourceMemtable  = "memtable"
+	GetSourceImmutable = "immutable"
+	GetSourceSSTable   = "sstable"
+	// GetSourceNone means no memtable or SSTable holds the key
+	GetSourceNone = "none"
+)
+
+// Metrics receives callbacks for observability, for instance to export them to
+// Prometheus. Set it through Options.Metrics, a nil Metrics costs nothing.
+// Callbacks run synchronously, flush and compaction ones while the DB holds its
+// lock, so they must be fast and must not call back into the DB.
+type Metrics interface {
+	// OnFlush is called after a memtable was written to an SSTable of bytes bytes
+	OnFlush(bytes int64, duration time.Duration)
+	// OnCompaction is called after in SSTables were merged into out, which
+	// hold bytes bytes. out is 0 when every entry was dropped.
+	OnCompaction(in, out int, bytes int64)
+	// OnWALSync is called after every fsync of the WAL
+	OnWALSync(duration time.Duration)
+	// OnGet is called for every DB.Get. hit reports whether a value was
+	// returned and source is where the lookup ended, one of the GetSource
+	// constants. A key deleted in the memtable is a miss from GetSourceMemtable.
+	OnGet(hit bool, source string)
+}
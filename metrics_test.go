@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// metricsRecorder is a Metrics counting every callback
+type metricsRecorder struct {
+	mu          sync.Mutex
+	flushes     int
+	flushBytes  int64
+	compactions int
+	walSyncs    int
+	gets        map[string]int
+	hits        int
+}
+
+func (m *metricsRecorder) OnFlush(bytes int64, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushes++
+	m.flushBytes += bytes
+}
+
+func (m *metricsRecorder) OnCompaction(in, out int, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compactions++
+}
+
+func (m *metricsRecorder) OnWALSync(duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.walSyncs++
+}
+
+func (m *metricsRecorder) OnGet(hit bool, source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.gets == nil {
+		m.gets = make(map[string]int)
+	}
+	m.gets[source]++
+	if hit {
+		m.hits++
+	}
+}
+
+func TestMetricsCallbacks(t *testing.T) {
+	recorder := &metricsRecorder{}
+	opts := DefaultOptions()
+	opts.Metrics = recorder
+	db, _ := openTestDB(t, opts)
+	//enough flushes for a compaction, then one key left in the memtable
+	flushTables(t, db, SSTableCountThreshold+1)
+	if err := db.WaitForCompaction(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("fresh"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	db.Get([]byte("fresh"))
+	db.Get([]byte("key00000"))
+	db.Get([]byte("missing"))
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.flushes != SSTableCountThreshold+1 || recorder.flushBytes == 0 {
+		t.Fatalf("%d flushes of %d bytes reported, want %d", recorder.flushes, recorder.flushBytes, SSTableCountThreshold+1)
+	}
+	if recorder.compactions == 0 {
+		t.Fatal("no compaction reported")
+	}
+	//WALSyncAlways syncs every write
+	if recorder.walSyncs < SSTableCountThreshold+2 {
+		t.Fatalf("%d WAL syncs reported for %d writes", recorder.walSyncs, SSTableCountThreshold+2)
+	}
+	if recorder.gets[GetSourceMemtable] != 1 || recorder.gets[GetSourceSSTable] != 1 || recorder.gets[GetSourceNone] != 1 || recorder.hits != 2 {
+		t.Fatalf("Gets reported by source %v with %d hits, want one per source and 2 hits", recorder.gets, recorder.hits)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import "time"
+
+const (
+	DefaultTombstoneCompactionRatio = 0.3
+	// DefaultBloomBitsPerKey gives a false positive rate of about 1%
+	DefaultBloomBitsPerKey = 10
+	// DefaultCompactionConcurrency runs one compaction at a time
+	DefaultCompactionConcurrency = 1
+)
+
+// Options holds the tunable settings of a DB.
+// Use DefaultOptions to get a valid starting point.
+type Options struct {
+	// TombstoneCompactionRatio is the fraction of tombstones in a single SSTable
+	// above which compaction is scheduled early, even if the table count is
+	// below SSTableCountThreshold. Set to 1 or more to disable.
+	TombstoneCompactionRatio float64
+
+	// UseHashIndex adds a hash index block to new SSTables so point lookups
+	// find their data block in O(1) instead of binary searching the index.
+	// The sorted index is still written and used for range scans.
+	UseHashIndex bool
+
+	// UseMmap memory-maps SSTable files so block reads are served from the
+	// OS page cache without a copy. Falls back to ReadAt where mmap is unavailable.
+	UseMmap bool
+
+	// InMemory keeps all data in the memtable only: no WAL, no SSTables and
+	// no state file are written, and the memtable is never flushed. Nothing
+	// survives the process exiting, so use it for tests and ephemeral caches.
+	// Set FS to NewMemFS() instead to stay in memory but keep the WAL, flushes
+	// and SSTables.
+	InMemory bool
+
+	// Compression is applied to every data block of new SSTables. Blocks that
+	// do not shrink are stored uncompressed.
+	Compression CompressionType
+
+	// BlockSize is the size in bytes, before compression, at which a data block
+	// of new SSTables is cut. Larger blocks shrink the index and speed up scans,
+	// smaller ones read less for each random lookup. 0 means DataBlockSize.
+	BlockSize int
+
+	// BlockRestartInterval is the number of entries between restart points in
+	// a data block. Keys in between only store the suffix they do not share
+	// with the previous key.
+	BlockRestartInterval int
+
+	// ValueChecksums stores a CRC-32 after every value in new SSTables, at a
+	// cost of 4 bytes per entry. Reads fail with a *ValueCorruptedError, which
+	// wraps ErrCorruption, on a mismatch, catching corruption that happened
+	// before the block was written. Tables record whether they have them, so
+	// tables with and without can be mixed.
+	ValueChecksums bool
+
+	// FilterPolicy builds the filter of new SSTables and is used to query it on
+	// reads. nil writes no filter, which saves the hashing for write-heavy or
+	// scan-only workloads where it is pure overhead.
+	FilterPolicy FilterPolicy
+
+	// IndexPartitionEntries is the number of index entries per partition of a
+	// two-level index. Tables with more data blocks than this only keep the
+	// top-level index in memory and read partitions on demand; smaller tables,
+	// or any table when it is 0, use a single-level index.
+	IndexPartitionEntries int
+
+	// FilterPartitionBlocks is the number of data blocks covered by each filter
+	// partition. Tables with more data blocks than this get a filter per group
+	// of blocks instead of a single one; readers keep only the partitions'
+	// locations in memory and read a partition when a lookup reaches its blocks.
+	// 0 always writes a single filter.
+	FilterPartitionBlocks int
+
+	// BlockCache caches decompressed data blocks of SSTables. Several DBs can
+	// share one Cache to stay within a single memory budget. nil disables it.
+	BlockCache *Cache
+
+	// FileLimiter bounds the number of SSTable files open at once, and can
+	// also be shared between DBs. nil means no limit.
+	FileLimiter *FileLimiter
+
+	// CompactionConcurrency is the number of goroutines running compactions.
+	// Jobs never share an input SSTable, so tables flushed while a compaction
+	// runs can be compacted by another worker. Values below 1 mean 1.
+	CompactionConcurrency int
+
+	// StatsLogInterval is how often the "leveldb.stats" property is logged.
+	// 0 disables the periodic stats log.
+	StatsLogInterval time.Duration
+
+	// WALRecoveryMode decides whether a corrupted WAL tail is truncated
+	// (PointInTimeRecovery, the default) or fails NewDB (AbsoluteConsistency),
+	// and whether corruption in the middle of a WAL is skipped
+	// (SkipAnyCorruptedRecords).
+	WALRecoveryMode WALRecoveryMode
+
+	// CompactOnOpen makes NewDB flush the data recovered from the WALs, remove
+	// WALs orphaned by a crash, and compact the SSTables into one, dropping
+	// tombstones. Opening takes longer but starts from a clean state.
+	CompactOnOpen bool
+
+	// PrefixExtractor, when set together with FilterPolicy, adds a filter over
+	// key prefixes to every SSTable. See PrefixExtractor.
+	PrefixExtractor PrefixExtractor
+
+	// WALSyncMode decides when the WAL is synced, see WALSyncMode. The zero
+	// value is WALSyncAlways.
+	WALSyncMode WALSyncMode
+	// WALSyncInterval is the time between background syncs with
+	// WALSyncPeriodic, 0 means DefaultWALSyncInterval
+	WALSyncInterval time.Duration
+	// WALSyncBytes, with WALSyncPeriodic, starts a background sync once that
+	// many bytes were written to the WAL since the last one. 0 only syncs on
+	// the interval.
+	WALSyncBytes int64
+
+	// FlushInterval, when positive, flushes a non-empty memtable in the
+	// background once that long has passed since the last flush, so data
+	// written before an idle period does not wait in the WAL for the memtable
+	// to fill. This bounds how much of the WAL is replayed after a crash.
+	FlushInterval time.Duration
+
+	// WALDir puts the WALs in another directory than the SSTables and state
+	// file, such as one on a faster device. Empty means the data directory. WALs
+	// left in the data directory are replayed and flushed when the DB is opened.
+	WALDir string
+
+	// FS holds the WALs, SSTables and state file. nil means OSFS, NewMemFS
+	// keeps the whole database in memory while still encoding it to files.
+	FS FS
+
+	// MemTableStallSize is the memtable size in bytes at which writes block
+	// while the previous memtable is still being flushed, until that flush
+	// finishes. It bounds memory when writes outpace flushes. 0 never blocks.
+	MemTableStallSize int
+
+	// ParanoidChecks makes NewDB read every live SSTable in full and compare it
+	// with the whole-file checksum in its footer, failing with ErrCorruption on
+	// a mismatch. Opening takes time proportional to the size of the DB.
+	ParanoidChecks bool
+
+	// AsyncSubscribers makes SubscribeFunc call its callback from a goroutine fed
+	// by a buffered channel instead of synchronously in the writing goroutine.
+	// Writers block once a subscriber's buffer is full.
+	AsyncSubscribers bool
+
+	// MemTableImpl selects the data structure of the memtables, see MemTableImpl.
+	// The zero value is MemTableSkipList.
+	MemTableImpl MemTableImpl
+
+	// NewMemTable, when set, returns every new empty memtable instead of one
+	// backed by the OrderedMap MemTableImpl selects, to plug in another
+	// implementation, such as an arena-allocated skip list that allocates less.
+	// NewMemTableWithMap wraps any other OrderedMap.
+	NewMemTable func() MemTable
+
+	// EnableBlobFiles separates large values from their keys: at flush, values
+	// of at least MinBlobSize bytes are appended to a blob file and the SSTable
+	// only stores where to find them, so compactions stop rewriting them. Get and
+	// iterators read them back transparently. Blob files whose fraction of dead
+	// data exceeds BlobGCRatio have their live values rewritten after a compaction.
+	EnableBlobFiles bool
+	MinBlobSize     int
+	BlobGCRatio     float64
+
+	// UserTimestampOrdering makes PutWithVersion drop a write whose user
+	// timestamp is below the one of the key's current value, so the highest
+	// user timestamp wins instead of the latest write.
+	UserTimestampOrdering bool
+
+	// Logger receives the DB's log messages. nil discards them.
+	Logger Logger
+
+	// Metrics receives callbacks on flushes, compactions, WAL syncs and Gets.
+	// nil disables them.
+	Metrics Metrics
+}
+
+// fileSystem returns the FS to use, OSFS unless Options.FS is set
+func (o *Options) fileSystem() FS {
+	if o.FS == nil {
+		return OSFS
+	}
+	return o.FS
+}
+
+// walDir returns the directory of the WALs of the DB in dataDir
+func (o *Options) walDir(dataDir string) string {
+	if o.WALDir == "" {
+		return dataDir
+	}
+	return o.WALDir
+}
+
+// logger returns the Logger to use, a no-op one unless Options.Logger is set
+func (o *Options) logger() Logger {
+	if o.Logger == nil {
+		return noopLogger{}
+	}
+	return o.Logger
+}
+
+// newMemTable returns an empty memtable of the configured implementation
+func (o *Options) newMemTable() MemTable {
+	if o.NewMemTable != nil {
+		return o.NewMemTable()
+	}
+	return NewMemTableWithImpl(o.MemTableImpl)
+}
+
+// DefaultOptions returns the options used by NewDB.
+func DefaultOptions() *Options {
+	return &Options{
+		TombstoneCompactionRatio: DefaultTombstoneCompactionRatio,
+		BlockSize:                DataBlockSize,
+		BlockRestartInterval:     DefaultBlockRestartInterval,
+		IndexPartitionEntries:    DefaultIndexPartitionEntries,
+		FilterPartitionBlocks:    DefaultFilterPartitionBlocks,
+		FilterPolicy:             NewBloomFilterPolicy(DefaultBloomBitsPerKey),
+		CompactionConcurrency:    DefaultCompactionConcurrency,
+		StatsLogInterval:         DefaultStatsLogInterval,
+		WALRecoveryMode:          PointInTimeRecovery,
+		MemTableStallSize:        DefaultMemTableStallSize,
+		MinBlobSize:              DefaultMinBlobSize,
+		BlobGCRatio:              DefaultBlobGCRatio,
+	}
+}
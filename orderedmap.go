@@ -0,0 +1,211 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/huandu/skiplist"
+)
+
+// MemTableImpl selects the OrderedMap holding the entries of every memtable
+type MemTableImpl int
+
+const (
+	// MemTableSkipList keeps entries in a skip list: O(log n) writes and reads
+	// in any order. It is the default.
+	MemTableSkipList MemTableImpl = iota
+	// MemTableSortedArray appends writes to an array that is sorted on the next
+	// read. Writes are cheaper and reads faster once sorted, but a read after a
+	// write re-sorts, so it suits bulk loads followed by reads, not mixed workloads.
+	MemTableSortedArray
+)
+
+// OrderedMap holds the entries of a memtable in InternalKey order. Set is never
+// called concurrently with any other method, the read methods may be called
+// concurrently with each other.
+type OrderedMap interface {
+	// Set adds key, replacing the value of an equal key
+	Set(key InternalKey, value []byte)
+	// Find returns the first entry >= key, or nil if there is none
+	Find(key InternalKey) MapEntry
+	// Front returns the smallest entry, or nil if the map is empty
+	Front() MapEntry
+	Len() int
+}
+
+// sortedRunSetter is implemented by OrderedMaps that add a run of keys in
+// ascending InternalKey order faster than one Set at a time
+type sortedRunSetter interface {
+	setSortedRun(keys []InternalKey, values [][]byte)
+}
+
+// MapEntry is an entry of an OrderedMap. It is only valid until the next Set.
+type MapEntry interface {
+	Key() InternalKey
+	Value() []byte
+	// Next returns the following entry, or nil at the end of the map
+	Next() MapEntry
+}
+
+// newOrderedMap returns an empty map of the given implementation
+func newOrderedMap(impl MemTableImpl) OrderedMap {
+	if impl == MemTableSortedArray {
+		return NewSortedArrayMap()
+	}
+	return NewSkipListMap()
+}
+
+// SkipListMap is an OrderedMap backed by github.com/huandu/skiplist
+type SkipListMap struct {
+	list *skiplist.SkipList
+}
+
+func NewSkipListMap() *SkipListMap {
+	return &SkipListMap{list: skiplist.New(internalKeyComparable{})}
+}
+
+func (m *SkipListMap) Set(key InternalKey, value []byte) {
+	m.list.Set(key, value)
+}
+
+func (m *SkipListMap) Find(key InternalKey) MapEntry {
+	return newSkipListEntry(m.list.Find(key))
+}
+
+func (m *SkipListMap) Front() MapEntry {
+	return newSkipListEntry(m.list.Front())
+}
+
+func (m *SkipListMap) Len() int {
+	return m.list.Len()
+}
+
+type skipListEntry struct {
+	e *skiplist.Element
+}
+
+// newSkipListEntry wraps e, returning an untyped nil for a nil element
+func newSkipListEntry(e *skiplist.Element) MapEntry {
+	if e == nil {
+		return nil
+	}
+	return skipListEntry{e: e}
+}
+
+func (e skipListEntry) Key() InternalKey { return e.e.Key().(InternalKey) }
+func (e skipListEntry) Value() []byte {
+	value, _ := e.e.Value.([]byte)
+	return value
+}
+func (e skipListEntry) Next() MapEntry { return newSkipListEntry(e.e.Next()) }
+
+// SortedArrayMap is an OrderedMap that appends writes and sorts them on the next
+// read, merging them into the already sorted entries
+type SortedArrayMap struct {
+	//guards sorting, which readers do under the memtable's read lock
+	mu      sync.Mutex
+	entries []arrayEntry
+	//entries[:sorted] are sorted and unique, the rest in insertion order
+	sorted int
+	cmp    internalKeyComparable
+}
+
+type arrayEntry struct {
+	key   InternalKey
+	value []byte
+}
+
+func NewSortedArrayMap() *SortedArrayMap {
+	return &SortedArrayMap{}
+}
+
+func (m *SortedArrayMap) Set(key InternalKey, value []byte) {
+	m.entries = append(m.entries, arrayEntry{key: key, value: value})
+}
+
+// setSortedRun appends the run, which needs no sorting if everything already
+// set is sorted and before the run
+func (m *SortedArrayMap) setSortedRun(keys []InternalKey, values [][]byte) {
+	inOrder := m.sorted == len(m.entries) && (len(m.entries) == 0 || len(keys) == 0 ||
+		m.cmp.Compare(m.entries[len(m.entries)-1].key, keys[0]) < 0)
+	for i, key := range keys {
+		m.entries = append(m.entries, arrayEntry{key: key, value: values[i]})
+	}
+	if inOrder {
+		m.sorted = len(m.entries)
+	}
+}
+
+// sort sorts the entries appended since the last read and merges them in. Of
+// equal keys the last one set wins.
+func (m *SortedArrayMap) sort() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sorted == len(m.entries) {
+		return
+	}
+	tail := m.entries[m.sorted:]
+	slices.SortStableFunc(tail, func(a, b arrayEntry) int { return m.cmp.Compare(a.key, b.key) })
+	merged := make([]arrayEntry, 0, len(m.entries))
+	head := m.entries[:m.sorted]
+	for len(head) > 0 || len(tail) > 0 {
+		var next arrayEntry
+		switch {
+		case len(tail) == 0:
+			next, head = head[0], head[1:]
+		case len(head) == 0:
+			next, tail = tail[0], tail[1:]
+		default:
+			c := m.cmp.Compare(head[0].key, tail[0].key)
+			if c < 0 {
+				next, head = head[0], head[1:]
+			} else {
+				if c == 0 {
+					//the newer write replaces the sorted one
+					head = head[1:]
+				}
+				next, tail = tail[0], tail[1:]
+			}
+		}
+		if n := len(merged); n > 0 && m.cmp.Compare(merged[n-1].key, next.key) == 0 {
+			merged[n-1] = next
+			continue
+		}
+		merged = append(merged, next)
+	}
+	m.entries, m.sorted = merged, len(merged)
+}
+
+func (m *SortedArrayMap) Find(key InternalKey) MapEntry {
+	m.sort()
+	i, _ := slices.BinarySearchFunc(m.entries, key, func(e arrayEntry, k InternalKey) int { return m.cmp.Compare(e.key, k) })
+	return m.entry(i)
+}
+
+func (m *SortedArrayMap) Front() MapEntry {
+	m.sort()
+	return m.entry(0)
+}
+
+// Len returns the number of distinct keys
+func (m *SortedArrayMap) Len() int {
+	m.sort()
+	return len(m.entries)
+}
+
+// entry returns the i-th entry, or nil past the end
+func (m *SortedArrayMap) entry(i int) MapEntry {
+	if i >= len(m.entries) {
+		return nil
+	}
+	return arrayMapEntry{m: m, i: i}
+}
+
+type arrayMapEntry struct {
+	m *SortedArrayMap
+	i int
+}
+
+func (e arrayMapEntry) Key() InternalKey { return e.m.entries[e.i].key }
+func (e arrayMapEntry) Value() []byte    { return e.m.entries[e.i].value }
+func (e arrayMapEntry) Next() MapEntry   { return e.m.entry(e.i + 1) }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// repairLogFileName records everything Repair dropped
+const repairLogFileName = "repair.log"
+
+// Repair rewrites the database in dir so that it opens again after partial
+// corruption. Every SSTable listed in the state file is copied to a new table
+// block by block, skipping blocks that fail their checksum or cannot be decoded,
+// and every WAL is truncated at its first bad entry. The state file is then
+// rewritten to list only the repaired tables. The DB must not be open.
+//
+// WARNING: Repair is destructive. Whole blocks are dropped, so readable entries
+// sharing a block with corrupt ones are lost too, as are tables whose index or
+// footer is damaged. Everything dropped is logged to repair.log in dir.
+func Repair(dir string) error {
+	return RepairWithOptions(dir, DefaultOptions())
+}
+
+// RepairWithOptions is Repair with the options the database is opened with,
+// Options.FS in particular
+func RepairWithOptions(dir string, opts *Options) error {
+	fs := opts.fileSystem()
+	fmt.Fprintf(os.Stderr, "WARNING: repairing %s, corrupt data and data sharing a block with it will be dropped, see %s\n",
+		dir, filepath.Join(dir, repairLogFileName))
+	logFile, err := fs.OpenFile(filepath.Join(dir, repairLogFileName), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open repair log: %w", err)
+	}
+	defer logFile.Close()
+	repairLog := log.New(logFile, "", log.LstdFlags)
+	repairLog.Printf("Repair of %s started", dir)
+
+	state, err := loadState(fs, dir, opts.logger())
+	if err != nil {
+		return fmt.Errorf("failed to read state: %w", err)
+	}
+	var repaired, replaced []int
+	generations := make(map[int]int)
+	for _, sstNum := range state.ActiveSSTables {
+		outputNum := state.NextFileNumber
+		state.NextFileNumber++
+		entries, err := repairSSTable(dir, sstNum, outputNum, opts, repairLog)
+		replaced = append(replaced, sstNum)
+		if err != nil {
+			repairLog.Printf("SSTable %d: dropped entirely: %v", sstNum, err)
+			continue
+		}
+		if entries == 0 {
+			repairLog.Printf("SSTable %d: no readable entries, dropped", sstNum)
+			continue
+		}
+		repairLog.Printf("SSTable %d: %d entries copied to %d", sstNum, entries, outputNum)
+		repaired = append(repaired, outputNum)
+		if gen := state.Generations[sstNum]; gen > 0 {
+			generations[outputNum] = gen
+		}
+	}
+
+	for _, walPath := range listWALs(fs, opts.walDir(dir)) {
+		if err := repairWAL(fs, walPath, repairLog); err != nil {
+			return err
+		}
+	}
+
+	state.FormatVersion = DBFormatVersion
+	state.ActiveSSTables = repaired
+	state.Generations = generations
+	if state.ActiveSSTables == nil {
+		state.ActiveSSTables = []int{}
+	}
+	if err := writeState(fs, dir, state); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	//only remove the originals once the state no longer lists them
+	for _, sstNum := range replaced {
+		path := filepath.Join(dir, fmt.Sprintf("%05d.sst", sstNum))
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			repairLog.Printf("Failed to remove replaced SSTable %s: %v", path, err)
+		}
+	}
+	repairLog.Printf("Repair of %s finished, active SSTables: %v", dir, state.ActiveSSTables)
+	return nil
+}
+
+// repairSSTable copies the readable blocks of SSTable sstNum to a new table
+// outputNum, returning the number of entries copied
+func repairSSTable(dir string, sstNum, outputNum int, opts *Options, repairLog *log.Logger) (uint64, error) {
+	r, err := NewSSTableReaderWithOptions(filepath.Join(dir, fmt.Sprintf("%05d.sst", sstNum)), opts)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	outputPath := filepath.Join(dir, fmt.Sprintf("%05d.sst", outputNum))
+	src := &repairSource{r: r, sstNum: sstNum, log: repairLog}
+	meta, err := WriteSSTable(outputPath, uint(r.properties.NumEntries), src, opts)
+	if err != nil {
+		return 0, err
+	}
+	if meta.NumEntries == 0 {
+		opts.fileSystem().Remove(outputPath)
+	}
+	return meta.NumEntries, nil
+}
+
+// repairSource feeds the entries of the readable data blocks of an SSTable to
+// WriteSSTable. A block is only used once all of its entries decoded cleanly.
+type repairSource struct {
+	r        *SSTableReader
+	sstNum   int
+	log      *log.Logger
+	blockIdx int
+	keys     []InternalKey
+	values   [][]byte
+	pos      int
+	//last key returned, entries that are not after it are out of order and dropped
+	last    InternalKey
+	hasLast bool
+}
+
+func (s *repairSource) Next() bool {
+	for {
+		s.pos++
+		if s.pos < len(s.keys) {
+			key := s.keys[s.pos]
+			if s.hasLast && s.r.cmp.Compare(s.last, key) >= 0 {
+				s.log.Printf("SSTable %d: dropped out of order key %q", s.sstNum, key.UserKey)
+				continue
+			}
+			s.last = key
+			s.hasLast = true
+			return true
+		}
+		if s.blockIdx >= s.r.index.Len() {
+			return false
+		}
+		s.loadBlock()
+	}
+}
+
+// loadBlock decodes the next data block, leaving no entries if it is corrupt
+func (s *repairSource) loadBlock() {
+	i := s.blockIdx
+	s.blockIdx++
+	s.keys, s.values, s.pos = s.keys[:0], s.values[:0], -1
+	entry, err := s.r.index.Entry(i)
+	if err != nil {
+		s.log.Printf("SSTable %d: dropped block %d, bad index entry: %v", s.sstNum, i, err)
+		return
+	}
+	data, err := s.r.readDataBlock(entry)
+	if err == nil {
+		var block *blockReader
+		if block, err = newBlockReader(data, s.r.blockFormat); err == nil {
+			for {
+				key, value, nextErr := block.next()
+				if nextErr == io.EOF {
+					break
+				}
+				if nextErr != nil {
+					err = nextErr
+					break
+				}
+				s.keys = append(s.keys, key)
+				s.values = append(s.values, value)
+			}
+		}
+	}
+	if err != nil {
+		s.log.Printf("SSTable %d: dropped block at offset %d (%d bytes): %v", s.sstNum, entry.Offset, entry.Size, err)
+		s.keys, s.values = s.keys[:0], s.values[:0]
+	}
+}
+
+func (s *repairSource) Key() InternalKey { return s.keys[s.pos] }
+func (s *repairSource) Value() []byte    { return s.values[s.pos] }
+func (s *repairSource) Error() error     { return nil }
+
+// repairWAL truncates the WAL at path at its first bad entry
+func repairWAL(fs FS, path string, repairLog *log.Logger) error {
+	before, err := fs.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, _, _, err := replayWAL(fs, path, PointInTimeRecovery, noopLogger{}); err != nil {
+		return fmt.Errorf("failed to repair WAL %s: %w", path, err)
+	}
+	after, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if dropped := before.Size() - after.Size(); dropped > 0 {
+		repairLog.Printf("WAL %s: truncated %d bytes after the last valid entry", path, dropped)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import "sort"
+
+// Snapshot is a point in the history of the DB that iterators can read at,
+// see IteratorOptions. Compactions keep the versions a live snapshot can see,
+// so call Release once it is no longer needed.
+type Snapshot struct {
+	db     *DB
+	seqNum uint64
+}
+
+// GetSnapshot returns a snapshot of the DB as of the last completed write
+func (db *DB) GetSnapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s := &Snapshot{db: db, seqNum: db.sequenceNum.Load()}
+	if db.snapshots == nil {
+		db.snapshots = make(map[*Snapshot]struct{})
+	}
+	db.snapshots[s] = struct{}{}
+	return s
+}
+
+// SeqNum returns the sequence number of the last write the snapshot sees
+func (s *Snapshot) SeqNum() uint64 {
+	return s.seqNum
+}
+
+// Release lets compactions drop the versions only the snapshot could see. The
+// snapshot must not be used afterwards, iterators already reading at it are
+// not affected.
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	delete(s.db.snapshots, s)
+}
+
+// snapshotSeqs returns the sequence numbers of the live snapshots in ascending
+// order. Caller must hold db.mu.
+func (db *DB) snapshotSeqs() []uint64 {
+	seqs := make([]uint64, 0, len(db.snapshots))
+	for s := range db.snapshots {
+		seqs = append(seqs, s.seqNum)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
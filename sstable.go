@@ -5,22 +5,76 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"math"
 	"os"
-	"sort"
-
-	"github.com/bits-and-blooms/bloom/v3"
-	"github.com/huandu/skiplist"
+	"path/filepath"
+	"time"
 )
 
 const (
-	//DataBlockSize groups key-value pairs into block of this size
-	DataBlockSize   = 1 * 1024 * 4 //4KB
+	//DataBlockSize groups key-value pairs into block of this size, the default Options.BlockSize
+	DataBlockSize = 1 * 1024 * 4 //4KB
+	//FooterBlockSize is the size of the length prefix before a gob encoded footer
 	FooterBlockSize = 4
+
+	// sstableMagic starts every SSTable file, followed by a 4-byte format version
+	sstableMagic = "\x57\xfb\x80\x8b\x24\x75\x47\xdb"
+	// SSTableFormatVersion is the file format version written in the header and footer.
+	// Version 0 files predate the header and start directly with data blocks,
+	// version 1 files end with a gob encoded footer instead of the fixed one,
+	// version 2 files have no block checksums, version 3 files no whole-file checksum,
+	// version 4 files no summary: their filter comes before the index.
+	SSTableFormatVersion = 5
+	// blockChecksumSize is the CRC-32 of the stored bytes that follows every data
+	// block since format version 3. IndexEntry.Size includes it.
+	blockChecksumSize = 4
+	// sstableHeaderSize is the magic plus the format version
+	sstableHeaderSize = len(sstableMagic) + 4
+	// fixedFooterSize is the size of the footer written by encodeFooter
+	fixedFooterSize = 4*8 + 4*4 + 2 + 4 + len(sstableMagic)
+	// fileChecksumSize is the CRC-32 in front of the fixed footer since format
+	// version 4. It covers every other byte of the file, footer included, so the
+	// whole file can be checked without decoding it.
+	fileChecksumSize = 4
+	// summaryFormatVersion is the first format version whose blocks loaded at
+	// open, from the index to the hash index, are contiguous and read in one go
+	summaryFormatVersion = 5
 )
 
+// ErrInvalidSSTableFormat is returned when a file is not an SSTable this code can read
+var ErrInvalidSSTableFormat = errors.New("invalid SSTable format")
+
+// ErrCorruption is returned when stored data fails its checksum
+var ErrCorruption = errors.New("data corruption")
+
+// ValueCorruptedError is returned for a value that fails the checksum stored
+// after it with Options.ValueChecksums. It wraps ErrCorruption.
+type ValueCorruptedError struct {
+	Key []byte
+}
+
+// ErrValueCorrupted returns the error for a value of key failing its checksum
+func ErrValueCorrupted(key []byte) error {
+	return &ValueCorruptedError{Key: bytes.Clone(key)}
+}
+
+func (e *ValueCorruptedError) Error() string {
+	return fmt.Sprintf("%v: value checksum mismatch for key %q", ErrCorruption, e.Key)
+}
+
+func (e *ValueCorruptedError) Unwrap() error {
+	return ErrCorruption
+}
+
+// ErrKeyOutOfOrder is returned by SSTableBuilder.Add for a key that does not
+// sort after the previous one
+var ErrKeyOutOfOrder = errors.New("key added out of order")
+
 // IndexEntry stores the last key of a data block and its location in SSTable file
 type IndexEntry struct {
 	LastKey InternalKey
@@ -28,234 +82,1701 @@ type IndexEntry struct {
 	Size    int
 }
 
-// Footer stores the location of the index and filter block
+// Footer stores the location of the index, filter and properties block
 type Footer struct {
-	IndexOffset  int64
-	IndexSize    int
-	FilterOffset int64
-	FilterSize   int
+	IndexOffset      int64
+	IndexSize        int
+	FilterOffset     int64
+	FilterSize       int
+	PropertiesOffset int64
+	PropertiesSize   int
+	IndexFormat      int
+	HashIndexOffset  int64
+	HashIndexSize    int
+	BlockFormat      int
+	//format version the table was written with, 0 for gob encoded footers
+	Version int
+	//whole-file CRC-32, see fileChecksumSize, 0 before version 4
+	FileChecksum uint32
+}
+
+// TableSource feeds WriteSSTable. Entries must come in InternalKey order.
+type TableSource interface {
+	Next() bool
+	Key() InternalKey
+	Value() []byte
+	Error() error
 }
+
+// TableMeta describes an SSTable written by WriteSSTable
+type TableMeta struct {
+	FileNum int
+	//size of the file in bytes
+	Size int64
+	//first and last entry of the table, zero for an empty table
+	Smallest   InternalKey
+	Largest    InternalKey
+	MinSeq     uint64
+	MaxSeq     uint64
+	NumEntries uint64
+	//average size of the data blocks before compression, as a fraction of the block size
+	AvgBlockFill float64
+	Properties   TableProperties
+}
+
+// TableProperties holds statistics collected while the SSTable was written.
+// It is gob encoded, so fields can be added freely: tables written before a
+// field existed read it as the zero value.
+type TableProperties struct {
+	NumEntries   uint64
+	NumDeletions uint64
+	//sum of the user key and value sizes of every entry, before encoding and compression
+	RawKeyBytes   uint64
+	RawValueBytes uint64
+	SmallestSeq   uint64
+	LargestSeq    uint64
+	//smallest and largest user key, LargestKey is empty for tables written before they were recorded
+	SmallestKey string
+	LargestKey  string
+	//unix time in seconds at which the table was written
+	CreationTime int64
+	Comparator   string
+	//name of the FilterPolicy that built the filter block, empty for tables
+	//written before it was recorded, which always used the bloom filter policy
+	FilterPolicy string
+	//name of the PrefixExtractor and location of the prefix filter block, which
+	//follows the filter block. Empty and zero for tables without one.
+	PrefixExtractor    string
+	PrefixFilterOffset int64
+	PrefixFilterSize   int
+	//CRC-32 of the filter and prefix filter blocks, 0 for tables written before
+	//they were recorded, whose filters are used unchecked
+	FilterChecksum       uint32
+	PrefixFilterChecksum uint32
+	//data blocks per filter partition, 0 for tables with a single filter. The
+	//filter block of a partitioned table ends with the partitions' locations,
+	//which FilterChecksum covers, see encodeFilterPartitions. Since format
+	//version 5 it holds nothing else.
+	FilterPartitionBlocks int
+	//bytes of the records, value and checksum, held in each blob file the table
+	//references, by file number
+	BlobBytes map[int]uint64
+	//block size the table was written with, the number of data blocks and their
+	//average size before compression as a fraction of it. Zero for tables written
+	//before they were recorded.
+	BlockSize    int
+	DataBlocks   uint64
+	AvgBlockFill float64
+}
+
+// TombstoneRatio returns the fraction of entries in the table that are delete tombstones
+func (p TableProperties) TombstoneRatio() float64 {
+	if p.NumEntries == 0 {
+		return 0
+	}
+	return float64(p.NumDeletions) / float64(p.NumEntries)
+}
+
+// overlaps reports whether the table may hold user keys in [start, end), a nil
+// start or end leaves that side unbounded. Without recorded keys it returns true.
+func (p TableProperties) overlaps(start, end []byte) bool {
+	if p.LargestKey == "" {
+		return true
+	}
+	if start != nil && p.LargestKey < string(start) {
+		return false
+	}
+	return end == nil || p.SmallestKey < string(end)
+}
+
+// SSTableReader reads an immutable SSTable file. Get, History and NewIterator may
+// be called from many goroutines at once, each returned iterator being used by
+// one goroutine. The fields set when the table is opened are never modified
+// afterwards, and every piece of mutable state is synchronized where it lives:
+//   - blocks are read with ReadAt, or sliced from the read-only mapping, into
+//     per-call or pooled buffers that no two calls share
+//   - the block cache and the index partition cache have their own mutexes
+//   - the filters are decoded when the table is opened, partitions when they
+//     are read under the partitioned filter's mutex, and only queried afterwards
+//
+// Close must not race with any of them.
 type SSTableReader struct {
-	file   *os.File
-	index  []IndexEntry
-	filter *bloom.BloomFilter
-	cmp    internalKeyComparable
+	src  io.ReaderAt
+	size int64
+	//for log messages, the path of tables read from a file
+	name string
+	//nil unless opened from a file, closed by Close
+	file File
+	//whole file mapping when opened with Options.UseMmap, nil otherwise
+	mmap []byte
+	//the blocks loaded at open, read in one go for tables that have a summary,
+	//starting at summaryOffset. readBlock serves reads within it from memory.
+	summary       []byte
+	summaryOffset int64
+	index         tableIndex
+	//nil when the table has no filter or it was built by a policy other than filterPolicy
+	filter filterMatcher
+	//size of the encoded filter, for filterFalsePositiveRate
+	filterSize int
+	//set instead of filter for tables with a partitioned filter
+	partitionedFilter *partitionedFilter
+	filterPolicy      FilterPolicy
+	//nil unless the table has a prefix filter built by prefixExtractor and filterPolicy
+	prefixFilter    filterMatcher
+	prefixExtractor PrefixExtractor
+	properties      TableProperties
+	//entry layout of the data blocks, see block.go
+	blockFormat int
+	//set for tables that follow every data block with a CRC-32, see blockChecksumSize
+	blockChecksums bool
+	//whole-file checksum from the footer, for tables that have one
+	fileChecksum    uint32
+	hasFileChecksum bool
+	//optional, nil when the table was written without a hash index
+	hashIndex hashIndex
+	cmp       internalKeyComparable
+	//optional block cache, set for tables opened through DB.openSSTable
+	cache    *Cache
+	cacheKey blockCacheKey
+	//set for iterators that should not evict cached blocks: blocks are still
+	//served from the cache but not added to it
+	skipCacheFill bool
+	//reads values moved to blob files, set for tables opened through DB.openSSTable
+	blobs *blobStore
+	//released on Close, when the table was opened with Options.FileLimiter
+	limiter *FileLimiter
+	logger  Logger
+}
+
+// WriteSSTable writes the entries of src, which must come in InternalKey order, to
+// a new SSTable at path. itemCount is a hint used to size the hash index. The
+// returned metadata describes the table, FileNum is left for the caller to set.
+// On error the partial file is removed.
+func WriteSSTable(path string, itemCount uint, src TableSource, opts *Options) (TableMeta, error) {
+	b, err := CreateSSTableBuilder(path, itemCount, opts)
+	if err != nil {
+		return TableMeta{}, err
+	}
+	defer b.Abort()
+	for src.Next() {
+		if err := b.Add(src.Key(), src.Value()); err != nil {
+			return TableMeta{}, err
+		}
+	}
+	if err := src.Error(); err != nil {
+		return TableMeta{}, err
+	}
+	return b.Finish()
 }
 
-func WriteSSTable(path string, itemCount uint, it *skiplist.Element) error {
-	file, err := os.Create(path)
+// SSTableBuilder writes an SSTable one entry at a time, for callers that do not
+// have their entries in a memtable. Every builder must end with Finish or Abort;
+// Abort after a successful Finish does nothing, so it can be deferred.
+type SSTableBuilder struct {
+	opts   *Options
+	writer *bufio.Writer
+	//set by CreateSSTableBuilder, the builder then owns the file, written at
+	//path and renamed to finalPath by Finish
+	path      string
+	file      File
+	finalPath string
+	//running checksum of everything written, for the footer
+	hash hash.Hash32
+	//counts the bytes that left writer, see checkPosition
+	written *countingWriter
+	//bytes written so far, where the next block starts
+	offset    int64
+	block     *blockBuilder
+	blockSize int
+	//size of the data blocks written so far, before compression
+	rawBlockBytes int64
+	indexEntries  []IndexEntry
+	filterKeys    [][]byte
+	//end of the keys of every data block written so far in filterKeys
+	filterKeyEnds []int
+	prefixKeys    [][]byte
+	hashBuilder   *hashIndexBuilder
+	props         TableProperties
+	meta          TableMeta
+	cmp           internalKeyComparable
+	//last key added, the block's last key when it is cut
+	lastKey InternalKey
+	//first write error, every later call returns it
+	err      error
+	finished bool
+	aborted  bool
+}
+
+// NewSSTableBuilder returns a builder streaming the table to w, starting with
+// its header. Writes to w are buffered, so its errors may only be returned by a
+// later Add or by Finish. w is neither synced nor closed, and Abort leaves what
+// was written in place. itemCount is a hint used to size the hash index with
+// Options.UseHashIndex.
+func NewSSTableBuilder(w io.Writer, itemCount uint, opts *Options) *SSTableBuilder {
+	h := crc32.NewIEEE()
+	written := &countingWriter{w: io.MultiWriter(w, h)}
+	blockSize := opts.BlockSize
+	if blockSize < 1 {
+		blockSize = DataBlockSize
+	}
+	b := &SSTableBuilder{
+		opts:      opts,
+		writer:    bufio.NewWriter(written),
+		hash:      h,
+		written:   written,
+		offset:    int64(sstableHeaderSize),
+		block:     newBlockBuilder(opts.BlockRestartInterval, opts.ValueChecksums),
+		blockSize: blockSize,
+		props: TableProperties{
+			SmallestSeq:  math.MaxUint64,
+			CreationTime: time.Now().Unix(),
+			Comparator:   internalKeyComparatorName,
+			BlockSize:    blockSize,
+		},
+	}
+	if opts.UseHashIndex {
+		b.hashBuilder = newHashIndexBuilder(itemCount)
+	}
+	//write the header, data blocks start right after it
+	header := make([]byte, sstableHeaderSize)
+	copy(header, sstableMagic)
+	binary.LittleEndian.PutUint32(header[len(sstableMagic):], SSTableFormatVersion)
+	//cannot fail, the header fits in the empty buffer
+	b.writer.Write(header)
+	return b
+}
+
+// CreateSSTableBuilder creates a temporary file next to path in Options.FS and
+// returns a builder writing to it. Finish syncs and closes the file, then renames
+// it to path and syncs the directory, so a crash never leaves a partial table
+// under its final name. Abort closes and removes it.
+func CreateSSTableBuilder(path string, itemCount uint, opts *Options) (*SSTableBuilder, error) {
+	tmpPath := path + tmpFileSuffix
+	file, err := opts.fileSystem().Create(tmpPath)
 	if err != nil {
+		return nil, err
+	}
+	b := NewSSTableBuilder(file, itemCount, opts)
+	b.path, b.file, b.finalPath = tmpPath, file, path
+	return b, nil
+}
+
+// Add appends an entry. Keys must be added in strictly increasing InternalKey
+// order, an out of order key is rejected with ErrKeyOutOfOrder and not added.
+func (b *SSTableBuilder) Add(key InternalKey, value []byte) error {
+	if err := b.usable(); err != nil {
 		return err
 	}
-	defer file.Close()
-	writer := bufio.NewWriter(file)
-	var indexEntries []IndexEntry
-	var currentOffset int64 = 0
-	filter := bloom.NewWithEstimates(itemCount, 0.01)
-	blockBuffer := new(bytes.Buffer)
-	var lastKeyInBlock InternalKey
-
-	for ; it != nil; it = it.Next() {
-		internalKey := it.Key().(InternalKey)
-		value := it.Value.([]byte)
-		filter.Add([]byte(internalKey.UserKey))
-		if blockBuffer.Len() > DataBlockSize {
-			//write data block to SSTable file
-			blockBytes := blockBuffer.Bytes()
-			n, err := writer.Write(blockBytes)
-			if err != nil {
-				return err
-			}
-			indexEntries = append(indexEntries, IndexEntry{
-				LastKey: lastKeyInBlock,
-				Offset:  currentOffset,
-				Size:    n,
-			})
-			currentOffset += int64(n)
-			blockBuffer.Reset()
-		}
-		keyBuf := new(bytes.Buffer)
-		if err := gob.NewEncoder(keyBuf).Encode(internalKey); err != nil {
+	first := b.props.NumEntries == 0
+	if !first && b.cmp.Compare(b.lastKey, key) >= 0 {
+		return fmt.Errorf("%w: %q seq %d after %q seq %d", ErrKeyOutOfOrder, key.UserKey, key.SeqNum, b.lastKey.UserKey, b.lastKey.SeqNum)
+	}
+	if first {
+		b.meta.Smallest = key
+		b.props.SmallestKey = key.UserKey
+	}
+	b.meta.Largest = key
+	b.props.NumEntries++
+	b.props.RawKeyBytes += uint64(len(key.UserKey))
+	b.props.RawValueBytes += uint64(len(value))
+	b.props.LargestKey = key.UserKey
+	b.props.SmallestSeq = min(b.props.SmallestSeq, key.SeqNum)
+	b.props.LargestSeq = max(b.props.LargestSeq, key.SeqNum)
+	if key.Type == OpTypeDelete {
+		b.props.NumDeletions++
+	}
+	if key.Type == OpTypeBlobIndex {
+		ref, err := decodeBlobRef(value)
+		if err != nil {
 			return err
 		}
-		keyBytes := keyBuf.Bytes()
-		binary.Write(blockBuffer, binary.LittleEndian, uint32(len(keyBytes)))
-		binary.Write(blockBuffer, binary.LittleEndian, uint32(len(value)))
-		blockBuffer.Write(keyBytes)
-		blockBuffer.Write(value)
-		lastKeyInBlock = internalKey
+		if b.props.BlobBytes == nil {
+			b.props.BlobBytes = make(map[int]uint64)
+		}
+		b.props.BlobBytes[ref.fileNum] += ref.length + blobChecksumSize
 	}
-	if blockBuffer.Len() > 0 {
-		blockBytes := blockBuffer.Bytes()
-		n, err := writer.Write(blockBytes)
-		if err != nil {
+	//an entry larger than a whole block gets a block of its own, instead of
+	//growing a block of small entries that are then read along with it. Cut
+	//before the filter and hash index bookkeeping below, which attribute the
+	//key to the block being built.
+	if size := b.block.entrySize(key, value); size > b.blockSize && !b.block.Empty() {
+		if err := b.flushBlock(); err != nil {
 			return err
 		}
-		indexEntries = append(indexEntries, IndexEntry{
-			LastKey: lastKeyInBlock,
-			Offset:  currentOffset,
-			Size:    n,
-		})
-		currentOffset += int64(n)
 	}
-	//write the filter block
-	filterOffset := currentOffset
-	filterSize, err := filter.WriteTo(writer)
+	if first || key.UserKey != b.lastKey.UserKey {
+		if b.opts.FilterPolicy != nil {
+			b.filterKeys = append(b.filterKeys, []byte(key.UserKey))
+		}
+		if b.prefixFilters() {
+			//keys are sorted, so equal prefixes are mostly adjacent
+			prefix := b.opts.PrefixExtractor.Transform([]byte(key.UserKey))
+			if prefix != nil && (len(b.prefixKeys) == 0 || !bytes.Equal(prefix, b.prefixKeys[len(b.prefixKeys)-1])) {
+				b.prefixKeys = append(b.prefixKeys, prefix)
+			}
+		}
+		//only the newest version matters for point lookups
+		if b.hashBuilder != nil {
+			b.hashBuilder.Add([]byte(key.UserKey), len(b.indexEntries))
+		}
+	} else if b.block.Empty() && b.opts.FilterPolicy != nil {
+		//a key continuing from the previous block must also be in this block's filter partition
+		b.filterKeys = append(b.filterKeys, []byte(key.UserKey))
+	}
+	b.block.Add(key, value)
+	b.lastKey = key
+	//cut after adding, so the index entry's LastKey is the entry ending the block
+	if b.block.EstimatedSize() >= b.blockSize {
+		return b.flushBlock()
+	}
+	return nil
+}
+
+// EstimatedSize returns the size of the data written so far plus the block
+// being built, excluding the filter, index and footer written by Finish
+func (b *SSTableBuilder) EstimatedSize() int64 {
+	return b.offset + int64(b.block.EstimatedSize())
+}
+
+// NumEntries returns the number of entries added so far
+func (b *SSTableBuilder) NumEntries() uint64 {
+	return b.props.NumEntries
+}
+
+// Finish writes the last data block, the filter, index and properties blocks
+// and the footer and flushes them, then syncs and closes the file of a builder
+// from CreateSSTableBuilder. The returned metadata describes the table, FileNum
+// is left for the caller to set.
+func (b *SSTableBuilder) Finish() (TableMeta, error) {
+	meta, err := b.finish()
 	if err != nil {
-		return err
+		b.err = err
+		return TableMeta{}, err
 	}
-	//write the index block
-	indexOffset := currentOffset + filterSize
-	if err := writer.Flush(); err != nil {
-		return err
+	b.finished = true
+	return meta, nil
+}
+
+func (b *SSTableBuilder) finish() (TableMeta, error) {
+	if err := b.usable(); err != nil {
+		return TableMeta{}, err
 	}
-	indexBuf := new(bytes.Buffer)
-	if err := gob.NewEncoder(indexBuf).Encode(indexEntries); err != nil {
-		return err
+	if !b.block.Empty() {
+		if err := b.flushBlock(); err != nil {
+			return TableMeta{}, err
+		}
 	}
-	indexBytes := indexBuf.Bytes()
-	if _, err := writer.Write(indexBytes); err != nil {
-		return err
+	opts, props, writer := b.opts, &b.props, b.writer
+	if props.NumEntries == 0 {
+		props.SmallestSeq = 0
+	}
+	props.DataBlocks = uint64(len(b.indexEntries))
+	if props.DataBlocks > 0 {
+		props.AvgBlockFill = float64(b.rawBlockBytes) / float64(props.DataBlocks) / float64(b.blockSize)
+	}
+	//the blocks read on demand come first: filter partitions, then index partitions
+	offset := b.offset
+	var filter []byte
+	if opts.FilterPolicy != nil {
+		if blocks := opts.FilterPartitionBlocks; blocks > 0 && len(b.indexEntries) > blocks {
+			partitionsSize, top, err := b.writeFilterPartitions(blocks)
+			if err != nil {
+				return TableMeta{}, err
+			}
+			offset += partitionsSize
+			filter = top
+			props.FilterPartitionBlocks = blocks
+		} else {
+			filter = opts.FilterPolicy.CreateFilter(b.filterKeys)
+		}
+		props.FilterPolicy = opts.FilterPolicy.Name()
+		props.FilterChecksum = crc32.ChecksumIEEE(filter)
+	}
+	//then the summary, everything a reader loads when it opens the table, which
+	//it reads in one go: the (top-level) index, the filter or the top level of a
+	//partitioned filter, the prefix filter, the properties and the hash index
+	if err := b.checkPosition(offset, "index"); err != nil {
+		return TableMeta{}, err
+	}
+	indexFormat, indexOffset, indexSize, err := writeIndex(writer, offset, b.indexEntries, opts.IndexPartitionEntries)
+	if err != nil {
+		return TableMeta{}, err
+	}
+	filterOffset := indexOffset + int64(indexSize)
+	if err := b.checkPosition(filterOffset, "filter"); err != nil {
+		return TableMeta{}, err
+	}
+	if _, err := writer.Write(filter); err != nil {
+		return TableMeta{}, err
+	}
+	filterSize := int64(len(filter))
+	//write the prefix filter block, built by the same policy
+	var prefixFilterSize int64
+	if b.prefixFilters() {
+		if err := b.checkPosition(filterOffset+filterSize, "prefix filter"); err != nil {
+			return TableMeta{}, err
+		}
+		filter := opts.FilterPolicy.CreateFilter(b.prefixKeys)
+		n, err := writer.Write(filter)
+		if err != nil {
+			return TableMeta{}, err
+		}
+		props.PrefixFilterChecksum = crc32.ChecksumIEEE(filter)
+		props.PrefixExtractor = opts.PrefixExtractor.Name()
+		props.PrefixFilterOffset = filterOffset + filterSize
+		props.PrefixFilterSize = n
+		prefixFilterSize = int64(n)
+	}
+	//write the properties block
+	propsBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(propsBuf).Encode(*props); err != nil {
+		return TableMeta{}, err
+	}
+	propsBytes := propsBuf.Bytes()
+	propsOffset := filterOffset + filterSize + prefixFilterSize
+	if err := b.checkPosition(propsOffset, "properties"); err != nil {
+		return TableMeta{}, err
+	}
+	if _, err := writer.Write(propsBytes); err != nil {
+		return TableMeta{}, err
+	}
+	//write the optional hash index block
+	var hashIndexBytes []byte
+	if err := b.checkPosition(propsOffset+int64(len(propsBytes)), "hash index"); err != nil {
+		return TableMeta{}, err
+	}
+	if b.hashBuilder != nil {
+		hashIndexBytes = b.hashBuilder.Finish()
+		if _, err := writer.Write(hashIndexBytes); err != nil {
+			return TableMeta{}, err
+		}
 	}
-	indexSize := len(indexBytes)
 	//write the footer
 	footer := Footer{
-		IndexOffset:  indexOffset,
-		IndexSize:    indexSize,
-		FilterOffset: filterOffset,
-		FilterSize:   int(filterSize),
+		IndexOffset:      indexOffset,
+		IndexSize:        indexSize,
+		FilterOffset:     filterOffset,
+		FilterSize:       int(filterSize),
+		PropertiesOffset: propsOffset,
+		PropertiesSize:   len(propsBytes),
+		IndexFormat:      indexFormat,
+		HashIndexOffset:  propsOffset + int64(len(propsBytes)),
+		HashIndexSize:    len(hashIndexBytes),
+		BlockFormat:      b.block.Format(),
+	}
+	//the file checksum covers everything but itself, flushed so the hash saw it all
+	fixed := encodeFooter(footer)
+	if err := writer.Flush(); err != nil {
+		return TableMeta{}, err
+	}
+	var checksum [fileChecksumSize]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.Update(b.hash.Sum32(), crc32.IEEETable, fixed))
+	if _, err := writer.Write(checksum[:]); err != nil {
+		return TableMeta{}, err
+	}
+	if _, err := writer.Write(fixed); err != nil {
+		return TableMeta{}, err
+	}
+	if err := writer.Flush(); err != nil {
+		return TableMeta{}, err
+	}
+	if b.file != nil {
+		if err := b.file.Sync(); err != nil {
+			return TableMeta{}, err
+		}
+		if err := b.file.Close(); err != nil {
+			return TableMeta{}, err
+		}
+		fs := b.opts.fileSystem()
+		if err := fs.Rename(b.path, b.finalPath); err != nil {
+			return TableMeta{}, err
+		}
+		//Abort removes the table if the rename cannot be made durable
+		b.path = b.finalPath
+		if err := fs.SyncDir(filepath.Dir(b.finalPath)); err != nil {
+			return TableMeta{}, err
+		}
+	}
+	meta := b.meta
+	meta.Size = footer.HashIndexOffset + int64(footer.HashIndexSize) + fileChecksumSize + int64(fixedFooterSize)
+	meta.MinSeq = props.SmallestSeq
+	meta.MaxSeq = props.LargestSeq
+	meta.NumEntries = props.NumEntries
+	meta.AvgBlockFill = props.AvgBlockFill
+	meta.Properties = *props
+	return meta, nil
+}
+
+// Abort stops the builder and, for a builder from CreateSSTableBuilder, closes
+// and removes the partial table. It does nothing after a successful Finish or a
+// previous Abort.
+func (b *SSTableBuilder) Abort() error {
+	if b.finished || b.aborted {
+		return nil
+	}
+	b.aborted = true
+	if b.file == nil {
+		return nil
+	}
+	//the file may already be closed by a failed Finish
+	b.file.Close()
+	if err := b.opts.fileSystem().Remove(b.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// usable returns the error that stops the builder from taking more calls, if any
+func (b *SSTableBuilder) usable() error {
+	switch {
+	case b.err != nil:
+		return b.err
+	case b.finished:
+		return errors.New("SSTable builder already finished")
+	case b.aborted:
+		return errors.New("SSTable builder aborted")
+	}
+	return nil
+}
+
+// prefixFilters reports whether the table gets a prefix filter
+func (b *SSTableBuilder) prefixFilters() bool {
+	return b.opts.FilterPolicy != nil && b.opts.PrefixExtractor != nil
+}
+
+// writeFilterPartitions writes a filter over the keys of every blocks data
+// blocks and returns their size and the top level of the partitioned filter,
+// which the caller writes in the summary and covers with FilterChecksum
+func (b *SSTableBuilder) writeFilterPartitions(blocks int) (int64, []byte, error) {
+	var partitions []filterPartition
+	var size int64
+	for start := 0; start < len(b.filterKeyEnds); start += blocks {
+		first := 0
+		if start > 0 {
+			first = b.filterKeyEnds[start-1]
+		}
+		last := b.filterKeyEnds[min(start+blocks, len(b.filterKeyEnds))-1]
+		filter := b.opts.FilterPolicy.CreateFilter(b.filterKeys[first:last])
+		if _, err := b.writer.Write(filter); err != nil {
+			return 0, nil, err
+		}
+		partitions = append(partitions, filterPartition{
+			offset:   b.offset + size,
+			size:     len(filter),
+			checksum: crc32.ChecksumIEEE(filter),
+		})
+		size += int64(len(filter))
 	}
-	footerBuffer := new(bytes.Buffer)
-	if err := gob.NewEncoder(footerBuffer).Encode(footer); err != nil {
+	return size, encodeFilterPartitions(partitions, blocks), nil
+}
+
+// checkPosition flushes the buffered writes and fails the table unless they end
+// at want, the offset the footer records for the next block, so a size that
+// does not match the bytes actually written cannot skew the layout
+func (b *SSTableBuilder) checkPosition(want int64, block string) error {
+	if err := b.writer.Flush(); err != nil {
 		return err
 	}
-	footerBytes := footerBuffer.Bytes()
-	if _, err := writer.Write(footerBytes); err != nil {
+	if b.written.n != want {
+		return fmt.Errorf("SSTable %s would start at offset %d, but %d bytes were written before it", block, want, b.written.n)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// flushBlock compresses the buffered block, writes it and records it in the index
+func (b *SSTableBuilder) flushBlock() error {
+	raw := b.block.Finish()
+	b.rawBlockBytes += int64(len(raw))
+	stored, err := compressBlock(raw, b.opts.Compression)
+	if err != nil {
+		b.err = err
 		return err
 	}
-	footerSizeUint := uint32(len(footerBytes))
-	if err := binary.Write(writer, binary.LittleEndian, footerSizeUint); err != nil {
+	n, err := b.writer.Write(stored)
+	if err != nil {
+		b.err = err
 		return err
 	}
-	if err := writer.Flush(); err != nil {
+	var checksum [blockChecksumSize]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(stored))
+	if _, err := b.writer.Write(checksum[:]); err != nil {
+		b.err = err
 		return err
 	}
-	return file.Sync()
+	n += blockChecksumSize
+	b.indexEntries = append(b.indexEntries, IndexEntry{
+		LastKey: b.lastKey,
+		Offset:  b.offset,
+		Size:    n,
+	})
+	b.offset += int64(n)
+	b.filterKeyEnds = append(b.filterKeyEnds, len(b.filterKeys))
+	b.block.Reset()
+	return nil
 }
 
+// Get returns the newest value of userKey in the table and whether the key was
+// found; a found key with a nil value is a tombstone. It is safe for concurrent use.
 func (r *SSTableReader) Get(userKey []byte) ([]byte, bool, error) {
-	if !r.filter.Test(userKey) {
-		return nil, false, nil
+	return r.GetAt(userKey, math.MaxUint64)
+}
+
+// GetAt is Get as of sequence number maxSeq: it returns the version of userKey
+// with the greatest sequence number <= maxSeq, ignoring newer versions.
+func (r *SSTableReader) GetAt(userKey []byte, maxSeq uint64) ([]byte, bool, error) {
+	val, _, found, err := r.getAtVersion(userKey, maxSeq)
+	return val, found, err
+}
+
+// getAtVersion is GetAt, also returning the user timestamp of a versioned put
+func (r *SSTableReader) getAtVersion(userKey []byte, maxSeq uint64) ([]byte, uint64, bool, error) {
+	if !r.mayContain(userKey) {
+		return nil, 0, false, nil
 	}
 	searchKey := InternalKey{
 		UserKey: string(userKey),
-		SeqNum:  math.MaxInt64,
+		SeqNum:  maxSeq,
 		Type:    OpTypePut,
 	}
-	// find the data block that contains this searchKey
-	blockIndex := sort.Search(len(r.index), func(i int) bool {
-		return r.cmp.Compare(r.index[i].LastKey, searchKey) >= 0
-	})
-	if blockIndex >= len(r.index) {
-		return nil, false, nil
+	// find the data block that contains this searchKey, through the hash index
+	// when the table has one and the bucket is unambiguous. The hash index points
+	// at the newest version, older ones may be in a later block, so it is only
+	// used when no version in the table is newer than maxSeq.
+	blockIndex := -1
+	if r.hashIndex != nil {
+		switch b := r.hashIndex.Lookup(userKey); b {
+		case hashIndexEmpty:
+			return nil, 0, false, nil
+		case hashIndexCollision:
+		default:
+			if maxSeq == math.MaxUint64 || r.properties.NumEntries > 0 && maxSeq >= r.properties.LargestSeq {
+				blockIndex = int(b)
+			}
+		}
+	}
+	if blockIndex < 0 {
+		var err error
+		blockIndex, err = r.index.Search(searchKey, r.cmp)
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+	if blockIndex >= r.index.Len() || !r.blockMayContain(userKey, blockIndex) {
+		return nil, 0, false, nil
+	}
+	entry, err := r.index.Entry(blockIndex)
+	if err != nil {
+		return nil, 0, false, err
 	}
-	entry := r.index[blockIndex]
-	blockData := make([]byte, entry.Size)
-	_, err := r.file.ReadAt(blockData, entry.Offset)
+	blockData, buf, err := r.readPooledDataBlock(entry)
 	if err != nil {
-		return nil, false, err
+		return nil, 0, false, err
+	}
+	defer putBlockBuffer(buf)
+	block, err := getBlockReader(blockData, r.blockFormat)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer block.release()
+	return r.lookupInBlock(block, userKey, maxSeq, buf != nil)
+}
+
+// lookupInBlock returns the newest version of userKey visible at maxSeq in a
+// data block, like getAtVersion. pooled tells whether the block is in a pooled
+// buffer, whose values must be copied.
+func (r *SSTableReader) lookupInBlock(block *blockReader, userKey []byte, maxSeq uint64, pooled bool) ([]byte, uint64, bool, error) {
+	searchKey := InternalKey{
+		UserKey: string(userKey),
+		SeqNum:  maxSeq,
+		Type:    OpTypePut,
+	}
+	if err := block.seek(searchKey, r.cmp); err != nil {
+		return nil, 0, false, err
 	}
-	reader := bytes.NewReader(blockData)
 	for {
-		var keySize, valueSize uint32
-		if err := binary.Read(reader, binary.LittleEndian, &keySize); err != nil {
-			if err == io.EOF {
-				break
+		e, err := block.nextEntry()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+		c := bytes.Compare(e.userKey, userKey)
+		if c == 0 && e.seqNum > maxSeq {
+			//newer than the requested sequence, an older version may follow
+			continue
+		}
+		if c == 0 {
+			//found the latest version of user key visible at maxSeq
+			if e.typ == OpTypeDelete {
+				return nil, 0, true, nil
+			}
+			if e.typ == OpTypeBlobIndex {
+				value, err := r.readBlob(e.value)
+				return value, 0, err == nil, err
 			}
-			return nil, false, err
+			if e.typ == OpTypeVersionedPut {
+				userTs, value, err := decodeVersionedValue(r.ownedValue(e.value, pooled))
+				return value, userTs, err == nil, err
+			}
+			return r.ownedValue(e.value, pooled), 0, true, nil
 		}
-		if err := binary.Read(reader, binary.LittleEndian, &valueSize); err != nil {
-			return nil, false, err
+		//keys are sorted, so the user key is not in this block
+		if c > 0 {
+			break
 		}
-		keyBytes := make([]byte, keySize)
-		if _, err := io.ReadFull(reader, keyBytes); err != nil {
-			return nil, false, err
+	}
+	return nil, 0, false, nil
+}
+
+// getManyAt looks up keys, which must be sorted, as of maxSeq and calls found
+// with the index in keys of every key the table holds a version of, with a nil
+// value for a tombstone. Keys in the same data block share one read of it.
+func (r *SSTableReader) getManyAt(keys [][]byte, maxSeq uint64, found func(i int, value []byte, userTs uint64)) error {
+	blockIndex := -1
+	var block *blockReader
+	var buf *[]byte
+	release := func() {
+		if block != nil {
+			block.release()
+			block = nil
 		}
-		var ik InternalKey
-		if err := gob.NewDecoder(bytes.NewReader(keyBytes)).Decode(&ik); err != nil {
-			//corrupted key, skip this entry
-			reader.Seek(int64(valueSize), io.SeekCurrent)
+		putBlockBuffer(buf)
+		buf = nil
+	}
+	defer release()
+	for i, userKey := range keys {
+		if !r.mayContain(userKey) {
 			continue
 		}
-		if ik.UserKey == string(userKey) {
-			//found the latest version of user key
-			if ik.Type == OpTypeDelete {
-				return nil, true, nil
+		idx, err := r.index.Search(InternalKey{UserKey: string(userKey), SeqNum: maxSeq, Type: OpTypePut}, r.cmp)
+		if err != nil {
+			return err
+		}
+		if idx >= r.index.Len() || !r.blockMayContain(userKey, idx) {
+			continue
+		}
+		if idx != blockIndex {
+			release()
+			entry, err := r.index.Entry(idx)
+			if err != nil {
+				return err
 			}
-			valueBuf := make([]byte, valueSize)
-			if _, err := io.ReadFull(reader, valueBuf); err != nil {
-				return nil, false, err
+			var blockData []byte
+			if blockData, buf, err = r.readPooledDataBlock(entry); err != nil {
+				return err
+			}
+			if block, err = getBlockReader(blockData, r.blockFormat); err != nil {
+				return err
 			}
-			return valueBuf, true, nil
+			blockIndex = idx
 		}
-		//key didn't match, so skip over the value to get to the next entry
-		if _, err := reader.Seek(int64(valueSize), io.SeekCurrent); err != nil {
-			return nil, false, err
+		value, userTs, ok, err := r.lookupInBlock(block, userKey, maxSeq, buf != nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			found(i, value, userTs)
+		}
+	}
+	return nil
+}
+
+// History returns every version of userKey stored in the table, newest first.
+// Versions of a key can span data blocks, so it keeps reading blocks until it
+// passes the key.
+func (r *SSTableReader) History(userKey []byte) ([]VersionedValue, error) {
+	if !r.mayContain(userKey) {
+		return nil, nil
+	}
+	searchKey := InternalKey{
+		UserKey: string(userKey),
+		SeqNum:  math.MaxUint64,
+		Type:    OpTypePut,
+	}
+	blockIndex, err := r.index.Search(searchKey, r.cmp)
+	if err != nil {
+		return nil, err
+	}
+	//the newest version, if any, is in the first block searched
+	if blockIndex < r.index.Len() && !r.blockMayContain(userKey, blockIndex) {
+		return nil, nil
+	}
+	var versions []VersionedValue
+	for ; blockIndex < r.index.Len(); blockIndex++ {
+		entry, err := r.index.Entry(blockIndex)
+		if err != nil {
+			return nil, err
+		}
+		done, err := r.blockHistory(entry, searchKey, userKey, &versions)
+		if err != nil || done {
+			return versions, err
 		}
 	}
-	return nil, false, nil
+	return versions, nil
+}
+
+// blockHistory appends the versions of userKey in one data block to versions,
+// reporting done once it passes the key. The block buffer is pooled, so every
+// value kept is a copy.
+func (r *SSTableReader) blockHistory(entry IndexEntry, searchKey InternalKey, userKey []byte, versions *[]VersionedValue) (bool, error) {
+	blockData, buf, err := r.readPooledDataBlock(entry)
+	if err != nil {
+		return false, err
+	}
+	defer putBlockBuffer(buf)
+	block, err := getBlockReader(blockData, r.blockFormat)
+	if err != nil {
+		return false, err
+	}
+	defer block.release()
+	if err := block.seek(searchKey, r.cmp); err != nil {
+		return false, err
+	}
+	for {
+		e, err := block.nextEntry()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		c := bytes.Compare(e.userKey, userKey)
+		if c > 0 {
+			return true, nil
+		}
+		if c == 0 {
+			version := VersionedValue{SeqNum: e.seqNum, Type: e.typ}
+			if e.typ == OpTypeBlobIndex {
+				if version.Value, err = r.readBlob(e.value); err != nil {
+					return false, err
+				}
+				version.Type = OpTypePut
+			} else if e.typ == OpTypeVersionedPut {
+				if version.UserTs, version.Value, err = decodeVersionedValue(r.ownedValue(e.value, buf != nil)); err != nil {
+					return false, err
+				}
+				version.Type = OpTypePut
+			} else {
+				version.Value = r.ownedValue(e.value, buf != nil)
+			}
+			*versions = append(*versions, version)
+		}
+	}
+}
+
+// NewSSTableReader reads the table of size bytes held by src, for tables that do
+// not live in a file, such as one built in a bytes.Buffer. Close does not close src.
+func NewSSTableReader(src io.ReaderAt, size int64, opts *Options) (*SSTableReader, error) {
+	r := newSSTableReader(src, size, "SSTable", opts)
+	if err := r.load(opts); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 // Construct an in-memory reader by reading metadata from the SSTable file tail
 // so you can do fast lookups (use filter + index to find a data block).
-func NewSSTableReader(path string) (*SSTableReader, error) {
-	file, err := os.Open(path)
+func NewSSTableReaderFromFile(path string) (*SSTableReader, error) {
+	return NewSSTableReaderWithOptions(path, DefaultOptions())
+}
+
+// NewSSTableReaderWithOptions is NewSSTableReaderFromFile with control over how the file is read,
+// with Options.UseMmap the whole file is memory-mapped instead of read block by block.
+func NewSSTableReaderWithOptions(path string, opts *Options) (*SSTableReader, error) {
+	if opts.FileLimiter != nil {
+		opts.FileLimiter.acquire()
+	}
+	file, err := opts.fileSystem().Open(path)
 	if err != nil {
+		if opts.FileLimiter != nil {
+			opts.FileLimiter.release()
+		}
 		return nil, err
 	}
+	r := newSSTableReader(file, 0, file.Name(), opts)
+	r.file, r.limiter = file, opts.FileLimiter
 	stat, err := file.Stat()
+	if err == nil {
+		r.size = stat.Size()
+		err = r.load(opts)
+	}
 	if err != nil {
+		r.Close()
 		return nil, err
 	}
+	return r, nil
+}
+
+// newSSTableReader returns a reader of src that still has to be loaded
+func newSSTableReader(src io.ReaderAt, size int64, name string, opts *Options) *SSTableReader {
+	return &SSTableReader{
+		src:             src,
+		size:            size,
+		name:            name,
+		cmp:             internalKeyComparable{},
+		filterPolicy:    opts.FilterPolicy,
+		prefixExtractor: opts.PrefixExtractor,
+		logger:          opts.logger(),
+	}
+}
+
+// load maps the file if requested and reads the footer, filter, index and properties
+func (r *SSTableReader) load(opts *Options) error {
+	if r.size < FooterBlockSize {
+		return fmt.Errorf("SSTable too small: %d bytes", r.size)
+	}
+	//only files of the operating system can be mapped
+	if osFile, ok := r.file.(*os.File); ok && opts.UseMmap {
+		data, err := mmapFile(osFile, r.size)
+		if err != nil {
+			r.logger.Warnf("mmap of %s failed, falling back to ReadAt: %v", r.name, err)
+		} else {
+			r.mmap = data
+		}
+	}
+	legacy, err := r.checkHeader()
+	if err != nil {
+		return err
+	}
+	footer, err := r.readFooter()
+	if err != nil {
+		if legacy {
+			return fmt.Errorf("%w: no header and %v", ErrInvalidSSTableFormat, err)
+		}
+		return err
+	}
+	if legacy {
+		r.logger.Warnf("%s has no header, reading it as a version 0 SSTable", r.name)
+	}
+	r.blockFormat = footer.BlockFormat
+	r.blockChecksums = footer.Version >= 3
+	r.fileChecksum, r.hasFileChecksum = footer.FileChecksum, footer.Version >= 4
+	if footer.Version >= summaryFormatVersion && r.mmap == nil {
+		end := footer.HashIndexOffset + int64(footer.HashIndexSize)
+		if r.summary, err = r.readBlock(footer.IndexOffset, int(end-footer.IndexOffset)); err != nil {
+			return fmt.Errorf("failed to read summary: %w", err)
+		}
+		r.summaryOffset = footer.IndexOffset
+	}
+	//read the index block
+	indexBuf, err := r.readBlock(footer.IndexOffset, footer.IndexSize)
+	if err != nil {
+		return fmt.Errorf("failed to read index block: %w", err)
+	}
+	switch footer.IndexFormat {
+	case indexFormatPartitioned:
+		r.index, err = newPartitionedIndex(indexBuf, indexFormatBinary, r.readBlock)
+	case indexFormatPartitionedPrefix:
+		r.index, err = newPartitionedIndex(indexBuf, indexFormatPrefix, r.readBlock)
+	default:
+		r.index, err = openIndexBlock(indexBuf, footer.IndexFormat)
+	}
+	if err != nil {
+		return err
+	}
+	//read the properties block, tables written before it existed have none
+	if footer.PropertiesSize > 0 {
+		propsBuf, err := r.readBlock(footer.PropertiesOffset, footer.PropertiesSize)
+		if err != nil {
+			return fmt.Errorf("failed to read properties block: %w", err)
+		}
+		if err := gob.NewDecoder(bytes.NewReader(propsBuf)).Decode(&r.properties); err != nil {
+			return fmt.Errorf("failed to decode properties: %w", err)
+		}
+	}
+	//read the filter block, tables written without a FilterPolicy have none
+	if footer.FilterSize > 0 && r.filterPolicy != nil {
+		name := r.properties.FilterPolicy
+		if name == "" {
+			name = bloomFilterPolicyName
+		}
+		if name != r.filterPolicy.Name() {
+			r.logger.Warnf("%s has a filter built by %q, not %q, reading it without the filter", r.name, name, r.filterPolicy.Name())
+		} else if r.properties.FilterPartitionBlocks > 0 {
+			if err := r.loadPartitionedFilter(footer); err != nil {
+				return err
+			}
+		} else {
+			filter, err := r.readBlock(footer.FilterOffset, footer.FilterSize)
+			if err != nil {
+				return fmt.Errorf("failed to read filter block: %w", err)
+			}
+			if filter = r.checkedFilter(filter, r.properties.FilterChecksum, "filter"); filter != nil {
+				r.filter, r.filterSize = newFilterMatcher(r.filterPolicy, filter), len(filter)
+			}
+		}
+	}
+	//read the prefix filter block, only usable with the same extractor and policy
+	if (r.filter != nil || r.partitionedFilter != nil) && r.prefixExtractor != nil && r.properties.PrefixFilterSize > 0 {
+		if r.properties.PrefixExtractor == r.prefixExtractor.Name() {
+			filter, err := r.readBlock(r.properties.PrefixFilterOffset, r.properties.PrefixFilterSize)
+			if err != nil {
+				return fmt.Errorf("failed to read prefix filter block: %w", err)
+			}
+			if filter = r.checkedFilter(filter, r.properties.PrefixFilterChecksum, "prefix filter"); filter != nil {
+				r.prefixFilter = newFilterMatcher(r.filterPolicy, filter)
+			}
+		} else {
+			r.logger.Warnf("%s has a prefix filter built by %q, not %q, reading it without the prefix filter", r.name, r.properties.PrefixExtractor, r.prefixExtractor.Name())
+		}
+	}
+	//read the hash index block, if the table was written with one
+	if footer.HashIndexSize > 0 {
+		hashBuf, err := r.readBlock(footer.HashIndexOffset, footer.HashIndexSize)
+		if err != nil {
+			return fmt.Errorf("failed to read hash index block: %w", err)
+		}
+		if r.hashIndex, err = newHashIndex(hashBuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHeader validates the magic and format version at the start of the file.
+// It reports legacy for files without the magic, which predate the header.
+func (r *SSTableReader) checkHeader() (legacy bool, err error) {
+	if r.size < int64(sstableHeaderSize) {
+		return true, nil
+	}
+	header, err := r.readBlock(0, sstableHeaderSize)
+	if err != nil {
+		return false, fmt.Errorf("failed to read header: %w", err)
+	}
+	if string(header[:len(sstableMagic)]) != sstableMagic {
+		return true, nil
+	}
+	version := binary.LittleEndian.Uint32(header[len(sstableMagic):])
+	if version == 0 {
+		return false, fmt.Errorf("%w: version 0 with a header", ErrInvalidSSTableFormat)
+	}
+	if version > SSTableFormatVersion {
+		return false, fmt.Errorf("%w: SSTable version %d, supported up to %d", ErrUnsupportedVersion, version, SSTableFormatVersion)
+	}
+	return false, nil
+}
+
+// encodeFooter serializes the footer in its fixed layout:
+// [Index Offset (8 bytes)][Filter Offset (8 bytes)][Properties Offset (8 bytes)][Hash Index Offset (8 bytes)]
+// [Index Size (4 bytes)][Filter Size (4 bytes)][Properties Size (4 bytes)][Hash Index Size (4 bytes)]
+// [Index Format (1 byte)][Block Format (1 byte)][Version (4 bytes)][Magic (8 bytes)]
+func encodeFooter(f Footer) []byte {
+	buf := make([]byte, fixedFooterSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(f.IndexOffset))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(f.FilterOffset))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(f.PropertiesOffset))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(f.HashIndexOffset))
+	binary.LittleEndian.PutUint32(buf[32:], uint32(f.IndexSize))
+	binary.LittleEndian.PutUint32(buf[36:], uint32(f.FilterSize))
+	binary.LittleEndian.PutUint32(buf[40:], uint32(f.PropertiesSize))
+	binary.LittleEndian.PutUint32(buf[44:], uint32(f.HashIndexSize))
+	buf[48] = byte(f.IndexFormat)
+	buf[49] = byte(f.BlockFormat)
+	binary.LittleEndian.PutUint32(buf[50:], SSTableFormatVersion)
+	copy(buf[54:], sstableMagic)
+	return buf
+}
+
+// decodeFooter parses a footer written by encodeFooter
+func decodeFooter(buf []byte) (Footer, error) {
+	version := binary.LittleEndian.Uint32(buf[50:])
+	if version < 2 {
+		return Footer{}, fmt.Errorf("%w: fixed footer with version %d", ErrInvalidSSTableFormat, version)
+	}
+	if version > SSTableFormatVersion {
+		return Footer{}, fmt.Errorf("%w: SSTable footer version %d, supported up to %d", ErrUnsupportedVersion, version, SSTableFormatVersion)
+	}
+	return Footer{
+		IndexOffset:      int64(binary.LittleEndian.Uint64(buf[0:])),
+		FilterOffset:     int64(binary.LittleEndian.Uint64(buf[8:])),
+		PropertiesOffset: int64(binary.LittleEndian.Uint64(buf[16:])),
+		HashIndexOffset:  int64(binary.LittleEndian.Uint64(buf[24:])),
+		IndexSize:        int(binary.LittleEndian.Uint32(buf[32:])),
+		FilterSize:       int(binary.LittleEndian.Uint32(buf[36:])),
+		PropertiesSize:   int(binary.LittleEndian.Uint32(buf[40:])),
+		HashIndexSize:    int(binary.LittleEndian.Uint32(buf[44:])),
+		IndexFormat:      int(buf[48]),
+		BlockFormat:      int(buf[49]),
+		Version:          int(version),
+	}, nil
+}
+
+// readFooter reads the fixed footer from the end of the file in a single read,
+// falling back to the gob footer of version 0 and 1 tables
+func (r *SSTableReader) readFooter() (Footer, error) {
+	if r.size >= int64(fixedFooterSize) {
+		//the file checksum in front of the footer comes along in the same read
+		tailSize := min(r.size, int64(fixedFooterSize+fileChecksumSize))
+		tail, err := r.readBlock(r.size-tailSize, int(tailSize))
+		if err != nil {
+			return Footer{}, fmt.Errorf("failed to read footer: %w", err)
+		}
+		buf := tail[len(tail)-fixedFooterSize:]
+		if string(buf[fixedFooterSize-len(sstableMagic):]) == sstableMagic {
+			footer, err := decodeFooter(buf)
+			if err != nil || footer.Version < 4 {
+				return footer, err
+			}
+			if len(tail) < fixedFooterSize+fileChecksumSize {
+				return Footer{}, fmt.Errorf("%w: no room for the file checksum", ErrCorruption)
+			}
+			footer.FileChecksum = binary.LittleEndian.Uint32(tail)
+			return footer, nil
+		}
+	}
+	return r.readGobFooter()
+}
+
+// readGobFooter reads the footer size from the end of the file, then the gob encoded footer itself
+func (r *SSTableReader) readGobFooter() (Footer, error) {
+	var footer Footer
 	//read the footerSize
-	fileSize := stat.Size()
-	footerSizeBuf := make([]byte, FooterBlockSize)
-	if _, err := file.ReadAt(footerSizeBuf, fileSize-FooterBlockSize); err != nil {
-		return nil, fmt.Errorf("failed to read footer size: %w", err)
+	footerSizeBuf, err := r.readBlock(r.size-FooterBlockSize, FooterBlockSize)
+	if err != nil {
+		return footer, fmt.Errorf("failed to read footer size: %w", err)
 	}
 	footerSize := binary.LittleEndian.Uint32(footerSizeBuf)
 	//read the footer
-	footerOffset := fileSize - FooterBlockSize - int64(footerSize)
-	footerBuf := make([]byte, footerSize)
-	if _, err := file.ReadAt(footerBuf, footerOffset); err != nil {
-		return nil, fmt.Errorf("failed to read footer: %w", err)
+	footerOffset := r.size - FooterBlockSize - int64(footerSize)
+	footerBuf, err := r.readBlock(footerOffset, int(footerSize))
+	if err != nil {
+		return footer, fmt.Errorf("failed to read footer: %w", err)
 	}
-	var footer Footer
 	if err := gob.NewDecoder(bytes.NewReader(footerBuf)).Decode(&footer); err != nil {
-		return nil, fmt.Errorf("failed to decode footer: %w", err)
+		return footer, fmt.Errorf("failed to decode footer: %w", err)
 	}
-	//read the filter block
-	filterBuf := make([]byte, footer.FilterSize)
-	if _, err := file.ReadAt(filterBuf, footer.FilterOffset); err != nil {
-		return nil, fmt.Errorf("failed to read filter block: %w", err)
+	return footer, nil
+}
+
+// readBlock returns size bytes starting at offset. With mmap the result is a subslice
+// of the mapping and is only valid until Close, otherwise it is a fresh buffer.
+func (r *SSTableReader) readBlock(offset int64, size int) ([]byte, error) {
+	if offset < 0 || size < 0 || offset+int64(size) > r.size {
+		return nil, fmt.Errorf("block [%d, %d) out of file bounds (%d bytes)", offset, offset+int64(size), r.size)
 	}
-	var filter = &bloom.BloomFilter{}
-	if _, err := filter.ReadFrom(bytes.NewReader(filterBuf)); err != nil {
-		return nil, fmt.Errorf("failed to read from filter buffer: %w", err)
+	if r.mmap != nil {
+		return r.mmap[offset : offset+int64(size)], nil
 	}
-	//read the index block
-	indexBuf := make([]byte, footer.IndexSize)
-	if _, err := file.ReadAt(indexBuf, footer.IndexOffset); err != nil {
-		return nil, fmt.Errorf("failed to read index block: %w", err)
+	if r.summary != nil && offset >= r.summaryOffset && offset+int64(size) <= r.summaryOffset+int64(len(r.summary)) {
+		start := offset - r.summaryOffset
+		return r.summary[start : start+int64(size)], nil
 	}
-	var index []IndexEntry
-	if err := gob.NewDecoder(bytes.NewReader(indexBuf)).Decode(&index); err != nil {
-		return nil, fmt.Errorf("failed to decode index: %w", err)
+	return r.readBlockInto(make([]byte, size), offset)
+}
+
+// readBlockInto fills buf with the bytes starting at offset, reading the file
+// even when it is mapped
+func (r *SSTableReader) readBlockInto(buf []byte, offset int64) ([]byte, error) {
+	if offset < 0 || offset+int64(len(buf)) > r.size {
+		return nil, fmt.Errorf("block [%d, %d) out of file bounds (%d bytes)", offset, offset+int64(len(buf)), r.size)
 	}
-	return &SSTableReader{
-		file:   file,
-		index:  index,
-		filter: filter,
-		cmp:    internalKeyComparable{},
-	}, nil
+	if _, err := r.src.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readDataBlock reads the data block described by entry, decompressing it if needed.
+// With a block cache, decompressed blocks are served from and added to the cache.
+func (r *SSTableReader) readDataBlock(entry IndexEntry) ([]byte, error) {
+	block, _, err := r.loadDataBlock(entry, false)
+	return block, err
+}
+
+// readPooledDataBlock is readDataBlock for callers that are done with the block
+// before they return. Without mmap or a block cache the block is read into a
+// pooled buffer, returned as buf, which the caller must hand back with
+// putBlockBuffer after copying out whatever it keeps. buf is nil otherwise.
+func (r *SSTableReader) readPooledDataBlock(entry IndexEntry) (block []byte, buf *[]byte, err error) {
+	return r.loadDataBlock(entry, r.mmap == nil && r.cache == nil)
+}
+
+func (r *SSTableReader) loadDataBlock(entry IndexEntry, pooled bool) ([]byte, *[]byte, error) {
+	key := r.cacheKey
+	key.offset = entry.Offset
+	if r.cache != nil {
+		if block, ok := r.cache.get(key); ok {
+			return block, nil, nil
+		}
+	}
+	var stored []byte
+	var buf *[]byte
+	var err error
+	//a corrupt index entry must not size the pooled buffer before it is checked
+	if pooled && entry.Size >= 0 && entry.Offset >= 0 && entry.Offset+int64(entry.Size) <= r.size {
+		buf = getBlockBuffer(entry.Size)
+		stored, err = r.readBlockInto(*buf, entry.Offset)
+	} else {
+		stored, err = r.readBlock(entry.Offset, entry.Size)
+	}
+	if err != nil {
+		putBlockBuffer(buf)
+		return nil, nil, err
+	}
+	block, err := r.decodeStoredBlock(stored)
+	if err != nil {
+		putBlockBuffer(buf)
+		return nil, nil, err
+	}
+	if buf != nil && !aliases(block, *buf) {
+		//decompressed into a fresh buffer, the stored block is no longer needed
+		putBlockBuffer(buf)
+		buf = nil
+	}
+	if r.cache != nil && !r.skipCacheFill {
+		if r.mmap != nil {
+			//the block may point into the mapping, which is gone after Close
+			block = append([]byte(nil), block...)
+		}
+		r.cache.add(key, block)
+	}
+	return block, buf, nil
+}
+
+// decodeStoredBlock verifies the checksum of a data block as stored in the file
+// and decompresses it
+func (r *SSTableReader) decodeStoredBlock(stored []byte) ([]byte, error) {
+	var err error
+	if r.blockChecksums {
+		if stored, err = checkBlockChecksum(stored); err != nil {
+			return nil, err
+		}
+	}
+	if r.blockFormat >= blockFormatCompressed {
+		return decompressBlock(stored)
+	}
+	return stored, nil
+}
+
+// aliases reports whether a and b share their first byte of backing memory
+func aliases(a, b []byte) bool {
+	return len(a) > 0 && cap(b) > 0 && &a[0] == &b[:cap(b)][0]
+}
+
+// checkFileChecksum opens the table at path and verifies its whole-file checksum
+func checkFileChecksum(path string, opts *Options) error {
+	r, err := NewSSTableReaderWithOptions(path, opts)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.verifyFileChecksum()
+}
+
+// verifyFileChecksum reads the whole file and compares its checksum with the one
+// in the footer. Tables written before format version 4 have none and pass.
+func (r *SSTableReader) verifyFileChecksum() error {
+	if !r.hasFileChecksum {
+		return nil
+	}
+	checksumAt := r.size - int64(fixedFooterSize) - fileChecksumSize
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(r.src, 0, checksumAt)); err != nil {
+		return fmt.Errorf("failed to read file for its checksum: %w", err)
+	}
+	fixed, err := r.readBlock(checksumAt+fileChecksumSize, fixedFooterSize)
+	if err != nil {
+		return err
+	}
+	h.Write(fixed)
+	if h.Sum32() != r.fileChecksum {
+		return fmt.Errorf("%w: file checksum mismatch", ErrCorruption)
+	}
+	return nil
+}
+
+// checkBlockChecksum verifies the CRC-32 trailer of a stored data block and returns
+// the block without it
+func checkBlockChecksum(stored []byte) ([]byte, error) {
+	if len(stored) < blockChecksumSize {
+		return nil, fmt.Errorf("%w: block too short for its checksum", ErrCorruption)
+	}
+	n := len(stored) - blockChecksumSize
+	if crc32.ChecksumIEEE(stored[:n]) != binary.LittleEndian.Uint32(stored[n:]) {
+		return nil, fmt.Errorf("%w: block checksum mismatch", ErrCorruption)
+	}
+	return stored[:n], nil
+}
+
+// mayContain reports whether userKey may be in the table according to its
+// prefix filter and its filter
+func (r *SSTableReader) mayContain(userKey []byte) bool {
+	if r.prefixFilter != nil {
+		if prefix := r.prefixExtractor.Transform(userKey); prefix != nil && !r.prefixFilter(prefix) {
+			return false
+		}
+	}
+	return r.filter == nil || r.filter(userKey)
+}
+
+// loadPartitionedFilter reads the top level of a partitioned filter, the end of
+// the filter region. A top level that fails its checksum leaves the table
+// without a filter.
+func (r *SSTableReader) loadPartitionedFilter(footer Footer) error {
+	end := footer.FilterOffset + int64(footer.FilterSize)
+	tail, err := r.readBlock(end-8, 8)
+	if err != nil {
+		return fmt.Errorf("failed to read filter block: %w", err)
+	}
+	topSize := int64(binary.LittleEndian.Uint32(tail[4:]))*filterPartitionEntrySize + 8
+	if topSize > int64(footer.FilterSize) {
+		r.logger.Warnf("%s has a corrupt filter block, reading it without the filter", r.name)
+		return nil
+	}
+	top, err := r.readBlock(end-topSize, int(topSize))
+	if err != nil {
+		return fmt.Errorf("failed to read filter block: %w", err)
+	}
+	if top = r.checkedFilter(top, r.properties.FilterChecksum, "filter"); top == nil {
+		return nil
+	}
+	r.partitionedFilter, err = newPartitionedFilter(top, r.filterPolicy, r.readFilterPartition)
+	return err
+}
+
+// readFilterPartition reads a filter partition, through the block cache if the
+// reader has one
+func (r *SSTableReader) readFilterPartition(offset int64, size int) ([]byte, error) {
+	key := r.cacheKey
+	key.offset = offset
+	if r.cache != nil {
+		if data, ok := r.cache.get(key); ok {
+			return data, nil
+		}
+	}
+	data, err := r.readBlock(offset, size)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache != nil {
+		if r.mmap != nil {
+			data = append([]byte(nil), data...)
+		}
+		r.cache.add(key, data)
+	}
+	return data, nil
+}
+
+// blockMayContain reports whether data block blockIndex may hold userKey, by
+// its filter partition. An unreadable partition rules nothing out.
+func (r *SSTableReader) blockMayContain(userKey []byte, blockIndex int) bool {
+	if r.partitionedFilter == nil {
+		return true
+	}
+	filter, err := r.partitionedFilter.partition(blockIndex)
+	if err != nil {
+		r.logger.Warnf("%s: %v, searching without the filter", r.name, err)
+		return true
+	}
+	return filter(userKey)
+}
+
+// checkedFilter returns filter, or nil if it does not match its checksum. A
+// corrupt filter could rule out keys the table holds, without one every block
+// that may hold a key is searched instead.
+func (r *SSTableReader) checkedFilter(filter []byte, checksum uint32, kind string) []byte {
+	if checksum == 0 || crc32.ChecksumIEEE(filter) == checksum {
+		return filter
+	}
+	r.logger.Warnf("%s has a corrupt %s block, reading it without the %s", r.name, kind, kind)
+	return nil
+}
+
+// mayContainPrefix reports whether the table may hold keys starting with prefix.
+// prefix must be a whole prefix as returned by the table's PrefixExtractor.
+func (r *SSTableReader) mayContainPrefix(prefix []byte) bool {
+	return r.prefixFilter == nil || r.prefixFilter(prefix)
+}
+
+// ownedValue returns a value that stays valid after the reader is closed and
+// that the caller may modify without corrupting the mapping, the block cache or,
+// when pooled is set, a pooled block buffer
+func (r *SSTableReader) ownedValue(value []byte, pooled bool) []byte {
+	if r.mmap == nil && r.cache == nil && !pooled {
+		return value
+	}
+	//Clone keeps an empty value non-nil, unlike a tombstone
+	return bytes.Clone(value)
+}
+
+// filterFalsePositiveRate estimates the false positive rate of the table's key
+// filter from its size, as a bloom filter with as many bits per key. It is 1
+// when the table has no usable filter.
+func (r *SSTableReader) filterFalsePositiveRate() float64 {
+	var filterBytes int
+	switch {
+	case r.filter != nil:
+		filterBytes = r.filterSize
+	case r.partitionedFilter != nil:
+		for _, p := range r.partitionedFilter.partitions {
+			filterBytes += int(p.size)
+		}
+	default:
+		return 1
+	}
+	if r.properties.NumEntries == 0 {
+		return 0
+	}
+	return bloomFalsePositiveRate(float64(filterBytes*8) / float64(r.properties.NumEntries))
 }
+
+// readBlob returns the value a blob reference stored in the table points at
+func (r *SSTableReader) readBlob(ref []byte) ([]byte, error) {
+	if r.blobs == nil {
+		return nil, fmt.Errorf("%s: value is in a blob file, open the table through its DB to read it", r.name)
+	}
+	return r.blobs.read(ref)
+}
+
+// Close unmaps the file, if mapped, and closes it. Readers from NewSSTableReader
+// leave their source open.
+func (r *SSTableReader) Close() error {
+	var err error
+	if r.mmap != nil {
+		err = munmapFile(r.mmap)
+		r.mmap = nil
+	}
+	if r.file != nil {
+		if cerr := r.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if r.limiter != nil {
+		r.limiter.release()
+		r.limiter = nil
+	}
+	return err
+}
+
+// Properties returns the statistics stored in the table's properties block
+func (r *SSTableReader) Properties() TableProperties {
+	return r.properties
+}
+
+// DumpEntries returns the key of every entry in the table in order: every version
+// of every key, tombstones and blob references included, as physically stored.
+// It reads the table block by block using the index and leaves the reader open.
+func (r *SSTableReader) DumpEntries() ([]InternalKey, error) {
+	it := r.NewIterator(math.MaxUint64)
+	var keys []InternalKey
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys, it.Error()
+}
+
+// scanReadAhead is the read buffer of ScanRange
+const scanReadAhead = 256 * 1024
+
+// ScanRange calls fn for every entry whose user key is in [start, end), in
+// InternalKey order, until fn returns false. Every version is passed, tombstones
+// and blob references included, as stored. A nil start or end leaves that side
+// unbounded. Data blocks are read in one sequential pass through a buffered
+// reader instead of a ReadAt per block, bypassing the block cache; value stays
+// valid after fn returns.
+func (r *SSTableReader) ScanRange(start, end []byte, fn func(key InternalKey, value []byte) bool) error {
+	first := 0
+	if start != nil {
+		var err error
+		if first, err = r.index.Search(InternalKey{UserKey: string(start), SeqNum: math.MaxUint64}, r.cmp); err != nil {
+			return err
+		}
+	}
+	if first >= r.index.Len() {
+		return nil
+	}
+	entry, err := r.index.Entry(first)
+	if err != nil {
+		return err
+	}
+	pos := entry.Offset
+	reader := bufio.NewReaderSize(io.NewSectionReader(r.src, pos, r.size-pos), scanReadAhead)
+	for i := first; i < r.index.Len(); i++ {
+		if entry, err = r.index.Entry(i); err != nil {
+			return err
+		}
+		if entry.Offset < pos || entry.Size < 0 || entry.Offset+int64(entry.Size) > r.size {
+			return fmt.Errorf("%w: data block %d at offset %d overlaps the previous one", ErrCorruption, i, entry.Offset)
+		}
+		if _, err := reader.Discard(int(entry.Offset - pos)); err != nil {
+			return err
+		}
+		stored := make([]byte, entry.Size)
+		if _, err := io.ReadFull(reader, stored); err != nil {
+			return fmt.Errorf("failed to read data block %d: %w", i, err)
+		}
+		pos = entry.Offset + int64(entry.Size)
+		data, err := r.decodeStoredBlock(stored)
+		if err != nil {
+			return err
+		}
+		more, err := r.scanBlock(data, start, end, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanBlock is ScanRange for one data block, it reports false once fn returned
+// false or the block passed end
+func (r *SSTableReader) scanBlock(data, start, end []byte, fn func(InternalKey, []byte) bool) (bool, error) {
+	block, err := getBlockReader(data, r.blockFormat)
+	if err != nil {
+		return false, err
+	}
+	defer block.release()
+	for {
+		e, err := block.nextEntry()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if start != nil && bytes.Compare(e.userKey, start) < 0 {
+			continue
+		}
+		if end != nil && bytes.Compare(e.userKey, end) >= 0 {
+			return false, nil
+		}
+		if !fn(InternalKey{UserKey: string(e.userKey), SeqNum: e.seqNum, Type: e.typ}, e.value) {
+			return false, nil
+		}
+	}
+}
+
+// readTableProperties opens the SSTable at path just long enough to read its properties
+func readTableProperties(path string, opts *Options) (TableProperties, error) {
+	reader, err := NewSSTableReaderWithOptions(path, opts)
+	if err != nil {
+		return TableProperties{}, err
+	}
+	defer reader.Close()
+	return reader.Properties(), nil
+}
+
+// scanLargestSeq returns the largest sequence number in the SSTable at path by
+// reading every entry, for tables whose properties do not record it
+func scanLargestSeq(path string, opts *Options) (uint64, error) {
+	reader, err := NewSSTableReaderWithOptions(path, opts)
+	if err != nil {
+		return 0, err
+	}
+	it := reader.NewIterator(math.MaxUint64)
+	defer it.Close()
+	var largest uint64
+	for it.Next() {
+		largest = max(largest, it.Key().SeqNum)
+	}
+	return largest, it.Error()
+}
+
+// tableIterator walks every entry of an SSTable block by block using the index.
+// Entries with a sequence number above maxSeq are skipped.
+type tableIterator struct {
+	r        *SSTableReader
+	maxSeq   uint64
+	blockIdx int
+	block    *blockReader
+	key      InternalKey
+	value    []byte
+	err      error
+}
+
+// NewIterator returns an iterator over the entries visible at sequence number maxSeq.
+// Closing the iterator closes the reader's file.
+func (r *SSTableReader) NewIterator(maxSeq uint64) *tableIterator {
+	return &tableIterator{
+		r:        r,
+		maxSeq:   maxSeq,
+		blockIdx: -1,
+	}
+}
+
+// loadNextBlock reads the next data block from the file. It returns false once all blocks are consumed.
+func (it *tableIterator) loadNextBlock() bool {
+	it.blockIdx++
+	if it.blockIdx >= it.r.index.Len() {
+		return false
+	}
+	entry, err := it.r.index.Entry(it.blockIdx)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	blockData, err := it.r.readDataBlock(entry)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if it.block, err = newBlockReader(blockData, it.r.blockFormat); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// seek positions the iterator near the first entry with a user key >= userKey,
+// skipping the blocks before it. Next may still return a few smaller keys from
+// the start of the block.
+func (it *tableIterator) seek(userKey []byte) {
+	target := InternalKey{UserKey: string(userKey), SeqNum: math.MaxUint64}
+	blockIdx, err := it.r.index.Search(target, it.r.cmp)
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.blockIdx = blockIdx - 1
+	if !it.loadNextBlock() {
+		return
+	}
+	if err := it.block.seek(target, it.r.cmp); err != nil {
+		it.err = err
+	}
+}
+
+func (it *tableIterator) Next() bool {
+	for it.err == nil {
+		if it.block == nil {
+			if !it.loadNextBlock() {
+				return false
+			}
+		}
+		ik, value, err := it.block.next()
+		if err == io.EOF {
+			it.block = nil
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		//written after the snapshot, invisible to this iterator
+		if ik.SeqNum > it.maxSeq {
+			continue
+		}
+		it.key = ik
+		it.value = it.r.ownedValue(value, false)
+		return true
+	}
+	return false
+}
+
+func (it *tableIterator) Key() InternalKey { return it.key }
+func (it *tableIterator) Value() []byte    { return it.value }
+func (it *tableIterator) Error() error     { return it.err }
+func (it *tableIterator) Close() error     { return it.r.Close() }
@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// buildTable writes keys, each with the value of the same index, to an
+// in-memory SSTable and returns a reader of it
+func buildTable(tb testing.TB, opts *Options, keys []string, values [][]byte) *SSTableReader {
+	tb.Helper()
+	var buf bytes.Buffer
+	b := NewSSTableBuilder(&buf, uint(len(keys)), opts)
+	for i, key := range keys {
+		if err := b.Add(InternalKey{UserKey: key, SeqNum: uint64(i + 1), Type: OpTypePut}, values[i]); err != nil {
+			tb.Fatalf("Add(%q): %v", key, err)
+		}
+	}
+	if _, err := b.Finish(); err != nil {
+		tb.Fatalf("Finish: %v", err)
+	}
+	r, err := NewSSTableReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), opts)
+	if err != nil {
+		tb.Fatalf("NewSSTableReader: %v", err)
+	}
+	tb.Cleanup(func() { r.Close() })
+	return r
+}
+
+// checkTable checks that Get and ScanRange return every key with its value
+func checkTable(t *testing.T, r *SSTableReader, keys []string, values [][]byte) {
+	t.Helper()
+	for i, key := range keys {
+		got, found, err := r.Get([]byte(key))
+		if err != nil || !found {
+			t.Fatalf("Get(%q) = found %v, err %v", key, found, err)
+		}
+		if !bytes.Equal(got, values[i]) {
+			t.Fatalf("Get(%q) returned %d bytes, want %d", key, len(got), len(values[i]))
+		}
+	}
+	i := 0
+	err := r.ScanRange(nil, nil, func(key InternalKey, value []byte) bool {
+		if i >= len(keys) || key.UserKey != keys[i] || !bytes.Equal(value, values[i]) {
+			t.Errorf("ScanRange entry %d is %q with %d bytes", i, key.UserKey, len(value))
+			return false
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ScanRange: %v", err)
+	}
+	if i != len(keys) {
+		t.Fatalf("ScanRange returned %d entries, want %d", i, len(keys))
+	}
+}
+
+func TestSSTableOversizedEntries(t *testing.T) {
+	const blockSize = 256
+	sizes := []int{blockSize - 1, blockSize, blockSize + 1, 1000, 3 << 20}
+	variants := map[string]func(*Options){
+		"default":          func(o *Options) {},
+		"hash index":       func(o *Options) { o.UseHashIndex = true },
+		"filter partition": func(o *Options) { o.FilterPartitionBlocks = 1 },
+		"no filter":        func(o *Options) { o.FilterPolicy = nil },
+	}
+	for name, configure := range variants {
+		for _, size := range sizes {
+			t.Run(fmt.Sprintf("%s/%d", name, size), func(t *testing.T) {
+				opts := DefaultOptions()
+				opts.BlockSize = blockSize
+				configure(opts)
+				var keys []string
+				var values [][]byte
+				//small entries around the oversized one, so it cuts a block in progress
+				for i := 0; i < 20; i++ {
+					value := bytes.Repeat([]byte{byte('a' + i)}, 10)
+					if i == 10 {
+						value = bytes.Repeat([]byte{'x'}, size)
+					}
+					keys = append(keys, fmt.Sprintf("key%03d", i))
+					values = append(values, value)
+				}
+				r := buildTable(t, opts, keys, values)
+				checkTable(t, r, keys, values)
+			})
+		}
+	}
+}
+
+func TestSSTableOversizedEntryAtFilterPartitionBoundary(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BlockSize = 256
+	opts.UseHashIndex = true
+	var keys []string
+	var values [][]byte
+	//every oversized entry cuts a block, so some cut lands on a partition boundary
+	for i := 0; i < 4*DefaultFilterPartitionBlocks; i++ {
+		value := []byte("small")
+		if i%3 == 0 {
+			value = bytes.Repeat([]byte{'x'}, 1000)
+		}
+		keys = append(keys, fmt.Sprintf("key%05d", i))
+		values = append(values, value)
+	}
+	r := buildTable(t, opts, keys, values)
+	checkTable(t, r, keys, values)
+}
+
+func TestSSTableFilterLookupDoesNotAllocate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PrefixExtractor = NewFixedPrefixExtractor(3)
+	keys := []string{"key1", "key2", "key3"}
+	values := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	r := buildTable(t, opts, keys, values)
+	if r.filter == nil || r.prefixFilter == nil {
+		t.Fatal("table was read without its filters")
+	}
+	missing := []byte("zzz-missing")
+	if allocs := testing.AllocsPerRun(100, func() { r.mayContain(missing) }); allocs != 0 {
+		t.Fatalf("mayContain allocates %v times per call, want 0", allocs)
+	}
+}
+
+// BenchmarkSSTableGet compares finding the data block of a key by binary search
+// in the index with the hash index, for random lookups in a table of 1M keys
+func BenchmarkSSTableGet(b *testing.B) {
+	const n = 1_000_000
+	keys := make([]string, n)
+	values := make([][]byte, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+		values[i] = []byte("value")
+	}
+	for _, hashIndex := range []bool{false, true} {
+		name := "binary search"
+		if hashIndex {
+			name = "hash index"
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.UseHashIndex = hashIndex
+			r := buildTable(b, opts, keys, values)
+			rng := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found, err := r.Get([]byte(keys[rng.Intn(n)])); err != nil || !found {
+					b.Fatalf("Get: found %v, err %v", found, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSSTableLargeFilterRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes tables of 200k keys")
+	}
+	keys := make([]string, 200000)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%07d", i)
+		values[i] = []byte(fmt.Sprintf("value%d", i))
+	}
+	for _, partitionBlocks := range []int{0, DefaultFilterPartitionBlocks} {
+		t.Run(fmt.Sprintf("partition blocks %d", partitionBlocks), func(t *testing.T) {
+			//every summary block after the filter, whose offsets all depend on its size
+			opts := DefaultOptions()
+			opts.FilterPartitionBlocks = partitionBlocks
+			opts.PrefixExtractor = NewFixedPrefixExtractor(6)
+			opts.UseHashIndex = true
+			r := buildTable(t, opts, keys, values)
+			footer, err := r.readFooter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			//the bits of a whole filter alone, at DefaultBloomBitsPerKey
+			if partitionBlocks == 0 && footer.FilterSize < len(keys)*DefaultBloomBitsPerKey/8 {
+				t.Fatalf("filter of %d bytes for %d keys", footer.FilterSize, len(keys))
+			}
+			if err := r.verifyFileChecksum(); err != nil {
+				t.Fatal(err)
+			}
+			checkTable(t, r, keys, values)
+			if _, found, err := r.Get([]byte("key9999999")); err != nil || found {
+				t.Fatalf("Get of an absent key = found %v, err %v", found, err)
+			}
+			if !r.mayContainPrefix([]byte("key012")) {
+				t.Fatal("the prefix filter rejects a prefix of the table")
+			}
+		})
+	}
+}
+
+// BenchmarkSSTableOpenFirstGet opens a table of 100k data blocks and looks up a
+// random key, which decodes only the index entries the binary search reaches
+func BenchmarkSSTableOpenFirstGet(b *testing.B) {
+	const n = 100000
+	opts := DefaultOptions()
+	//every entry fills a block on its own
+	opts.BlockSize = 1
+	var buf bytes.Buffer
+	builder := NewSSTableBuilder(&buf, n, opts)
+	for i := 0; i < n; i++ {
+		if err := builder.Add(InternalKey{UserKey: fmt.Sprintf("key%08d", i), SeqNum: uint64(i + 1), Type: OpTypePut}, []byte("value")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := builder.Finish(); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	r, err := NewSSTableReader(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if blocks := r.index.Len(); blocks < n {
+		b.Fatalf("table has %d blocks, want %d", blocks, n)
+	}
+	r.Close()
+	rng := rand.New(rand.NewSource(1))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := NewSSTableReader(bytes.NewReader(data), int64(len(data)), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, found, err := r.Get([]byte(fmt.Sprintf("key%08d", rng.Intn(n)))); err != nil || !found {
+			b.Fatalf("Get: found %v, err %v", found, err)
+		}
+		r.Close()
+	}
+}
+
+// BenchmarkSSTableMmap compares random lookups in a table file read with ReadAt
+// and memory-mapped, with every block already in the page cache
+func BenchmarkSSTableMmap(b *testing.B) {
+	const n = 100000
+	path := filepath.Join(b.TempDir(), "00001.sst")
+	builder, err := CreateSSTableBuilder(path, n, DefaultOptions())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := builder.Add(InternalKey{UserKey: fmt.Sprintf("key%08d", i), SeqNum: uint64(i + 1), Type: OpTypePut}, bytes.Repeat([]byte{'v'}, 100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := builder.Finish(); err != nil {
+		b.Fatal(err)
+	}
+	for _, mmap := range []bool{false, true} {
+		name := "ReadAt"
+		if mmap {
+			name = "mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.UseMmap = mmap
+			r, err := NewSSTableReaderWithOptions(path, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer r.Close()
+			if mmap && r.mmap == nil {
+				b.Skip("mmap is not supported here")
+			}
+			rng := rand.New(rand.NewSource(1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found, err := r.Get([]byte(fmt.Sprintf("key%08d", rng.Intn(n)))); err != nil || !found {
+					b.Fatalf("Get: found %v, err %v", found, err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSSTableGetInBlock compares point lookups in blocks of 64 entries
+// scanned from their only restart point with lookups binary searching restart
+// points every DefaultBlockRestartInterval entries
+func BenchmarkSSTableGetInBlock(b *testing.B) {
+	const n = 100000
+	keys := make([]string, n)
+	values := make([][]byte, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+		values[i] = bytes.Repeat([]byte{'v'}, 50)
+	}
+	for _, restartInterval := range []int{64, DefaultBlockRestartInterval} {
+		name := "linear scan"
+		if restartInterval != 64 {
+			name = "binary search"
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.BlockRestartInterval = restartInterval
+			//64 entries of about 60 bytes
+			opts.BlockSize = 64 * 60
+			r := buildTable(b, opts, keys, values)
+			if perBlock := n / r.index.Len(); perBlock < 56 || perBlock > 72 {
+				b.Fatalf("%d entries per block, want about 64", perBlock)
+			}
+			rng := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found, err := r.Get([]byte(keys[rng.Intn(n)])); err != nil || !found {
+					b.Fatalf("Get: found %v, err %v", found, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSSTableDetectsCorruptedValues(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueChecksums = true
+	var buf bytes.Buffer
+	b := NewSSTableBuilder(&buf, 2, opts)
+	for i, key := range []string{"apple", "banana"} {
+		value := []byte(fmt.Sprintf("value-of-%s", key))
+		if err := b.Add(InternalKey{UserKey: key, SeqNum: uint64(i + 1), Type: OpTypePut}, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[bytes.Index(data, []byte("value-of-banana"))] ^= 1
+	r, err := NewSSTableReader(bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, err := r.Get([]byte("banana")); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Get of a corrupted value = %v, want ErrCorruption", err)
+	}
+}
+
+// TestSSTableBlockBoundaries sweeps the entry size so that, for some sizes, an
+// entry ends exactly at the block size. Every index entry must name the last
+// key of its own block, and only the last block, or a block followed by an
+// entry too large for any block, may be cut short of the block size.
+func TestSSTableBlockBoundaries(t *testing.T) {
+	const blockSize = 256
+	exact := 0
+	for valueSize := 1; valueSize <= blockSize; valueSize++ {
+		opts := DefaultOptions()
+		opts.BlockSize = blockSize
+		var keys []string
+		var values [][]byte
+		for i := 0; i < 40; i++ {
+			keys = append(keys, fmt.Sprintf("key%05d", i))
+			values = append(values, bytes.Repeat([]byte{'v'}, valueSize))
+		}
+		r := buildTable(t, opts, keys, values)
+		checkTable(t, r, keys, values)
+		oversized := newBlockBuilder(opts.BlockRestartInterval, false).entrySize(InternalKey{UserKey: keys[0]}, values[0]) > blockSize
+		for i := 0; i < r.index.Len(); i++ {
+			entry, err := r.index.Entry(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := r.readDataBlock(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readBlock(t, data, r.blockFormat)
+			if last := got.keys[len(got.keys)-1]; last != entry.LastKey {
+				t.Fatalf("value size %d: block %d ends with %+v, its index entry says %+v", valueSize, i, last, entry.LastKey)
+			}
+			if len(data) < blockSize && i < r.index.Len()-1 && !oversized {
+				t.Fatalf("value size %d: block %d was cut at %d bytes", valueSize, i, len(data))
+			}
+			if len(data) == blockSize {
+				exact++
+			}
+		}
+	}
+	if exact == 0 {
+		t.Fatal("no block ended exactly at the block size")
+	}
+}
+
+func TestSSTableRejectsNewerVersion(t *testing.T) {
+	opts := DefaultOptions()
+	var buf bytes.Buffer
+	b := NewSSTableBuilder(&buf, 1, opts)
+	if err := b.Add(InternalKey{UserKey: "key", SeqNum: 1, Type: OpTypePut}, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	//the version in the header, then the one in the footer
+	for name, at := range map[string]int{
+		"header": len(sstableMagic),
+		"footer": buf.Len() - fixedFooterSize + 50,
+	} {
+		data := bytes.Clone(buf.Bytes())
+		binary.LittleEndian.PutUint32(data[at:], SSTableFormatVersion+1)
+		r, err := NewSSTableReader(bytes.NewReader(data), int64(len(data)), opts)
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			if err == nil {
+				r.Close()
+			}
+			t.Fatalf("opening an SSTable with version %d in the %s = %v, want ErrUnsupportedVersion", SSTableFormatVersion+1, name, err)
+		}
+	}
+}
+
+// BenchmarkSSTableGetAllocs reports the allocations of a point lookup, and of
+// reading its data block into a pooled buffer against a fresh one
+func BenchmarkSSTableGetAllocs(b *testing.B) {
+	const n = 10000
+	keys := make([]string, n)
+	values := make([][]byte, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+		values[i] = bytes.Repeat([]byte{'v'}, 100)
+	}
+	r := buildTable(b, DefaultOptions(), keys, values)
+	entry, err := r.index.Entry(r.index.Len() / 2)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, found, err := r.Get([]byte(keys[i%n])); err != nil || !found {
+				b.Fatalf("Get: found %v, err %v", found, err)
+			}
+		}
+	})
+	b.Run("block/pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, buf, err := r.readPooledDataBlock(entry)
+			if err != nil {
+				b.Fatal(err)
+			}
+			putBlockBuffer(buf)
+		}
+	})
+	b.Run("block/unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := r.readDataBlock(entry); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSSTableReaderConcurrentGets(t *testing.T) {
+	keys := make([]string, 2000)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%05d", i)
+		values[i] = []byte(fmt.Sprintf("value%05d", i))
+	}
+	variants := map[string]func(*Options){
+		"read at":     func(o *Options) {},
+		"mmap":        func(o *Options) { o.UseMmap = true },
+		"block cache": func(o *Options) { o.BlockCache = NewCache(64 << 10) },
+		"hash index and filter partitions": func(o *Options) {
+			o.UseHashIndex = true
+			o.FilterPartitionBlocks = 2
+		},
+	}
+	for name, configure := range variants {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions()
+			configure(opts)
+			var buf bytes.Buffer
+			b := NewSSTableBuilder(&buf, uint(len(keys)), opts)
+			for i, key := range keys {
+				if err := b.Add(InternalKey{UserKey: key, SeqNum: uint64(i + 1), Type: OpTypePut}, values[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := b.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "00001.sst")
+			if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewSSTableReaderWithOptions(path, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			//one reader shared by every goroutine
+			var wg sync.WaitGroup
+			errs := make(chan error, 16)
+			for g := 0; g < 16; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for n := 0; n < len(keys); n++ {
+						i := (g*len(keys)/16 + n) % len(keys)
+						value, found, err := r.Get([]byte(keys[i]))
+						if err != nil || !found || !bytes.Equal(value, values[i]) {
+							errs <- fmt.Errorf("Get(%s) = %q, %v, %v", keys[i], value, found, err)
+							return
+						}
+						if _, found, _ := r.Get([]byte(keys[i] + "-missing")); found {
+							errs <- fmt.Errorf("Get found %s-missing", keys[i])
+							return
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSSTableGetAtSequence(t *testing.T) {
+	versions := []struct {
+		key   InternalKey
+		value []byte
+	}{
+		{InternalKey{UserKey: "a", SeqNum: 1, Type: OpTypePut}, []byte("a1")},
+		{InternalKey{UserKey: "b", SeqNum: 10, Type: OpTypePut}, []byte("b10")},
+		{InternalKey{UserKey: "b", SeqNum: 8, Type: OpTypeDelete}, nil},
+		{InternalKey{UserKey: "b", SeqNum: 5, Type: OpTypePut}, []byte("b5")},
+		{InternalKey{UserKey: "b", SeqNum: 2, Type: OpTypePut}, []byte("b2")},
+		{InternalKey{UserKey: "c", SeqNum: 3, Type: OpTypePut}, []byte("c3")},
+	}
+	//the version of b each snapshot sees, empty for the tombstone and nil for none
+	want := func(maxSeq uint64) []byte {
+		switch {
+		case maxSeq >= 10:
+			return []byte("b10")
+		case maxSeq >= 8:
+			return []byte{}
+		case maxSeq >= 5:
+			return []byte("b5")
+		case maxSeq >= 2:
+			return []byte("b2")
+		}
+		return nil
+	}
+	//every version in one block, and one block per entry
+	for _, blockSize := range []int{DefaultOptions().BlockSize, 1} {
+		opts := DefaultOptions()
+		opts.BlockSize = blockSize
+		opts.BlockRestartInterval = 2
+		var buf bytes.Buffer
+		b := NewSSTableBuilder(&buf, uint(len(versions)), opts)
+		for _, v := range versions {
+			if err := b.Add(v.key, v.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewSSTableReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, maxSeq := range []uint64{0, 1, 2, 3, 4, 5, 7, 8, 9, 10, 11, math.MaxUint64} {
+			value, found, err := r.GetAt([]byte("b"), maxSeq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := want(maxSeq)
+			if found != (w != nil) || (found && !bytes.Equal(value, w)) || (found && len(w) == 0 && value != nil) {
+				t.Fatalf("block size %d: GetAt(b, %d) = %q, %v, want %q", blockSize, maxSeq, value, found, w)
+			}
+		}
+		if value, found, err := r.Get([]byte("b")); err != nil || !found || string(value) != "b10" {
+			t.Fatalf("block size %d: Get(b) = %q, %v, %v, want the newest version", blockSize, value, found, err)
+		}
+		r.Close()
+	}
+}
+
+func TestSSTableBlockSize(t *testing.T) {
+	keys := make([]string, 1000)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%05d", i)
+		values[i] = []byte(fmt.Sprintf("value%05d", i))
+	}
+	blocks := make(map[int]uint64)
+	for _, blockSize := range []int{1024, DefaultOptions().BlockSize} {
+		opts := DefaultOptions()
+		opts.BlockSize = blockSize
+		props := buildTable(t, opts, keys, values).Properties()
+		if props.DataBlocks == 0 || props.AvgBlockFill <= 0 || props.AvgBlockFill > 1.5 {
+			t.Fatalf("block size %d: %d blocks with an average fill of %.2f", blockSize, props.DataBlocks, props.AvgBlockFill)
+		}
+		blocks[blockSize] = props.DataBlocks
+	}
+	if blocks[1024] <= blocks[DefaultOptions().BlockSize] {
+		t.Fatalf("%d blocks of 1KB, %d of the default size", blocks[1024], blocks[DefaultOptions().BlockSize])
+	}
+}
+
+func TestSSTableCorruptFilterFallsBackToBlocks(t *testing.T) {
+	keys := make([]string, 200)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%05d", i)
+		values[i] = []byte(fmt.Sprintf("value%05d", i))
+	}
+	//zeroing the bits of a whole filter but not the sizes in front of them
+	//leaves a filter that decodes and rejects every key, zeroing the top level
+	//of a partitioned filter leaves no partitions
+	variants := []struct {
+		name            string
+		partitionBlocks int
+		keep            int64
+	}{{"whole", 0, 24}, {"partitioned", 1, 0}}
+	for _, v := range variants {
+		name := v.name
+		opts := DefaultOptions()
+		opts.BlockSize = 256
+		opts.FilterPartitionBlocks = v.partitionBlocks
+		var buf bytes.Buffer
+		b := NewSSTableBuilder(&buf, uint(len(keys)), opts)
+		for i, key := range keys {
+			if err := b.Add(InternalKey{UserKey: key, SeqNum: uint64(i + 1), Type: OpTypePut}, values[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewSSTableReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		footer, err := r.readFooter()
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if footer.FilterSize == 0 {
+			t.Fatalf("%s: table written without a filter", name)
+		}
+		data := bytes.Clone(buf.Bytes())
+		clear(data[footer.FilterOffset+v.keep : footer.FilterOffset+int64(footer.FilterSize)])
+		r, err = NewSSTableReader(bytes.NewReader(data), int64(len(data)), opts)
+		if err != nil {
+			t.Fatalf("%s: opening with a corrupt filter: %v", name, err)
+		}
+		for i, key := range keys {
+			value, found, err := r.Get([]byte(key))
+			if err != nil || !found || !bytes.Equal(value, values[i]) {
+				t.Fatalf("%s: Get(%s) with a corrupt filter = %q, %v, %v", name, key, value, found, err)
+			}
+		}
+		r.Close()
+	}
+}
+
+func TestSSTableDumpEntries(t *testing.T) {
+	written := []InternalKey{
+		{UserKey: "apple", SeqNum: 7, Type: OpTypePut},
+		{UserKey: "apple", SeqNum: 4, Type: OpTypeDelete},
+		{UserKey: "apple", SeqNum: 2, Type: OpTypePut},
+		{UserKey: "banana", SeqNum: 5, Type: OpTypeDelete},
+		{UserKey: "cherry", SeqNum: 1, Type: OpTypePut},
+	}
+	opts := DefaultOptions()
+	//one entry per block, so the dump walks the index
+	opts.BlockSize = 1
+	path := filepath.Join(t.TempDir(), "00001.sst")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewSSTableBuilder(file, uint(len(written)), opts)
+	for _, key := range written {
+		if err := b.Add(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSSTableReaderWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	dumped, err := r.DumpEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumped) != len(written) {
+		t.Fatalf("dumped %d entries, wrote %d", len(dumped), len(written))
+	}
+	for i := range written {
+		if dumped[i] != written[i] {
+			t.Fatalf("entry %d is %+v, wrote %+v", i, dumped[i], written[i])
+		}
+	}
+	//the CLI prints one line per entry
+	var out bytes.Buffer
+	if err := dumpSSTable(&out, path); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != len(written) || lines[1] != `"apple" seq=4 delete` {
+		t.Fatalf("dump printed:\n%s", out.String())
+	}
+}
+
+func TestDBGetUsesHashIndex(t *testing.T) {
+	opts := DefaultOptions()
+	opts.UseHashIndex = true
+	db, dir := openTestDB(t, opts)
+	putKeys(t, db, 0, 20)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("%d SSTables after a flush, err %v", len(paths), err)
+	}
+	r, err := NewSSTableReaderWithOptions(paths[0], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer, err := r.readFooter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unambiguous []int
+	for i := 0; i < 20; i++ {
+		if b := r.hashIndex.Lookup([]byte(fmt.Sprintf("key%05d", i))); b != hashIndexEmpty && b != hashIndexCollision {
+			unambiguous = append(unambiguous, i)
+		}
+	}
+	r.Close()
+	if len(unambiguous) < 10 {
+		t.Fatalf("only %d of 20 keys have a bucket of their own", len(unambiguous))
+	}
+	//zero the user keys of the index, which then sorts before every key, so a
+	//binary search of it finds nothing and only the hash index finds the block
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := data[footer.IndexOffset : footer.IndexOffset+int64(footer.IndexSize)]
+	copy(index, bytes.ReplaceAll(index, []byte("key"), []byte{0, 0, 0}))
+	if err := os.WriteFile(paths[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range unambiguous {
+		got, found, err := db.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if want := fmt.Sprintf("value%05d", i); err != nil || !found || string(got) != want {
+			t.Fatalf("Get(key%05d) = %q, found %v, err %v, want %q", i, got, found, err, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultStatsLogInterval is the Options.StatsLogInterval set by DefaultOptions
+const DefaultStatsLogInterval = 30 * time.Second
+
+// GetProperty returns the value of a DB property and whether the property is known.
+// Supported properties:
+//   - "leveldb.stats": a table of file counts, sizes and compaction totals per level
+//   - "leveldb.level-stats": GetLevelInfo as a JSON array
+//   - "leveldb.sstables": one line per active SSTable, oldest first, with its
+//     size, entry count, data blocks and average block fill
+func (db *DB) GetProperty(name string) (string, bool) {
+	switch name {
+	case "leveldb.stats":
+		return db.levelStats(), true
+	case "leveldb.level-stats":
+		levels, err := db.GetLevelInfo()
+		if err != nil {
+			return "", false
+		}
+		out, err := json.Marshal(levels)
+		if err != nil {
+			return "", false
+		}
+		return string(out), true
+	case "leveldb.sstables":
+		return db.sstablesProperty(), true
+	default:
+		return "", false
+	}
+}
+
+// LevelInfo describes the SSTables of one level
+type LevelInfo struct {
+	Level      int
+	FileCount  int
+	TotalBytes int64
+	//number of tables a lookup may have to check, every file for level 0
+	ReadAmplification float64
+	//bytes written to the level by compaction per byte originally written by flushes
+	WriteAmplification float64
+}
+
+// GetLevelInfo returns the file count, size and amplification of every level.
+// All SSTables live in level 0, so it has a single entry.
+func (db *DB) GetLevelInfo() ([]LevelInfo, error) {
+	db.mu.RLock()
+	tables := make([]int, len(db.activeSSTables))
+	copy(tables, db.activeSSTables)
+	stats := db.stats
+	db.mu.RUnlock()
+	info := LevelInfo{Level: 0, FileCount: len(tables), ReadAmplification: float64(len(tables))}
+	fs := db.opts.fileSystem()
+	for _, num := range tables {
+		fi, err := fs.Stat(fmt.Sprintf("%s/%05d.sst", db.dataDir, num))
+		if os.IsNotExist(err) {
+			//removed by a compaction since the list was copied
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat SSTable %d: %w", num, err)
+		}
+		info.TotalBytes += fi.Size()
+	}
+	if stats.TotalFlushBytesWritten > 0 {
+		info.WriteAmplification = float64(stats.TotalCompactionBytesWritten) / float64(stats.TotalFlushBytesWritten)
+	}
+	return []LevelInfo{info}, nil
+}
+
+// levelStats formats the stats like LevelDB's "leveldb.stats" property.
+// All SSTables live in level 0, so it has a single row.
+func (db *DB) levelStats() string {
+	db.mu.RLock()
+	tables := make([]int, len(db.activeSSTables))
+	copy(tables, db.activeSSTables)
+	stats := db.stats
+	db.mu.RUnlock()
+	var size int64
+	for _, num := range tables {
+		size += fileSize(db.opts.fileSystem(), fmt.Sprintf("%s/%05d.sst", db.dataDir, num))
+	}
+	const mb = 1048576.0
+	var sb strings.Builder
+	sb.WriteString("                               Compactions\n")
+	sb.WriteString("Level  Files Size(MB) Time(sec) Read(MB) Write(MB)\n")
+	sb.WriteString("--------------------------------------------------\n")
+	fmt.Fprintf(&sb, "%3d %8d %8.0f %9.0f %8.0f %9.0f\n",
+		0,
+		len(tables),
+		float64(size)/mb,
+		stats.TotalCompactionDuration.Seconds(),
+		float64(stats.TotalCompactionBytesRead)/mb,
+		float64(stats.TotalCompactionBytesWritten)/mb)
+	return sb.String()
+}
+
+// sstablesProperty formats the "leveldb.sstables" property. Tables whose
+// properties could not be read show only their size.
+func (db *DB) sstablesProperty() string {
+	db.mu.RLock()
+	tables := make([]int, len(db.activeSSTables))
+	copy(tables, db.activeSSTables)
+	props := make(map[int]TableProperties, len(tables))
+	generations := make(map[int]int, len(tables))
+	for _, num := range tables {
+		if p, ok := db.tableProps[num]; ok {
+			props[num] = p
+		}
+		generations[num] = db.generations[num]
+	}
+	db.mu.RUnlock()
+	var sb strings.Builder
+	for _, num := range tables {
+		size := fileSize(db.opts.fileSystem(), fmt.Sprintf("%s/%05d.sst", db.dataDir, num))
+		fmt.Fprintf(&sb, "%05d.sst: %d bytes, generation %d", num, size, generations[num])
+		if p, ok := props[num]; ok {
+			fmt.Fprintf(&sb, ", %d entries, %d blocks of %d bytes, avg fill %.2f, keys [%q .. %q]",
+				p.NumEntries, p.DataBlocks, p.BlockSize, p.AvgBlockFill, p.SmallestKey, p.LargestKey)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// SSTableInfo describes a live SSTable, as returned by DB.SSTables
+type SSTableInfo struct {
+	Path    string
+	FileNum int
+	//all SSTables live in a single level for now, so this is always 0
+	Level int
+	//compactions the data went through, 0 for a flushed table
+	Generation int
+	Size       int64
+	NumEntries uint64
+	//user key range, LargestKey is empty for tables written before it was recorded
+	SmallestKey string
+	LargestKey  string
+	// FilterFalsePositiveRate estimates the fraction of lookups of absent keys
+	// that get past the filter, from the filter's bits per key. It is 1 for a
+	// table without a filter the DB's FilterPolicy can use.
+	FilterFalsePositiveRate float64
+}
+
+// SSTables describes the live SSTables, oldest first. It reads the properties
+// kept in memory and the filter of each table, not its data blocks. A table
+// that cannot be opened is still listed, with a false positive rate of 1.
+func (db *DB) SSTables() []SSTableInfo {
+	db.mu.RLock()
+	tables := make([]int, len(db.activeSSTables))
+	copy(tables, db.activeSSTables)
+	props := make(map[int]TableProperties, len(tables))
+	generations := make(map[int]int, len(tables))
+	for _, num := range tables {
+		if p, ok := db.tableProps[num]; ok {
+			props[num] = p
+		}
+		generations[num] = db.generations[num]
+	}
+	db.mu.RUnlock()
+	infos := make([]SSTableInfo, 0, len(tables))
+	for _, num := range tables {
+		info := SSTableInfo{
+			Path:                    fmt.Sprintf("%s/%05d.sst", db.dataDir, num),
+			FileNum:                 num,
+			Generation:              generations[num],
+			FilterFalsePositiveRate: 1,
+		}
+		info.Size = fileSize(db.opts.fileSystem(), info.Path)
+		p, ok := props[num]
+		reader, err := db.openSSTable(num)
+		if err != nil {
+			db.opts.logger().Errorf("Failed to open SSTable %d to describe it: %v", num, err)
+		} else {
+			if !ok {
+				p = reader.properties
+			}
+			info.FilterFalsePositiveRate = reader.filterFalsePositiveRate()
+			reader.Close()
+		}
+		info.NumEntries = p.NumEntries
+		info.SmallestKey, info.LargestKey = p.SmallestKey, p.LargestKey
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// logStatsLoop logs the "leveldb.stats" property every interval until the DB is closed
+func (db *DB) logStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats, _ := db.GetProperty("leveldb.stats")
+			db.opts.logger().Infof("DB stats:\n%s", stats)
+		case <-db.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSSTablesInfo(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 10, 110)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tables := db.SSTables()
+	if len(tables) != 1 {
+		t.Fatalf("%d SSTables after one flush, want 1", len(tables))
+	}
+	info := tables[0]
+	stat, err := os.Stat(info.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(db.dataDir, fmt.Sprintf("%05d.sst", info.FileNum)); filepath.Clean(info.Path) != want {
+		t.Fatalf("Path = %s, want %s", info.Path, want)
+	}
+	if info.Size != stat.Size() || info.NumEntries != 100 || info.Level != 0 || info.Generation != 0 {
+		t.Fatalf("info %+v, want %d bytes and 100 entries of a flushed table", info, stat.Size())
+	}
+	if info.SmallestKey != "key00010" || info.LargestKey != "key00109" {
+		t.Fatalf("key range [%s, %s], want [key00010, key00109]", info.SmallestKey, info.LargestKey)
+	}
+	//a bloom filter of DefaultBloomBitsPerKey bits per key is close to 1%
+	if info.FilterFalsePositiveRate <= 0 || info.FilterFalsePositiveRate > 0.02 {
+		t.Fatalf("FilterFalsePositiveRate = %v, want about 1%%", info.FilterFalsePositiveRate)
+	}
+}
+
+func TestLevelDBStatsProperty(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 0, 10000)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	out, ok := db.GetProperty("leveldb.stats")
+	if !ok {
+		t.Fatal("leveldb.stats is not a known property")
+	}
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) != 4 || strings.Join(strings.Fields(lines[1]), " ") != "Level Files Size(MB) Time(sec) Read(MB) Write(MB)" {
+		t.Fatalf("unexpected leveldb.stats layout:\n%s", out)
+	}
+	row := strings.Fields(lines[3])
+	if len(row) != 6 {
+		t.Fatalf("level row has %d columns, want 6: %q", len(row), lines[3])
+	}
+	for i, field := range row {
+		if _, err := strconv.ParseFloat(field, 64); err != nil {
+			t.Fatalf("column %d of the level row: %v", i, err)
+		}
+	}
+	if row[0] != "0" {
+		t.Fatalf("row is for level %s, want 0", row[0])
+	}
+	if files, _ := strconv.Atoi(row[1]); files < 1 {
+		t.Fatalf("leveldb.stats shows %d L0 files after a flush:\n%s", files, out)
+	}
+	if _, ok := db.GetProperty("leveldb.unknown"); ok {
+		t.Fatal("an unknown property was reported as known")
+	}
+}
+
+func TestSSTablesProperty(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BlockSize = 1024
+	db, _ := openTestDB(t, opts)
+	putKeys(t, db, 0, 100)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	out, ok := db.GetProperty("leveldb.sstables")
+	if !ok {
+		t.Fatal("leveldb.sstables is not a known property")
+	}
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) != len(db.SSTables()) {
+		t.Fatalf("%d lines for %d SSTables:\n%s", len(lines), len(db.SSTables()), out)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "blocks of 1024 bytes, avg fill ") {
+			t.Fatalf("line without the block size and fill: %q", line)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync"
+)
+
+// subscriber queues the entries of one Subscribe call. The queue is unbounded,
+// so a slow reader never blocks writers; it only grows the queue.
+type subscriber struct {
+	mu      sync.Mutex
+	fromSeq uint64
+	queue   []LogEntry
+	//sequence numbers already read from the WALs, a live write may be published
+	//after its WAL entry was read and must not be delivered twice
+	seen    map[uint64]bool
+	notify  chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+}
+
+func (s *subscriber) push(entries []LogEntry) {
+	s.mu.Lock()
+	for _, entry := range entries {
+		if entry.SeqNum < s.fromSeq {
+			continue
+		}
+		if s.seen[entry.SeqNum] {
+			delete(s.seen, entry.SeqNum)
+			continue
+		}
+		s.queue = append(s.queue, entry)
+	}
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) stop() {
+	s.stopped.Do(func() { close(s.done) })
+}
+
+// deliver sends queued entries to out in order until the subscriber is stopped
+func (s *subscriber) deliver(out chan<- LogEntry) {
+	defer close(out)
+	for {
+		s.mu.Lock()
+		batch := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, entry := range batch {
+			select {
+			case out <- entry:
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Subscribe streams every committed put, delete and range delete with a sequence
+// number >= fromSeq. Entries still in the rotated and active WALs are delivered
+// first, then live writes, all in sequence order. Entries whose WAL
+// was already deleted after a flush are not available. The returned func stops
+// delivery and closes the channel; Close stops every subscription.
+func (db *DB) Subscribe(fromSeq uint64) (<-chan LogEntry, func()) {
+	sub := &subscriber{
+		fromSeq: fromSeq,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	//register before reading the WALs so no write falls in between
+	db.subMu.Lock()
+	if db.subscribers == nil {
+		db.subscribers = make(map[*subscriber]struct{})
+	}
+	db.subscribers[sub] = struct{}{}
+	db.subMu.Unlock()
+
+	history := db.walHistory(fromSeq)
+	sub.mu.Lock()
+	sub.seen = make(map[uint64]bool, len(history))
+	for _, entry := range history {
+		sub.seen[entry.SeqNum] = true
+	}
+	//live entries that were also read from the WAL are dropped
+	for _, entry := range sub.queue {
+		if sub.seen[entry.SeqNum] {
+			delete(sub.seen, entry.SeqNum)
+			continue
+		}
+		history = append(history, entry)
+	}
+	sub.queue = history
+	sub.mu.Unlock()
+
+	out := make(chan LogEntry)
+	go sub.deliver(out)
+	unsubscribe := func() {
+		db.subMu.Lock()
+		delete(db.subscribers, sub)
+		db.subMu.Unlock()
+		sub.stop()
+	}
+	return out, unsubscribe
+}
+
+// subscriberBufferSize is the channel buffer of every SubscribeFunc callback
+// with Options.AsyncSubscribers
+const subscriberBufferSize = 1024
+
+// funcSubscriber is a SubscribeFunc registration
+type funcSubscriber struct {
+	fn func(key, value []byte, opType OpType)
+	//AsyncSubscribers only: entries waiting for the delivery goroutine
+	ch      chan LogEntry
+	stopped sync.Once
+}
+
+func (s *funcSubscriber) stop() {
+	if s.ch != nil {
+		s.stopped.Do(func() { close(s.ch) })
+	}
+}
+
+// SubscribeFunc registers fn to be called with every put and delete after it
+// committed, including each key of a WriteBatch once the batch is in the WAL.
+// Range deletes are not reported, use Subscribe to see them, and values written
+// by PutWithVersion are passed without their user timestamp. The returned func
+// unsubscribes.
+//
+// By default fn runs synchronously in the writing goroutine before the next
+// write commits, so callbacks of concurrent writes never overlap and come in
+// sequence order. key and value must not be retained after fn
+// returns and fn must not unsubscribe itself. With Options.AsyncSubscribers fn
+// is called from a dedicated goroutine with copies of key and value instead.
+func (db *DB) SubscribeFunc(fn func(key, value []byte, opType OpType)) func() {
+	sub := &funcSubscriber{fn: fn}
+	if db.opts.AsyncSubscribers {
+		sub.ch = make(chan LogEntry, subscriberBufferSize)
+		go func() {
+			for entry := range sub.ch {
+				fn(entry.Key, userValue(&entry), opTypeOf(entry.Op))
+			}
+		}()
+	}
+	db.notifyMu.Lock()
+	if db.funcSubscribers == nil {
+		db.funcSubscribers = make(map[*funcSubscriber]struct{})
+	}
+	db.funcSubscribers[sub] = struct{}{}
+	db.notifyMu.Unlock()
+	return func() {
+		db.notifyMu.Lock()
+		delete(db.funcSubscribers, sub)
+		db.notifyMu.Unlock()
+		sub.stop()
+	}
+}
+
+// opTypeOf maps a WAL operation to the OpType of its internal key
+func opTypeOf(op byte) OpType {
+	if op == OpDelete {
+		return OpTypeDelete
+	}
+	return OpTypePut
+}
+
+// userValue returns the value of a put as the caller wrote it, without the user
+// timestamp of a versioned put
+func userValue(entry *LogEntry) []byte {
+	if entry.Op == OpPutVersioned {
+		_, value, _ := decodeVersionedValue(entry.Value)
+		return value
+	}
+	return entry.Value
+}
+
+// publish hands committed entries to every subscriber
+func (db *DB) publish(entries ...*LogEntry) {
+	db.publishChannels(entries)
+	db.publishFuncs(entries)
+}
+
+// publishFuncs calls the SubscribeFunc callbacks, or queues the entries for the
+// asynchronous ones
+func (db *DB) publishFuncs(entries []*LogEntry) {
+	db.notifyMu.Lock()
+	defer db.notifyMu.Unlock()
+	for sub := range db.funcSubscribers {
+		for _, entry := range entries {
+			if entry.Op == OpRangeDelete {
+				continue
+			}
+			if sub.ch == nil {
+				sub.fn(entry.Key, userValue(entry), opTypeOf(entry.Op))
+				continue
+			}
+			//copy, the caller may reuse its key and value buffers
+			sub.ch <- LogEntry{Op: entry.Op, Key: bytes.Clone(entry.Key), Value: bytes.Clone(entry.Value), SeqNum: entry.SeqNum}
+		}
+	}
+}
+
+// publishChannels hands committed entries to every Subscribe channel
+func (db *DB) publishChannels(entries []*LogEntry) {
+	db.subMu.Lock()
+	defer db.subMu.Unlock()
+	if len(db.subscribers) == 0 {
+		return
+	}
+	//copy, the caller may reuse its key and value buffers
+	copies := make([]LogEntry, len(entries))
+	for i, entry := range entries {
+		copies[i] = LogEntry{
+			Op:     entry.Op,
+			Key:    bytes.Clone(entry.Key),
+			Value:  bytes.Clone(entry.Value),
+			SeqNum: entry.SeqNum,
+		}
+	}
+	for sub := range db.subscribers {
+		sub.push(copies)
+	}
+}
+
+// stopSubscribers ends every subscription of Subscribe and SubscribeFunc, called by Close
+func (db *DB) stopSubscribers() {
+	db.subMu.Lock()
+	defer db.subMu.Unlock()
+	for sub := range db.subscribers {
+		sub.stop()
+	}
+	db.subscribers = nil
+	db.notifyMu.Lock()
+	defer db.notifyMu.Unlock()
+	for sub := range db.funcSubscribers {
+		sub.stop()
+	}
+	db.funcSubscribers = nil
+}
+
+// walHistory reads the entries with a sequence number >= fromSeq from the
+// rotated and active WALs, sorted by sequence number
+func (db *DB) walHistory(fromSeq uint64) []LogEntry {
+	if db.opts.InMemory {
+		return nil
+	}
+	//flushes rotate and delete WALs under the write lock
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	fs := db.opts.fileSystem()
+	walFiles := listWALs(fs, db.walDir())
+	var history []LogEntry
+	for _, walPath := range walFiles {
+		entries, err := readWALEntries(fs, walPath)
+		if err != nil {
+			db.opts.logger().Errorf("Subscribe: failed to read WAL %s: %v", walPath, err)
+		}
+		for _, entry := range entries {
+			if entry.SeqNum >= fromSeq {
+				history = append(history, *entry)
+			}
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].SeqNum < history[j].SeqNum })
+	return history
+}
+
+// readWALEntries reads the valid entries of a WAL without modifying it. Unlike
+// Replay it stops quietly at a bad entry, which may be a write still in progress.
+func readWALEntries(fs FS, path string) ([]*LogEntry, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := newWALReader(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*LogEntry
+	for {
+		entry, err := reader.next()
+		if err != nil {
+			//io.EOF, or a torn entry at the tail
+			return entries, nil
+		}
+		entries = append(entries, entry)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receive reads n entries from ch, failing if they take more than a few seconds
+func receive(t *testing.T, ch <-chan LogEntry, n int) []LogEntry {
+	t.Helper()
+	var entries []LogEntry
+	timeout := time.After(5 * time.Second)
+	for len(entries) < n {
+		select {
+		case entry, ok := <-ch:
+			if !ok {
+				t.Fatalf("subscription closed after %d of %d entries", len(entries), n)
+			}
+			entries = append(entries, entry)
+		case <-timeout:
+			t.Fatalf("received %d of %d entries", len(entries), n)
+		}
+	}
+	return entries
+}
+
+func TestSubscribe(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	//written before subscribing, replayed from the WAL
+	putKeys(t, db, 0, 10)
+	ch, unsubscribe := db.Subscribe(0)
+	putKeys(t, db, 10, 100)
+	if err := db.Delete([]byte("key00005")); err != nil {
+		t.Fatal(err)
+	}
+	entries := receive(t, ch, 101)
+	for i, entry := range entries[:100] {
+		key, value := fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i)
+		if entry.Op != OpPut || string(entry.Key) != key || string(entry.Value) != value {
+			t.Fatalf("entry %d is %v %s = %s, want a put of %s = %s", i, entry.Op, entry.Key, entry.Value, key, value)
+		}
+		if i > 0 && entry.SeqNum <= entries[i-1].SeqNum {
+			t.Fatalf("entry %d has seqnum %d after %d", i, entry.SeqNum, entries[i-1].SeqNum)
+		}
+	}
+	if last := entries[100]; last.Op != OpDelete || string(last.Key) != "key00005" {
+		t.Fatalf("last entry is %v %s, want the delete of key00005", last.Op, last.Key)
+	}
+	unsubscribe()
+	putKeys(t, db, 100, 110)
+	for entry := range ch {
+		t.Fatalf("received %v %s after unsubscribing", entry.Op, entry.Key)
+	}
+}
+
+func TestSubscribeFromSeq(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	putKeys(t, db, 0, 20)
+	ch, unsubscribe := db.Subscribe(0)
+	all := receive(t, ch, 20)
+	unsubscribe()
+	//only the entries from the eleventh on
+	ch, unsubscribe = db.Subscribe(all[10].SeqNum)
+	defer unsubscribe()
+	for i, entry := range receive(t, ch, 10) {
+		if entry.SeqNum != all[10+i].SeqNum || string(entry.Key) != string(all[10+i].Key) {
+			t.Fatalf("entry %d is %s at seqnum %d, want %s at %d", i, entry.Key, entry.SeqNum, all[10+i].Key, all[10+i].SeqNum)
+		}
+	}
+}
+
+func TestSubscribeConcurrentWritersInOrder(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	ch, unsubscribe := db.Subscribe(0)
+	defer unsubscribe()
+	const writers, writes = 8, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := []byte(fmt.Sprintf("w%02d-%05d", w, i))
+				var err error
+				if i%10 == 0 {
+					//a batch takes two sequence numbers at once
+					b := NewWriteBatch()
+					b.Put(key, []byte("batched"))
+					b.Delete(key)
+					err = db.Write(b)
+				} else {
+					err = db.Put(key, []byte("value"))
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	entries := receive(t, ch, writers*(writes+writes/10))
+	for i := 1; i < len(entries); i++ {
+		if entries[i].SeqNum != entries[i-1].SeqNum+1 {
+			t.Fatalf("entry %d has seqnum %d after %d", i, entries[i].SeqNum, entries[i-1].SeqNum)
+		}
+	}
+}
+
+// notification is a call of a SubscribeFunc callback
+type notification struct {
+	key, value string
+	opType     OpType
+}
+
+func TestSubscribeFunc(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async %v", async), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.AsyncSubscribers = async
+			db, _ := openTestDB(t, opts)
+			received := make(chan notification, 200)
+			unsubscribe := db.SubscribeFunc(func(key, value []byte, opType OpType) {
+				received <- notification{string(key), string(value), opType}
+			})
+			putKeys(t, db, 0, 100)
+			batch := NewWriteBatch()
+			batch.Put([]byte("batched"), []byte("value"))
+			batch.Delete([]byte("key00000"))
+			if err := db.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			want := make([]notification, 0, 102)
+			for i := 0; i < 100; i++ {
+				want = append(want, notification{fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i), OpTypePut})
+			}
+			want = append(want, notification{"batched", "value", OpTypePut}, notification{"key00000", "", OpTypeDelete})
+			timeout := time.After(5 * time.Second)
+			for i, w := range want {
+				select {
+				case got := <-received:
+					if got != w {
+						t.Fatalf("notification %d is %+v, want %+v", i, got, w)
+					}
+				case <-timeout:
+					t.Fatalf("received %d of %d notifications", i, len(want))
+				}
+			}
+			unsubscribe()
+			putKeys(t, db, 100, 110)
+			//give an asynchronous subscriber time to deliver a late notification
+			time.Sleep(10 * time.Millisecond)
+			select {
+			case got := <-received:
+				t.Fatalf("notified of %+v after unsubscribing", got)
+			default:
+			}
+		})
+	}
+}
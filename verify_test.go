@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyReportsCorruptedDataBlock(t *testing.T) {
+	db, dir := openTestDB(t, nil)
+	for round := 0; round < 2; round++ {
+		putKeys(t, db, round*100, (round+1)*100)
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := db.Verify()
+	if err != nil || !report.OK() {
+		t.Fatalf("Verify of intact tables = %v, %+v", err, report.Errors)
+	}
+	tables := db.SSTables()
+	//a value in the data blocks of the newest table
+	name := fmt.Sprintf("%05d.sst", tables[len(tables)-1].FileNum)
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(data, []byte("value00150"))
+	if pos < 0 {
+		t.Fatalf("value00150 not found in %s", name)
+	}
+	//the data block holding it
+	r, err := NewSSTableReader(bytes.NewReader(data), int64(len(data)), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := int64(-1)
+	for i := 0; i < r.index.Len(); i++ {
+		entry, err := r.index.Entry(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Offset <= int64(pos) && int64(pos) < entry.Offset+int64(entry.Size) {
+			block = entry.Offset
+		}
+	}
+	r.Close()
+	if block < 0 {
+		t.Fatalf("offset %d is not in a data block", pos)
+	}
+	data[pos] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = db.Verify()
+	if !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Verify of a corrupted table = %v, want ErrCorruption", err)
+	}
+	if report.FilesChecked != len(tables) || len(report.Errors) != 1 || len(report.Errors[name]) == 0 {
+		t.Fatalf("report checked %d files with errors %+v, want errors for %s only", report.FilesChecked, report.Errors, name)
+	}
+	found := false
+	for _, blockErr := range report.Errors[name] {
+		found = found || blockErr.Offset == block
+	}
+	if !found {
+		t.Fatalf("no error points at the data block at offset %d: %v", block, report.Errors[name])
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OpTypeVersionedPut marks a put written by PutWithVersion. The stored value
+// carries the caller's timestamp in front of the value:
+// [User Timestamp (8 bytes)][Value]
+// It is the same in the WAL, the memtables and the SSTables.
+const OpTypeVersionedPut OpType = 4
+
+// OpPutVersioned is the WAL operation of PutWithVersion. It equals
+// OpTypeVersionedPut because replay uses the operation as the key type.
+const OpPutVersioned byte = OpTypeVersionedPut
+
+// userTsSize is the size of the user timestamp in front of a versioned value
+const userTsSize = 8
+
+// encodeVersionedValue prefixes value with userTs
+func encodeVersionedValue(userTs uint64, value []byte) []byte {
+	buf := make([]byte, userTsSize+len(value))
+	binary.BigEndian.PutUint64(buf, userTs)
+	copy(buf[userTsSize:], value)
+	return buf
+}
+
+// decodeVersionedValue splits a stored versioned value into its user timestamp
+// and value. The value shares data.
+func decodeVersionedValue(data []byte) (uint64, []byte, error) {
+	if len(data) < userTsSize {
+		return 0, nil, fmt.Errorf("%w: versioned value of %d bytes", ErrCorruption, len(data))
+	}
+	return binary.BigEndian.Uint64(data), data[userTsSize:], nil
+}
+
+// PutWithVersion is Put with a timestamp chosen by the caller, such as a hybrid
+// logical clock, kept next to the value and returned by GetWithVersion, History
+// and Iterator.Version. It is unrelated to the sequence number, which still
+// orders writes unless Options.UserTimestampOrdering is set: then a write whose
+// userTs is below the one of the current value of key is dropped, so the value
+// with the highest userTs wins whatever the order the writes arrive in. Values
+// written by Put count as userTs 0.
+func (db *DB) PutWithVersion(key, value []byte, userTs uint64) error {
+	if !db.opts.UserTimestampOrdering {
+		db.writeMu.RLock()
+		defer db.writeMu.RUnlock()
+		return db.putVersionedLocked(key, value, userTs)
+	}
+	//hold off other writes between the check and the put, like CompareAndSwap
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	_, currentTs, found, _, err := db.get(key)
+	if err != nil {
+		return err
+	}
+	if found && currentTs > userTs {
+		db.opts.logger().Debugf("Dropped put of %q at user timestamp %d, current is %d", key, userTs, currentTs)
+		return nil
+	}
+	return db.putVersionedLocked(key, value, userTs)
+}
+
+// putVersionedLocked is PutWithVersion for callers already holding writeMu
+func (db *DB) putVersionedLocked(key, value []byte, userTs uint64) error {
+	return db.write(key, encodeVersionedValue(userTs, value), OpTypeVersionedPut, true)
+}
+
+// GetWithVersion is Get, also returning the user timestamp the value was written
+// with by PutWithVersion, or 0 for a value written by Put.
+func (db *DB) GetWithVersion(key []byte) ([]byte, uint64, bool, error) {
+	val, userTs, found, source, err := db.get(key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if m := db.opts.Metrics; m != nil {
+		m.OnGet(found, source)
+	}
+	return val, userTs, found, nil
+}
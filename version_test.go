@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+// checkVersion fails unless key holds value at user timestamp userTs
+func checkVersion(t *testing.T, db *DB, key, value string, userTs uint64) {
+	t.Helper()
+	got, gotTs, found, err := db.GetWithVersion([]byte(key))
+	if err != nil || !found || string(got) != value || gotTs != userTs {
+		t.Fatalf("GetWithVersion(%s) = %q at %d, found %v, err %v, want %q at %d", key, got, gotTs, found, err, value, userTs)
+	}
+}
+
+func TestPutWithVersion(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	if err := db.PutWithVersion([]byte("key"), []byte("new"), 20); err != nil {
+		t.Fatal(err)
+	}
+	//without UserTimestampOrdering the latest write wins whatever its userTs
+	if err := db.PutWithVersion([]byte("key"), []byte("old"), 10); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, "key", "old", 10)
+	if err := db.Put([]byte("key"), []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, "key", "plain", 0)
+}
+
+func TestUserTimestampOrdering(t *testing.T) {
+	opts := DefaultOptions()
+	opts.UserTimestampOrdering = true
+	db, dir := openTestDB(t, opts)
+	put := func(key, value string, userTs uint64) {
+		t.Helper()
+		if err := db.PutWithVersion([]byte(key), []byte(value), userTs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("memtable", "new", 20)
+	put("memtable", "old", 10)
+	checkVersion(t, db, "memtable", "new", 20)
+	//an equal timestamp is not older, so the later write wins the tie
+	put("memtable", "tie", 20)
+	checkVersion(t, db, "memtable", "tie", 20)
+	put("memtable", "newer", 30)
+	checkVersion(t, db, "memtable", "newer", 30)
+
+	//the current timestamp is also found once it is in an SSTable
+	put("sstable", "new", 20)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	put("sstable", "old", 10)
+	checkVersion(t, db, "sstable", "new", 20)
+
+	//a value written by Put counts as userTs 0
+	if err := db.Put([]byte("plain"), []byte("put")); err != nil {
+		t.Fatal(err)
+	}
+	put("plain", "versioned", 1)
+	checkVersion(t, db, "plain", "versioned", 1)
+
+	//the timestamps survive WAL replay
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDBWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkVersion(t, db, "memtable", "newer", 30)
+	checkVersion(t, db, "sstable", "new", 20)
+	if err := db.PutWithVersion([]byte("memtable"), []byte("stale"), 25); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, "memtable", "newer", 30)
+}
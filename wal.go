@@ -6,13 +6,77 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math/bits"
 	"os"
 	"sync"
+	"time"
 )
 
 const (
 	OpPut byte = iota
 	OpDelete
+	// OpRangeDelete deletes every key in [Key, Value), it is only written by WriteBatch
+	OpRangeDelete
+)
+
+// OpBatch is the operation of a WAL record holding several entries written
+// together by WAL.WriteEntries, replayed all or none. The high bit keeps it
+// apart from the operations of single entries, which double as InternalKey types.
+const OpBatch byte = 0x80
+
+// validWALOp reports whether op is the operation of a WAL entry
+func validWALOp(op byte) bool {
+	switch op {
+	case OpPut, OpDelete, OpRangeDelete, OpPutVersioned:
+		return true
+	}
+	return false
+}
+
+const (
+	// walMagic starts every WAL file, followed by a 4-byte format version
+	walMagic = "\x8c\x1e\x53\xa7\x0b\x6d\x2f\x91"
+	// WALFormatVersion is the version written in the header of new WAL files.
+	// Version 2 files are cut into blocks of walBlockSize bytes holding record
+	// fragments, version 3 files can also hold OpBatch records. Version 1 files
+	// are a stream of entries after the header and version 0 files predate the
+	// header; these older versions are only replayed, once.
+	WALFormatVersion = 3
+	// walHeaderSize is the magic plus the format version
+	walHeaderSize = len(walMagic) + 4
+)
+
+// A WAL of version 2 or later is a sequence of blocks of walBlockSize bytes,
+// counted from the start of the file, so the header is in the first block.
+// Every entry is written as a record, the entry without its checksum:
+// [Seq (8 bytes)][Key Size (4 bytes)][Value Size (4 bytes)][Operation (1 byte)][Key][Value]
+// A record is cut into fragments that never cross a block boundary:
+// [Checksum (4 bytes)][Length (2 bytes)][Type (1 byte)][Data (Length bytes)]
+// The checksum covers the type and the data. A record fitting in the rest of a
+// block is a single FULL fragment, others are a FIRST fragment, MIDDLE
+// fragments and a LAST fragment. The last bytes of a block too few for a
+// fragment header are zeros the reader skips. After a bad fragment the reader
+// can resynchronize at the next block, see SkipAnyCorruptedRecords.
+//
+// Entries written together are a single OpBatch record, from version 3. Its key
+// is empty, its sequence number is the first of its entries and its value is
+// the number of entries followed by the entries, each encoded as a record:
+// [Count (4 bytes)][Entry 1]...[Entry Count]
+// Since one record has one checksum, a batch cut short by a crash or corrupted
+// is dropped as a whole.
+const (
+	walBlockSize          = 32 * 1024
+	walFragmentHeaderSize = 4 + 2 + 1
+	// walRecordHeaderSize is the sequence number, key and value sizes and operation
+	walRecordHeaderSize = 8 + 4 + 4 + 1
+)
+
+// fragment types of a WAL of version 2 or later
+const (
+	walFullFragment byte = iota + 1
+	walFirstFragment
+	walMiddleFragment
+	walLastFragment
 )
 
 // Log Entry represents single operation in the WAL
@@ -24,78 +88,306 @@ type LogEntry struct {
 }
 
 type WAL struct {
-	file *os.File
+	file File
 	mu   sync.Mutex
 	bw   *bufio.Writer
+	//optional, told how long every sync takes
+	metrics Metrics
+	//*[]byte scratch space for encoding entries, with power of two capacities
+	bufPool sync.Pool
+	//when WriteEntries syncs, set by the DB from Options.WALSyncMode
+	syncMode WALSyncMode
+	//bytes written since the last sync, counted by writeRecord
+	unsynced int64
+	//with WALSyncPeriodic, syncDue is signalled once unsynced reaches syncBytes
+	syncBytes int64
+	syncDue   chan<- struct{}
+	closed    bool
+	//position of the end of the file in its current block
+	blockOffset int
+}
+
+// maxPooledWALBuffer is the largest encoding buffer kept in WAL.bufPool, so a
+// single huge value does not stay pinned in memory
+const maxPooledWALBuffer = 1 << 20
+
+// getBuffer returns a buffer of length size from the pool, growing it to the
+// next power of two when the pooled one is too small
+func (w *WAL) getBuffer(size int) *[]byte {
+	buf, _ := w.bufPool.Get().(*[]byte)
+	if buf == nil {
+		buf = new([]byte)
+	}
+	if cap(*buf) < size {
+		*buf = make([]byte, size, 1<<bits.Len(uint(size-1)))
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// putBuffer hands a buffer from getBuffer back once it has been written
+func (w *WAL) putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledWALBuffer {
+		return
+	}
+	w.bufPool.Put(buf)
 }
 
 // NewWAL opens or create a WAL file at the given path
 func NewWal(path string) (*WAL, error) {
+	return openWAL(OSFS, path)
+}
+
+// openWAL is NewWal on fs
+func openWAL(fs FS, path string) (*WAL, error) {
 	//open the file with flags for appending, creating if it not exists and writing
 	flag := os.O_APPEND | os.O_WRONLY | os.O_CREATE
 	mode := 0644 // user/owner can read, write, cannot execute
-	file, err := os.OpenFile(path, flag, os.FileMode(mode))
+	file, err := fs.OpenFile(path, flag, os.FileMode(mode))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	//a new file gets the header, an existing one must be in the current format
+	//to be appended to, older WALs are only replayed
+	size := stat.Size()
+	if size == 0 {
+		header := make([]byte, walHeaderSize)
+		copy(header, walMagic)
+		binary.LittleEndian.PutUint32(header[len(walMagic):], WALFormatVersion)
+		if _, err := file.Write(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+		size = int64(walHeaderSize)
+	} else if version, err := readWALVersion(fs, path); err != nil || version != WALFormatVersion {
+		file.Close()
+		if err == nil {
+			err = fmt.Errorf("%w: cannot append to WAL %s of version %d", ErrUnsupportedVersion, path, version)
+		}
 		return nil, err
 	}
 	return &WAL{
-		file: file,
-		bw:   bufio.NewWriter(file),
+		file:        file,
+		bw:          bufio.NewWriter(file),
+		blockOffset: int(size % walBlockSize),
 	}, nil
 }
 
-// Close WAL file
+// readWALVersion returns the format version of the WAL at path
+func readWALVersion(fs FS, path string) (uint32, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	version, _, err := readWALHeader(bufio.NewReader(file))
+	return version, err
+}
+
+// readWALHeader consumes the header at the start of a WAL, returning its format
+// version and size. Files without the magic predate the header, they are
+// version 0 and read from the start.
+func readWALHeader(reader *bufio.Reader) (uint32, int, error) {
+	header, _ := reader.Peek(walHeaderSize)
+	if len(header) < walHeaderSize || string(header[:len(walMagic)]) != walMagic {
+		return 0, 0, nil
+	}
+	version := binary.LittleEndian.Uint32(header[len(walMagic):])
+	if version == 0 || version > WALFormatVersion {
+		return 0, 0, fmt.Errorf("%w: WAL version %d, supported up to %d", ErrUnsupportedVersion, version, WALFormatVersion)
+	}
+	n, err := reader.Discard(walHeaderSize)
+	return version, n, err
+}
+
+// Close WAL file, syncing what was written since the last sync
 func (w *WAL) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.bw.Flush(); err != nil {
 		return err
 	}
+	if w.unsynced > 0 {
+		if err := w.sync(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	w.closed = true
 	return w.file.Close()
 }
 
-// LogEntry format: crc(4 bytes) - length (2 bytes) - type(1 byte) - data(power of 1 byte)
-// Header: 7 bytes - crc(4 bytes) - length (2 bytes) - type(1 byte)
-// [crc (4 bytes)] [length (2 bytes, little-endian)] [type (1 byte)] [payload (length bytes)]
-// i use slightly different format
-// [Checksum(4 bytes)][Header][KV]
-// Header =[Seq(8 bytes)][Key Size (4 bytes)] [Value Size (4 bytes)] [Operation (1 byte)]
-// KV = [Key][Value]
-func (w *WAL) Write(entry *LogEntry) error {
+// Sync syncs everything written so far to stable storage. It does nothing
+// once the WAL is closed, Close synced it.
+func (w *WAL) Sync() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	keySize := len(entry.Key)
-	valueSize := len(entry.Value)
+	if w.closed || w.unsynced == 0 {
+		return nil
+	}
+	return w.sync()
+}
 
-	//Total size: seq(8 byte) + key_size(4) + value_size(4) + op(1) + key + value
-	entrySize := 8 + 4 + 4 + 1 + keySize + valueSize
-	buf := make([]byte, entrySize)
+// sync fsyncs the file, the caller holds w.mu and flushed w.bw
+func (w *WAL) sync() error {
+	var err error
+	if w.metrics == nil {
+		err = w.file.Sync()
+	} else {
+		start := time.Now()
+		err = w.file.Sync()
+		w.metrics.OnWALSync(time.Since(start))
+	}
+	if err == nil {
+		w.unsynced = 0
+	}
+	return err
+}
 
-	//encode the entry fields into the buffer
-	binary.LittleEndian.PutUint64(buf[0:8], entry.SeqNum)
-	binary.LittleEndian.PutUint32(buf[8:12], uint32(keySize))
-	binary.LittleEndian.PutUint32(buf[12:16], uint32(valueSize))
-	buf[16] = entry.Op
-	copy(buf[17:17+keySize], entry.Key)
-	copy(buf[17+keySize:], entry.Value)
-	//Calculate checksum over the encoded data
-	checkSum := crc32.ChecksumIEEE(buf)
-
-	//1.write checksum to the buffer writer
-	if err := binary.Write(w.bw, binary.LittleEndian, checkSum); err != nil {
-		return err
+// Write appends entry as a single record, see walBlockSize for the format
+func (w *WAL) Write(entry *LogEntry) error {
+	return w.WriteEntries([]*LogEntry{entry})
+}
+
+// WriteEntries appends all entries and, with WALSyncAlways, syncs the file once.
+// Several entries are written as one OpBatch record, so replay applies either
+// all of them or none.
+func (w *WAL) WriteEntries(entries []*LogEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	if len(entries) == 1 {
+		err = w.writeEntry(entries[0])
+	} else {
+		err = w.writeBatch(entries)
 	}
-	//2.write the rest of entry data
-	if _, err := w.bw.Write(buf); err != nil {
+	if err != nil {
 		return err
 	}
-	//3.flush the buffer to the file
+	//flush the buffer to the file
 	//aka moving data from the application buffer to os buffer
 	if err := w.bw.Flush(); err != nil {
 		return err
 	}
-	//4. Fsync to guarantee the write to persistent storage
-	return w.file.Sync()
+	switch w.syncMode {
+	case WALSyncAlways:
+		//Fsync to guarantee the write to persistent storage
+		return w.sync()
+	case WALSyncPeriodic:
+		if w.syncBytes > 0 && w.unsynced >= w.syncBytes {
+			select {
+			case w.syncDue <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// writeEntry encodes entry into the buffered writer, the caller flushes and syncs
+func (w *WAL) writeEntry(entry *LogEntry) error {
+	keySize := len(entry.Key)
+	valueSize := len(entry.Value)
+
+	//Total size: seq(8 byte) + key_size(4) + value_size(4) + op(1) + key + value
+	pooled := w.getBuffer(walRecordHeaderSize + keySize + valueSize)
+	defer w.putBuffer(pooled)
+	buf := *pooled
+
+	encodeWALRecord(buf, entry.SeqNum, entry.Op, entry.Key, entry.Value)
+
+	//the buffered writer copies the bytes, so the buffer can go back to the pool
+	return w.writeRecord(buf)
+}
+
+// writeBatch encodes entries as one OpBatch record into the buffered writer
+func (w *WAL) writeBatch(entries []*LogEntry) error {
+	valueSize := 4
+	for _, entry := range entries {
+		valueSize += walRecordHeaderSize + len(entry.Key) + len(entry.Value)
+	}
+	pooled := w.getBuffer(walRecordHeaderSize + valueSize)
+	defer w.putBuffer(pooled)
+	buf := *pooled
+
+	binary.LittleEndian.PutUint64(buf[0:8], entries[0].SeqNum)
+	binary.LittleEndian.PutUint32(buf[8:12], 0)
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(valueSize))
+	buf[16] = OpBatch
+	binary.LittleEndian.PutUint32(buf[walRecordHeaderSize:], uint32(len(entries)))
+	pos := walRecordHeaderSize + 4
+	for _, entry := range entries {
+		pos += encodeWALRecord(buf[pos:], entry.SeqNum, entry.Op, entry.Key, entry.Value)
+	}
+	return w.writeRecord(buf)
+}
+
+// encodeWALRecord encodes an entry into buf, which must have room for it, and
+// returns the number of bytes written
+func encodeWALRecord(buf []byte, seqNum uint64, op byte, key, value []byte) int {
+	binary.LittleEndian.PutUint64(buf[0:8], seqNum)
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(len(value)))
+	buf[16] = op
+	copy(buf[17:17+len(key)], key)
+	copy(buf[17+len(key):], value)
+	return walRecordHeaderSize + len(key) + len(value)
+}
+
+// walBlockTrailer pads the end of a block too short for a fragment header
+var walBlockTrailer [walFragmentHeaderSize - 1]byte
+
+// writeRecord writes record as fragments that do not cross a block boundary and
+// adds the bytes written, padding and fragment headers included, to w.unsynced
+func (w *WAL) writeRecord(record []byte) error {
+	var header [walFragmentHeaderSize]byte
+	first := true
+	for {
+		left := walBlockSize - w.blockOffset
+		if left < walFragmentHeaderSize {
+			if _, err := w.bw.Write(walBlockTrailer[:left]); err != nil {
+				return err
+			}
+			w.unsynced += int64(left)
+			w.blockOffset, left = 0, walBlockSize
+		}
+		n := min(len(record), left-walFragmentHeaderSize)
+		last := n == len(record)
+		typ := walMiddleFragment
+		switch {
+		case first && last:
+			typ = walFullFragment
+		case first:
+			typ = walFirstFragment
+		case last:
+			typ = walLastFragment
+		}
+		binary.LittleEndian.PutUint32(header[0:4], fragmentChecksum(typ, record[:n]))
+		binary.LittleEndian.PutUint16(header[4:6], uint16(n))
+		header[6] = typ
+		if _, err := w.bw.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.bw.Write(record[:n]); err != nil {
+			return err
+		}
+		w.blockOffset += walFragmentHeaderSize + n
+		w.unsynced += int64(walFragmentHeaderSize + n)
+		if last {
+			return nil
+		}
+		record, first = record[n:], false
+	}
+}
+
+// fragmentChecksum is the checksum of a fragment of type typ holding data
+func fragmentChecksum(typ byte, data []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE([]byte{typ}), crc32.IEEETable, data)
 }
 
 type RecoveredValue struct {
@@ -103,70 +395,430 @@ type RecoveredValue struct {
 	Type  OpType
 }
 
+// WALSyncMode decides when the WAL is synced to stable storage, trading the
+// durability of the latest writes for write throughput. In every mode a write
+// that returned has reached the OS, so it survives a crash of the process; the
+// modes differ in what a crash of the machine or a power loss may lose. The WAL
+// is also synced when it is rotated by a memtable flush, when the DB is closed
+// and by DB.SyncWAL.
+type WALSyncMode int
+
+const (
+	// WALSyncAlways syncs the WAL before every write returns: a write that
+	// returned survives a machine crash. It is the default.
+	WALSyncAlways WALSyncMode = iota
+	// WALSyncPeriodic syncs the WAL in the background every
+	// Options.WALSyncInterval, and as soon as Options.WALSyncBytes bytes were
+	// written since the last sync. A machine crash loses at most the writes of
+	// the last interval or, with WALSyncBytes set, about that many bytes of them.
+	WALSyncPeriodic
+	// WALSyncNever leaves syncing the WAL to the OS. A machine crash may lose
+	// every write since the last rotation, Close or DB.SyncWAL.
+	WALSyncNever
+)
+
+// DefaultWALSyncInterval is the time between background syncs of the WAL with
+// WALSyncPeriodic when Options.WALSyncInterval is 0
+const DefaultWALSyncInterval = 100 * time.Millisecond
+
+// WALRecoveryMode controls how Replay reacts to a corrupted or partially written entry
+type WALRecoveryMode int
+
+const (
+	// PointInTimeRecovery stops replaying at the first bad entry and truncates
+	// the WAL there, treating it as a write torn by a crash
+	PointInTimeRecovery WALRecoveryMode = iota
+	// AbsoluteConsistency fails recovery on any bad entry
+	AbsoluteConsistency
+	// SkipAnyCorruptedRecords skips a bad entry in the middle of a WAL, resuming
+	// at the first entry starting in a later block, and truncates a bad tail
+	// like PointInTimeRecovery. The entries skipped are lost while later ones
+	// are kept. WALs written before format version 2 have no blocks, they are
+	// truncated at their first bad entry.
+	SkipAnyCorruptedRecords
+)
+
+// walEntryHeaderSize is the checksum in front of an entry of a WAL before
+// format version 2, followed by the record header
+const walEntryHeaderSize = 4 + walRecordHeaderSize
+
+// readLogEntry reads and verifies the next entry of a WAL before format version
+// 2, returning the number of bytes it occupies in the file. io.EOF is returned
+// only at a clean entry boundary.
+// remaining is the number of bytes left in the file, sizes that do not fit in it
+// are rejected before anything is allocated for them.
+func readLogEntry(reader *bufio.Reader, remaining int64) (*LogEntry, int, error) {
+	//1.read and verify checksum
+	var storedChecksum uint32
+	if err := binary.Read(reader, binary.LittleEndian, &storedChecksum); err != nil {
+		return nil, 0, err
+	}
+
+	//2.read sizes
+	headerBuf := make([]byte, 8+4+4+1)
+	if _, err := io.ReadFull(reader, headerBuf); err != nil {
+		return nil, 0, fmt.Errorf("could not read header: %w", err)
+	}
+	seqNum := binary.LittleEndian.Uint64(headerBuf[0:8])
+	keySize := binary.LittleEndian.Uint32(headerBuf[8:12])
+	valueSize := binary.LittleEndian.Uint32(headerBuf[12:16])
+	op := headerBuf[16]
+	if uint64(keySize)+uint64(valueSize) > uint64(max(remaining-walEntryHeaderSize, 0)) {
+		return nil, 0, fmt.Errorf("%w: entry sizes %d+%d exceed the %d bytes left in the WAL", ErrCorruption, keySize, valueSize, remaining)
+	}
+	kvBuf := make([]byte, int(keySize)+int(valueSize))
+	if _, err := io.ReadFull(reader, kvBuf); err != nil {
+		return nil, 0, fmt.Errorf("could not read key/value: %v", err)
+	}
+
+	fullDataPayload := append(headerBuf, kvBuf...)
+	actualChecksum := crc32.ChecksumIEEE(fullDataPayload)
+	if storedChecksum != actualChecksum {
+		return nil, 0, fmt.Errorf("data corruption: checksum mismatch")
+	}
+	return &LogEntry{
+		Op:     op,
+		Key:    kvBuf[:keySize],
+		Value:  kvBuf[keySize:],
+		SeqNum: seqNum,
+	}, 4 + len(fullDataPayload), nil
+}
+
+// decodeWALRecord decodes a record of a WAL of version 2 or later. Key and Value share record.
+func decodeWALRecord(record []byte) (*LogEntry, error) {
+	if len(record) < walRecordHeaderSize {
+		return nil, fmt.Errorf("%w: WAL record of %d bytes", ErrCorruption, len(record))
+	}
+	keySize := binary.LittleEndian.Uint32(record[8:12])
+	valueSize := binary.LittleEndian.Uint32(record[12:16])
+	if uint64(keySize)+uint64(valueSize) != uint64(len(record)-walRecordHeaderSize) {
+		return nil, fmt.Errorf("%w: WAL record sizes %d+%d do not match its %d bytes", ErrCorruption, keySize, valueSize, len(record))
+	}
+	kv := record[walRecordHeaderSize:]
+	return &LogEntry{
+		Op:     record[16],
+		Key:    kv[:keySize],
+		Value:  kv[keySize:],
+		SeqNum: binary.LittleEndian.Uint64(record[0:8]),
+	}, nil
+}
+
+// decodeWALBatch decodes the entries packed in the value of an OpBatch record.
+// They share value.
+func decodeWALBatch(value []byte) ([]*LogEntry, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("%w: WAL batch of %d bytes", ErrCorruption, len(value))
+	}
+	count := binary.LittleEndian.Uint32(value)
+	//every entry takes at least a record header, check before allocating
+	if uint64(count)*walRecordHeaderSize > uint64(len(value)-4) {
+		return nil, fmt.Errorf("%w: WAL batch of %d entries in %d bytes", ErrCorruption, count, len(value))
+	}
+	entries := make([]*LogEntry, 0, count)
+	data := value[4:]
+	for range count {
+		if len(data) < walRecordHeaderSize {
+			return nil, fmt.Errorf("%w: WAL batch entry %d is truncated", ErrCorruption, len(entries))
+		}
+		size := uint64(walRecordHeaderSize) + uint64(binary.LittleEndian.Uint32(data[8:12])) + uint64(binary.LittleEndian.Uint32(data[12:16]))
+		if size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: WAL batch entry %d is truncated", ErrCorruption, len(entries))
+		}
+		entry, err := decodeWALRecord(data[:size])
+		if err != nil {
+			return nil, err
+		}
+		if !validWALOp(entry.Op) {
+			return nil, fmt.Errorf("%w: WAL batch entry has unknown operation %d", ErrCorruption, entry.Op)
+		}
+		entries = append(entries, entry)
+		data = data[size:]
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("%w: %d bytes after the entries of a WAL batch", ErrCorruption, len(data))
+	}
+	return entries, nil
+}
+
+// walReader reads the entries of a WAL of any format version
+type walReader struct {
+	r       *bufio.Reader
+	version uint32
+	size    int64
+	//bytes consumed
+	offset int64
+	//start of the fragment, or entry before version 2, read last
+	fragmentStart int64
+	//end of the last entry returned
+	lastGood int64
+	//set by skipToNextBlock until the next entry is returned
+	resyncing bool
+	//bytes between entries dropped by skipToNextBlock, once a later entry was found
+	skipped int64
+	//entries of the OpBatch record read last that next has not returned yet
+	batch []*LogEntry
+}
+
+// newWALReader reads the header of file
+func newWALReader(file File) (*walReader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	version, headerSize, err := readWALHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &walReader{
+		r:        r,
+		version:  version,
+		size:     stat.Size(),
+		offset:   int64(headerSize),
+		lastGood: int64(headerSize),
+	}, nil
+}
+
+// next returns the next entry. io.EOF is returned only at a clean entry
+// boundary, any other error is a corrupted or partially written entry.
+func (r *walReader) next() (*LogEntry, error) {
+	if len(r.batch) > 0 {
+		entry := r.batch[0]
+		r.batch = r.batch[1:]
+		return entry, nil
+	}
+	if r.version < 2 {
+		r.fragmentStart = r.offset
+		entry, n, err := readLogEntry(r.r, r.size-r.offset)
+		if err != nil {
+			return nil, err
+		}
+		r.offset += int64(n)
+		if !validWALOp(entry.Op) {
+			return nil, fmt.Errorf("%w: WAL entry has unknown operation %d", ErrCorruption, entry.Op)
+		}
+		r.lastGood = r.offset
+		return entry, nil
+	}
+	record, start, err := r.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := decodeWALRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Op == OpBatch {
+		batch, err := decodeWALBatch(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return nil, fmt.Errorf("%w: empty WAL batch", ErrCorruption)
+		}
+		entry, r.batch = batch[0], batch[1:]
+	} else if !validWALOp(entry.Op) {
+		return nil, fmt.Errorf("%w: WAL entry has unknown operation %d", ErrCorruption, entry.Op)
+	}
+	if r.resyncing {
+		r.skipped += start - r.lastGood
+		r.resyncing = false
+	}
+	r.lastGood = r.offset
+	return entry, nil
+}
+
+// readRecord assembles the fragments of the next record of a WAL of version 2 or later,
+// returning it with the offset of its first fragment
+func (r *walReader) readRecord() ([]byte, int64, error) {
+	var record []byte
+	var start int64
+	inRecord := false
+	header := make([]byte, walFragmentHeaderSize)
+	for {
+		r.fragmentStart = r.offset
+		if r.offset >= r.size {
+			if inRecord {
+				return nil, 0, fmt.Errorf("WAL record at offset %d has no last fragment: %w", start, io.ErrUnexpectedEOF)
+			}
+			return nil, 0, io.EOF
+		}
+		left := walBlockSize - r.offset%walBlockSize
+		if left < walFragmentHeaderSize {
+			//block trailer
+			n, err := r.r.Discard(int(min(left, r.size-r.offset)))
+			r.offset += int64(n)
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not read block trailer: %w", io.ErrUnexpectedEOF)
+			}
+			continue
+		}
+		if _, err := io.ReadFull(r.r, header); err != nil {
+			return nil, 0, fmt.Errorf("could not read fragment header: %w", io.ErrUnexpectedEOF)
+		}
+		r.offset += walFragmentHeaderSize
+		length := int64(binary.LittleEndian.Uint16(header[4:6]))
+		typ := header[6]
+		if walFragmentHeaderSize+length > left {
+			return nil, 0, fmt.Errorf("%w: WAL fragment of %d bytes crosses a block boundary", ErrCorruption, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return nil, 0, fmt.Errorf("could not read fragment: %w", io.ErrUnexpectedEOF)
+		}
+		r.offset += length
+		if binary.LittleEndian.Uint32(header[0:4]) != fragmentChecksum(typ, data) {
+			return nil, 0, fmt.Errorf("%w: WAL fragment checksum mismatch", ErrCorruption)
+		}
+		switch typ {
+		case walFullFragment, walFirstFragment:
+			if inRecord {
+				return nil, 0, fmt.Errorf("%w: WAL record at offset %d has no last fragment", ErrCorruption, start)
+			}
+			if typ == walFullFragment {
+				return data, r.fragmentStart, nil
+			}
+			record, start, inRecord = data, r.fragmentStart, true
+		case walMiddleFragment, walLastFragment:
+			if !inRecord {
+				if r.resyncing {
+					//the rest of a record that started before the skip
+					continue
+				}
+				return nil, 0, fmt.Errorf("%w: WAL fragment of type %d outside a record", ErrCorruption, typ)
+			}
+			record = append(record, data...)
+			if typ == walLastFragment {
+				return record, start, nil
+			}
+		default:
+			return nil, 0, fmt.Errorf("%w: unknown WAL fragment type %d", ErrCorruption, typ)
+		}
+	}
+}
+
+// skipToNextBlock moves past the block holding the fragment read last, after it
+// turned out bad. It reports false if there is no later block, or no blocks at
+// all before format version 2.
+func (r *walReader) skipToNextBlock() bool {
+	if r.version < 2 {
+		return false
+	}
+	next := (r.fragmentStart/walBlockSize + 1) * walBlockSize
+	if next >= r.size {
+		return false
+	}
+	if next > r.offset {
+		n, err := r.r.Discard(int(next - r.offset))
+		r.offset += int64(n)
+		if err != nil {
+			return false
+		}
+	}
+	r.resyncing = true
+	return true
+}
+
+// WALReplayReport tells how much of a WAL Replay recovered. A WAL cut short by
+// a crash usually ends in a partially written entry, which is discarded along
+// with everything after it in PointInTimeRecovery.
+type WALReplayReport struct {
+	//entries replayed
+	Records int
+	//bytes of the WAL up to the end of the last entry replayed, header included,
+	//less the bytes skipped
+	RecoveredBytes int64
+	//bytes skipped in the middle of the WAL, see SkipAnyCorruptedRecords, and
+	//bytes after the last entry replayed, truncated from the WAL
+	DiscardedBytes int64
+	//format version of the WAL, see WALFormatVersion
+	FormatVersion uint32
+}
+
 // Replay read all entries from the WAL file at the given path and reconstruct
-// the in-memory state by replaying the operations
-func Replay(path string) (map[InternalKey]RecoveredValue, uint64, error) {
+// the in-memory state by replaying the operations.
+// Range deletes are returned with Type OpRangeDelete, keyed by their start key,
+// with the end key as Value; the caller expands them once all sources are open.
+func Replay(path string, recoveryMode WALRecoveryMode) (map[InternalKey]RecoveredValue, uint64, error) {
+	data, maxSeqNum, _, err := replayWAL(OSFS, path, recoveryMode, noopLogger{})
+	return data, maxSeqNum, err
+}
+
+// ReplayWithReport is Replay, also reporting how much of the WAL was recovered
+// and how much was discarded
+func ReplayWithReport(path string, recoveryMode WALRecoveryMode) (map[InternalKey]RecoveredValue, uint64, WALReplayReport, error) {
+	return replayWAL(OSFS, path, recoveryMode, noopLogger{})
+}
+
+// replayWAL is ReplayWithReport on fs, logging a truncated tail to logger
+func replayWAL(fs FS, path string, recoveryMode WALRecoveryMode, logger Logger) (map[InternalKey]RecoveredValue, uint64, WALReplayReport, error) {
 	//open the file for reading only
 	flag := os.O_RDONLY
 	mode := os.FileMode(0644)
-	file, err := os.OpenFile(path, flag, mode)
+	file, err := fs.OpenFile(path, flag, mode)
 	if err != nil {
 		//if the file doesn't exist, meaning no data to recover
 		if os.IsNotExist(err) {
-			return make(map[InternalKey]RecoveredValue), 0, nil
+			return make(map[InternalKey]RecoveredValue), 0, WALReplayReport{}, nil
 		}
-		return nil, 0, err
+		return nil, 0, WALReplayReport{}, err
 
 	}
 	defer file.Close()
 	data := make(map[InternalKey]RecoveredValue)
 	var maxSeqNum uint64 = 0
-	reader := bufio.NewReader(file)
-
+	reader, err := newWALReader(file)
+	if err != nil {
+		return nil, 0, WALReplayReport{}, fmt.Errorf("%s: %w", path, err)
+	}
+	report := WALReplayReport{FormatVersion: reader.version}
+	//the error that ended the replay early, if any
+	var tailErr error
 	for {
-		//1.read and verify checksum
-		var storedChecksum uint32
-		err := binary.Read(reader, binary.LittleEndian, &storedChecksum)
+		entry, err := reader.next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, 0, err
-		}
-
-		//2.read sizes
-		headerBuf := make([]byte, 8+4+4+1)
-		if _, err := io.ReadFull(reader, headerBuf); err != nil {
-			return nil, 0, fmt.Errorf("could not read header: %w", err)
-		}
-		seqNum := binary.LittleEndian.Uint64(headerBuf[0:8])
-		keySize := binary.LittleEndian.Uint32(headerBuf[8:12])
-		valueSize := binary.LittleEndian.Uint32(headerBuf[12:16])
-		op := headerBuf[16]
-		kvBuf := make([]byte, keySize+valueSize)
-		if _, err := io.ReadFull(reader, kvBuf); err != nil {
-			return nil, 0, fmt.Errorf("could not read key/value: %v", err)
-		}
-
-		fullDataPayload := append(headerBuf, kvBuf...)
-		actualChecksum := crc32.ChecksumIEEE(fullDataPayload)
-		if storedChecksum != actualChecksum {
-			return nil, 0, fmt.Errorf("data corruption: checksum mismatch")
+			if recoveryMode == AbsoluteConsistency {
+				return nil, 0, WALReplayReport{}, fmt.Errorf("WAL %s corrupted at offset %d: %w", path, reader.fragmentStart, err)
+			}
+			badOffset := reader.fragmentStart
+			if recoveryMode == SkipAnyCorruptedRecords && reader.skipToNextBlock() {
+				logger.Warnf("WAL %s is corrupted at offset %d (%v), skipping to offset %d", path, badOffset, err, reader.offset)
+				continue
+			}
+			tailErr = fmt.Errorf("corrupted at offset %d: %w", badOffset, err)
+			break
 		}
-		if seqNum > maxSeqNum {
-			maxSeqNum = seqNum
+		report.Records++
+		if entry.SeqNum > maxSeqNum {
+			maxSeqNum = entry.SeqNum
 		}
-		key := kvBuf[:keySize]
-		value := kvBuf[keySize:]
 		internalKey := InternalKey{
-			UserKey: string(key),
-			SeqNum:  seqNum,
-			Type:    op,
+			UserKey: string(entry.Key),
+			SeqNum:  entry.SeqNum,
+			Type:    entry.Op,
 		}
 		data[internalKey] = RecoveredValue{
-			Value: value,
-			Type:  op,
+			Value: entry.Value,
+			Type:  entry.Op,
+		}
+	}
+	report.RecoveredBytes = reader.lastGood - reader.skipped
+	report.DiscardedBytes = reader.skipped
+	//anything after the last entry is a bad or partially written tail, which
+	//must go before the WAL is appended to
+	if tail := reader.size - reader.lastGood; tail > 0 {
+		if tailErr == nil {
+			tailErr = io.ErrUnexpectedEOF
+		}
+		report.DiscardedBytes += tail
+		logger.Warnf("WAL %s is %v, truncating it to the last valid entry: %d entries recovered, %d bytes discarded",
+			path, tailErr, report.Records, report.DiscardedBytes)
+		if err := fs.Truncate(path, reader.lastGood); err != nil {
+			return nil, 0, WALReplayReport{}, fmt.Errorf("failed to truncate corrupted WAL: %w", err)
 		}
 	}
-	return data, maxSeqNum, nil
+	return data, maxSeqNum, report, nil
 }
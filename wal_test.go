@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"testing"
+)
+
+// testWALEntries are a put, a delete and a batch, written by writeTestWAL
+var testWALEntries = [][]*LogEntry{
+	{{Op: OpPut, Key: []byte("apple"), Value: []byte("red"), SeqNum: 1}},
+	{{Op: OpDelete, Key: []byte("banana"), SeqNum: 2}},
+	{
+		{Op: OpPut, Key: []byte("cherry"), Value: []byte("dark"), SeqNum: 3},
+		{Op: OpRangeDelete, Key: []byte("d"), Value: []byte("f"), SeqNum: 4},
+	},
+}
+
+// writeTestWAL writes every group of entries as one WriteEntries call to a new
+// WAL at path in fs, and returns the content of the file
+func writeTestWAL(tb testing.TB, fs FS, path string, groups [][]*LogEntry) []byte {
+	tb.Helper()
+	wal, err := openWAL(fs, path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, entries := range groups {
+		if err := wal.WriteEntries(entries); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestWALCountsUnsyncedBytesOfLargeRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, err := NewWal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	wal.syncMode = WALSyncNever
+	//larger than the bufio buffer, so it is written straight to the file
+	value := bytes.Repeat([]byte{'v'}, 20<<10)
+	if err := wal.Write(&LogEntry{Op: OpPut, Key: []byte("key"), Value: value, SeqNum: 1}); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := wal.file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := stat.Size() - int64(walHeaderSize); wal.unsynced != want {
+		t.Fatalf("unsynced = %d, want the %d bytes written", wal.unsynced, want)
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if wal.unsynced != 0 {
+		t.Fatalf("unsynced = %d after Sync, want 0", wal.unsynced)
+	}
+}
+
+// FuzzDecodeWALRecord decodes arbitrary bytes as a WAL record and as the value
+// of a batch record. Sizes that do not fit in the input must be rejected
+// before anything is allocated for them.
+func FuzzDecodeWALRecord(f *testing.F) {
+	record := make([]byte, walRecordHeaderSize+len("key")+len("value"))
+	encodeWALRecord(record, 1, OpPut, []byte("key"), []byte("value"))
+	f.Add(record)
+	batch := binary.LittleEndian.AppendUint32(nil, 2)
+	batch = append(batch, record...)
+	batch = append(batch, record...)
+	f.Add(batch)
+	//sizes far beyond the input
+	f.Add([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, OpPut})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if entry, err := decodeWALRecord(data); err == nil && len(entry.Key)+len(entry.Value) > len(data) {
+			t.Fatalf("decoded a %d byte key and a %d byte value from %d bytes", len(entry.Key), len(entry.Value), len(data))
+		}
+		entries, err := decodeWALBatch(data)
+		if err != nil {
+			return
+		}
+		size := 0
+		for _, entry := range entries {
+			if !validWALOp(entry.Op) {
+				t.Fatalf("batch entry has unknown operation %d", entry.Op)
+			}
+			size += len(entry.Key) + len(entry.Value)
+		}
+		if size > len(data) {
+			t.Fatalf("decoded %d bytes of keys and values from %d bytes", size, len(data))
+		}
+	})
+}
+
+// FuzzReplayWAL replays arbitrary bytes following a valid WAL header in every
+// recovery mode. Replay must fail or recover cleanly, never panic, and leave no
+// more of the WAL than it recovered.
+func FuzzReplayWAL(f *testing.F) {
+	data := writeTestWAL(f, NewMemFS(), "seed.wal", testWALEntries)
+	f.Add(data[walHeaderSize:])
+	f.Add(data[walHeaderSize : len(data)-3])
+	corrupted := bytes.Clone(data[walHeaderSize:])
+	corrupted[len(corrupted)/2] ^= 0xff
+	f.Add(corrupted)
+	f.Add([]byte{})
+
+	header := data[:walHeaderSize]
+	f.Fuzz(func(t *testing.T, body []byte) {
+		for _, mode := range []WALRecoveryMode{PointInTimeRecovery, AbsoluteConsistency, SkipAnyCorruptedRecords} {
+			fs := NewMemFS()
+			if err := fs.WriteFile("fuzz.wal", append(bytes.Clone(header), body...), 0644); err != nil {
+				t.Fatal(err)
+			}
+			recovered, _, report, err := replayWAL(fs, "fuzz.wal", mode, noopLogger{})
+			if err != nil {
+				continue
+			}
+			if len(recovered) > report.Records {
+				t.Fatalf("%d entries recovered from %d records", len(recovered), report.Records)
+			}
+			size := int64(walHeaderSize + len(body))
+			if report.RecoveredBytes+report.DiscardedBytes != size {
+				t.Fatalf("report %+v does not account for the %d bytes of the WAL", report, size)
+			}
+			left, err := fs.ReadFile("fuzz.wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(left)) < report.RecoveredBytes || int64(len(left)) > size {
+				t.Fatalf("WAL truncated to %d bytes, report %+v", len(left), report)
+			}
+		}
+	})
+}
+
+func TestReplayTruncatesCorruptedTail(t *testing.T) {
+	fs := NewMemFS()
+	good := writeTestWAL(t, fs, "good.wal", testWALEntries[:2])
+	data := writeTestWAL(t, fs, "test.wal", testWALEntries)
+	//the last 10 bytes belong to the batch, written last
+	for i := len(data) - 10; i < len(data); i++ {
+		data[i] ^= 0xff
+	}
+	if err := fs.WriteFile("test.wal", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := replayWAL(fs, "test.wal", AbsoluteConsistency, noopLogger{}); err == nil {
+		t.Fatal("AbsoluteConsistency replayed a corrupted WAL")
+	}
+	recovered, maxSeqNum, report, err := replayWAL(fs, "test.wal", PointInTimeRecovery, noopLogger{})
+	if err != nil {
+		t.Fatalf("PointInTimeRecovery: %v", err)
+	}
+	if len(recovered) != 2 || maxSeqNum != 2 {
+		t.Fatalf("recovered %d entries up to seqnum %d, want the 2 before the batch", len(recovered), maxSeqNum)
+	}
+	if _, ok := recovered[InternalKey{UserKey: "apple", SeqNum: 1, Type: OpPut}]; !ok {
+		t.Fatalf("apple was not recovered: %v", recovered)
+	}
+	if report.RecoveredBytes != int64(len(good)) || report.DiscardedBytes != int64(len(data)-len(good)) {
+		t.Fatalf("report %+v, want %d bytes recovered of %d", report, len(good), len(data))
+	}
+	left, err := fs.ReadFile("test.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(left, good) {
+		t.Fatalf("WAL truncated to %d bytes, want the %d bytes before the batch", len(left), len(good))
+	}
+}
+
+func TestReplayTruncatedAtEveryOffsetOfLastRecord(t *testing.T) {
+	fs := NewMemFS()
+	good := writeTestWAL(t, fs, "good.wal", testWALEntries[:2])
+	data := writeTestWAL(t, fs, "test.wal", testWALEntries)
+	for size := len(good); size < len(data); size++ {
+		if err := fs.WriteFile("test.wal", data[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		recovered, maxSeqNum, report, err := replayWAL(fs, "test.wal", PointInTimeRecovery, noopLogger{})
+		if err != nil {
+			t.Fatalf("WAL cut to %d bytes: %v", size, err)
+		}
+		//only the batch, written last, is lost
+		if len(recovered) != 2 || maxSeqNum != 2 {
+			t.Fatalf("WAL cut to %d bytes: recovered %d entries up to seqnum %d, want the 2 before the batch", size, len(recovered), maxSeqNum)
+		}
+		if report.RecoveredBytes != int64(len(good)) || report.RecoveredBytes+report.DiscardedBytes != int64(size) {
+			t.Fatalf("WAL cut to %d bytes: report %+v, want %d bytes recovered", size, report, len(good))
+		}
+		left, err := fs.ReadFile("test.wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(left, good) {
+			t.Fatalf("WAL cut to %d bytes truncated to %d, want the %d bytes before the batch", size, len(left), len(good))
+		}
+	}
+}
+
+// checkReplayedValues fails unless recovered holds a put of values[i] under key
+// i at seqnum i+1 for every i
+func checkReplayedValues(t *testing.T, recovered map[InternalKey]RecoveredValue, values [][]byte) {
+	t.Helper()
+	if len(recovered) != len(values) {
+		t.Fatalf("recovered %d entries, want %d", len(recovered), len(values))
+	}
+	for i, value := range values {
+		got, ok := recovered[InternalKey{UserKey: fmt.Sprint(i), SeqNum: uint64(i + 1), Type: OpPut}]
+		if !ok || !bytes.Equal(got.Value, value) {
+			t.Fatalf("entry %d recovered as %d bytes, %v, want %d bytes", i, len(got.Value), ok, len(value))
+		}
+	}
+}
+
+// putGroups returns a put of values[i] under key i at seqnum i+1 for every i,
+// each written on its own
+func putGroups(values [][]byte) [][]*LogEntry {
+	groups := make([][]*LogEntry, len(values))
+	for i, value := range values {
+		groups[i] = []*LogEntry{{Op: OpPut, Key: []byte(fmt.Sprint(i)), Value: value, SeqNum: uint64(i + 1)}}
+	}
+	return groups
+}
+
+func TestReplayMultiFragmentRecords(t *testing.T) {
+	values := [][]byte{
+		//ends the first block 3 bytes short of its end, too few for a fragment header
+		bytes.Repeat([]byte{'a'}, walBlockSize-3-walHeaderSize-walFragmentHeaderSize-walRecordHeaderSize-1),
+		[]byte("small"),
+		//a first, middle and last fragment
+		bytes.Repeat([]byte{'b'}, 2*walBlockSize+100),
+		//an empty value
+		nil,
+		[]byte("small"),
+	}
+	fs := NewMemFS()
+	data := writeTestWAL(t, fs, "test.wal", putGroups(values))
+	if data[walBlockSize-3] != 0 || data[walBlockSize-2] != 0 || data[walBlockSize-1] != 0 {
+		t.Fatal("the first block does not end in a trailer")
+	}
+	for _, mode := range []WALRecoveryMode{PointInTimeRecovery, AbsoluteConsistency, SkipAnyCorruptedRecords} {
+		recovered, maxSeqNum, report, err := replayWAL(fs, "test.wal", mode, noopLogger{})
+		if err != nil {
+			t.Fatalf("mode %v: %v", mode, err)
+		}
+		checkReplayedValues(t, recovered, values)
+		if maxSeqNum != uint64(len(values)) || report.RecoveredBytes != int64(len(data)) || report.DiscardedBytes != 0 {
+			t.Fatalf("mode %v: maxSeqNum %d, report %+v for %d bytes", mode, maxSeqNum, report, len(data))
+		}
+	}
+}
+
+func TestReplayTornMultiFragmentRecord(t *testing.T) {
+	values := [][]byte{[]byte("small"), bytes.Repeat([]byte{'b'}, 3*walBlockSize)}
+	fs := NewMemFS()
+	good := writeTestWAL(t, fs, "good.wal", putGroups(values[:1]))
+	data := writeTestWAL(t, fs, "test.wal", putGroups(values))
+	//a crash in the first, a middle and the last fragment, and at block boundaries
+	for _, size := range []int{len(good) + 10, walBlockSize, walBlockSize + 10, 2 * walBlockSize, 3 * walBlockSize, len(data) - 1} {
+		for _, mode := range []WALRecoveryMode{PointInTimeRecovery, SkipAnyCorruptedRecords} {
+			//replay truncated the file of the previous mode
+			if err := fs.WriteFile("test.wal", data[:size], 0644); err != nil {
+				t.Fatal(err)
+			}
+			recovered, _, report, err := replayWAL(fs, "test.wal", mode, noopLogger{})
+			if err != nil {
+				t.Fatalf("WAL cut to %d bytes, mode %v: %v", size, mode, err)
+			}
+			checkReplayedValues(t, recovered, values[:1])
+			if report.RecoveredBytes != int64(len(good)) {
+				t.Fatalf("WAL cut to %d bytes, mode %v: report %+v, want %d bytes recovered", size, mode, report, len(good))
+			}
+		}
+	}
+}
+
+func TestReplayDropsTornBatch(t *testing.T) {
+	var batch []*LogEntry
+	for i := 0; i < 100; i++ {
+		batch = append(batch, &LogEntry{Op: OpPut, Key: []byte(fmt.Sprint(i)), Value: bytes.Repeat([]byte{'v'}, 1000), SeqNum: uint64(i + 2)})
+	}
+	groups := [][]*LogEntry{testWALEntries[0], batch}
+	fs := NewMemFS()
+	good := writeTestWAL(t, fs, "good.wal", groups[:1])
+	data := writeTestWAL(t, fs, "test.wal", groups)
+	if len(data) < 3*walBlockSize {
+		t.Fatalf("the batch fills %d bytes, want several blocks", len(data))
+	}
+	//a crash in the first, a middle and the last fragment, and at block boundaries
+	for _, size := range []int{len(good) + 10, walBlockSize, walBlockSize + 10, 2 * walBlockSize, len(data) - 1} {
+		if err := fs.WriteFile("test.wal", data[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		recovered, maxSeqNum, report, err := replayWAL(fs, "test.wal", PointInTimeRecovery, noopLogger{})
+		if err != nil {
+			t.Fatalf("WAL cut to %d bytes: %v", size, err)
+		}
+		if len(recovered) != 1 || maxSeqNum != 1 || report.RecoveredBytes != int64(len(good)) {
+			t.Fatalf("WAL cut to %d bytes: recovered %d entries up to seqnum %d, report %+v, want the put before the batch", size, len(recovered), maxSeqNum, report)
+		}
+	}
+	//a batch whose checksum fails is dropped as a whole too
+	corrupted := bytes.Clone(data)
+	corrupted[len(corrupted)-10] ^= 0xff
+	if err := fs.WriteFile("test.wal", corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	recovered, _, _, err := replayWAL(fs, "test.wal", PointInTimeRecovery, noopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 {
+		t.Fatalf("recovered %d entries with the last fragment of the batch corrupted, want the put before it", len(recovered))
+	}
+}
+
+func TestReplaySkipsCorruptedBlock(t *testing.T) {
+	values := make([][]byte, 100)
+	for i := range values {
+		values[i] = bytes.Repeat([]byte{byte('a' + i%26)}, 1000)
+	}
+	fs := NewMemFS()
+	data := writeTestWAL(t, fs, "test.wal", putGroups(values))
+	if len(data) < 3*walBlockSize {
+		t.Fatalf("the WAL fills %d bytes, want more than 3 blocks", len(data))
+	}
+	//in the middle of the second block
+	data[walBlockSize+walBlockSize/2] ^= 0xff
+	replay := func(mode WALRecoveryMode) (map[InternalKey]RecoveredValue, WALReplayReport, error) {
+		if err := fs.WriteFile("test.wal", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		recovered, _, report, err := replayWAL(fs, "test.wal", mode, noopLogger{})
+		return recovered, report, err
+	}
+	if _, _, err := replay(AbsoluteConsistency); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("AbsoluteConsistency = %v, want ErrCorruption", err)
+	}
+	before, _, err := replay(PointInTimeRecovery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, report, err := replay(SkipAnyCorruptedRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) == 0 || len(recovered) <= len(before) || len(recovered) >= len(values) {
+		t.Fatalf("recovered %d entries, %d up to the corruption, of %d", len(recovered), len(before), len(values))
+	}
+	//everything but one run of entries around the corruption
+	lost := 0
+	for i := range values {
+		_, ok := recovered[InternalKey{UserKey: fmt.Sprint(i), SeqNum: uint64(i + 1), Type: OpPut}]
+		switch {
+		case i < len(before) && !ok:
+			t.Fatalf("entry %d before the corruption was lost", i)
+		case i >= len(before) && !ok:
+			if lost != i-len(before) {
+				t.Fatalf("entry %d lost after entry %d was recovered", i, i-1)
+			}
+			lost++
+		}
+	}
+	if report.DiscardedBytes == 0 || report.RecoveredBytes+report.DiscardedBytes != int64(len(data)) {
+		t.Fatalf("report %+v for %d bytes", report, len(data))
+	}
+}
+
+func TestReplayVersion1WAL(t *testing.T) {
+	values := [][]byte{[]byte("red"), {}, bytes.Repeat([]byte{'v'}, walBlockSize)}
+	//[Checksum (4 bytes)][Seq (8 bytes)][Key Size (4 bytes)][Value Size (4 bytes)][Operation (1 byte)][Key][Value]
+	data := binary.LittleEndian.AppendUint32([]byte(walMagic), 1)
+	for _, group := range putGroups(values) {
+		entry := group[0]
+		record := make([]byte, walRecordHeaderSize+len(entry.Key)+len(entry.Value))
+		encodeWALRecord(record, entry.SeqNum, entry.Op, entry.Key, entry.Value)
+		data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(record))
+		data = append(data, record...)
+	}
+	fs := NewMemFS()
+	if err := fs.WriteFile("test.wal", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	recovered, _, report, err := replayWAL(fs, "test.wal", AbsoluteConsistency, noopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReplayedValues(t, recovered, values)
+	if report.FormatVersion != 1 || report.RecoveredBytes != int64(len(data)) {
+		t.Fatalf("report %+v for a version 1 WAL of %d bytes", report, len(data))
+	}
+}
+
+func TestReplayRejectsUnknownOperation(t *testing.T) {
+	fs := NewMemFS()
+	good := writeTestWAL(t, fs, "good.wal", testWALEntries[:1])
+	data := writeTestWAL(t, fs, "test.wal", testWALEntries)
+	//the operation of the delete, the second record, with a checksum that
+	//still matches so only the operation is wrong
+	fragment := data[len(good):]
+	length := int(binary.LittleEndian.Uint16(fragment[4:6]))
+	if typ := fragment[6]; typ != walFullFragment {
+		t.Fatalf("the delete is in a fragment of type %d, want a full one", typ)
+	}
+	record := fragment[walFragmentHeaderSize : walFragmentHeaderSize+length]
+	if record[16] != OpDelete {
+		t.Fatalf("operation byte is %d, want the delete", record[16])
+	}
+	record[16] = 42
+	binary.LittleEndian.PutUint32(fragment[0:4], fragmentChecksum(walFullFragment, record))
+	write := func() {
+		if err := fs.WriteFile("test.wal", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	if _, _, _, err := replayWAL(fs, "test.wal", AbsoluteConsistency, noopLogger{}); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("AbsoluteConsistency = %v, want ErrCorruption", err)
+	}
+	recovered, _, report, err := replayWAL(fs, "test.wal", PointInTimeRecovery, noopLogger{})
+	if err != nil {
+		t.Fatalf("PointInTimeRecovery: %v", err)
+	}
+	if len(recovered) != 1 || report.RecoveredBytes != int64(len(good)) {
+		t.Fatalf("recovered %d entries, report %+v, want the put before the bad record", len(recovered), report)
+	}
+	for key := range recovered {
+		if key.Type != OpPut {
+			t.Fatalf("recovered an entry of operation %d", key.Type)
+		}
+	}
+	//nor is it replayed when skipping corrupted records
+	write()
+	recovered, _, _, err = replayWAL(fs, "test.wal", SkipAnyCorruptedRecords, noopLogger{})
+	if err != nil {
+		t.Fatalf("SkipAnyCorruptedRecords: %v", err)
+	}
+	for key := range recovered {
+		if !validWALOp(key.Type) {
+			t.Fatalf("recovered an entry of operation %d", key.Type)
+		}
+	}
+}
+
+func TestReplayRejectsNewerWALVersion(t *testing.T) {
+	fs := NewMemFS()
+	data := writeTestWAL(t, fs, "test.wal", testWALEntries)
+	binary.LittleEndian.PutUint32(data[len(walMagic):], WALFormatVersion+1)
+	if err := fs.WriteFile("test.wal", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []WALRecoveryMode{PointInTimeRecovery, AbsoluteConsistency, SkipAnyCorruptedRecords} {
+		if _, _, _, err := replayWAL(fs, "test.wal", mode, noopLogger{}); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Fatalf("replaying a WAL of version %d in mode %v = %v, want ErrUnsupportedVersion", WALFormatVersion+1, mode, err)
+		}
+	}
+	//nothing was truncated as a corrupted tail
+	left, err := fs.ReadFile("test.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(left, data) {
+		t.Fatal("replay modified a WAL it does not support")
+	}
+}
+
+// BenchmarkWALWrite reports the allocations of 100 000 sequential puts written
+// with the pooled encoding buffers of the WAL, and with a new buffer per put
+func BenchmarkWALWrite(b *testing.B) {
+	const puts = 100000
+	entry := &LogEntry{Op: OpPut, Key: []byte("key00000"), Value: bytes.Repeat([]byte{'v'}, 100)}
+	write := map[string]func(w *WAL) error{
+		"pooled": func(w *WAL) error { return w.Write(entry) },
+		"unpooled": func(w *WAL) error {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			buf := make([]byte, walRecordHeaderSize+len(entry.Key)+len(entry.Value))
+			encodeWALRecord(buf, entry.SeqNum, entry.Op, entry.Key, entry.Value)
+			if err := w.writeRecord(buf); err != nil {
+				return err
+			}
+			return w.bw.Flush()
+		},
+	}
+	for _, name := range []string{"pooled", "unpooled"} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				wal, err := openWAL(OSFS, filepath.Join(b.TempDir(), "bench.wal"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				wal.syncMode = WALSyncNever
+				b.StartTimer()
+				for n := 0; n < puts; n++ {
+					if err := write[name](wal); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				wal.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}